@@ -0,0 +1,444 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Admin is the /admin API for inspecting and changing runtime settings
+// without a restart:
+//
+//	GET   /admin/settings                 current settings and routes
+//	PATCH /admin/settings                 {"timeout", "concurrency", "log_level"}
+//	POST  /admin/routes/{name}/disable    answer 503 for the route
+//	POST  /admin/routes/{name}/enable
+//	POST  /admin/routes/{name}/restart    drain and replace the route's worker
+//	GET   /admin/breakers                 circuit breaker state of each route
+//	DELETE /admin/breakers/{name}         close the route's circuit
+//	PUT   /admin/routes/{name}/fault      {"error_rate", "status", "latency", "latency_rate", "duration"}
+//	DELETE /admin/routes/{name}/fault     stop injecting failure into the route
+//	GET   /admin/faults                   injected faults with their expiry
+//	POST  /admin/reload                   reload the --config file, recycling changed routes
+//	GET   /admin/schedules                cron triggers with their last run
+//	GET   /admin/materialized             materialized routes with their last refresh
+//	GET   /admin/analytics                payload and response shapes, ?route= to filter
+//	DELETE /admin/analytics               start collecting afresh
+//	GET   /admin/dead-letters             failed invocations, ?route= to filter
+//	GET   /admin/dead-letters/{id}        one, with its payload and stderr
+//	POST  /admin/dead-letters/{id}/redrive  invoke the route with it again
+//	DELETE /admin/dead-letters/{id}       discard it
+//	GET   /debug/invocations              running invocations with their age, pid and output so far
+//	DELETE /debug/invocations/{id}        cancel one, killing its script
+//
+// Changes are not persisted and only affect invocations started afterwards.
+// Other authenticated APIs are mounted alongside with Handle.
+type Admin struct {
+	inv   *Invoker
+	token string
+	// routes change when the config is reloaded.
+	mu     sync.RWMutex
+	routes map[string]*Route
+	// reload, when set, reloads the --config file for POST /admin/reload.
+	reload func() (*reloadReport, error)
+	// dir, when set, resolves script directory routes for re-drives.
+	dir *ScriptDir
+	// faultRoutes are the patterns of the routes faults may be injected
+	// into, for game days; none when empty.
+	faultRoutes []string
+	mux         *http.ServeMux
+}
+
+func NewAdmin(inv *Invoker, token string) *Admin {
+	a := &Admin{inv: inv, token: token, routes: map[string]*Route{}, mux: http.NewServeMux()}
+	a.mux.HandleFunc("GET /admin/settings", a.getSettings)
+	a.mux.HandleFunc("PATCH /admin/settings", a.patchSettings)
+	a.mux.HandleFunc("POST /admin/routes/{name}/enable", a.setEnabled(true))
+	a.mux.HandleFunc("POST /admin/routes/{name}/disable", a.setEnabled(false))
+	a.mux.HandleFunc("POST /admin/routes/{name}/restart", a.restartWorker)
+	a.mux.HandleFunc("GET /admin/breakers", a.getBreakers)
+	// Script directory routes are named by their path.
+	a.mux.HandleFunc("DELETE /admin/breakers/{name...}", a.resetBreaker)
+	a.mux.HandleFunc("PUT /admin/routes/{name}/fault", a.setFault)
+	a.mux.HandleFunc("DELETE /admin/routes/{name}/fault", a.clearFault)
+	a.mux.HandleFunc("GET /admin/faults", a.getFaults)
+	a.mux.HandleFunc("POST /admin/reload", a.reloadConfig)
+	a.mux.HandleFunc("GET /admin/schedules", a.getSchedules)
+	a.mux.HandleFunc("GET /admin/materialized", a.getMaterialized)
+	a.mux.HandleFunc("GET /debug/invocations", a.listInvocations)
+	a.mux.HandleFunc("DELETE /debug/invocations/{id}", a.cancelInvocation)
+	if inv.analytics != nil {
+		a.mux.HandleFunc("GET /admin/analytics", a.getAnalytics)
+		a.mux.HandleFunc("DELETE /admin/analytics", a.resetAnalytics)
+	}
+	if inv.deadLetters != nil {
+		a.mux.HandleFunc("GET /admin/dead-letters", a.listDeadLetters)
+		a.mux.HandleFunc("GET /admin/dead-letters/{id}", a.getDeadLetter)
+		a.mux.HandleFunc("POST /admin/dead-letters/{id}/redrive", a.redriveDeadLetter)
+		a.mux.HandleFunc("DELETE /admin/dead-letters/{id}", a.deleteDeadLetter)
+	}
+	return a
+}
+
+// Handle serves h behind the admin credentials.
+func (a *Admin) Handle(pattern string, h http.Handler) {
+	a.mux.Handle(pattern, h)
+}
+
+// Add makes route manageable through the API, replacing any route of the
+// same name.
+func (a *Admin) Add(route *Route) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.routes[route.Name] = route
+}
+
+// Remove drops the route name, e.g. when a reload removed it.
+func (a *Admin) Remove(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.routes, name)
+}
+
+func (a *Admin) lookup(name string) (*Route, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	route, ok := a.routes[name]
+	return route, ok
+}
+
+// sortedRoutes returns the routes ordered by name.
+func (a *Admin) sortedRoutes() []*Route {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	out := make([]*Route, 0, len(a.routes))
+	for _, name := range sortedRoutes(a.routes) {
+		out = append(out, a.routes[name])
+	}
+	return out
+}
+
+type adminSettings struct {
+	Timeout     string            `json:"timeout"`
+	Concurrency adminConcurrency  `json:"concurrency"`
+	LogLevel    string            `json:"log_level"`
+	Routes      []adminRouteState `json:"routes"`
+}
+
+type adminConcurrency struct {
+	Limit  int `json:"limit"`
+	Active int `json:"active"`
+	Queued int `json:"queued"`
+}
+
+type adminRouteState struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	// WorkerReady is only reported for persistent routes.
+	WorkerReady *bool `json:"worker_ready,omitempty"`
+	// Timeout and Concurrency are only reported for routes overriding
+	// the server-wide settings.
+	Timeout     string            `json:"timeout,omitempty"`
+	Concurrency *adminConcurrency `json:"concurrency,omitempty"`
+	// Build is the metadata embedded in the route's script bundle, if
+	// any.
+	Build *BuildInfo `json:"build,omitempty"`
+}
+
+// adminPatch is the body of PATCH /admin/settings; omitted fields are left
+// unchanged.
+type adminPatch struct {
+	Timeout     *string `json:"timeout"`
+	Concurrency *int    `json:"concurrency"`
+	LogLevel    *string `json:"log_level"`
+}
+
+// Handler serves the API, requiring the bearer token when one is set.
+func (a *Admin) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.token != "" {
+			got, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(a.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		a.mux.ServeHTTP(w, r)
+	})
+}
+
+func (a *Admin) settings() adminSettings {
+	limit, active, queued := a.inv.slots.Stats()
+	s := adminSettings{
+		Timeout:     a.inv.Timeout().String(),
+		Concurrency: adminConcurrency{Limit: limit, Active: active, Queued: queued},
+		LogLevel:    currentLogLevel(),
+		Routes:      []adminRouteState{},
+	}
+	for _, route := range a.sortedRoutes() {
+		st := adminRouteState{Name: route.Name, Enabled: !route.disabled.Load(), Build: route.build()}
+		if route.worker != nil {
+			ready := route.worker.Ready()
+			st.WorkerReady = &ready
+		}
+		if route.Timeout > 0 {
+			st.Timeout = route.Timeout.String()
+		}
+		if route.slots != nil {
+			limit, active, queued := route.slots.Stats()
+			st.Concurrency = &adminConcurrency{Limit: limit, Active: active, Queued: queued}
+		}
+		s.Routes = append(s.Routes, st)
+	}
+	return s
+}
+
+func (a *Admin) getSettings(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.settings())
+}
+
+func (a *Admin) patchSettings(w http.ResponseWriter, r *http.Request) {
+	var p adminPatch
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		http.Error(w, "invalid settings: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Validate everything before applying anything.
+	var timeout time.Duration
+	if p.Timeout != nil {
+		d, err := time.ParseDuration(*p.Timeout)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("invalid timeout %q: must be a positive duration", *p.Timeout), http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+	if p.Concurrency != nil && *p.Concurrency < 0 {
+		http.Error(w, "invalid concurrency: must be 0 (unlimited) or more", http.StatusBadRequest)
+		return
+	}
+	// setLogLevel only fails on an invalid level, so it validates last.
+	if p.LogLevel != nil {
+		if err := setLogLevel(*p.LogLevel); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if p.Timeout != nil {
+		a.inv.SetTimeout(timeout)
+	}
+	if p.Concurrency != nil {
+		a.inv.slots.SetLimit(*p.Concurrency)
+	}
+	s := a.settings()
+	logAdmin(r, "settings changed: timeout=%s concurrency=%d log_level=%s", s.Timeout, s.Concurrency.Limit, s.LogLevel)
+	writeJSON(w, http.StatusOK, s)
+}
+
+func (a *Admin) route(w http.ResponseWriter, r *http.Request) *Route {
+	route, ok := a.lookup(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "unknown route", http.StatusNotFound)
+	}
+	return route
+}
+
+func (a *Admin) setEnabled(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route := a.route(w, r)
+		if route == nil {
+			return
+		}
+		route.disabled.Store(!enabled)
+		logAdmin(r, "route %s enabled=%t", route.Name, enabled)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// restartWorker returns once in-flight invocations have drained and the
+// old process was stopped; the new one starts in the background.
+func (a *Admin) restartWorker(w http.ResponseWriter, r *http.Request) {
+	route := a.route(w, r)
+	if route == nil {
+		return
+	}
+	if route.worker == nil {
+		http.Error(w, "route has no persistent worker", http.StatusConflict)
+		return
+	}
+	logAdmin(r, "restarting worker for %s", route.Name)
+	route.worker.Restart()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *Admin) getBreakers(w http.ResponseWriter, r *http.Request) {
+	status := a.inv.breakers.Status()
+	out := []breakerStatus{}
+	for _, name := range sortedRoutes(status) {
+		out = append(out, status[name])
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (a *Admin) resetBreaker(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !a.inv.breakers.Reset(name) {
+		http.Error(w, "route has no circuit breaker state", http.StatusNotFound)
+		return
+	}
+	logAdmin(r, "circuit of %s reset", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if a.reload == nil {
+		http.Error(w, "reloading requires --config", http.StatusConflict)
+		return
+	}
+	report, err := a.reload()
+	if err != nil {
+		http.Error(w, "reload failed: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	logAdmin(r, "config reloaded: %s", report)
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (a *Admin) getSchedules(w http.ResponseWriter, r *http.Request) {
+	out := []cronStatus{}
+	for _, route := range a.sortedRoutes() {
+		if tr := route.Triggers; tr != nil {
+			for _, c := range tr.Cron {
+				out = append(out, c.status(route.Name))
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (a *Admin) getMaterialized(w http.ResponseWriter, r *http.Request) {
+	out := []materializedStatus{}
+	for _, route := range a.sortedRoutes() {
+		if m := route.Materialized; m != nil {
+			out = append(out, m.status(route.Name))
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (a *Admin) listInvocations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.inv.inflight.List())
+}
+
+func (a *Admin) cancelInvocation(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !a.inv.inflight.Cancel(id) {
+		http.Error(w, "no such invocation running", http.StatusNotFound)
+		return
+	}
+	logAdmin(r, "invocation %s canceled", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) getAnalytics(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.inv.analytics.Report(r.URL.Query().Get("route")))
+}
+
+func (a *Admin) resetAnalytics(w http.ResponseWriter, r *http.Request) {
+	a.inv.analytics.Reset()
+	logAdmin(r, "analytics reset")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	dls, err := a.inv.deadLetters.List(r.URL.Query().Get("route"))
+	if err != nil {
+		log.Printf("dead letters: %v", err)
+		http.Error(w, "failed to list dead letters", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, dls)
+}
+
+// deadLetter loads the dead letter named in the request path, writing the
+// error response when that fails.
+func (a *Admin) deadLetter(w http.ResponseWriter, r *http.Request) *deadLetter {
+	dl, err := a.inv.deadLetters.Get(r.PathValue("id"))
+	if errors.Is(err, errDeadLetterNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		log.Printf("dead letters: %v", err)
+		http.Error(w, "failed to read dead letter", http.StatusInternalServerError)
+		return nil
+	}
+	return dl
+}
+
+func (a *Admin) getDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if dl := a.deadLetter(w, r); dl != nil {
+		writeJSON(w, http.StatusOK, dl)
+	}
+}
+
+// redriveDeadLetter answers 200 with the outcome of the re-drive, whether
+// the script succeeded or not.
+func (a *Admin) redriveDeadLetter(w http.ResponseWriter, r *http.Request) {
+	dl := a.deadLetter(w, r)
+	if dl == nil {
+		return
+	}
+	route, ok := a.lookup(dl.Route)
+	if !ok && a.dir != nil {
+		route, _ = a.dir.Resolve(dl.Route)
+	}
+	if route == nil {
+		http.Error(w, fmt.Sprintf("route %s no longer exists", dl.Route), http.StatusConflict)
+		return
+	}
+	res, err := a.inv.deadLetters.redrive(r, a.inv, route, dl)
+	if errors.Is(err, errDeadLetterNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("dead letters: %v", err)
+		http.Error(w, "failed to update dead letter", http.StatusInternalServerError)
+		return
+	}
+	logAdmin(r, "dead letter %s of %s re-driven: ok=%t", dl.ID, dl.Route, res.OK)
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (a *Admin) deleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	err := a.inv.deadLetters.Delete(id)
+	if errors.Is(err, errDeadLetterNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("dead letters: %v", err)
+		http.Error(w, "failed to delete dead letter", http.StatusInternalServerError)
+		return
+	}
+	logAdmin(r, "dead letter %s deleted", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// logAdmin records changes made through the API regardless of log level.
+func logAdmin(r *http.Request, format string, args ...any) {
+	log.Printf("admin (%s): "+format, append([]any{r.RemoteAddr}, args...)...)
+}
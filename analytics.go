@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// maxAnalyticsKeys bounds the distinct top-level keys tracked per route, so
+// payloads with generated keys can't grow the counts without limit.
+const maxAnalyticsKeys = 200
+
+// analyticsBuckets are the upper bounds of the size histogram buckets.
+var analyticsBuckets = [...]int64{128, 1 << 10, 8 << 10, 64 << 10, 512 << 10, 4 << 20}
+
+// Analytics collects the shape of each route's traffic for script owners
+// planning a refactor: how large payloads and responses are, and which
+// top-level payload keys callers send. Only sizes and key names are kept,
+// never values. Streamed input and output are not measured.
+type Analytics struct {
+	mu     sync.Mutex
+	routes map[string]*routeAnalytics
+}
+
+type routeAnalytics struct {
+	invocations int64
+	payload     sizeHistogram
+	response    sizeHistogram
+	// keys counts the payloads containing each top-level key; objects
+	// counts the payloads that were JSON objects at all.
+	keys      map[string]int64
+	objects   int64
+	otherKeys int64
+}
+
+type sizeHistogram struct {
+	counts   [len(analyticsBuckets) + 1]int64
+	count    int64
+	sum      int64
+	min, max int64
+}
+
+func (h *sizeHistogram) add(n int64) {
+	i := sort.Search(len(analyticsBuckets), func(i int) bool { return n <= analyticsBuckets[i] })
+	h.counts[i]++
+	if h.count == 0 || n < h.min {
+		h.min = n
+	}
+	h.max = max(h.max, n)
+	h.count++
+	h.sum += n
+}
+
+func NewAnalytics() *Analytics {
+	return &Analytics{routes: map[string]*routeAnalytics{}}
+}
+
+// Record accounts for call and its result.
+func (a *Analytics) Record(call Invocation, res *Result, err error) {
+	var keys map[string]json.RawMessage
+	if call.Stdin == nil {
+		json.Unmarshal(call.Payload, &keys)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ra := a.routes[call.Route.Name]
+	if ra == nil {
+		ra = &routeAnalytics{keys: map[string]int64{}}
+		a.routes[call.Route.Name] = ra
+	}
+	ra.invocations++
+	if call.Stdin == nil {
+		ra.payload.add(int64(len(call.Payload)))
+	}
+	if keys != nil {
+		ra.objects++
+		for k := range keys {
+			if _, ok := ra.keys[k]; ok || len(ra.keys) < maxAnalyticsKeys {
+				ra.keys[k]++
+			} else {
+				ra.otherKeys++
+			}
+		}
+	}
+	if err == nil && call.Stdout == nil {
+		ra.response.add(int64(len(res.Stdout)))
+	}
+}
+
+type analyticsReport struct {
+	Route       string         `json:"route"`
+	Invocations int64          `json:"invocations"`
+	Payload     sizeReport     `json:"payload_size"`
+	Response    sizeReport     `json:"response_size"`
+	Keys        []keyFrequency `json:"top_level_keys"`
+	OtherKeys   int64          `json:"other_keys,omitempty"`
+}
+
+// sizeReport summarizes a size histogram.
+type sizeReport struct {
+	Count   int64        `json:"count"`
+	Min     int64        `json:"min"`
+	Max     int64        `json:"max"`
+	Mean    int64        `json:"mean"`
+	Buckets []sizeBucket `json:"buckets"`
+}
+
+// sizeBucket counts the sizes above the previous bucket's bound up to LE
+// bytes, or +Inf.
+type sizeBucket struct {
+	LE    string `json:"le"`
+	Count int64  `json:"count"`
+}
+
+// keyFrequency is how many payloads contained Key, and which fraction of
+// the object payloads that is.
+type keyFrequency struct {
+	Key      string  `json:"key"`
+	Count    int64   `json:"count"`
+	Fraction float64 `json:"fraction"`
+}
+
+func (h *sizeHistogram) report() sizeReport {
+	r := sizeReport{Count: h.count, Min: h.min, Max: h.max}
+	if h.count > 0 {
+		r.Mean = h.sum / h.count
+	}
+	for i, n := range h.counts {
+		le := "+Inf"
+		if i < len(analyticsBuckets) {
+			le = strconv.FormatInt(analyticsBuckets[i], 10)
+		}
+		r.Buckets = append(r.Buckets, sizeBucket{le, n})
+	}
+	return r
+}
+
+// Report returns the analytics of route, or of every route when route is
+// empty, sorted by route name. Keys are sorted by descending frequency.
+func (a *Analytics) Report(route string) []analyticsReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := []analyticsReport{}
+	for _, name := range sortedRoutes(a.routes) {
+		if route != "" && name != route {
+			continue
+		}
+		ra := a.routes[name]
+		rep := analyticsReport{
+			Route:       name,
+			Invocations: ra.invocations,
+			Payload:     ra.payload.report(),
+			Response:    ra.response.report(),
+			Keys:        make([]keyFrequency, 0, len(ra.keys)),
+			OtherKeys:   ra.otherKeys,
+		}
+		for k, n := range ra.keys {
+			rep.Keys = append(rep.Keys, keyFrequency{Key: k, Count: n, Fraction: float64(n) / float64(ra.objects)})
+		}
+		sort.Slice(rep.Keys, func(i, j int) bool {
+			if rep.Keys[i].Count != rep.Keys[j].Count {
+				return rep.Keys[i].Count > rep.Keys[j].Count
+			}
+			return rep.Keys[i].Key < rep.Keys[j].Key
+		})
+		out = append(out, rep)
+	}
+	return out
+}
+
+// Reset discards everything collected so far.
+func (a *Analytics) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.routes = map[string]*routeAnalytics{}
+}
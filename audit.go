@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Audit payload modes.
+const (
+	auditPayloadHash = "hash"
+	auditPayloadFull = "full"
+	auditPayloadNone = "none"
+)
+
+const (
+	auditQueueSize     = 4096
+	auditBatchSize     = 256
+	auditFlushInterval = time.Second
+)
+
+// AuditConfig enables the audit log, which records every invocation for
+// compliance. Sink is a file, rotated once it reaches MaxSize with MaxFiles
+// old files kept, an http(s) URL receiving batches of records as JSON
+// lines, or a storage URL (redis://, postgres:// or sqlite:), where each
+// record is kept under its own key in the audit namespace until removed. Payload selects whether payloads are
+// recorded as a SHA-256 hash, in full with the fields at Redact masked, or
+// not at all.
+type AuditConfig struct {
+	Sink     string
+	Payload  string
+	Redact   []string
+	MaxSize  int64
+	MaxFiles int
+}
+
+func (c AuditConfig) validate() error {
+	switch c.Payload {
+	case auditPayloadHash, auditPayloadFull, auditPayloadNone:
+	default:
+		return fmt.Errorf("unknown payload mode %q (want %s, %s or %s)", c.Payload, auditPayloadHash, auditPayloadFull, auditPayloadNone)
+	}
+	if c.MaxSize < 0 || c.MaxFiles < 0 {
+		return errors.New("max size and max files must not be negative")
+	}
+	if len(c.Redact) > 0 {
+		if _, err := parsePaths(c.Redact); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Route     string    `json:"route"`
+	Trigger   string    `json:"trigger,omitempty"`
+	Caller    string    `json:"caller,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	TraceID   string    `json:"trace_id,omitempty"`
+	// PayloadSHA256 or Payload is set depending on the payload mode;
+	// streamed payloads are never recorded.
+	PayloadSHA256 string          `json:"payload_sha256,omitempty"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+	// Status is ok, error or canceled.
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	ExitCode   *int    `json:"exit_code,omitempty"`
+	Cached     bool    `json:"cached,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// Auditor appends a record per invocation to the audit sink. Records are
+// queued and written in the background so invocations never wait on the
+// sink; when the queue is full they are dropped and counted.
+type Auditor struct {
+	*recordQueue
+	payload string
+	redact  Transform
+}
+
+// auditSink stores a batch of records, each a JSON line.
+type auditSink interface {
+	write(batch [][]byte) error
+	close() error
+}
+
+func NewAuditor(c AuditConfig) (*Auditor, error) {
+	a := &Auditor{payload: c.Payload}
+	if len(c.Redact) > 0 {
+		paths, err := parsePaths(c.Redact)
+		if err != nil {
+			return nil, err
+		}
+		a.redact = &maskTransform{paths: paths, with: "***"}
+	}
+	var sink auditSink
+	switch {
+	case isHTTPURL(c.Sink):
+		sink = &httpAuditSink{url: c.Sink, client: &http.Client{Timeout: 10 * time.Second}}
+	case isStorageURL(c.Sink):
+		kv, err := openStorage(c.Sink, "audit")
+		if err != nil {
+			return nil, err
+		}
+		sink = &kvAuditSink{kv: kv}
+	default:
+		s, err := openAuditFile(c.Sink, c.MaxSize, c.MaxFiles)
+		if err != nil {
+			return nil, err
+		}
+		sink = s
+	}
+	a.recordQueue = newRecordQueue("audit", sink, auditBatchSize, auditFlushInterval)
+	return a, nil
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+// Record queues the audit record of call, which started at started and
+// ended with res and err.
+func (a *Auditor) Record(call Invocation, res *Result, err error, started time.Time, canceled bool) {
+	rec := auditRecord{
+		Time:       started.UTC(),
+		RequestID:  call.Request.ID,
+		Route:      call.Route.Name,
+		Trigger:    call.Request.Trigger,
+		Caller:     call.Request.Caller,
+		Tenant:     call.Request.Tenant,
+		TraceID:    call.Request.TraceID,
+		Status:     "ok",
+		Cached:     res.Cached,
+		DurationMS: float64(time.Since(started).Microseconds()) / 1000,
+	}
+	if call.Stdin == nil {
+		switch a.payload {
+		case auditPayloadHash:
+			sum := sha256.Sum256(call.Payload)
+			rec.PayloadSHA256 = hex.EncodeToString(sum[:])
+		case auditPayloadFull:
+			rec.Payload = a.redacted(call.Payload)
+		}
+	}
+	if err != nil {
+		rec.Status = "error"
+		if canceled {
+			rec.Status = "canceled"
+		}
+		rec.Error = err.Error()
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			code := exit.ExitCode()
+			rec.ExitCode = &code
+		}
+	}
+	a.add(rec)
+}
+
+// redacted returns payload with the redacted fields masked. Payloads that
+// aren't JSON are replaced by a string, as they can't be redacted.
+func (a *Auditor) redacted(payload []byte) json.RawMessage {
+	if !json.Valid(payload) {
+		return json.RawMessage(`"(not JSON)"`)
+	}
+	if a.redact == nil {
+		return payload
+	}
+	out, err := applyTransforms([]Transform{a.redact}, payload)
+	if err != nil {
+		return json.RawMessage(`"(not redactable)"`)
+	}
+	return out
+}
+
+// Close writes the queued records and closes the sink. Records made
+// afterwards are lost.
+func (a *Auditor) Close() {
+	if a == nil {
+		return
+	}
+	a.recordQueue.close()
+}
+
+// recordQueue hands JSON lines to a sink in batches from the background,
+// so producers never wait on the sink; when the queue is full records are
+// dropped and counted.
+type recordQueue struct {
+	// name prefixes logged sink errors.
+	name     string
+	sink     auditSink
+	batch    int
+	interval time.Duration
+
+	queue chan []byte
+	done  chan struct{}
+	// stopped is closed once the queue was drained after close.
+	stopped chan struct{}
+	once    sync.Once
+
+	recorded, dropped, failed atomic.Int64
+}
+
+// newRecordQueue starts writing to sink once batch records are queued or
+// every interval.
+func newRecordQueue(name string, sink auditSink, batch int, interval time.Duration) *recordQueue {
+	q := &recordQueue{
+		name:     name,
+		sink:     sink,
+		batch:    batch,
+		interval: interval,
+		queue:    make(chan []byte, auditQueueSize),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// add queues the JSON encoding of rec.
+func (q *recordQueue) add(rec any) {
+	b, _ := json.Marshal(rec)
+	select {
+	case q.queue <- b:
+	default:
+		q.dropped.Add(1)
+	}
+}
+
+func (q *recordQueue) run() {
+	defer close(q.stopped)
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+	var batch [][]byte
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := q.sink.write(batch); err != nil {
+			q.failed.Add(int64(len(batch)))
+			log.Printf("%s: %v", q.name, err)
+		} else {
+			q.recorded.Add(int64(len(batch)))
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case b := <-q.queue:
+			batch = append(batch, b)
+			if len(batch) >= q.batch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-q.done:
+			for {
+				select {
+				case b := <-q.queue:
+					batch = append(batch, b)
+				default:
+					flush()
+					if err := q.sink.close(); err != nil {
+						log.Printf("%s: %v", q.name, err)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// close writes the queued records and closes the sink.
+func (q *recordQueue) close() {
+	q.once.Do(func() { close(q.done) })
+	<-q.stopped
+}
+
+// auditFile appends to a file, rotating it to path.1, path.2 and so on
+// once it reaches maxSize (0 = never).
+type auditFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	f    *os.File
+	size int64
+}
+
+func openAuditFile(path string, maxSize int64, maxFiles int) (*auditFile, error) {
+	s := &auditFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	return s, s.open()
+}
+
+func (s *auditFile) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, info.Size()
+	return nil
+}
+
+func (s *auditFile) write(batch [][]byte) error {
+	for _, b := range batch {
+		if s.maxSize > 0 && s.size > 0 && s.size+int64(len(b))+1 > s.maxSize {
+			if err := s.rotate(); err != nil {
+				return fmt.Errorf("rotate %s: %w", s.path, err)
+			}
+		}
+		n, err := s.f.Write(append(b, '\n'))
+		s.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *auditFile) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	if s.maxFiles == 0 {
+		if err := os.Remove(s.path); err != nil {
+			return err
+		}
+		return s.open()
+	}
+	for i := s.maxFiles - 1; i > 0; i-- {
+		os.Rename(s.path+"."+strconv.Itoa(i), s.path+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *auditFile) close() error {
+	return s.f.Close()
+}
+
+// httpAuditSink posts every batch as application/x-ndjson.
+type httpAuditSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpAuditSink) write(batch [][]byte) error {
+	body := append(bytes.Join(batch, []byte{'\n'}), '\n')
+	resp, err := s.client.Post(s.url, "application/x-ndjson", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", strings.SplitN(s.url, "?", 2)[0], resp.Status)
+	}
+	return nil
+}
+
+func (s *httpAuditSink) close() error { return nil }
+
+// kvAuditSink stores every record under a new key, ordered by time. Local
+// audit logs stay files, which log shippers can tail, rather than a file
+// per record.
+type kvAuditSink struct {
+	kv KVBackend
+}
+
+func (s *kvAuditSink) write(batch [][]byte) error {
+	for _, b := range batch {
+		if _, err := s.kv.Put(newRecordID(), b, 0, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *kvAuditSink) close() error { return s.kv.Close() }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// RouteAuth requires requests to a route's endpoints to carry a bearer
+// token: a static one, read from a file or environment variable, or a JWT;
+// see JWTConfig.
+type RouteAuth struct {
+	tokenFile string
+	tokenEnv  string
+	jwt       *jwtVerifier
+}
+
+func newRouteAuth(tokenFile, tokenEnv string, jwt *JWTConfig) (*RouteAuth, error) {
+	set := 0
+	for _, ok := range []bool{tokenFile != "", tokenEnv != "", jwt != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, errors.New("must set exactly one of token_file, token_env or jwt")
+	}
+	a := &RouteAuth{tokenFile: tokenFile, tokenEnv: tokenEnv}
+	if jwt != nil {
+		v, err := newJWTVerifier(*jwt)
+		if err != nil {
+			return nil, err
+		}
+		a.jwt = v
+	}
+	return a, nil
+}
+
+// token returns the expected token, re-reading the file each time so a
+// rotated token applies without a restart.
+func (a *RouteAuth) token() (string, error) {
+	if a.tokenFile != "" {
+		b, err := os.ReadFile(a.tokenFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	v := os.Getenv(a.tokenEnv)
+	if v == "" {
+		return "", fmt.Errorf("%s is not set", a.tokenEnv)
+	}
+	return v, nil
+}
+
+// authorize reports whether r carries the route's token, returning the
+// claims of a JWT forwarded to the script. It writes the error response
+// when not.
+func (a *RouteAuth) authorize(w http.ResponseWriter, r *http.Request, route string) (map[string]any, bool) {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if a.jwt != nil {
+		if !ok {
+			unauthorized(w, route, "")
+			return nil, false
+		}
+		claims, err := a.jwt.verify(r.Context(), got)
+		if errors.Is(err, errJWKSUnavailable) {
+			log.Printf("route %s: auth: %v", route, err)
+			http.Error(w, "auth unavailable", http.StatusServiceUnavailable)
+			return nil, false
+		}
+		if err != nil {
+			infof("route %s: rejected token: %v", route, err)
+			unauthorized(w, route, `, error="invalid_token"`)
+			return nil, false
+		}
+		return claims, true
+	}
+
+	want, err := a.token()
+	if err != nil {
+		// Never let a missing token open the route.
+		log.Printf("route %s: auth: %v", route, err)
+		http.Error(w, "auth unavailable", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		unauthorized(w, route, "")
+		return nil, false
+	}
+	return nil, true
+}
+
+func unauthorized(w http.ResponseWriter, route, params string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="`+route+`"`+params)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+type claimsKey struct{}
+
+// withClaims returns r carrying the forwarded claims of its token, for
+// requestInfo.
+func withClaims(r *http.Request, claims map[string]any) *http.Request {
+	if claims == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims))
+}
+
+func requestClaims(r *http.Request) map[string]any {
+	claims, _ := r.Context().Value(claimsKey{}).(map[string]any)
+	return claims
+}
+
+type authenticatedKey struct{}
+
+// withAuthenticated returns r marked as coming from a caller that passed
+// its route's auth or tenant key.
+func withAuthenticated(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), authenticatedKey{}, true))
+}
+
+func authenticated(r *http.Request) bool {
+	return r.Context().Value(authenticatedKey{}) != nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// backpressurePoll is how often Backpressure.Reserve checks for a free
+// slot.
+const backpressurePoll = 25 * time.Millisecond
+
+// Backpressure reports how saturated the concurrency limits a route's
+// invocations run under are: the route's own, its tenant's and the
+// server-wide one. Queue-based triggers use it to pull messages only as
+// fast as they can be processed, leaving the rest with the broker instead
+// of holding them while their visibility or ack deadlines run out.
+//
+// A source calls Reserve before pulling each message, then either fires
+// it or calls Cancel. The reservation holds the place of the invocation
+// until it has taken its slots, so sources firing concurrently don't pull
+// more than there is room for.
+type Backpressure struct {
+	limiters []*limiter
+	// pending is shared by the sources of the route; reserved is this
+	// source's part of it.
+	pending  *pendingReservations
+	reserved int
+}
+
+// pendingReservations counts the reservations of a route whose invocation
+// hasn't taken its slots yet.
+type pendingReservations struct {
+	mu sync.Mutex
+	n  int
+}
+
+func newBackpressure(inv *Invoker, route *Route) *Backpressure {
+	bp := &Backpressure{limiters: []*limiter{inv.slots}, pending: &pendingReservations{}}
+	if route.slots != nil {
+		bp.limiters = append(bp.limiters, route.slots)
+	}
+	if t := route.Tenant; t != nil && t.slots != nil {
+		bp.limiters = append(bp.limiters, t.slots)
+	}
+	return bp
+}
+
+// source returns the Backpressure of one of the route's sources.
+func (bp *Backpressure) source() *Backpressure {
+	return &Backpressure{limiters: bp.limiters, pending: bp.pending}
+}
+
+// backpressureKey is the context key of the Backpressure handed to a
+// trigger's Run.
+type backpressureKey struct{}
+
+// TriggerBackpressure returns the Backpressure of the trigger whose Run
+// was passed ctx, for pacing prefetches and polls. It is nil for other
+// contexts.
+func TriggerBackpressure(ctx context.Context) *Backpressure {
+	bp, _ := ctx.Value(backpressureKey{}).(*Backpressure)
+	return bp
+}
+
+// Available returns how many more invocations of the route would start
+// right away rather than wait for a slot, math.MaxInt when unlimited.
+func (bp *Backpressure) Available() int {
+	bp.pending.mu.Lock()
+	defer bp.pending.mu.Unlock()
+	return bp.availableLocked()
+}
+
+func (bp *Backpressure) availableLocked() int {
+	n := math.MaxInt
+	for _, l := range bp.limiters {
+		limit, active, queued := l.Stats()
+		if limit > 0 {
+			n = min(n, max(limit-active-queued-bp.pending.n, 0))
+		}
+	}
+	return n
+}
+
+// Saturation returns the busiest limit's running and waiting invocations
+// as a fraction of its limit: below 1 there is room, above it invocations
+// are queueing. It is 0 when nothing is limited.
+func (bp *Backpressure) Saturation() float64 {
+	var s float64
+	for _, l := range bp.limiters {
+		limit, active, queued := l.Stats()
+		if limit > 0 {
+			s = max(s, float64(active+queued)/float64(limit))
+		}
+	}
+	return s
+}
+
+// Reserve blocks until an invocation of the route would start right away,
+// and holds its place, or until ctx is done.
+func (bp *Backpressure) Reserve(ctx context.Context) error {
+	if bp.tryReserve() {
+		return nil
+	}
+	t := time.NewTicker(backpressurePoll)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			if bp.tryReserve() {
+				return nil
+			}
+		}
+	}
+}
+
+func (bp *Backpressure) tryReserve() bool {
+	bp.pending.mu.Lock()
+	defer bp.pending.mu.Unlock()
+	if bp.availableLocked() == 0 {
+		return false
+	}
+	bp.pending.n++
+	bp.reserved++
+	return true
+}
+
+// Cancel gives up a reservation that won't be fired. It is also called
+// once a fired invocation took its slots, or ended without; sources that
+// don't reserve have nothing to give up.
+func (bp *Backpressure) Cancel() {
+	bp.pending.mu.Lock()
+	defer bp.pending.mu.Unlock()
+	if bp.reserved > 0 {
+		bp.reserved--
+		bp.pending.n--
+	}
+}
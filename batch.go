@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BatchResult is the outcome of one item in a batch invocation.
+type BatchResult struct {
+	Status     int             `json:"status"`
+	Output     json.RawMessage `json:"output,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	Violations []Violation     `json:"violations,omitempty"`
+}
+
+// makeBatchHandler serves POST /invoke/batch: a JSON array of payloads is
+// fanned out across the invoker with at most opts.BatchParallelism items
+// in flight, and the per-item results are returned in request order.
+func makeBatchHandler(inv *Invoker, route *Route, opts handlerOptions) http.HandlerFunc {
+	return makeDispatchHandler(inv, route, serveBatch, opts)
+}
+
+func serveBatch(w http.ResponseWriter, r *http.Request, inv *Invoker, route *Route, opts handlerOptions) {
+	w, r, span := startServerSpan(w, r, opts.Tracer, "batch "+route.Name)
+	defer span.End()
+	span.SetAttr("invoke.route", route.Name)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	setBuildHeaders(w, route.build())
+	if route.Encryption != "" {
+		http.Error(w, "route requires an encrypted payload, which batches can't carry", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	fields, err := requestFields(r)
+	if err != nil {
+		http.Error(w, "invalid fields: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		http.Error(w, "batch payload must be a JSON array", http.StatusBadRequest)
+		return
+	}
+
+	clock, err := requestClock(r, route, opts.FakeClock || opts.Deterministic)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	priority, err := requestPriority(r, route, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	parallelism := max(opts.BatchParallelism, 1)
+	rounds := (len(items) + parallelism - 1) / parallelism
+	extendDeadlines(w, time.Duration(rounds)*inv.budget(route)+inv.cfg.HTTPTimeoutMargin)
+	span.SetAttr("invoke.batch.size", len(items))
+	h := propagate(r.Header, span)
+	base := Invocation{
+		Route:    route,
+		Env:      forwardedHeadersEnv(h, opts.ForwardHeaders),
+		Request:  requestInfo(w, r, h, opts),
+		NoCache:  noCache(r),
+		Clock:    clock,
+		Priority: priority,
+	}
+	route.Experiment.assign(w, r, &base.Request)
+	if opts.Deterministic {
+		if err := makeDeterministic(w, r, &base); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	results := make([]BatchResult, len(items))
+	answer := holdWriteDeadline(w, inv.cfg.HTTPTimeoutMargin)
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+
+	for i, item := range items {
+		item, err := applyTransforms(route.RequestTransforms, item)
+		if err != nil {
+			results[i] = BatchResult{Status: http.StatusBadRequest, Error: "payload transform failed: " + err.Error()}
+			continue
+		}
+		if route.Schema != nil {
+			if route.Coerce || opts.CoercePayload {
+				item, err = route.Schema.Coerce(item)
+			}
+			var violations []Violation
+			if err == nil {
+				violations, err = route.Schema.Validate(item)
+			}
+			if err != nil || len(violations) > 0 {
+				results[i] = BatchResult{
+					Status:     http.StatusBadRequest,
+					Error:      "payload does not match schema",
+					Violations: violations,
+				}
+				continue
+			}
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			call := base
+			call.Payload = item
+			results[i] = runBatchItem(r, inv, call, fields)
+		}()
+	}
+	wg.Wait()
+	answer()
+
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	enc.Encode(results)
+	if err := opts.Signer.sign(w.Header(), out.Bytes()); err != nil {
+		log.Printf("%s: response signing failed: %v", route.Name, err)
+		http.Error(w, "response signing failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeCompressed(w, r, http.StatusOK, out.Bytes(), opts.CompressMinSize)
+}
+
+func runBatchItem(r *http.Request, inv *Invoker, call Invocation, fields fieldSet) BatchResult {
+	res, err := inv.Invoke(r.Context(), call)
+	if errors.Is(err, errTokenUnavailable) {
+		return BatchResult{Status: http.StatusServiceUnavailable, Error: err.Error()}
+	}
+	var open *circuitOpenError
+	if errors.As(err, &open) {
+		return BatchResult{Status: http.StatusServiceUnavailable, Error: open.Error()}
+	}
+	var limit *limitError
+	if errors.As(err, &limit) {
+		log.Printf("node error: %v, stderr: %s", err, res.Stderr)
+		return BatchResult{Status: limit.status(), Error: limit.Error()}
+	}
+	var fault *faultError
+	if errors.As(err, &fault) {
+		return BatchResult{Status: fault.status, Error: fault.Error()}
+	}
+	if errors.Is(err, errTimeout) {
+		log.Printf("node error: %v, stderr: %s", err, res.Stderr)
+		return BatchResult{Status: inv.cfg.TimeoutStatus, Error: err.Error()}
+	}
+	if err != nil {
+		log.Printf("node error: %v, stderr: %s", err, res.Stderr)
+		return BatchResult{
+			Status: http.StatusInternalServerError,
+			Error:  "node.js failed: " + firstLine(string(res.Stderr), err.Error()),
+		}
+	}
+	out, err := applyTransforms(call.Route.ResponseTransforms, res.Stdout)
+	if err != nil {
+		log.Printf("%s: output transform failed: %v", call.Route.Name, err)
+		return BatchResult{Status: http.StatusInternalServerError, Error: "output transform failed"}
+	}
+	return BatchResult{Status: http.StatusOK, Output: rawOutput(fields.filterOutput(out))}
+}
+
+// rawOutput embeds script output as-is when it is JSON, and as a JSON
+// string otherwise.
+func rawOutput(out []byte) json.RawMessage {
+	if json.Valid(out) {
+		return out
+	}
+	b, _ := json.Marshal(string(out))
+	return b
+}
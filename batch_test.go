@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBatchRoutes(t *testing.T) {
+	config := `
+routes:
+  double:
+    script: "` + strings.ReplaceAll(stdinScript("p < 0 ? process.exit(1) : p * 2"), `"`, `\"`) + `"
+    schema: number.json
+  text:
+    script: "process.stdout.write('plain')"
+`
+	s := newRouteTest(t, map[string]string{
+		"config.yaml": config,
+		"number.json": `{"type": "number"}`,
+	}, nil)
+
+	w := serveTest(t, s, "/invoke/batch/double", `[1, 2, -1, "x", 4]`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("batch = %d %s", w.Code, w.Body)
+	}
+	var results []BatchResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		status int
+		output string
+	}{{200, "2"}, {200, "4"}, {500, ""}, {400, ""}, {200, "8"}}
+	if len(results) != len(want) {
+		t.Fatalf("%d results for %d items", len(results), len(want))
+	}
+	// Results are in request order, each item failing on its own.
+	for i, w := range want {
+		if got := results[i]; got.Status != w.status || strings.TrimSpace(string(got.Output)) != w.output {
+			t.Errorf("item %d = %d %s, want %d %s", i, got.Status, got.Output, w.status, w.output)
+		}
+	}
+	if len(results[3].Violations) == 0 {
+		t.Error("schema violations of item 3 weren't reported")
+	}
+
+	// Output that isn't JSON is returned as a string.
+	w = serveTest(t, s, "/invoke/batch/text", `[{}]`, nil)
+	if !strings.Contains(w.Body.String(), `"output":"plain"`) {
+		t.Errorf("batch of text = %s, want the output as a JSON string", w.Body)
+	}
+
+	for _, body := range []string{`{}`, `not json`} {
+		if w := serveTest(t, s, "/invoke/batch/double", body, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("batch of %s = %d, want 400", body, w.Code)
+		}
+	}
+}
+
+func TestBatchParallelism(t *testing.T) {
+	// Each item reports when it ran, as [start, end] in milliseconds.
+	config := `
+routes:
+  slow:
+    script: "const start = Date.now(); setTimeout(() => process.stdout.write(JSON.stringify([start, Date.now()])), 200)"
+`
+	s := newRouteTest(t, map[string]string{"config.yaml": config}, nil)
+	s.opts.BatchParallelism = 2
+	if _, err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	w := serveTest(t, s, "/invoke/batch/slow", `[1, 2, 3, 4, 5]`, nil)
+	var results []BatchResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("batch = %d %s", w.Code, w.Body)
+	}
+	var spans [][2]int64
+	for _, res := range results {
+		var span [2]int64
+		if err := json.Unmarshal(res.Output, &span); err != nil {
+			t.Fatalf("item = %+v", res)
+		}
+		spans = append(spans, span)
+	}
+	for _, a := range spans {
+		running := 0
+		for _, b := range spans {
+			if b[0] <= a[0] && a[0] < b[1] {
+				running++
+			}
+		}
+		if running > 2 {
+			t.Fatalf("%d items ran at once, want at most 2: %v", running, spans)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BreakerPolicy opens a route's circuit after Failures failed invocations
+// within Window, rejecting further invocations for Cooldown instead of
+// spawning node processes that are bound to fail. A single trial
+// invocation is then let through: success closes the circuit, failure
+// opens it for another Cooldown.
+type BreakerPolicy struct {
+	// Failures is the number of failures that opens the circuit; 0
+	// disables the breaker.
+	Failures int           `yaml:"failures"`
+	Window   time.Duration `yaml:"window"`
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+func (p BreakerPolicy) validate() error {
+	if p.Failures < 0 || p.Window < 0 || p.Cooldown < 0 {
+		return errors.New("failures, window and cooldown must not be negative")
+	}
+	return nil
+}
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// circuitOpenError rejects an invocation of a route whose circuit is open.
+type circuitOpenError struct {
+	route      string
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open for %s after repeated failures", e.route)
+}
+
+// reject writes the 503 response for e.
+func (e *circuitOpenError) reject(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.retryAfter.Seconds()))))
+	http.Error(w, e.Error(), http.StatusServiceUnavailable)
+}
+
+// Breakers holds the circuit of every route invoked so far, keyed by route
+// name so that script directory routes, which are resolved per request,
+// share one circuit.
+type Breakers struct {
+	policy BreakerPolicy
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	policy   BreakerPolicy
+	state    string
+	failures []time.Time
+	// until is when an open circuit admits its trial invocation.
+	until time.Time
+	// trial is set while the half-open trial invocation runs.
+	trial bool
+	trips int64
+}
+
+// breakerStatus is the state of one route's circuit as reported by the
+// admin API.
+type breakerStatus struct {
+	Route    string     `json:"route"`
+	State    string     `json:"state"`
+	Failures int        `json:"failures"`
+	Until    *time.Time `json:"until,omitempty"`
+	Trips    int64      `json:"trips"`
+}
+
+func newBreakers(policy BreakerPolicy) *Breakers {
+	return &Breakers{policy: policy, circuits: map[string]*circuit{}}
+}
+
+// circuitLocked returns route's circuit, or nil when its breaker is
+// disabled.
+func (b *Breakers) circuitLocked(route *Route) *circuit {
+	if c, ok := b.circuits[route.Name]; ok {
+		return c
+	}
+	policy := b.policy
+	if rp := route.Breaker; rp != nil {
+		// A route's policy inherits the window and cooldown it omits.
+		policy.Failures = rp.Failures
+		if rp.Window > 0 {
+			policy.Window = rp.Window
+		}
+		if rp.Cooldown > 0 {
+			policy.Cooldown = rp.Cooldown
+		}
+	}
+	if policy.Failures <= 0 {
+		return nil
+	}
+	c := &circuit{policy: policy, state: breakerClosed}
+	b.circuits[route.Name] = c
+	return c
+}
+
+// Allow returns a *circuitOpenError when route's circuit rejects an
+// invocation. Every allowed invocation must be followed by Record.
+func (b *Breakers) Allow(route *Route) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuitLocked(route)
+	if c == nil {
+		return nil
+	}
+	now := time.Now()
+	switch c.state {
+	case breakerOpen:
+		if now.Before(c.until) {
+			return &circuitOpenError{route: route.Name, retryAfter: c.until.Sub(now)}
+		}
+		c.state = breakerHalfOpen
+		c.trial = true
+		infof("%s: circuit half-open; trying one invocation", route.Name)
+	case breakerHalfOpen:
+		if c.trial {
+			return &circuitOpenError{route: route.Name, retryAfter: time.Second}
+		}
+		c.trial = true
+	}
+	return nil
+}
+
+// Record counts the outcome of an invocation allowed by Allow. ctx is the
+// caller's context: failures after it was canceled, a missing OAuth token
+// and exceeded resource limits say nothing about the script and are not
+// counted.
+func (b *Breakers) Record(ctx context.Context, route *Route, err error) {
+	var limit *limitError
+	ignored := err != nil && (ctx.Err() != nil || errors.Is(err, errTokenUnavailable) || errors.Is(err, errCanceled) || errors.As(err, &limit))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuitLocked(route)
+	if c == nil {
+		return
+	}
+	now := time.Now()
+	if c.state == breakerHalfOpen {
+		c.trial = false
+		switch {
+		case ignored:
+		case err == nil:
+			c.state = breakerClosed
+			c.failures = nil
+			log.Printf("%s: circuit closed", route.Name)
+		default:
+			c.open(now)
+			log.Printf("%s: trial invocation failed; circuit open for %s", route.Name, c.policy.Cooldown)
+		}
+		return
+	}
+	if err == nil || ignored || c.state == breakerOpen {
+		return
+	}
+
+	c.failures = append(c.failures, now)
+	cutoff := now.Add(-c.policy.Window)
+	for len(c.failures) > 0 && c.failures[0].Before(cutoff) {
+		c.failures = c.failures[1:]
+	}
+	if len(c.failures) >= c.policy.Failures {
+		log.Printf("%s: %d failures within %s; circuit open for %s", route.Name, len(c.failures), c.policy.Window, c.policy.Cooldown)
+		c.open(now)
+	}
+}
+
+func (c *circuit) open(now time.Time) {
+	c.state = breakerOpen
+	c.until = now.Add(c.policy.Cooldown)
+	c.failures = nil
+	c.trips++
+}
+
+// Reset closes route's circuit and forgets its failures. It reports
+// whether the route had a circuit.
+func (b *Breakers) Reset(route string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[route]
+	if ok {
+		c.state = breakerClosed
+		c.failures = nil
+		c.trial = false
+	}
+	return ok
+}
+
+// Status returns the state of every circuit, keyed by route name.
+func (b *Breakers) Status() map[string]breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	out := make(map[string]breakerStatus, len(b.circuits))
+	for name, c := range b.circuits {
+		st := breakerStatus{Route: name, State: c.state, Failures: len(c.failures), Trips: c.trips}
+		if c.state == breakerClosed {
+			// Failures outside the window no longer count.
+			cutoff := now.Add(-c.policy.Window)
+			for _, t := range c.failures {
+				if t.Before(cutoff) {
+					st.Failures--
+				}
+			}
+		}
+		if c.state == breakerOpen {
+			until := c.until
+			st.Until = &until
+		}
+		out[name] = st
+	}
+	return out
+}
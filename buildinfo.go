@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+)
+
+const (
+	// buildMarker introduces the build metadata a bundler embeds in a
+	// script, typically as a banner comment:
+	//
+	//	/*! @build {"git_sha":"3f2c1ab","build_time":"2024-05-01T12:00:00Z"} */
+	buildMarker = "@build"
+	// buildHeaderSize is how much of a script is searched for the marker.
+	buildHeaderSize = 4 << 10
+
+	buildHeader     = "X-Script-Build"
+	buildTimeHeader = "X-Script-Build-Time"
+)
+
+// BuildInfo is the build metadata embedded in a script bundle, tying an
+// invocation to the commit it was built from.
+type BuildInfo struct {
+	GitSHA    string `json:"git_sha,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+}
+
+// String describes b for logs.
+func (b *BuildInfo) String() string {
+	if b == nil {
+		return "unknown build"
+	}
+	s := "build " + b.GitSHA
+	if b.BuildTime != "" {
+		s += " (" + b.BuildTime + ")"
+	}
+	return s
+}
+
+// parseBuildInfo returns the metadata following the first buildMarker in
+// src, or nil when there is none.
+func parseBuildInfo(src []byte) *BuildInfo {
+	_, rest, ok := bytes.Cut(src, []byte(buildMarker))
+	if !ok {
+		return nil
+	}
+	var b BuildInfo
+	// The decoder stops after the object, ignoring the rest of the
+	// comment.
+	if err := json.NewDecoder(bytes.NewReader(rest)).Decode(&b); err != nil || b.GitSHA == "" {
+		return nil
+	}
+	return &b
+}
+
+// readBuildInfo reads the metadata embedded near the top of file.
+func readBuildInfo(file string) *BuildInfo {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	head := make([]byte, buildHeaderSize)
+	n, _ := io.ReadFull(f, head)
+	return parseBuildInfo(head[:n])
+}
+
+// build returns the metadata embedded in the route's script, read fresh
+// each time so that redeployed bundles are reported without a restart.
+func (rt *Route) build() *BuildInfo {
+	if rt.InlineScript != "" {
+		return parseBuildInfo([]byte(rt.InlineScript))
+	}
+	if rt.ScriptFile != "" {
+		return readBuildInfo(rt.ScriptFile)
+	}
+	return nil
+}
+
+// setBuildHeaders reports b on the response, if known.
+func setBuildHeaders(w http.ResponseWriter, b *BuildInfo) {
+	if b == nil {
+		return
+	}
+	w.Header().Set(buildHeader, b.GitSHA)
+	if b.BuildTime != "" {
+		w.Header().Set(buildTimeHeader, b.BuildTime)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resultCache is an LRU of successful script outputs with a fixed TTL,
+// letting idempotent scripts answer repeated payloads without spawning
+// node. It also backs the cache scripts use through the Store. A nil
+// *resultCache caches nothing.
+//
+// Entries are kept in process unless the cache is shared, when they live
+// in a KVBackend that several servers can use; see share. There they are
+// bounded by the TTL alone, and it's up to the storage to evict.
+type resultCache struct {
+	ttl  time.Duration
+	size int
+	// maxBytes, when positive, bounds the total size of keys and values.
+	maxBytes int64
+	// kv, when set, holds the entries instead of the LRU.
+	kv KVBackend
+
+	mu        sync.Mutex
+	ll        *list.List
+	items     map[string]*list.Element
+	bytes     int64
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+type cacheEntry struct {
+	key     string
+	stdout  []byte
+	expires time.Time
+}
+
+// newResultCache returns nil, disabling caching, unless both ttl and size
+// are positive.
+func newResultCache(size int, ttl time.Duration) *resultCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &resultCache{
+		ttl:   ttl,
+		size:  size,
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+// share moves the cache into the storage spec names, keeping its entries
+// under namespace, so that servers using the same storage share them.
+// "memory" leaves the cache in process; see openStorage for the others.
+func (c *resultCache) share(spec, namespace string) error {
+	if c == nil || spec == "" || spec == "memory" {
+		return nil
+	}
+	if !isStorageURL(spec) {
+		return fmt.Errorf("unknown backend %q: want memory, or a redis://, postgres:// or sqlite: URL", spec)
+	}
+	kv, err := openStorage(spec, namespace)
+	if err != nil {
+		return err
+	}
+	c.kv = kv
+	return nil
+}
+
+// Get returns the cached output for key if present and unexpired.
+func (c *resultCache) Get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	if c.kv != nil {
+		out, err := c.kv.Get(key)
+		if err != nil && !errors.Is(err, errKeyNotFound) {
+			log.Printf("cache: %v", err)
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if err != nil {
+			c.misses++
+			return nil, false
+		}
+		c.hits++
+		return out, true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if ok && time.Now().After(el.Value.(*cacheEntry).expires) {
+		c.removeLocked(el)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.ll.MoveToFront(el)
+	return el.Value.(*cacheEntry).stdout, true
+}
+
+// Put stores out under key, evicting the least recently used entries when
+// the cache is full.
+func (c *resultCache) Put(key string, out []byte) {
+	c.PutTTL(key, out, c.ttl)
+}
+
+// PutTTL is Put with an entry specific TTL, capped at the cache's.
+func (c *resultCache) PutTTL(key string, out []byte, ttl time.Duration) {
+	if c == nil {
+		return
+	}
+	if c.kv != nil {
+		if _, err := c.kv.Put(key, out, min(ttl, c.ttl), false); err != nil {
+			log.Printf("cache: %v", err)
+		}
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := time.Now().Add(min(ttl, c.ttl))
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*cacheEntry)
+		c.bytes += int64(len(out) - len(e.stdout))
+		e.stdout, e.expires = out, expires
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[key] = c.ll.PushFront(&cacheEntry{key: key, stdout: out, expires: expires})
+		c.bytes += int64(len(key) + len(out))
+	}
+	for c.ll.Len() > c.size || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.removeLocked(c.ll.Back())
+		c.evictions++
+	}
+}
+
+// Delete removes key.
+func (c *resultCache) Delete(key string) {
+	if c == nil {
+		return
+	}
+	if c.kv != nil {
+		if err := c.kv.Delete(key); err != nil {
+			log.Printf("cache: %v", err)
+		}
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.removeLocked(el)
+	}
+}
+
+// Purge drops every entry, e.g. after a script changed. A shared cache
+// is purged for every server using it.
+func (c *resultCache) Purge() {
+	if c == nil {
+		return
+	}
+	if c.kv != nil {
+		keys, err := c.kv.Keys("")
+		for _, key := range keys {
+			if err == nil {
+				err = c.kv.Delete(key)
+			}
+		}
+		if err != nil {
+			log.Printf("cache: purge: %v", err)
+		}
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	clear(c.items)
+	c.bytes = 0
+}
+
+// Stats returns the hit and miss counts and the number of cached entries,
+// which for a shared cache is the number the storage holds.
+func (c *resultCache) Stats() (hits, misses int64, entries int) {
+	c.mu.Lock()
+	hits, misses, entries = c.hits, c.misses, c.ll.Len()
+	c.mu.Unlock()
+	if c.kv != nil {
+		entries, _ = c.kv.Len()
+	}
+	return hits, misses, entries
+}
+
+// Usage returns the size of the cached keys and values and the number of
+// entries evicted to make room, both zero for a shared cache, whose
+// storage evicts by itself.
+func (c *resultCache) Usage() (bytes, evictions int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes, c.evictions
+}
+
+func (c *resultCache) removeLocked(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	c.ll.Remove(el)
+	delete(c.items, e.key)
+	c.bytes -= int64(len(e.key) + len(e.stdout))
+}
+
+// cacheKey identifies an invocation by the script it runs, its payload and
+// who it runs for: the tenant and JWT claims scripts see in INVOKE_CONTEXT
+// may change their output. Per-request environment such as forwarded
+// headers is deliberately left out so trace and request IDs don't defeat
+// the cache.
+func cacheKey(call Invocation) string {
+	rt := call.Route
+	// Maps are marshaled with sorted keys, so equal claims hash alike.
+	claims, _ := json.Marshal(call.Request.Claims)
+	h := sha256.New()
+	for _, part := range []string{rt.Name, rt.revision, rt.InlineScript, rt.ScriptFile, strings.Join(rt.EnvFiles, "\n"), call.Request.Variant, call.Request.Tenant, string(claims)} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	h.Write(call.Payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// noCache reports whether the client asked to bypass cached results.
+func noCache(r *http.Request) bool {
+	for _, v := range r.Header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(d), "no-cache") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func cacheStatus(hit bool) string {
+	if hit {
+		return "HIT"
+	}
+	return "MISS"
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSharedResultCache checks that caches sharing storage, as servers
+// behind a load balancer do, see each other's entries.
+func TestSharedResultCache(t *testing.T) {
+	spec := "sqlite:" + filepath.Join(t.TempDir(), "cache.db")
+	open := func() *resultCache {
+		c := newResultCache(10, time.Minute)
+		if err := c.share(spec, "cache"); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.kv.Close() })
+		return c
+	}
+	a, b := open(), open()
+
+	a.Put("k", []byte("out"))
+	if out, ok := b.Get("k"); !ok || string(out) != "out" {
+		t.Errorf("Get from the other server = %q, %v, want out", out, ok)
+	}
+	if _, ok := b.Get("missing"); ok {
+		t.Error("Get of a missing key hit")
+	}
+	if hits, misses, entries := b.Stats(); hits != 1 || misses != 1 || entries != 1 {
+		t.Errorf("Stats = %d hits, %d misses, %d entries, want 1, 1, 1", hits, misses, entries)
+	}
+
+	a.PutTTL("short", []byte("x"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := b.Get("short"); ok {
+		t.Error("Get of an expired entry hit")
+	}
+
+	b.Purge()
+	if _, ok := a.Get("k"); ok {
+		t.Error("entry survived the other server's Purge")
+	}
+}
+
+func TestResultCacheShareUnknownBackend(t *testing.T) {
+	if err := newResultCache(10, time.Minute).share(t.TempDir(), "cache"); err == nil {
+		t.Error("a directory was accepted as the cache backend")
+	}
+	var disabled *resultCache
+	if err := disabled.share("sqlite:x.db", "cache"); err != nil {
+		t.Errorf("sharing a disabled cache = %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// callbackParam is the query parameter naming the URL an asynchronous
+	// invocation's result is delivered to.
+	callbackParam = "callbackUrl"
+
+	callbackSignatureHeader = "X-Invoke-Signature"
+	callbackTimeout         = 10 * time.Second
+	callbackMaxBackoff      = time.Minute
+)
+
+// CallbackConfig enables asynchronous invocations: a request to
+// /invoke?callbackUrl=... is answered with 202 Accepted right away, and
+// once the script finished its result envelope is POSTed to the callback
+// URL, whose host must match one of AllowHosts. Deliveries are signed with
+// the secret in SecretFile and tried up to Attempts times, backing off
+// from Backoff.
+type CallbackConfig struct {
+	AllowHosts []string
+	SecretFile string
+	Attempts   int
+	Backoff    time.Duration
+}
+
+func (c CallbackConfig) Enabled() bool {
+	return len(c.AllowHosts) > 0
+}
+
+func (c CallbackConfig) validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.SecretFile == "" {
+		return errors.New("--callback-allow-hosts requires --callback-secret-file")
+	}
+	if c.Attempts < 1 || c.Backoff <= 0 {
+		return errors.New("--callback-attempts and --callback-backoff must be positive")
+	}
+	return nil
+}
+
+// callbackEnvelope is the body POSTed to a callback URL:
+//
+//	{
+//	  "id": "4bf92f3577b34da6",
+//	  "route": "reports/build",
+//	  "status": "succeeded",
+//	  "output": {…},
+//	  "started": "2024-05-01T12:00:00Z",
+//	  "completed": "2024-05-01T12:00:42.5Z"
+//	}
+//
+// A failed invocation has status failed and error instead of output. The
+// ID is the request ID returned in the 202 response.
+type callbackEnvelope struct {
+	ID        string          `json:"id"`
+	Route     string          `json:"route"`
+	Status    string          `json:"status"`
+	Output    json.RawMessage `json:"output,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Started   time.Time       `json:"started"`
+	Completed time.Time       `json:"completed"`
+}
+
+// Callbacks runs asynchronous invocations and delivers their results.
+//
+// Every delivery carries an X-Invoke-Signature header of the form
+// t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">, keyed with the
+// secret, which receivers verify like a Stripe webhook. Deliveries that
+// fail with a network error, a 429 or a 5xx status are retried; other
+// statuses are final.
+type Callbacks struct {
+	cfg    CallbackConfig
+	client *http.Client
+	wg     sync.WaitGroup
+
+	delivered, failed atomic.Int64
+}
+
+func NewCallbacks(cfg CallbackConfig) *Callbacks {
+	return &Callbacks{cfg: cfg, client: &http.Client{Timeout: callbackTimeout}}
+}
+
+// target parses and checks the callback URL requested by a client.
+func (c *Callbacks) target(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid %s %q", callbackParam, raw)
+	}
+	if !hostAllowed(u.Hostname(), c.cfg.AllowHosts) {
+		return nil, fmt.Errorf("%s host %q is not allowed", callbackParam, u.Hostname())
+	}
+	return u, nil
+}
+
+// Start runs call in the background and delivers its result to target.
+func (c *Callbacks) Start(ctx context.Context, inv *Invoker, call Invocation, target *url.URL) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		env := callbackEnvelope{ID: call.Request.ID, Route: call.Route.Name, Started: time.Now().UTC()}
+		res, err := inv.Invoke(ctx, call)
+		out := res.Stdout
+		if err == nil {
+			out, err = applyTransforms(call.Route.ResponseTransforms, out)
+		}
+		if err == nil && !json.Valid(out) {
+			err = errors.New("output is not JSON")
+		}
+		env.Completed = time.Now().UTC()
+		if err != nil {
+			log.Printf("%s: async invocation %s failed: %v, stderr: %s", call.Route.Name, env.ID, err, res.Stderr)
+			env.Status, env.Error = "failed", firstLine(string(res.Stderr), err.Error())
+		} else {
+			env.Status, env.Output = "succeeded", out
+		}
+		body, _ := json.Marshal(env)
+		if err := c.deliver(target, body); err != nil {
+			c.failed.Add(1)
+			log.Printf("%s: callback for %s to %s failed: %v", call.Route.Name, env.ID, target.Host, err)
+			return
+		}
+		c.delivered.Add(1)
+		infof("%s: delivered callback for %s to %s", call.Route.Name, env.ID, target.Host)
+	}()
+}
+
+// deliver POSTs body to target, retrying transient failures.
+func (c *Callbacks) deliver(target *url.URL, body []byte) error {
+	backoff := c.cfg.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		if retry, err = c.post(target, body); err == nil || !retry || attempt == c.cfg.Attempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff = min(2*backoff, callbackMaxBackoff)
+	}
+}
+
+// post makes one delivery attempt and reports whether a failure is worth
+// retrying.
+func (c *Callbacks) post(target *url.URL, body []byte) (retry bool, err error) {
+	secret, err := os.ReadFile(c.cfg.SecretFile)
+	if err != nil {
+		return false, fmt.Errorf("load secret: %w", err)
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := hmacSHA256([]byte(strings.TrimRight(string(secret), "\r\n")), ts, ".", string(body))
+
+	req, err := http.NewRequest(http.MethodPost, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(callbackSignatureHeader, "t="+ts+",v1="+hex.EncodeToString(sig))
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, errors.New(resp.Status)
+}
+
+// Wait waits up to timeout for running invocations and deliveries to
+// finish, and reports whether they did.
+func (c *Callbacks) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,123 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+var cgroupSeq atomic.Uint64
+
+// cgroup is a cgroup v2 holding a single invocation.
+type cgroup struct {
+	path string
+	fd   *os.File
+}
+
+// enableCgroupControllers turns on the controllers the limits need for
+// children of the parent cgroup.
+func (l ResourceLimits) enableCgroupControllers() error {
+	var ctrl []string
+	if l.Memory > 0 {
+		ctrl = append(ctrl, "+memory")
+	}
+	if l.CPUWeight > 0 {
+		ctrl = append(ctrl, "+cpu")
+	}
+	if l.Pids > 0 {
+		ctrl = append(ctrl, "+pids")
+	}
+	f := filepath.Join(l.CgroupParent, "cgroup.subtree_control")
+	if err := os.WriteFile(f, []byte(strings.Join(ctrl, " ")), 0); err != nil {
+		return fmt.Errorf("enable controllers in %s: %w", l.CgroupParent, err)
+	}
+	return nil
+}
+
+// newCgroup creates a cgroup below the parent with the limits applied.
+func (l ResourceLimits) newCgroup() (*cgroup, error) {
+	dir := filepath.Join(l.CgroupParent, fmt.Sprintf("invoke-%d-%d", os.Getpid(), cgroupSeq.Add(1)))
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return nil, err
+	}
+	cg := &cgroup{path: dir}
+
+	settings := map[string]string{}
+	if l.Memory > 0 {
+		settings["memory.max"] = strconv.FormatInt(l.Memory, 10)
+		settings["memory.swap.max"] = "0"
+		// Kill the whole invocation, not just the largest process.
+		settings["memory.oom.group"] = "1"
+	}
+	if l.CPUWeight > 0 {
+		settings["cpu.weight"] = strconv.Itoa(l.CPUWeight)
+	}
+	if l.Pids > 0 {
+		settings["pids.max"] = strconv.Itoa(l.Pids)
+	}
+	for name, v := range settings {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(v), 0)
+		// memory.swap.max is absent when swap accounting is off.
+		if err != nil && !(name == "memory.swap.max" && os.IsNotExist(err)) {
+			cg.Remove()
+			return nil, fmt.Errorf("set %s: %w", name, err)
+		}
+	}
+
+	fd, err := os.Open(dir)
+	if err != nil {
+		cg.Remove()
+		return nil, err
+	}
+	cg.fd = fd
+	return cg, nil
+}
+
+// apply makes cmd start inside the cgroup.
+func (cg *cgroup) apply(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(cg.fd.Fd())
+}
+
+// exceeded returns the resource whose limit was hit, or "".
+func (cg *cgroup) exceeded() string {
+	if cg.eventCount("memory.events", "oom_kill") > 0 {
+		return "memory"
+	}
+	if cg.eventCount("pids.events", "max") > 0 {
+		return "pids"
+	}
+	return ""
+}
+
+func (cg *cgroup) eventCount(file, key string) int {
+	b, err := os.ReadFile(filepath.Join(cg.path, file))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if k, v, ok := strings.Cut(line, " "); ok && k == key {
+			n, _ := strconv.Atoi(v)
+			return n
+		}
+	}
+	return 0
+}
+
+// Remove deletes the cgroup once its processes have exited.
+func (cg *cgroup) Remove() {
+	if cg.fd != nil {
+		cg.fd.Close()
+	}
+	os.Remove(cg.path)
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var errCgroupUnsupported = errors.New("cgroup limits are only supported on Linux")
+
+type cgroup struct{}
+
+func (l ResourceLimits) enableCgroupControllers() error { return errCgroupUnsupported }
+
+func (l ResourceLimits) newCgroup() (*cgroup, error) { return nil, errCgroupUnsupported }
+
+func (cg *cgroup) apply(cmd *exec.Cmd) {}
+
+func (cg *cgroup) exceeded() string { return "" }
+
+func (cg *cgroup) Remove() {}
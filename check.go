@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// runCheck validates what the server would start with, without serving:
+// the node executable, the schema, every route's script, which node parses
+// with --check, and env file, and that the listen addresses are free. It
+// prints a line per check to stdout and returns the exit status, 1 when
+// anything failed, for use as a CI gate or container preflight.
+func runCheck(cfg Config) int {
+	c := &checker{out: os.Stdout}
+
+	// Like setupNode, a missing node only fails the routes needing it
+	// unless it was asked for.
+	node, err := findNode(cfg.NodePath)
+	switch {
+	case err != nil && cfg.NodePath == "" && cfg.RequireNodeVersion == nil:
+		c.warn("node", err)
+	case err != nil:
+		c.report("node", err, "")
+	default:
+		nodeBinary = node
+		version, err := checkNode(node, cfg.RequireNodeVersion)
+		if err != nil && cfg.NodeVersionMismatch == nodeVersionWarn {
+			c.warn("node", err)
+		} else {
+			c.report("node", err, version+" at "+node)
+		}
+	}
+
+	var schema *Schema
+	if cfg.SchemaFile != "" {
+		schema, err = LoadSchema(cfg.SchemaFile)
+		c.report("schema "+cfg.SchemaFile, err, "")
+	}
+
+	routes, err := checkRoutes(cfg, schema)
+	c.report("routes", err, fmt.Sprintf("%d found", len(routes)))
+	envFiles := map[string]bool{}
+	for _, route := range routes {
+		if !route.hasScript() {
+			continue
+		}
+		if route.runtime() == "" {
+			c.report("route "+route.Name, errors.New("no node executable"), "")
+			continue
+		}
+		if _, err := exec.LookPath(route.runtime()); err != nil {
+			c.report("route "+route.Name, fmt.Errorf("runtime: %w", err), "")
+			continue
+		}
+		c.report("route "+route.Name, checkSyntax(route), scriptLabel(route))
+		for _, f := range route.EnvFiles {
+			if !envFiles[f] {
+				envFiles[f] = true
+				c.report("env file "+f, checkEnvFile(f), "")
+			}
+		}
+	}
+
+	if cfg.Listen == listenSystemd || cfg.Listen == "" && os.Getenv("LISTEN_FDS") != "" {
+		c.report("listen", nil, "socket passed by systemd")
+	} else {
+		c.report("listen "+listenAddr(cfg.Listen, cfg.Port), checkListen(cfg.Listen, cfg.Port, cfg.ListenMode), "")
+	}
+	if cfg.AdminListen != "" {
+		c.report("admin listen "+cfg.AdminListen, checkListen(cfg.AdminListen, 0, cfg.ListenMode), "")
+	}
+
+	if c.failed > 0 {
+		fmt.Fprintf(c.out, "%d of %d checks failed\n", c.failed, c.checks)
+		return exitFailure
+	}
+	fmt.Fprintf(c.out, "all %d checks passed\n", c.checks)
+	return 0
+}
+
+type checker struct {
+	out            io.Writer
+	checks, failed int
+}
+
+// report prints the outcome of the check of what, with detail on success.
+func (c *checker) report(what string, err error, detail string) {
+	c.checks++
+	if err != nil {
+		c.failed++
+		fmt.Fprintf(c.out, "FAIL  %s: %v\n", what, err)
+		return
+	}
+	if detail != "" {
+		what += ": " + detail
+	}
+	fmt.Fprintf(c.out, "ok    %s\n", what)
+}
+
+// warn prints a problem that doesn't fail the check.
+func (c *checker) warn(what string, err error) {
+	fmt.Fprintf(c.out, "warn  %s: %v\n", what, err)
+}
+
+// checkRoutes builds the routes of the script source cfg selects. The
+// scripts of a --script-dir are all the files requests could resolve to.
+func checkRoutes(cfg Config, schema *Schema) ([]*Route, error) {
+	switch {
+	case cfg.ConfigFile != "":
+		fc, err := LoadFileConfig(cfg.ConfigFile, cfg.Profile, cfg.StrictConfig)
+		if err != nil {
+			return nil, err
+		}
+		return fc.BuildRoutes(filepath.Dir(cfg.ConfigFile))
+
+	case cfg.ScriptDir != "":
+		dir, err := NewScriptDir(cfg.ScriptDir, cfg.EnvFiles, schema)
+		if err != nil {
+			return nil, err
+		}
+		var routes []*Route
+		err = filepath.WalkDir(dir.root, func(p string, e fs.DirEntry, err error) error {
+			if err != nil || e.IsDir() {
+				return err
+			}
+			ext := filepath.Ext(p)
+			if !slices.Contains(scriptExtensions, ext) {
+				return nil
+			}
+			rel, _ := filepath.Rel(dir.root, strings.TrimSuffix(p, ext))
+			name := filepath.ToSlash(rel)
+			if !validScriptName(name) {
+				return nil
+			}
+			route, err := dir.Resolve(name)
+			if err != nil {
+				return fmt.Errorf("script %s: %w", name, err)
+			}
+			// Resolve picks the first extension; a shadowed file is
+			// never run.
+			if route.ScriptFile == p {
+				routes = append(routes, route)
+			}
+			return nil
+		})
+		return routes, err
+	}
+	return []*Route{{
+		Name:         "default",
+		InlineScript: cfg.InlineScript,
+		ScriptFile:   cfg.ScriptFile,
+		EnvFiles:     cfg.EnvFiles,
+	}}, nil
+}
+
+func scriptLabel(route *Route) string {
+	if route.InlineScript != "" {
+		return "inline script"
+	}
+	return route.ScriptFile
+}
+
+// checkSyntax parses route's script with node --check. TypeScript is only
+// checked to exist, since it needs a build step first.
+func checkSyntax(route *Route) error {
+	var cmd *exec.Cmd
+	if route.InlineScript != "" {
+		cmd = exec.Command(route.runtime(), "--check")
+		cmd.Stdin = strings.NewReader(route.InlineScript)
+	} else {
+		if _, err := os.Stat(route.ScriptFile); err != nil {
+			return err
+		}
+		if isTypeScript(route.ScriptFile) {
+			return nil
+		}
+		cmd = exec.Command(route.runtime(), "--check", route.ScriptFile)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return errors.New(syntaxError(stderr.String()))
+	}
+	return err
+}
+
+// syntaxError condenses node's report of a syntax error to its location
+// and message.
+func syntaxError(stderr string) string {
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	for _, l := range lines {
+		if strings.Contains(l, "Error:") {
+			return strings.TrimSpace(lines[0]) + ": " + strings.TrimSpace(l)
+		}
+	}
+	return strings.TrimSpace(lines[0])
+}
+
+// checkEnvFile verifies path is an env file parseEnv reads.
+func checkEnvFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	_, err = parseEnv(string(data), nil, os.LookupEnv)
+	return err
+}
+
+func listenAddr(addr string, port int) string {
+	if addr == "" {
+		return fmt.Sprintf(":%d", port)
+	}
+	return addr
+}
+
+// checkListen verifies the listener described by addr can be opened.
+func checkListen(addr string, port int, perm os.FileMode) error {
+	ln, err := listen(addr, port, perm)
+	if err != nil {
+		return err
+	}
+	return ln.Close()
+}
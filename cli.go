@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+// Exit statuses of the run subcommand besides the script's own.
+const (
+	exitFailure = 1
+	exitUsage   = 2
+	// exitTimeout matches timeout(1).
+	exitTimeout = 124
+)
+
+// runOptions are the flags of `go-invoke-node run`, which performs one
+// invocation without starting a server:
+//
+//	go-invoke-node run --script-file job.js --input payload.json
+//
+// The script's output goes to stdout and its stderr to stderr, and the
+// process exits with the script's exit status.
+type runOptions struct {
+	// Input is a file holding the JSON payload, or - for stdin.
+	Input string
+	// Route picks the route with --config or the script with --script-dir.
+	Route string
+}
+
+func (o *runOptions) register() {
+	flag.StringVar(&o.Input, "input", o.Input,
+		"run: file holding the JSON payload, - for stdin (default {})")
+	flag.StringVar(&o.Route, "route", o.Route,
+		"run: route name with --config, or script name with --script-dir")
+}
+
+// runOnce invokes the selected script once and returns the exit status.
+func runOnce(cfg Config, inv *Invoker, schema *Schema, o runOptions) int {
+	route, err := oneShotRoute(cfg, schema, o.Route)
+	if err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+
+	payload := []byte("{}")
+	switch o.Input {
+	case "":
+	case "-":
+		payload, err = io.ReadAll(os.Stdin)
+	default:
+		payload, err = os.ReadFile(o.Input)
+	}
+	if err != nil {
+		log.Printf("read input: %v", err)
+		return exitUsage
+	}
+	if !json.Valid(payload) {
+		log.Print("invalid JSON payload")
+		return exitUsage
+	}
+	if payload, err = applyTransforms(route.RequestTransforms, payload); err != nil {
+		log.Printf("payload transform failed: %v", err)
+		return exitUsage
+	}
+	if route.Schema != nil {
+		if route.Coerce || cfg.CoercePayload {
+			payload, _ = route.Schema.Coerce(payload)
+		}
+		violations, _ := route.Schema.Validate(payload)
+		if len(violations) > 0 {
+			b, _ := json.Marshal(violations)
+			log.Printf("payload does not match schema: %s", b)
+			return exitUsage
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	res, err := inv.Invoke(ctx, Invocation{Route: route, Payload: payload})
+	if err == nil {
+		if res.Stdout, err = applyTransforms(route.ResponseTransforms, res.Stdout); err != nil {
+			log.Printf("output transform failed: %v", err)
+			return exitFailure
+		}
+	}
+	os.Stdout.Write(res.Stdout)
+	os.Stderr.Write(res.Stderr)
+	return exitStatus(err)
+}
+
+// oneShotRoute builds the route run by the run subcommand.
+func oneShotRoute(cfg Config, schema *Schema, name string) (*Route, error) {
+	switch {
+	case cfg.ScriptDir != "":
+		if name == "" {
+			return nil, errors.New("--route is required with --script-dir")
+		}
+		dir, err := NewScriptDir(cfg.ScriptDir, cfg.EnvFiles, schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid script dir %q: %v", cfg.ScriptDir, err)
+		}
+		route, err := dir.Resolve(name)
+		if err != nil {
+			return nil, fmt.Errorf("script %q: %v", name, err)
+		}
+		return route, nil
+
+	case cfg.ConfigFile != "":
+		if name == "" {
+			return nil, errors.New("--route is required with --config")
+		}
+		fc, err := LoadFileConfig(cfg.ConfigFile, cfg.Profile, cfg.StrictConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: %v", err)
+		}
+		routes, err := fc.BuildRoutes(filepath.Dir(cfg.ConfigFile))
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: %v", err)
+		}
+		for _, route := range routes {
+			if route.Name != name {
+				continue
+			}
+			if !route.hasScript() && route.Pipeline == nil {
+				return nil, fmt.Errorf("route %q only dispatches to other routes", name)
+			}
+			if route.Schema == nil {
+				route.Schema = schema
+			}
+			return route, nil
+		}
+		return nil, fmt.Errorf("config %s has no route %q", cfg.ConfigFile, name)
+	}
+
+	return &Route{
+		Name:         "default",
+		InlineScript: cfg.InlineScript,
+		ScriptFile:   cfg.ScriptFile,
+		EnvFiles:     cfg.EnvFiles,
+		Schema:       schema,
+	}, nil
+}
+
+// exitStatus mirrors the script's exit status for err.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if errors.Is(err, errTimeout) {
+		log.Print(err)
+		return exitTimeout
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() > 0 {
+		return exit.ExitCode()
+	}
+	if errors.As(err, &exit) {
+		// Like a shell, report death by signal as 128+n.
+		if ws, ok := exit.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			log.Print(err)
+			return 128 + int(ws.Signal())
+		}
+	}
+	log.Print(err)
+	return exitFailure
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signatureHeader = "X-Invoke-Signature"
+	// DefaultCallbackTolerance is how old a callback's signature may be
+	// when ParseCallback is given no tolerance.
+	DefaultCallbackTolerance = 5 * time.Minute
+)
+
+// ErrBadSignature is returned by ParseCallback for deliveries that weren't
+// signed with the secret.
+var ErrBadSignature = errors.New("invalid callback signature")
+
+// CallbackResult is the result of an asynchronous invocation, delivered to
+// its callback URL.
+type CallbackResult struct {
+	// ID is the ID Start returned.
+	ID    string `json:"id"`
+	Route string `json:"route"`
+	// Status is succeeded or failed.
+	Status    string          `json:"status"`
+	Output    json.RawMessage `json:"output,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Started   time.Time       `json:"started"`
+	Completed time.Time       `json:"completed"`
+}
+
+// Succeeded reports whether the invocation succeeded.
+func (r *CallbackResult) Succeeded() bool {
+	return r.Status == "succeeded"
+}
+
+// ParseCallback verifies that the callback delivery r was signed with the
+// server's --callback-secret-file secret no longer than tolerance ago, and
+// returns its result. The handler receiving it should answer 2xx once it
+// is handled; other statuses make the server retry 429s and 5xxs.
+func ParseCallback(r *http.Request, secret []byte, tolerance time.Duration) (*CallbackResult, error) {
+	if tolerance <= 0 {
+		tolerance = DefaultCallbackTolerance
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	var ts, sig string
+	for _, part := range strings.Split(r.Header.Get(signatureHeader), ",") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sig = v
+		}
+	}
+	t, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: missing timestamp", ErrBadSignature)
+	}
+	if d := time.Since(time.Unix(t, 0)); d > tolerance || d < -tolerance {
+		return nil, fmt.Errorf("%w: timestamp outside tolerance", ErrBadSignature)
+	}
+	got, err := hex.DecodeString(sig)
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(ts + "."))
+	m.Write(body)
+	if err != nil || !hmac.Equal(got, m.Sum(nil)) {
+		return nil, ErrBadSignature
+	}
+	var res CallbackResult
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, fmt.Errorf("invoke: decode callback: %w", err)
+	}
+	return &res, nil
+}
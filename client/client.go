@@ -0,0 +1,278 @@
+// Package client calls a go-invoke-node server from Go:
+//
+//	c := &client.Client{BaseURL: "http://localhost:8080", Token: token}
+//	var order Order
+//	err := c.Invoke(ctx, "orders/create", req, &order)
+//
+// Besides buffered invocations, it streams the output of long-running
+// scripts (Stream), starts asynchronous invocations whose result is
+// delivered to a callback URL (Start, ParseCallback), and retries
+// invocations the server turned away.
+//
+// Unlike the client `go-invoke-node gen` writes for a server's routes, it
+// takes route names and payloads of any type.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRetryBackoff is the delay before the first retry when
+	// Client.RetryBackoff is unset.
+	DefaultRetryBackoff = 200 * time.Millisecond
+	maxRetryBackoff     = 10 * time.Second
+
+	idempotencyKeyHeader = "Idempotency-Key"
+	apiKeyHeader         = "X-API-Key"
+)
+
+// Client invokes the routes of a go-invoke-node server. Its methods may be
+// called concurrently.
+type Client struct {
+	// BaseURL is the server's address, such as http://localhost:8080.
+	BaseURL string
+	// Token, when set, is sent as a bearer token. TokenFunc, when set,
+	// supplies it for every request instead, e.g. to use fresh OIDC
+	// tokens.
+	Token     string
+	TokenFunc func(context.Context) (string, error)
+	// APIKey, when set, is sent in X-API-Key, for servers with tenants.
+	APIKey string
+	// HTTPClient makes the requests; nil means http.DefaultClient.
+	HTTPClient *http.Client
+
+	// Retries is how many times a buffered invocation is retried when the
+	// request fails or the server turns it away with 429 or 503, waiting
+	// RetryBackoff, then twice as long after every retry, or as long as
+	// the server's Retry-After says. Retried requests carry an
+	// Idempotency-Key, so servers with --idempotency-dir run the script
+	// at most once.
+	Retries      int
+	RetryBackoff time.Duration
+}
+
+// Error is returned when the server answers with a non-2xx status, or a
+// streamed invocation fails after its response started, with StatusCode
+// 0.
+type Error struct {
+	StatusCode int
+	Message    string
+	// RetryAfter is the server's Retry-After, if any.
+	RetryAfter time.Duration
+	// TimedOut is set when the script was killed by its timeout, and
+	// PartialOutput when it had written output by then.
+	TimedOut      bool
+	PartialOutput bool
+}
+
+func (e *Error) Error() string {
+	if e.StatusCode == 0 {
+		return "invoke: " + e.Message
+	}
+	return fmt.Sprintf("invoke: %d %s", e.StatusCode, e.Message)
+}
+
+// Invoke runs route with payload, which is encoded as JSON unless it is a
+// json.RawMessage or []byte, and decodes the script's JSON output into out.
+// out may be nil to discard it, or a *json.RawMessage to keep it as is. An
+// empty route invokes the script of a --script or --script-file server.
+func (c *Client) Invoke(ctx context.Context, route string, payload any, out any) error {
+	body, err := encodePayload(payload)
+	if err != nil {
+		return err
+	}
+	var key string
+	if c.Retries > 0 {
+		key = newIdempotencyKey()
+	}
+	backoff := c.RetryBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		var resp []byte
+		resp, err = c.invoke(ctx, route, body, key)
+		if err == nil {
+			if out == nil || len(bytes.TrimSpace(resp)) == 0 {
+				return nil
+			}
+			if err := json.Unmarshal(resp, out); err != nil {
+				return fmt.Errorf("invoke: decode output: %w", err)
+			}
+			return nil
+		}
+		wait, retry := retryable(err, backoff)
+		if !retry || attempt >= c.Retries || ctx.Err() != nil {
+			return err
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
+
+func (c *Client) invoke(ctx context.Context, route string, body []byte, key string) ([]byte, error) {
+	req, err := c.newRequest(ctx, route, "", body)
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		req.Header.Set(idempotencyKeyHeader, key)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, responseError(resp, out)
+	}
+	return out, nil
+}
+
+// retryable reports whether an invocation that failed with err is retried,
+// and after how long.
+func retryable(err error, backoff time.Duration) (time.Duration, bool) {
+	var e *Error
+	if !errors.As(err, &e) {
+		// The request failed, e.g. the connection was refused or reset.
+		return backoff, !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	if e.StatusCode != http.StatusTooManyRequests && e.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	if e.RetryAfter > 0 {
+		return e.RetryAfter, true
+	}
+	return backoff, true
+}
+
+// newRequest returns a POST of body to route, with query appended to its
+// URL.
+func (c *Client) newRequest(ctx context.Context, route, query string, body []byte) (*http.Request, error) {
+	u := strings.TrimRight(c.BaseURL, "/") + "/invoke"
+	if route != "" {
+		u += "/" + strings.Trim(route, "/")
+	}
+	if query != "" {
+		u += "?" + query
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	token := c.Token
+	if c.TokenFunc != nil {
+		if token, err = c.TokenFunc(ctx); err != nil {
+			return nil, fmt.Errorf("invoke: token: %w", err)
+		}
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if c.APIKey != "" {
+		req.Header.Set(apiKeyHeader, c.APIKey)
+	}
+	return req, nil
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Start starts an asynchronous invocation of route, whose result the
+// server POSTs to callbackURL once the script finished, and returns its
+// ID. The server must allow the callback's host with
+// --callback-allow-hosts; see ParseCallback for receiving the result.
+func (c *Client) Start(ctx context.Context, route string, payload any, callbackURL string) (string, error) {
+	body, err := encodePayload(payload)
+	if err != nil {
+		return "", err
+	}
+	req, err := c.newRequest(ctx, route, "callbackUrl="+url.QueryEscape(callbackURL), body)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return "", responseError(resp, out)
+	}
+	var accepted struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(out, &accepted); err != nil {
+		return "", fmt.Errorf("invoke: decode response: %w", err)
+	}
+	return accepted.ID, nil
+}
+
+func encodePayload(payload any) ([]byte, error) {
+	switch p := payload.(type) {
+	case nil:
+		return []byte("{}"), nil
+	case json.RawMessage:
+		return p, nil
+	case []byte:
+		return p, nil
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invoke: encode payload: %w", err)
+	}
+	return b, nil
+}
+
+func responseError(resp *http.Response, body []byte) *Error {
+	e := &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+		e.RetryAfter = time.Duration(s) * time.Second
+	}
+	var timeout struct {
+		Error         string `json:"error"`
+		PartialOutput bool   `json:"partial_output"`
+	}
+	if json.Unmarshal(body, &timeout) == nil && timeout.Error == "script timed out" {
+		e.TimedOut, e.PartialOutput = true, timeout.PartialOutput
+	}
+	return e
+}
+
+func newIdempotencyKey() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Event is an event of a streamed invocation. Name is empty for the
+// script's lines of output, and otherwise names an event the script sent
+// on a route with stream_events, or "result" for its final line there.
+type Event struct {
+	Name string
+	Data string
+}
+
+// Stream reads the events of a streamed invocation:
+//
+//	s, err := c.Stream(ctx, "reports/build", req)
+//	if err != nil {
+//		return err
+//	}
+//	defer s.Close()
+//	for s.Next() {
+//		fmt.Println(s.Event().Data)
+//	}
+//	return s.Err()
+type Stream struct {
+	body  io.ReadCloser
+	r     *bufio.Reader
+	event Event
+	err   error
+	done  bool
+}
+
+// Stream invokes route with payload and returns its output as server-sent
+// events, as the script produces it. Streamed invocations aren't retried.
+func (c *Client) Stream(ctx context.Context, route string, payload any) (*Stream, error) {
+	body, err := encodePayload(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, route, "", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		return nil, responseError(resp, out)
+	}
+	return &Stream{body: resp.Body, r: bufio.NewReader(resp.Body)}, nil
+}
+
+// Next advances to the next event, returning false once the invocation
+// ended or failed; Err tells which.
+func (s *Stream) Next() bool {
+	if s.done {
+		return false
+	}
+	var ev Event
+	var data []string
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			s.done = true
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			s.err = err
+			return false
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			if data == nil {
+				// Keep-alives are comments, which leave no data.
+				continue
+			}
+			ev.Data = strings.Join(data, "\n")
+			return s.dispatch(ev)
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "event:"):
+			ev.Name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+}
+
+// dispatch handles the server's own events, which end the stream.
+func (s *Stream) dispatch(ev Event) bool {
+	switch ev.Name {
+	case "done":
+		s.done = true
+		return false
+	case "error":
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal([]byte(ev.Data), &e) != nil || e.Error == "" {
+			e.Error = ev.Data
+		}
+		s.done, s.err = true, &Error{Message: e.Error}
+		return false
+	}
+	s.event = ev
+	return true
+}
+
+// Event returns the event Next advanced to.
+func (s *Stream) Event() Event {
+	return s.event
+}
+
+// Err returns why the stream ended: nil when the invocation succeeded, an
+// *Error when it failed.
+func (s *Stream) Err() error {
+	return s.err
+}
+
+// Close ends the stream, canceling the invocation if it is still running.
+func (s *Stream) Close() error {
+	s.done = true
+	return s.body.Close()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// clockHeader sets the current time scripts see, when --fake-clock
+	// or --deterministic allows it.
+	clockHeader = "X-Invoke-Clock"
+	// seedHeader sets the seed of scripts' randomness in deterministic
+	// mode.
+	seedHeader = "X-Invoke-Seed"
+
+	clockEnvKey       = "INVOKE_CLOCK"
+	clockFrozenEnvKey = "INVOKE_CLOCK_FROZEN"
+	seedEnvKey        = "INVOKE_SEED"
+)
+
+var (
+	//go:embed clockshim.js
+	clockShim []byte
+	//go:embed seedshim.js
+	seedShim []byte
+)
+
+// clockShimPath and seedShimPath write the preloads faking Date and
+// seeding randomness once, returning their paths.
+var (
+	clockShimPath = sync.OnceValues(func() (string, error) {
+		return writeShim("clock", clockShim)
+	})
+	seedShimPath = sync.OnceValues(func() (string, error) {
+		return writeShim("seed", seedShim)
+	})
+)
+
+// requestClock returns the time r asks its script to run at, as an RFC
+// 3339 timestamp in the X-Invoke-Clock header, so time-dependent logic
+// such as billing cycles and expirations can be tested end to end. It is
+// zero when the header is absent. Scripts of persistent workers can't be
+// given a time of their own.
+func requestClock(r *http.Request, route *Route, allowed bool) (time.Time, error) {
+	v := r.Header.Get(clockHeader)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if !allowed {
+		return time.Time{}, errors.New(clockHeader + " requires --fake-clock")
+	}
+	if route.worker != nil {
+		return time.Time{}, errors.New(clockHeader + " is not supported by persistent workers")
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: %v", clockHeader, err)
+	}
+	return t, nil
+}
+
+// makeDeterministic makes call reproducible for debugging: its script
+// sees a clock frozen at the X-Invoke-Clock time, or now, and randomness
+// seeded with X-Invoke-Seed, or a random seed. Both are returned in the
+// response headers, so resending them replays the invocation. Persistent
+// workers are left alone.
+func makeDeterministic(w http.ResponseWriter, r *http.Request, call *Invocation) error {
+	if call.Route.worker != nil {
+		return nil
+	}
+	if v := r.Header.Get(seedHeader); v != "" {
+		seed, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", seedHeader, err)
+		}
+		call.Seed = seed
+	} else {
+		var b [8]byte
+		rand.Read(b[:])
+		call.Seed = binary.BigEndian.Uint64(b[:])
+	}
+	if call.Clock.IsZero() {
+		call.Clock = time.Now().UTC()
+	}
+	call.Deterministic = true
+	w.Header().Set(seedHeader, strconv.FormatUint(call.Seed, 10))
+	w.Header().Set(clockHeader, call.Clock.Format(time.RFC3339Nano))
+	return nil
+}
+
+// simulation returns the preloads faking the clock and randomness of
+// call's script, and their environment.
+func (call Invocation) simulation() (preloads, env []string, err error) {
+	if !call.Clock.IsZero() {
+		path, err := clockShimPath()
+		if err != nil {
+			return nil, nil, fmt.Errorf("clock: %w", err)
+		}
+		preloads = append(preloads, path)
+		env = append(env, clockEnvKey+"="+call.Clock.Format(time.RFC3339Nano))
+		if call.Deterministic {
+			env = append(env, clockFrozenEnvKey+"=1")
+		}
+	}
+	if call.Deterministic {
+		path, err := seedShimPath()
+		if err != nil {
+			return nil, nil, fmt.Errorf("seed: %w", err)
+		}
+		preloads = append(preloads, path)
+		env = append(env, seedEnvKey+"="+strconv.FormatUint(call.Seed, 10))
+	}
+	return preloads, env, nil
+}
@@ -0,0 +1,29 @@
+// Simulated clock of go-invoke-node, preloaded with --require into scripts
+// invoked with the X-Invoke-Clock header or in deterministic mode. Date
+// starts at the time in INVOKE_CLOCK and keeps ticking from there, unless
+// INVOKE_CLOCK_FROZEN is set; timers and performance.now() are left alone.
+'use strict';
+
+const RealDate = Date;
+const start = RealDate.parse(process.env.INVOKE_CLOCK);
+const offset = start - RealDate.now();
+const frozen = Boolean(process.env.INVOKE_CLOCK_FROZEN);
+
+function now() {
+  return frozen ? start : RealDate.now() + offset;
+}
+
+function FakeDate(...args) {
+  if (new.target === undefined) {
+    // Date() called as a function returns the current time as a string.
+    return new RealDate(now()).toString();
+  }
+  return args.length === 0 ? new RealDate(now()) : new RealDate(...args);
+}
+Object.setPrototypeOf(FakeDate, RealDate);
+FakeDate.prototype = RealDate.prototype;
+FakeDate.now = now;
+
+if (!Number.isNaN(offset)) {
+  globalThis.Date = FakeDate;
+}
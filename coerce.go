@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Coerce converts payload towards the schema before validation: strings
+// holding numbers or booleans become numbers or booleans where the schema
+// asks for them, numbers and booleans become strings where it asks for a
+// string, and missing object properties with a default are filled in.
+// Values that can't be converted are left for Validate to report. The
+// payload is returned unchanged when nothing was coerced.
+func (s *Schema) Coerce(payload []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	out, changed := s.coerce(v)
+	if !changed {
+		return payload, nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(out); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}), nil
+}
+
+func (s *Schema) coerce(v any) (any, bool) {
+	if s == nil || s.boolean != nil {
+		return v, false
+	}
+	changed := false
+	apply := func(sub *Schema) {
+		var c bool
+		v, c = sub.coerce(v)
+		changed = changed || c
+	}
+
+	if s.Ref != "" {
+		if target, err := s.resolve(); err == nil {
+			apply(target)
+		}
+	}
+	for _, sub := range s.AllOf {
+		apply(sub)
+	}
+
+	if len(s.Type) > 0 {
+		if c, ok := coerceScalar(v, s.Type); ok {
+			v, changed = c, true
+		}
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		for k, sub := range s.Properties {
+			child, ok := val[k]
+			if !ok {
+				if d, ok := sub.defaultValue(); ok {
+					val[k] = d
+					changed = true
+				}
+				continue
+			}
+			if c, ok := sub.coerce(child); ok {
+				val[k] = c
+				changed = true
+			}
+		}
+		if s.AdditionalProperties != nil {
+			for k, child := range val {
+				if _, ok := s.Properties[k]; ok {
+					continue
+				}
+				if c, ok := s.AdditionalProperties.coerce(child); ok {
+					val[k] = c
+					changed = true
+				}
+			}
+		}
+	case []any:
+		if s.Items != nil {
+			for i, item := range val {
+				if c, ok := s.Items.coerce(item); ok {
+					val[i] = c
+					changed = true
+				}
+			}
+		}
+	}
+	return v, changed
+}
+
+// defaultValue decodes the schema's default, following a $ref.
+func (s *Schema) defaultValue() (any, bool) {
+	if s == nil {
+		return nil, false
+	}
+	if len(s.Default) == 0 && s.Ref != "" {
+		if target, err := s.resolve(); err == nil {
+			return target.defaultValue()
+		}
+	}
+	if len(s.Default) == 0 {
+		return nil, false
+	}
+	dec := json.NewDecoder(bytes.NewReader(s.Default))
+	dec.UseNumber()
+	var d any
+	if err := dec.Decode(&d); err != nil {
+		return nil, false
+	}
+	return d, true
+}
+
+// coerceScalar converts v to the first of types it can be represented as.
+// It reports false when v already has one of the types or can't be
+// converted.
+func coerceScalar(v any, types []string) (any, bool) {
+	if slicesContainsType(types, decodedNumber(v)) {
+		return nil, false
+	}
+	for _, t := range types {
+		switch val := v.(type) {
+		case string:
+			s := strings.TrimSpace(val)
+			switch t {
+			case "integer", "number":
+				f, err := strconv.ParseFloat(s, 64)
+				// json.Valid rejects forms ParseFloat accepts, such as
+				// "Inf" or "0x1p-2".
+				if err != nil || !json.Valid([]byte(s)) {
+					continue
+				}
+				if t == "integer" && f != math.Trunc(f) {
+					continue
+				}
+				return json.Number(s), true
+			case "boolean":
+				if b, err := strconv.ParseBool(s); err == nil {
+					return b, true
+				}
+			case "null":
+				if s == "" || s == "null" {
+					return nil, true
+				}
+			}
+		case json.Number, bool:
+			if t == "string" {
+				return jsonString(val), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// decodedNumber converts a json.Number to float64 so the validator's type
+// checks apply to values decoded with UseNumber.
+func decodedNumber(v any) any {
+	if n, ok := v.(json.Number); ok {
+		f, _ := n.Float64()
+		return f
+	}
+	return v
+}
+
+func jsonString(v any) string {
+	if b, ok := v.(bool); ok {
+		return strconv.FormatBool(b)
+	}
+	return v.(json.Number).String()
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// subcommands are the commands taking the place of serving, with their own
+// flags besides the server's.
+var subcommands = []struct {
+	name, args, usage string
+	register          func()
+}{
+	{"run", "", "invoke the script once and exit with its status", func() { new(runOptions).register() }},
+	{"gen", "", "write a Go client or TypeScript declarations for the routes", func() { new(genOptions).register() }},
+	{"contract-test", "", "check the scripts against their schemas with generated payloads", func() { new(contractOptions).register() }},
+	{"replay", "", "re-invoke recorded invocations, diffing them against a candidate script", func() { new(replayOptions).register() }},
+	{"completion", "bash|zsh|fish", "print a shell completion script", nil},
+	{"config", "schema", "print the JSON Schema of the --config file", nil},
+	{"sdk", "<dir|file.tgz>", "write the go-invoke package scripts require", nil},
+}
+
+// cliCommand describes the command line for --help-json. The flags of a
+// subcommand are those it takes besides the server's, which all but
+// config also accept.
+type cliCommand struct {
+	Name        string       `json:"name"`
+	Args        string       `json:"args,omitempty"`
+	Usage       string       `json:"usage"`
+	Flags       []cliFlag    `json:"flags"`
+	Subcommands []cliCommand `json:"subcommands,omitempty"`
+}
+
+type cliFlag struct {
+	Name string `json:"name"`
+	// Type is bool for flags taking no value, and otherwise names the
+	// value: string, int, duration and so on.
+	Type    string `json:"type"`
+	Default string `json:"default,omitempty"`
+	Usage   string `json:"usage"`
+}
+
+// describeCLI describes the command line, with the flag defaults of
+// defaults.
+func describeCLI(defaults Config) cliCommand {
+	cmd := cliCommand{
+		Name:  progName(),
+		Usage: "serve node.js scripts over HTTP",
+		Flags: describeFlags("", func() {
+			c := defaults
+			c.registerFlags()
+		}),
+	}
+	for _, sub := range subcommands {
+		cmd.Subcommands = append(cmd.Subcommands, cliCommand{
+			Name:  sub.name,
+			Args:  sub.args,
+			Usage: sub.usage,
+			Flags: describeFlags(sub.name, sub.register),
+		})
+	}
+	return cmd
+}
+
+// describeFlags returns the flags register defines, on a flag set of its
+// own so the command line's are left alone. The "<subcommand>: " prefix of
+// a subcommand's usages is dropped.
+func describeFlags(subcommand string, register func()) []cliFlag {
+	saved := flag.CommandLine
+	defer func() { flag.CommandLine = saved }()
+	flag.CommandLine = flag.NewFlagSet(saved.Name(), flag.ContinueOnError)
+	if register != nil {
+		register()
+	}
+	flags := []cliFlag{}
+	flag.VisitAll(func(f *flag.Flag) {
+		typ, usage := flag.UnquoteUsage(f)
+		switch typ {
+		case "":
+			typ = "bool"
+		case "value":
+			// flag.Func values are parsed from strings.
+			typ = "string"
+		}
+		flags = append(flags, cliFlag{
+			Name:    f.Name,
+			Type:    typ,
+			Default: f.DefValue,
+			Usage:   strings.TrimPrefix(usage, subcommand+": "),
+		})
+	})
+	return flags
+}
+
+// writeHelpJSON prints the description of the command line for wrapper
+// tooling.
+func writeHelpJSON(w io.Writer, defaults Config) int {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(describeCLI(defaults)); err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	return 0
+}
+
+func progName() string {
+	return filepath.Base(os.Args[0])
+}
+
+var nonIdentifier = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// writeCompletion prints the completion script for shell, completing the
+// subcommands, the flags each accepts, and file names for flag values and
+// arguments:
+//
+//	source <(go-invoke-node completion bash)
+//	source <(go-invoke-node completion zsh)
+//	go-invoke-node completion fish | source
+func writeCompletion(w io.Writer, defaults Config, shell string) int {
+	cmd := describeCLI(defaults)
+	fn := "_" + nonIdentifier.ReplaceAllString(cmd.Name, "_")
+	var err error
+	switch shell {
+	case "bash":
+		err = bashCompletion(w, cmd, fn)
+	case "zsh":
+		err = zshCompletion(w, cmd, fn)
+	case "fish":
+		err = fishCompletion(w, cmd)
+	default:
+		log.Printf("completion: unknown shell %q: must be bash, zsh or fish", shell)
+		return exitUsage
+	}
+	if err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	return 0
+}
+
+func bashCompletion(w io.Writer, cmd cliCommand, fn string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# bash completion for %s; load with: source <(%[1]s completion bash)\n\n", cmd.Name)
+	fmt.Fprintf(&b, "%s() {\n", fn)
+	b.WriteString("\tlocal cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]} sub=${COMP_WORDS[1]}\n")
+	fmt.Fprintf(&b, "\tlocal flags=%q values=%q\n", bashFlags(cmd.Flags), bashValueFlags(cmd.Flags))
+	b.WriteString("\tcase $sub in\n")
+	for _, sub := range cmd.Subcommands {
+		if len(sub.Flags) > 0 {
+			fmt.Fprintf(&b, "\t%s)\n\t\tflags+=%q\n\t\tvalues+=%q\n\t\t;;\n", sub.Name, " "+bashFlags(sub.Flags), " "+bashValueFlags(sub.Flags))
+		}
+	}
+	b.WriteString("\tesac\n")
+	b.WriteString("\tlocal p=${prev#-}\n\tp=${p#-}\n")
+	b.WriteString("\tif [[ $prev == -* && \" $values \" == *\" $p \"* ]]; then\n\t\treturn\n\tfi\n")
+	fmt.Fprintf(&b, "\tif [[ $COMP_CWORD -eq 1 && $cur != -* ]]; then\n\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n\t\treturn\n\tfi\n", subcommandNames(cmd))
+	b.WriteString("\tlocal args\n\tcase $sub in\n")
+	for _, sub := range cmd.Subcommands {
+		if sub.Args != "" {
+			fmt.Fprintf(&b, "\t%s) args=%q ;;\n", sub.Name, strings.ReplaceAll(sub.Args, "|", " "))
+		}
+	}
+	b.WriteString("\tesac\n")
+	b.WriteString("\tif [[ -n $args && $COMP_CWORD -eq 2 && $cur != -* ]]; then\n\t\tCOMPREPLY=($(compgen -W \"$args\" -- \"$cur\"))\n\t\treturn\n\tfi\n")
+	b.WriteString("\tif [[ $cur == -* ]]; then\n\t\tCOMPREPLY=($(compgen -W \"$flags\" -- \"$cur\"))\n\tfi\n")
+	b.WriteString("}\n\n")
+	fmt.Fprintf(&b, "complete -o default -F %s %s\n", fn, cmd.Name)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func bashFlags(flags []cliFlag) string {
+	names := make([]string, len(flags))
+	for i, f := range flags {
+		names[i] = "--" + f.Name
+	}
+	return strings.Join(names, " ")
+}
+
+// bashValueFlags lists the flags taking a value, without their dashes.
+func bashValueFlags(flags []cliFlag) string {
+	var names []string
+	for _, f := range flags {
+		if f.Type != "bool" {
+			names = append(names, f.Name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+func subcommandNames(cmd cliCommand) string {
+	names := make([]string, len(cmd.Subcommands))
+	for i, sub := range cmd.Subcommands {
+		names[i] = sub.Name
+	}
+	return strings.Join(names, " ")
+}
+
+func zshCompletion(w io.Writer, cmd cliCommand, fn string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#compdef %s\n# zsh completion for %[1]s; load with: source <(%[1]s completion zsh)\n\n", cmd.Name)
+	fmt.Fprintf(&b, "%s() {\n", fn)
+	b.WriteString("\tlocal -a subcommands flags\n\tsubcommands=(\n")
+	for _, sub := range cmd.Subcommands {
+		fmt.Fprintf(&b, "\t\t%s\n", shellQuote(sub.Name+":"+sub.Usage))
+	}
+	b.WriteString("\t)\n\tflags=(\n")
+	writeZshFlags(&b, cmd.Flags, "\t\t")
+	b.WriteString("\t)\n\tcase $words[2] in\n")
+	for _, sub := range cmd.Subcommands {
+		if len(sub.Flags) > 0 {
+			fmt.Fprintf(&b, "\t%s)\n\t\tflags+=(\n", sub.Name)
+			writeZshFlags(&b, sub.Flags, "\t\t\t")
+			b.WriteString("\t\t)\n\t\t;;\n")
+		}
+	}
+	b.WriteString("\tesac\n")
+	b.WriteString("\tif (( CURRENT == 2 )) && [[ $PREFIX != -* ]]; then\n\t\t_describe -t commands command subcommands\n\t\treturn\n\tfi\n")
+	b.WriteString("\tif (( CURRENT == 3 )) && [[ $PREFIX != -* ]]; then\n\t\tcase $words[2] in\n")
+	for _, sub := range cmd.Subcommands {
+		if sub.Args != "" {
+			fmt.Fprintf(&b, "\t\t%s)\n\t\t\tcompadd %s\n\t\t\treturn\n\t\t\t;;\n", sub.Name, strings.ReplaceAll(sub.Args, "|", " "))
+		}
+	}
+	b.WriteString("\t\tesac\n\tfi\n")
+	b.WriteString("\t_arguments $flags '*:file:_files'\n}\n\n")
+	fmt.Fprintf(&b, "if [[ $zsh_eval_context[-1] == loadautofunc ]]; then\n\t%s \"$@\"\nelse\n\tcompdef %[1]s %s\nfi\n", fn, cmd.Name)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var zshDescEscaper = strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`)
+
+func writeZshFlags(b *strings.Builder, flags []cliFlag, indent string) {
+	for _, f := range flags {
+		spec := "--" + f.Name + "[" + zshDescEscaper.Replace(f.Usage) + "]"
+		if f.Type != "bool" {
+			spec += ":" + f.Type + ":_files"
+		}
+		fmt.Fprintf(b, "%s%s\n", indent, shellQuote(spec))
+	}
+}
+
+// shellQuote single-quotes s for bash and zsh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func fishCompletion(w io.Writer, cmd cliCommand) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# fish completion for %s; load with: %[1]s completion fish | source\n\n", cmd.Name)
+	for _, sub := range cmd.Subcommands {
+		fmt.Fprintf(&b, "complete -c %s -n __fish_use_subcommand -f -a %s -d %s\n", cmd.Name, sub.Name, fishQuote(sub.Usage))
+	}
+	writeFishFlags(&b, cmd.Name, "", cmd.Flags)
+	for _, sub := range cmd.Subcommands {
+		writeFishFlags(&b, cmd.Name, "-n '__fish_seen_subcommand_from "+sub.Name+"' ", sub.Flags)
+	}
+	for _, sub := range cmd.Subcommands {
+		if sub.Args != "" {
+			fmt.Fprintf(&b, "complete -c %s -n '__fish_seen_subcommand_from %s' -f -a %s\n", cmd.Name, sub.Name, fishQuote(strings.ReplaceAll(sub.Args, "|", " ")))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeFishFlags(b *strings.Builder, name, cond string, flags []cliFlag) {
+	for _, f := range flags {
+		value := ""
+		if f.Type != "bool" {
+			value = "-r "
+		}
+		fmt.Fprintf(b, "complete -c %s %s-l %s %s-d %s\n", name, cond, f.Name, value, fishQuote(f.Usage))
+	}
+}
+
+var fishEscaper = strings.NewReplacer(`\`, `\\`, "'", `\'`)
+
+func fishQuote(s string) string {
+	return "'" + fishEscaper.Replace(s) + "'"
+}
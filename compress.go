@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(io.Discard) },
+}
+
+// writeCompressed writes body, gzipped when it is at least minSize bytes
+// and the client accepts gzip. minSize 0 disables compression. Callers set
+// the Content-Type.
+func writeCompressed(w http.ResponseWriter, r *http.Request, status int, body []byte, minSize int64) {
+	if minSize > 0 {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if int64(len(body)) >= minSize && acceptsGzip(r.Header) {
+			var buf bytes.Buffer
+			zw := gzipWriters.Get().(*gzip.Writer)
+			zw.Reset(&buf)
+			zw.Write(body)
+			zw.Close()
+			gzipWriters.Put(zw)
+			w.Header().Set("Content-Encoding", "gzip")
+			body = buf.Bytes()
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// acceptsGzip reports whether the Accept-Encoding header in h allows a
+// gzip response.
+func acceptsGzip(h http.Header) bool {
+	ok := false
+	for _, v := range h.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "gzip" && name != "x-gzip" && name != "*" {
+				continue
+			}
+			q := 1.0
+			if p, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+				q, _ = strconv.ParseFloat(p, 64)
+			}
+			if name != "*" && q == 0 {
+				// An explicit refusal of gzip overrides *.
+				return false
+			}
+			ok = ok || q > 0
+		}
+	}
+	return ok
+}
+
+// decompressRequests decodes gzip-encoded request bodies before next sees
+// them, so scripts always receive plain JSON or raw bytes. maxSize bounds
+// the decompressed body (0 = unlimited); other encodings are rejected with
+// 415.
+func decompressRequests(maxSize int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, "invalid gzip request body", http.StatusBadRequest)
+				return
+			}
+			var body io.ReadCloser = zr
+			if maxSize > 0 {
+				body = http.MaxBytesReader(w, zr, maxSize)
+			}
+			r.Body = body
+			r.ContentLength = -1
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+		default:
+			w.Header().Set("Accept-Encoding", "gzip")
+			http.Error(w, "unsupported Content-Encoding "+strconv.Quote(enc), http.StatusUnsupportedMediaType)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,1962 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPort       = 8080
+	defaultListen     = ""
+	defaultListenMode = 0o660
+	defaultEnvFile    = ""
+	defaultTimeout    = 30 * time.Second
+	defaultInline     = ""
+	defaultScriptFile = ""
+	defaultScriptDir  = ""
+	defaultConfigFile = ""
+	defaultSchemaFile = ""
+
+	defaultTimeoutStatus = http.StatusGatewayTimeout
+
+	defaultStrictConfig = false
+	defaultProfile      = ""
+
+	defaultWarmupPayload = "{}"
+
+	defaultProbeInterval = 0
+	defaultProbePayload  = "{}"
+
+	defaultDependencyCheckInterval = 30 * time.Second
+
+	defaultConcurrency      = 0
+	defaultBatchParallelism = 4
+
+	defaultForwardHeaders = "traceparent,tracestate,baggage,x-request-id"
+
+	defaultKeepaliveInterval = 15 * time.Second
+
+	defaultRawContentTypes = "application/octet-stream"
+	defaultRawResponseType = "application/octet-stream"
+
+	defaultMaxUploadSize = 100 << 20
+
+	defaultCompressMinSize = 1 << 10
+
+	defaultMaxConnections      = 0
+	defaultMaxConnectionsPerIP = 0
+	defaultHTTPIdleTimeout     = 120 * time.Second
+	defaultHTTPKeepAlives      = true
+	defaultHTTPTimeoutMargin   = 30 * time.Second
+
+	defaultTLSCert = ""
+	defaultTLSKey  = ""
+	defaultHTTP2   = true
+	defaultH2C     = false
+
+	defaultHTTP3Listen = ""
+	defaultHTTP3Cert   = ""
+	defaultHTTP3Key    = ""
+
+	defaultCoercePayload = false
+
+	defaultFakeClock     = false
+	defaultDeterministic = false
+
+	defaultTenantHeader = ""
+
+	defaultTrustPriorityHeader = false
+
+	defaultCacheTTL     = 0
+	defaultCacheSize    = 1000
+	defaultCacheBackend = "memory"
+
+	defaultRetryAttempts = 1
+	defaultRetryBackoff  = 100 * time.Millisecond
+	defaultRetryOn       = ""
+
+	defaultBreakerFailures = 0
+	defaultBreakerWindow   = time.Minute
+	defaultBreakerCooldown = 30 * time.Second
+
+	defaultPersistent             = false
+	defaultPersistentReadyTimeout = 10 * time.Second
+	defaultWorkerProtocol         = workerProtocolHTTP
+
+	defaultWorkerMaxRSS        = 0
+	defaultWorkerMaxRequests   = 0
+	defaultWorkerCheckInterval = 15 * time.Second
+
+	defaultNodeMaxOldSpaceSize = 0
+	defaultCPUWeight           = 0
+	defaultPidsLimit           = 0
+	defaultCgroupParent        = ""
+	defaultOutputLimitPolicy   = outputLimitKill
+
+	defaultExecutor    = executorLocal
+	defaultDockerImage = "node:22-slim"
+
+	defaultSandbox = false
+
+	defaultEnvClean = false
+
+	defaultDeadLetterDir = ""
+
+	defaultIdempotencyDir = ""
+	defaultIdempotencyTTL = 24 * time.Hour
+
+	defaultCallbackAllowHosts = ""
+	defaultCallbackSecretFile = ""
+	defaultCallbackAttempts   = 5
+	defaultCallbackBackoff    = time.Second
+
+	defaultResponseSigning        = ""
+	defaultResponseSigningKeyFile = ""
+
+	defaultPayloadDecryptionKeyFile = ""
+
+	defaultAnalytics = false
+
+	defaultAuditLog         = ""
+	defaultAuditPayload     = auditPayloadHash
+	defaultAuditRedact      = ""
+	defaultAuditLogMaxSize  = 100 << 20
+	defaultAuditLogMaxFiles = 5
+
+	defaultSampleSink   = ""
+	defaultSampleRate   = 0.01
+	defaultSampleRedact = ""
+
+	defaultNodePath            = ""
+	defaultNodeVersionMismatch = nodeVersionFail
+	defaultPackageJSON         = ""
+	defaultPackagesDir         = ""
+	defaultNodeRequire         = ""
+	defaultCompileCacheDir     = ""
+
+	defaultIsolateWorkdir  = false
+	defaultWorkdirTemplate = ""
+
+	defaultEgressProxy = false
+
+	defaultStore              = false
+	defaultStoreBackend       = "memory"
+	defaultStoreMaxKeys       = 10000
+	defaultStoreCacheSize     = 10000
+	defaultStoreCacheMaxBytes = 64 << 20
+	defaultStoreCacheTTL      = 10 * time.Minute
+
+	defaultStreamWriteTimeout = 30 * time.Second
+	defaultSlowClientPolicy   = slowClientDisconnect
+
+	defaultRegion = ""
+	defaultZone   = ""
+
+	defaultLogLevel     = logLevelInfo
+	defaultAdminListen  = ""
+	defaultScriptUpload = false
+	defaultDebugListen  = ""
+
+	defaultCORSOrigins = ""
+	defaultCORSMethods = "GET,POST"
+	defaultCORSHeaders = "Content-Type,Authorization,Idempotency-Key"
+	defaultCORSMaxAge  = 10 * time.Minute
+
+	envPortKey       = "PORT"
+	envListenKey     = "LISTEN"
+	envInlineKey     = "SCRIPT"
+	envScriptFileKey = "SCRIPT_FILE"
+	envScriptDirKey  = "SCRIPT_DIR"
+	envConfigFileKey = "CONFIG_FILE"
+	envEnvFileKey    = "ENV_FILE"
+	envTimeoutKey    = "TIMEOUT_DURATION"
+
+	envTimeoutStatusKey = "TIMEOUT_STATUS"
+
+	envSchemaFileKey = "SCHEMA_FILE"
+
+	envStrictConfigKey = "STRICT_CONFIG"
+	envProfileKey      = "CONFIG_PROFILE"
+
+	envWarmupKey        = "WARMUP"
+	envWarmupPayloadKey = "WARMUP_PAYLOAD"
+
+	envProbeIntervalKey = "PROBE_INTERVAL"
+	envProbePayloadKey  = "PROBE_PAYLOAD"
+
+	envDependencyCheckIntervalKey = "DEPENDENCY_CHECK_INTERVAL"
+
+	envConcurrencyKey      = "CONCURRENCY"
+	envBatchParallelismKey = "BATCH_PARALLELISM"
+
+	envForwardHeadersKey = "FORWARD_HEADERS"
+
+	envKeepaliveIntervalKey = "KEEPALIVE_INTERVAL"
+
+	envRawContentTypesKey = "RAW_CONTENT_TYPES"
+	envRawResponseTypeKey = "RAW_RESPONSE_TYPE"
+
+	envMaxUploadSizeKey = "MAX_UPLOAD_SIZE"
+
+	envCompressMinSizeKey = "COMPRESS_MIN_SIZE"
+
+	envMaxConnectionsKey      = "MAX_CONNECTIONS"
+	envMaxConnectionsPerIPKey = "MAX_CONNECTIONS_PER_IP"
+	envHTTPIdleTimeoutKey     = "HTTP_IDLE_TIMEOUT"
+	envHTTPKeepAlivesKey      = "HTTP_KEEP_ALIVES"
+	envHTTPTimeoutMarginKey   = "HTTP_TIMEOUT_MARGIN"
+
+	envTLSCertKey = "TLS_CERT"
+	envTLSKeyKey  = "TLS_KEY"
+	envHTTP2Key   = "HTTP2"
+	envH2CKey     = "H2C"
+
+	envHTTP3ListenKey = "HTTP3_LISTEN"
+	envHTTP3CertKey   = "HTTP3_CERT"
+	envHTTP3KeyKey    = "HTTP3_KEY"
+
+	envCoercePayloadKey = "COERCE_PAYLOAD"
+
+	envFakeClockKey     = "FAKE_CLOCK"
+	envDeterministicKey = "DETERMINISTIC"
+
+	envTenantHeaderKey = "TENANT_HEADER"
+
+	envTrustPriorityHeaderKey = "TRUST_PRIORITY_HEADER"
+
+	envCacheTTLKey     = "CACHE_TTL"
+	envCacheSizeKey    = "CACHE_SIZE"
+	envCacheBackendKey = "CACHE_BACKEND"
+
+	envRetryAttemptsKey = "RETRY_ATTEMPTS"
+	envRetryBackoffKey  = "RETRY_BACKOFF"
+	envRetryOnKey       = "RETRY_ON"
+
+	envBreakerFailuresKey = "BREAKER_FAILURES"
+	envBreakerWindowKey   = "BREAKER_WINDOW"
+	envBreakerCooldownKey = "BREAKER_COOLDOWN"
+
+	envPersistentKey             = "PERSISTENT"
+	envPersistentReadyTimeoutKey = "PERSISTENT_READY_TIMEOUT"
+	envWorkerProtocolKey         = "WORKER_PROTOCOL"
+
+	envWorkerMaxRSSKey        = "WORKER_MAX_RSS"
+	envWorkerMaxRequestsKey   = "WORKER_MAX_REQUESTS"
+	envWorkerCheckIntervalKey = "WORKER_CHECK_INTERVAL"
+
+	envNodeMaxOldSpaceSizeKey = "NODE_MAX_OLD_SPACE_SIZE"
+	envMemoryLimitKey         = "MEMORY_LIMIT"
+	envCPUWeightKey           = "CPU_WEIGHT"
+	envPidsLimitKey           = "PIDS_LIMIT"
+	envCgroupParentKey        = "CGROUP_PARENT"
+	envMaxOutputBytesKey      = "MAX_OUTPUT_BYTES"
+	envOutputLimitPolicyKey   = "OUTPUT_LIMIT_POLICY"
+
+	envExecutorKey      = "EXECUTOR"
+	envDockerImageKey   = "DOCKER_IMAGE"
+	envDockerNetworkKey = "DOCKER_NETWORK"
+	envDockerMountsKey  = "DOCKER_MOUNTS"
+
+	// NODE_PATH is taken by node itself.
+	envNodePathKey            = "NODE_BINARY"
+	envRequireNodeVersionKey  = "REQUIRE_NODE_VERSION"
+	envNodeVersionMismatchKey = "NODE_VERSION_MISMATCH"
+	envPackageJSONKey         = "PACKAGE_JSON"
+	envPackagesDirKey         = "PACKAGES_DIR"
+	envNodeRequireKey         = "NODE_REQUIRE"
+	envCompileCacheDirKey     = "COMPILE_CACHE_DIR"
+
+	envIsolateWorkdirKey  = "ISOLATE_WORKDIR"
+	envWorkdirTemplateKey = "WORKDIR_TEMPLATE"
+
+	envDeadLetterDirKey = "DEAD_LETTER_DIR"
+
+	envIdempotencyDirKey = "IDEMPOTENCY_DIR"
+	envIdempotencyTTLKey = "IDEMPOTENCY_TTL"
+
+	envCallbackAllowHostsKey = "CALLBACK_ALLOW_HOSTS"
+	envCallbackSecretFileKey = "CALLBACK_SECRET_FILE"
+	envCallbackAttemptsKey   = "CALLBACK_ATTEMPTS"
+	envCallbackBackoffKey    = "CALLBACK_BACKOFF"
+
+	envResponseSigningKey        = "RESPONSE_SIGNING"
+	envResponseSigningKeyFileKey = "RESPONSE_SIGNING_KEY_FILE"
+
+	envPayloadDecryptionKeyFileKey = "PAYLOAD_DECRYPTION_KEY_FILE"
+
+	envAnalyticsKey = "ANALYTICS"
+
+	envAuditLogKey         = "AUDIT_LOG"
+	envAuditPayloadKey     = "AUDIT_PAYLOAD"
+	envAuditRedactKey      = "AUDIT_REDACT"
+	envAuditLogMaxSizeKey  = "AUDIT_LOG_MAX_SIZE"
+	envAuditLogMaxFilesKey = "AUDIT_LOG_MAX_FILES"
+
+	envSampleSinkKey   = "SAMPLE_SINK"
+	envSampleRateKey   = "SAMPLE_RATE"
+	envSampleRedactKey = "SAMPLE_REDACT"
+
+	envSandboxKey             = "SANDBOX"
+	envSandboxAllowFSReadKey  = "SANDBOX_ALLOW_FS_READ"
+	envSandboxAllowFSWriteKey = "SANDBOX_ALLOW_FS_WRITE"
+	envSandboxAllowNetKey     = "SANDBOX_ALLOW_NET"
+
+	envEnvCleanKey     = "ENV_CLEAN"
+	envEnvAllowlistKey = "ENV_ALLOWLIST"
+	envEnvDenylistKey  = "ENV_DENYLIST"
+
+	envRegionKey = "REGION"
+	envZoneKey   = "ZONE"
+
+	envLogLevelKey     = "LOG_LEVEL"
+	envAdminTokenKey   = "ADMIN_TOKEN"
+	envAdminListenKey  = "ADMIN_LISTEN"
+	envDebugListenKey  = "DEBUG_LISTEN"
+	envScriptUploadKey = "SCRIPT_UPLOAD"
+	envFaultRoutesKey  = "FAULT_ROUTES"
+
+	envCORSOriginsKey       = "CORS_ORIGINS"
+	envCORSMethodsKey       = "CORS_METHODS"
+	envCORSHeadersKey       = "CORS_HEADERS"
+	envCORSExposeHeadersKey = "CORS_EXPOSE_HEADERS"
+	envCORSMaxAgeKey        = "CORS_MAX_AGE"
+	envCORSCredentialsKey   = "CORS_CREDENTIALS"
+
+	envEgressProxyKey    = "EGRESS_PROXY"
+	envEgressMaxCallsKey = "EGRESS_MAX_CALLS"
+	envEgressMaxTimeKey  = "EGRESS_MAX_TIME"
+	envEgressAllowKey    = "EGRESS_ALLOW"
+
+	envStoreKey              = "STORE"
+	envStoreBackendKey       = "STORE_BACKEND"
+	envStoreMaxKeysKey       = "STORE_MAX_KEYS"
+	envStoreCacheSizeKey     = "STORE_CACHE_SIZE"
+	envStoreCacheMaxBytesKey = "STORE_CACHE_MAX_BYTES"
+	envStoreCacheTTLKey      = "STORE_CACHE_TTL"
+
+	envStreamWriteTimeoutKey = "STREAM_WRITE_TIMEOUT"
+	envSlowClientPolicyKey   = "SLOW_CLIENT_POLICY"
+
+	envOAuthTokenURLKey     = "OAUTH_TOKEN_URL"
+	envOAuthClientIDKey     = "OAUTH_CLIENT_ID"
+	envOAuthClientSecretKey = "OAUTH_CLIENT_SECRET"
+	envOAuthScopesKey       = "OAUTH_SCOPES"
+	envOAuthAudienceKey     = "OAUTH_AUDIENCE"
+	envOAuthTokenFileKey    = "OAUTH_TOKEN_FILE"
+)
+
+type Config struct {
+	Port         int
+	InlineScript string
+	ScriptFile   string
+	ScriptDir    string
+	ConfigFile   string
+	EnvFiles     []string
+	Timeout      time.Duration
+	// TimeoutStatus is the status of responses to invocations killed by
+	// their timeout.
+	TimeoutStatus int
+	SchemaFile    string
+	OAuth         OAuthConfig
+
+	// StrictConfig rejects unknown keys in the --config file.
+	StrictConfig bool
+	// Check validates the configuration and scripts and exits instead of
+	// serving; see runCheck.
+	Check bool
+	// HelpJSON prints the flags and subcommands as JSON and exits; see
+	// describeCLI.
+	HelpJSON bool
+	// Profile selects the overlay merged over the --config file; see
+	// LoadFileConfig.
+	Profile string
+
+	// Listen overrides Port with a tcp, unix or systemd listener; see
+	// listen.
+	Listen     string
+	ListenMode os.FileMode
+
+	Warmup        int
+	WarmupPayload string
+
+	// ProbeInterval enables periodic synthetic invocations whose outcome
+	// drives /readyz.
+	ProbeInterval time.Duration
+	ProbePayload  string
+
+	// DependencyCheckInterval is how often the dependencies declared by
+	// --config routes are rechecked.
+	DependencyCheckInterval time.Duration
+
+	Concurrency      int
+	BatchParallelism int
+
+	// ForwardHeaders lists the request headers passed to scripts so they
+	// can propagate them to downstream calls.
+	ForwardHeaders []string
+
+	KeepaliveInterval time.Duration
+
+	// RawContentTypes lists request media types, e.g. image/*, whose
+	// bodies are streamed to the script's stdin instead of being parsed
+	// as JSON.
+	RawContentTypes []string
+	RawResponseType string
+
+	// MaxUploadSize bounds multipart/form-data requests, whose files are
+	// staged on disk for the script, webhook deliveries, which are read
+	// before their signature is verified, and the decompressed size of
+	// gzip-encoded requests.
+	MaxUploadSize int64
+
+	// CompressMinSize is the smallest JSON response gzipped for clients
+	// accepting it; 0 disables response compression.
+	CompressMinSize int64
+
+	// Connections bounds the server's open connections; see ConnLimits.
+	Connections ConnLimits
+	// HTTPIdleTimeout is how long an idle keep-alive connection is kept
+	// open; HTTPKeepAlives false closes connections after every response.
+	HTTPIdleTimeout time.Duration
+	HTTPKeepAlives  bool
+	// HTTPTimeoutMargin is the time reading a request and writing its
+	// response may take beyond the invocation's own budget; see
+	// Invoker.budget.
+	HTTPTimeoutMargin time.Duration
+
+	// TLS serves the listener over TLS, and HTTP2 lets TLS clients
+	// negotiate HTTP/2 on it; see TLSConfig. H2C accepts HTTP/2 without
+	// TLS from clients that know the server speaks it, for plaintext
+	// deployments behind a load balancer or inside a cluster.
+	TLS   TLSConfig
+	HTTP2 bool
+	H2C   bool
+
+	// HTTP3 adds an experimental HTTP/3 listener; see HTTP3Config.
+	HTTP3 HTTP3Config
+
+	// CoercePayload converts payloads towards their schema before
+	// validation; see Schema.Coerce.
+	CoercePayload bool
+
+	// FakeClock lets requests run scripts at a simulated time with the
+	// X-Invoke-Clock header; see requestClock. Deterministic runs every
+	// invocation reproducibly; see makeDeterministic.
+	FakeClock     bool
+	Deterministic bool
+
+	// TenantHeader names the request header identifying the caller's
+	// tenant to scripts; see InvocationContext.
+	TenantHeader string
+
+	// TrustPriorityHeader honors X-Invoke-Priority from every caller, not
+	// only those that passed their route's auth or tenant key; see
+	// requestPriority.
+	TrustPriorityHeader bool
+
+	// CacheTTL enables caching of successful outputs by payload; scripts
+	// must be idempotent for this to be safe.
+	CacheTTL  time.Duration
+	CacheSize int
+	// CacheBackend holds the result cache and the store's cache: memory,
+	// or a storage URL to share them between servers; see resultCache.
+	CacheBackend string
+
+	Retry RetryPolicy
+
+	// Breaker fast-fails routes whose script keeps failing; see
+	// BreakerPolicy.
+	Breaker BreakerPolicy
+
+	Limits ResourceLimits
+
+	// Executor is where scripts run: executorLocal as child processes, or
+	// executorDocker in containers configured by Docker.
+	Executor string
+	Docker   DockerConfig
+
+	// DeadLetterDir enables capturing failed invocations there, a
+	// directory or storage URL; see DeadLetters and openStorage.
+	DeadLetterDir string
+
+	// IdempotencyDir enables Idempotency-Key handling, keeping keys and
+	// outputs there, a directory or storage URL, for IdempotencyTTL; see
+	// Idempotency.
+	IdempotencyDir string
+	IdempotencyTTL time.Duration
+
+	// Callbacks enables asynchronous invocations delivering their result
+	// to a client's callback URL; see CallbackConfig.
+	Callbacks CallbackConfig
+
+	// Signing signs successful invocation responses; see SigningConfig.
+	Signing SigningConfig
+
+	// PayloadDecryptionKeyFile enables JWE payloads; see Decrypter.
+	PayloadDecryptionKeyFile string
+
+	// Analytics collects per-route payload and response shapes for
+	// /admin/analytics; see Analytics.
+	Analytics bool
+
+	// Audit records every invocation when its Sink is set; see
+	// AuditConfig.
+	Audit AuditConfig
+
+	// Sampling forwards a sample of invocations when its Sink is set; see
+	// SamplingConfig.
+	Sampling SamplingConfig
+
+	// NodePath is the node executable; empty means node from PATH or a
+	// version manager's install. RequireNodeVersion, when set, is checked
+	// against it and every route runtime, failing or warning per
+	// NodeVersionMismatch.
+	NodePath            string
+	RequireNodeVersion  *VersionConstraint
+	NodeVersionMismatch string
+
+	// PackageJSON, when set, has its dependencies installed below
+	// PackagesDir before serving; see installPackages.
+	PackageJSON string
+	PackagesDir string
+
+	// NodeRequire lists modules preloaded into every script, and
+	// CompileCacheDir enables node's compile cache there; both are
+	// composed with the NODE_OPTIONS scripts inherit, see nodeEnv.
+	NodeRequire     []string
+	CompileCacheDir string
+
+	// Workdir gives every invocation its own scratch working directory;
+	// see Workdir.
+	Workdir Workdir
+
+	// Sandbox runs every script under Node's permission model with the
+	// allowlists in SandboxPolicy.
+	Sandbox       bool
+	SandboxPolicy Sandbox
+
+	// EnvClean, EnvAllowlist and EnvDenylist select the server variables
+	// scripts inherit; see envFilter.
+	EnvClean     bool
+	EnvAllowlist []string
+	EnvDenylist  []string
+
+	// EgressProxy routes script HTTP traffic through a local proxy
+	// enforcing EgressBudget per invocation.
+	EgressProxy  bool
+	EgressBudget EgressBudget
+
+	// Store gives scripts a shared key/value and pub/sub store; see Store.
+	Store bool
+	// StoreBackend holds the store's keys: memory, or a storage URL to
+	// keep them across restarts or share them between servers. StoreMaxKeys bounds the memory backend.
+	StoreBackend string
+	StoreMaxKeys int
+	// StoreCacheSize, StoreCacheMaxBytes and StoreCacheTTL bound the
+	// store's LRU cache; a zero size or TTL disables it.
+	StoreCacheSize     int
+	StoreCacheMaxBytes int64
+	StoreCacheTTL      time.Duration
+
+	StreamWriteTimeout time.Duration
+	SlowClientPolicy   string
+
+	// Persistent runs the script once as a long-lived worker that serves
+	// invocations over WorkerProtocol; see Worker.
+	Persistent             bool
+	PersistentReadyTimeout time.Duration
+	WorkerProtocol         string
+	// WorkerRecycle replaces persistent workers that grew too large or
+	// served too many invocations.
+	WorkerRecycle WorkerRecycle
+
+	// Locality names the region and zone the server runs in; see
+	// Locality.
+	Locality Locality
+
+	LogLevel string
+
+	// AdminToken and AdminListen enable the /admin API, behind a bearer
+	// token, on a separate listener, or both.
+	AdminToken  string
+	AdminListen string
+	// DebugListen serves pprof and runtime stats of the server itself on
+	// a separate listener; see debugHandler.
+	DebugListen string
+
+	// CORS lets browsers on other origins call the invoke endpoints of
+	// routes without a policy of their own; see CORSPolicy.
+	CORS CORSPolicy
+	// ScriptUpload adds the script upload API to the admin API; see
+	// ScriptStore.
+	ScriptUpload bool
+	// FaultRoutes are the route name patterns the admin API may inject
+	// faults into.
+	FaultRoutes []string
+}
+
+func (c *Config) LoadEnv() {
+	if v := os.Getenv(envPortKey); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envPortKey, v, err)
+		}
+		c.Port = p
+	}
+
+	if v := os.Getenv(envListenKey); v != "" {
+		c.Listen = v
+	}
+
+	if v := os.Getenv(envInlineKey); v != "" {
+		c.InlineScript = v
+	}
+
+	if v := os.Getenv(envScriptFileKey); v != "" {
+		c.ScriptFile = v
+	}
+
+	if v := os.Getenv(envScriptDirKey); v != "" {
+		c.ScriptDir = v
+	}
+
+	if v := os.Getenv(envConfigFileKey); v != "" {
+		c.ConfigFile = v
+	}
+	if v := os.Getenv(envStrictConfigKey); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envStrictConfigKey, v, err)
+		}
+		c.StrictConfig = b
+	}
+	if v := os.Getenv(envProfileKey); v != "" {
+		c.Profile = v
+	}
+
+	if c.scriptSources() > 1 {
+		log.Fatalf("must provide only one of %s, %s, %s or %s", envInlineKey, envScriptFileKey, envScriptDirKey, envConfigFileKey)
+	}
+
+	if v := os.Getenv(envEnvFileKey); v != "" {
+		c.EnvFiles = splitList(v)
+	}
+
+	if v := os.Getenv(envTimeoutKey); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envTimeoutKey, v, err)
+		}
+		c.Timeout = d
+	}
+
+	if v := os.Getenv(envTimeoutStatusKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envTimeoutStatusKey, v, err)
+		}
+		c.TimeoutStatus = n
+	}
+
+	if v := os.Getenv(envSchemaFileKey); v != "" {
+		c.SchemaFile = v
+	}
+
+	if v := os.Getenv(envWarmupKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envWarmupKey, v, err)
+		}
+		c.Warmup = n
+	}
+
+	if v := os.Getenv(envWarmupPayloadKey); v != "" {
+		c.WarmupPayload = v
+	}
+
+	if v := os.Getenv(envProbeIntervalKey); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envProbeIntervalKey, v, err)
+		}
+		c.ProbeInterval = d
+	}
+
+	if v := os.Getenv(envProbePayloadKey); v != "" {
+		c.ProbePayload = v
+	}
+
+	if v := os.Getenv(envDependencyCheckIntervalKey); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envDependencyCheckIntervalKey, v, err)
+		}
+		c.DependencyCheckInterval = d
+	}
+
+	if v := os.Getenv(envConcurrencyKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envConcurrencyKey, v, err)
+		}
+		c.Concurrency = n
+	}
+
+	if v := os.Getenv(envBatchParallelismKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envBatchParallelismKey, v, err)
+		}
+		c.BatchParallelism = n
+	}
+
+	if v, ok := os.LookupEnv(envForwardHeadersKey); ok {
+		c.ForwardHeaders = splitList(v)
+	}
+
+	if v := os.Getenv(envKeepaliveIntervalKey); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envKeepaliveIntervalKey, v, err)
+		}
+		c.KeepaliveInterval = d
+	}
+
+	if v, ok := os.LookupEnv(envRawContentTypesKey); ok {
+		c.RawContentTypes = splitList(v)
+	}
+
+	if v := os.Getenv(envRawResponseTypeKey); v != "" {
+		c.RawResponseType = v
+	}
+
+	if v := os.Getenv(envMaxUploadSizeKey); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envMaxUploadSizeKey, v, err)
+		}
+		c.MaxUploadSize = n
+	}
+
+	if v := os.Getenv(envCompressMinSizeKey); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envCompressMinSizeKey, v, err)
+		}
+		c.CompressMinSize = n
+	}
+
+	if v := os.Getenv(envMaxConnectionsKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envMaxConnectionsKey, v, err)
+		}
+		c.Connections.Max = n
+	}
+
+	if v := os.Getenv(envMaxConnectionsPerIPKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envMaxConnectionsPerIPKey, v, err)
+		}
+		c.Connections.PerIP = n
+	}
+
+	if v := os.Getenv(envHTTPIdleTimeoutKey); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envHTTPIdleTimeoutKey, v, err)
+		}
+		c.HTTPIdleTimeout = d
+	}
+
+	if v := os.Getenv(envHTTPKeepAlivesKey); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envHTTPKeepAlivesKey, v, err)
+		}
+		c.HTTPKeepAlives = b
+	}
+
+	if v := os.Getenv(envHTTPTimeoutMarginKey); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envHTTPTimeoutMarginKey, v, err)
+		}
+		c.HTTPTimeoutMargin = d
+	}
+
+	if v := os.Getenv(envTLSCertKey); v != "" {
+		c.TLS.CertFile = v
+	}
+	if v := os.Getenv(envTLSKeyKey); v != "" {
+		c.TLS.KeyFile = v
+	}
+	if v := os.Getenv(envHTTP2Key); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envHTTP2Key, v, err)
+		}
+		c.HTTP2 = b
+	}
+	if v := os.Getenv(envH2CKey); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envH2CKey, v, err)
+		}
+		c.H2C = b
+	}
+
+	if v := os.Getenv(envHTTP3ListenKey); v != "" {
+		c.HTTP3.Listen = v
+	}
+	if v := os.Getenv(envHTTP3CertKey); v != "" {
+		c.HTTP3.CertFile = v
+	}
+	if v := os.Getenv(envHTTP3KeyKey); v != "" {
+		c.HTTP3.KeyFile = v
+	}
+
+	if v := os.Getenv(envCoercePayloadKey); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envCoercePayloadKey, v, err)
+		}
+		c.CoercePayload = b
+	}
+
+	if v := os.Getenv(envFakeClockKey); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envFakeClockKey, v, err)
+		}
+		c.FakeClock = b
+	}
+
+	if v := os.Getenv(envDeterministicKey); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envDeterministicKey, v, err)
+		}
+		c.Deterministic = b
+	}
+
+	if v := os.Getenv(envTenantHeaderKey); v != "" {
+		c.TenantHeader = v
+	}
+
+	if v := os.Getenv(envTrustPriorityHeaderKey); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envTrustPriorityHeaderKey, v, err)
+		}
+		c.TrustPriorityHeader = b
+	}
+
+	if v := os.Getenv(envCacheTTLKey); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envCacheTTLKey, v, err)
+		}
+		c.CacheTTL = d
+	}
+
+	if v := os.Getenv(envCacheSizeKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envCacheSizeKey, v, err)
+		}
+		c.CacheSize = n
+	}
+
+	if v := os.Getenv(envCacheBackendKey); v != "" {
+		c.CacheBackend = v
+	}
+
+	if v := os.Getenv(envRetryAttemptsKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envRetryAttemptsKey, v, err)
+		}
+		c.Retry.Attempts = n
+	}
+
+	if v := os.Getenv(envRetryBackoffKey); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envRetryBackoffKey, v, err)
+		}
+		c.Retry.Backoff = d
+	}
+
+	if v, ok := os.LookupEnv(envRetryOnKey); ok {
+		c.Retry.On = splitList(v)
+	}
+
+	if v := os.Getenv(envBreakerFailuresKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envBreakerFailuresKey, v, err)
+		}
+		c.Breaker.Failures = n
+	}
+
+	if v := os.Getenv(envBreakerWindowKey); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envBreakerWindowKey, v, err)
+		}
+		c.Breaker.Window = d
+	}
+
+	if v := os.Getenv(envBreakerCooldownKey); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envBreakerCooldownKey, v, err)
+		}
+		c.Breaker.Cooldown = d
+	}
+
+	if v := os.Getenv(envNodeMaxOldSpaceSizeKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envNodeMaxOldSpaceSizeKey, v, err)
+		}
+		c.Limits.MaxOldSpaceSize = n
+	}
+
+	if v := os.Getenv(envMemoryLimitKey); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envMemoryLimitKey, v, err)
+		}
+		c.Limits.Memory = n
+	}
+
+	if v := os.Getenv(envCPUWeightKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envCPUWeightKey, v, err)
+		}
+		c.Limits.CPUWeight = n
+	}
+
+	if v := os.Getenv(envPidsLimitKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envPidsLimitKey, v, err)
+		}
+		c.Limits.Pids = n
+	}
+
+	if v := os.Getenv(envCgroupParentKey); v != "" {
+		c.Limits.CgroupParent = v
+	}
+
+	if v := os.Getenv(envMaxOutputBytesKey); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envMaxOutputBytesKey, v, err)
+		}
+		c.Limits.MaxOutput = n
+	}
+
+	if v := os.Getenv(envOutputLimitPolicyKey); v != "" {
+		c.Limits.OutputPolicy = v
+	}
+
+	if v := os.Getenv(envExecutorKey); v != "" {
+		c.Executor = v
+	}
+	if v := os.Getenv(envDockerImageKey); v != "" {
+		c.Docker.Image = v
+	}
+	if v := os.Getenv(envDockerNetworkKey); v != "" {
+		c.Docker.Network = v
+	}
+	if v := os.Getenv(envDockerMountsKey); v != "" {
+		c.Docker.Mounts = splitList(v)
+	}
+
+	if v := os.Getenv(envDeadLetterDirKey); v != "" {
+		c.DeadLetterDir = v
+	}
+
+	if v := os.Getenv(envIdempotencyDirKey); v != "" {
+		c.IdempotencyDir = v
+	}
+	if v := os.Getenv(envIdempotencyTTLKey); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envIdempotencyTTLKey, v, err)
+		}
+		c.IdempotencyTTL = d
+	}
+
+	if v := os.Getenv(envCallbackAllowHostsKey); v != "" {
+		c.Callbacks.AllowHosts = splitList(v)
+	}
+	if v := os.Getenv(envCallbackSecretFileKey); v != "" {
+		c.Callbacks.SecretFile = v
+	}
+	if v := os.Getenv(envCallbackAttemptsKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envCallbackAttemptsKey, v, err)
+		}
+		c.Callbacks.Attempts = n
+	}
+	if v := os.Getenv(envCallbackBackoffKey); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envCallbackBackoffKey, v, err)
+		}
+		c.Callbacks.Backoff = d
+	}
+
+	if v := os.Getenv(envResponseSigningKey); v != "" {
+		c.Signing.Mode = v
+	}
+	if v := os.Getenv(envResponseSigningKeyFileKey); v != "" {
+		c.Signing.KeyFile = v
+	}
+
+	if v := os.Getenv(envPayloadDecryptionKeyFileKey); v != "" {
+		c.PayloadDecryptionKeyFile = v
+	}
+
+	if v := os.Getenv(envAnalyticsKey); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envAnalyticsKey, v, err)
+		}
+		c.Analytics = b
+	}
+
+	if v := os.Getenv(envAuditLogKey); v != "" {
+		c.Audit.Sink = v
+	}
+	if v := os.Getenv(envAuditPayloadKey); v != "" {
+		c.Audit.Payload = v
+	}
+	if v := os.Getenv(envAuditRedactKey); v != "" {
+		c.Audit.Redact = splitList(v)
+	}
+	if v := os.Getenv(envAuditLogMaxSizeKey); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envAuditLogMaxSizeKey, v, err)
+		}
+		c.Audit.MaxSize = n
+	}
+	if v := os.Getenv(envAuditLogMaxFilesKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envAuditLogMaxFilesKey, v, err)
+		}
+		c.Audit.MaxFiles = n
+	}
+
+	if v := os.Getenv(envSampleSinkKey); v != "" {
+		c.Sampling.Sink = v
+	}
+	if v := os.Getenv(envSampleRateKey); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envSampleRateKey, v, err)
+		}
+		c.Sampling.Rate = f
+	}
+	if v := os.Getenv(envSampleRedactKey); v != "" {
+		c.Sampling.Redact = splitList(v)
+	}
+
+	if v := os.Getenv(envNodePathKey); v != "" {
+		c.NodePath = v
+	}
+	if v := os.Getenv(envRequireNodeVersionKey); v != "" {
+		vc, err := parseVersionConstraint(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envRequireNodeVersionKey, v, err)
+		}
+		c.RequireNodeVersion = vc
+	}
+	if v := os.Getenv(envNodeVersionMismatchKey); v != "" {
+		c.NodeVersionMismatch = v
+	}
+	if v := os.Getenv(envPackageJSONKey); v != "" {
+		c.PackageJSON = v
+	}
+	if v := os.Getenv(envPackagesDirKey); v != "" {
+		c.PackagesDir = v
+	}
+	if v := os.Getenv(envNodeRequireKey); v != "" {
+		c.NodeRequire = splitList(v)
+	}
+	if v := os.Getenv(envCompileCacheDirKey); v != "" {
+		c.CompileCacheDir = v
+	}
+
+	if v := os.Getenv(envIsolateWorkdirKey); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envIsolateWorkdirKey, v, err)
+		}
+		c.Workdir.Isolate = b
+	}
+	if v := os.Getenv(envWorkdirTemplateKey); v != "" {
+		c.Workdir.Template = v
+	}
+
+	if v := os.Getenv(envSandboxKey); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envSandboxKey, v, err)
+		}
+		c.Sandbox = b
+	}
+
+	if v, ok := os.LookupEnv(envSandboxAllowFSReadKey); ok {
+		c.SandboxPolicy.AllowFSRead = splitList(v)
+	}
+
+	if v, ok := os.LookupEnv(envSandboxAllowFSWriteKey); ok {
+		c.SandboxPolicy.AllowFSWrite = splitList(v)
+	}
+
+	if v := os.Getenv(envSandboxAllowNetKey); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envSandboxAllowNetKey, v, err)
+		}
+		c.SandboxPolicy.AllowNet = b
+	}
+
+	if v := os.Getenv(envEnvCleanKey); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envEnvCleanKey, v, err)
+		}
+		c.EnvClean = b
+	}
+
+	if v, ok := os.LookupEnv(envEnvAllowlistKey); ok {
+		c.EnvAllowlist = splitList(v)
+	}
+
+	if v, ok := os.LookupEnv(envEnvDenylistKey); ok {
+		c.EnvDenylist = splitList(v)
+	}
+
+	if v := os.Getenv(envEgressProxyKey); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envEgressProxyKey, v, err)
+		}
+		c.EgressProxy = b
+	}
+
+	if v := os.Getenv(envStoreKey); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envStoreKey, v, err)
+		}
+		c.Store = b
+	}
+
+	if v := os.Getenv(envStoreBackendKey); v != "" {
+		c.StoreBackend = v
+	}
+
+	if v := os.Getenv(envStoreMaxKeysKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envStoreMaxKeysKey, v, err)
+		}
+		c.StoreMaxKeys = n
+	}
+
+	if v := os.Getenv(envStoreCacheSizeKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envStoreCacheSizeKey, v, err)
+		}
+		c.StoreCacheSize = n
+	}
+
+	if v := os.Getenv(envStoreCacheMaxBytesKey); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envStoreCacheMaxBytesKey, v, err)
+		}
+		c.StoreCacheMaxBytes = n
+	}
+
+	if v := os.Getenv(envStoreCacheTTLKey); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envStoreCacheTTLKey, v, err)
+		}
+		c.StoreCacheTTL = d
+	}
+
+	if v := os.Getenv(envEgressMaxCallsKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envEgressMaxCallsKey, v, err)
+		}
+		c.EgressBudget.MaxCalls = n
+	}
+
+	if v := os.Getenv(envEgressMaxTimeKey); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envEgressMaxTimeKey, v, err)
+		}
+		c.EgressBudget.MaxTime = d
+	}
+
+	if v, ok := os.LookupEnv(envEgressAllowKey); ok {
+		c.EgressBudget.Allow = splitList(v)
+	}
+
+	if v := os.Getenv(envStreamWriteTimeoutKey); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envStreamWriteTimeoutKey, v, err)
+		}
+		c.StreamWriteTimeout = d
+	}
+
+	if v := os.Getenv(envSlowClientPolicyKey); v != "" {
+		c.SlowClientPolicy = v
+	}
+
+	if v := os.Getenv(envPersistentKey); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envPersistentKey, v, err)
+		}
+		c.Persistent = b
+	}
+
+	if v := os.Getenv(envPersistentReadyTimeoutKey); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envPersistentReadyTimeoutKey, v, err)
+		}
+		c.PersistentReadyTimeout = d
+	}
+
+	if v := os.Getenv(envWorkerProtocolKey); v != "" {
+		c.WorkerProtocol = v
+	}
+
+	if v := os.Getenv(envWorkerMaxRSSKey); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envWorkerMaxRSSKey, v, err)
+		}
+		c.WorkerRecycle.MaxRSS = n
+	}
+
+	if v := os.Getenv(envWorkerMaxRequestsKey); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envWorkerMaxRequestsKey, v, err)
+		}
+		c.WorkerRecycle.MaxRequests = n
+	}
+
+	if v := os.Getenv(envWorkerCheckIntervalKey); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envWorkerCheckIntervalKey, v, err)
+		}
+		c.WorkerRecycle.Interval = d
+	}
+
+	if v := os.Getenv(envRegionKey); v != "" {
+		c.Locality.Region = v
+	}
+	if v := os.Getenv(envZoneKey); v != "" {
+		c.Locality.Zone = v
+	}
+
+	if v := os.Getenv(envLogLevelKey); v != "" {
+		c.LogLevel = v
+	}
+	if v := os.Getenv(envAdminTokenKey); v != "" {
+		c.AdminToken = v
+	}
+	if v := os.Getenv(envAdminListenKey); v != "" {
+		c.AdminListen = v
+	}
+	if v := os.Getenv(envDebugListenKey); v != "" {
+		c.DebugListen = v
+	}
+
+	if v, ok := os.LookupEnv(envCORSOriginsKey); ok {
+		c.CORS.Origins = splitList(v)
+	}
+	if v, ok := os.LookupEnv(envCORSMethodsKey); ok {
+		c.CORS.Methods = splitList(v)
+	}
+	if v, ok := os.LookupEnv(envCORSHeadersKey); ok {
+		c.CORS.Headers = splitList(v)
+	}
+	if v, ok := os.LookupEnv(envCORSExposeHeadersKey); ok {
+		c.CORS.ExposeHeaders = splitList(v)
+	}
+	if v := os.Getenv(envCORSMaxAgeKey); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envCORSMaxAgeKey, v, err)
+		}
+		c.CORS.MaxAge = d
+	}
+	if v := os.Getenv(envCORSCredentialsKey); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envCORSCredentialsKey, v, err)
+		}
+		c.CORS.Credentials = b
+	}
+	if v := os.Getenv(envScriptUploadKey); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s %q: %v", envScriptUploadKey, v, err)
+		}
+		c.ScriptUpload = b
+	}
+	if v, ok := os.LookupEnv(envFaultRoutesKey); ok {
+		c.FaultRoutes = splitList(v)
+	}
+
+	if v := os.Getenv(envOAuthTokenURLKey); v != "" {
+		c.OAuth.TokenURL = v
+	}
+	if v := os.Getenv(envOAuthClientIDKey); v != "" {
+		c.OAuth.ClientID = v
+	}
+	if v := os.Getenv(envOAuthClientSecretKey); v != "" {
+		c.OAuth.ClientSecret = v
+	}
+	if v := os.Getenv(envOAuthScopesKey); v != "" {
+		c.OAuth.Scopes = v
+	}
+	if v := os.Getenv(envOAuthAudienceKey); v != "" {
+		c.OAuth.Audience = v
+	}
+	if v := os.Getenv(envOAuthTokenFileKey); v != "" {
+		c.OAuth.TokenFile = v
+	}
+}
+
+func (c *Config) LoadFlags() {
+	c.registerFlags()
+	flag.Parse()
+	c.validateFlags()
+}
+
+// registerFlags defines the server's flags on flag.CommandLine, with c's
+// values as their defaults.
+func (c *Config) registerFlags() {
+	flag.IntVar(&c.Port, "port", c.Port, "port to listen on")
+	flag.StringVar(&c.Listen, "listen", c.Listen,
+		"address to listen on instead of --port: host:port, unix:///path/to.sock or systemd (default systemd when LISTEN_FDS is set)")
+	flag.Func("listen-mode",
+		fmt.Sprintf("permissions of a unix socket created by --listen (default %#o)", c.ListenMode),
+		func(v string) error {
+			m, err := strconv.ParseUint(v, 8, 32)
+			c.ListenMode = os.FileMode(m)
+			return err
+		})
+
+	flag.StringVar(&c.InlineScript, "script", c.InlineScript,
+		"inline JavaScript to evaluate (mutually exclusive with --script-file, --script-dir, --config)")
+	flag.StringVar(&c.ScriptFile, "script-file", c.ScriptFile,
+		"path to JavaScript or TypeScript file to run (mutually exclusive with --script, --script-dir, --config)")
+	flag.StringVar(&c.ScriptDir, "script-dir", c.ScriptDir,
+		"directory of scripts; POST /invoke/foo/bar runs foo/bar.js (mutually exclusive with --script, --script-file, --config)")
+	flag.StringVar(&c.ConfigFile, "config", c.ConfigFile,
+		"YAML file declaring routes served at /invoke/<name>, reloaded on SIGHUP (mutually exclusive with --script, --script-file, --script-dir)")
+	flag.BoolVar(&c.StrictConfig, "strict-config", c.StrictConfig,
+		"fail on unknown or misspelled keys in the --config file")
+	flag.StringVar(&c.Profile, "profile", c.Profile,
+		"merge the overlay for this profile over the --config file, e.g. prod merges config.prod.yaml over config.yaml")
+	flag.BoolVar(&c.Check, "check", c.Check,
+		"check node, the scripts, env files and listen addresses, print a summary and exit non-zero on any problem")
+	flag.BoolVar(&c.HelpJSON, "help-json", c.HelpJSON,
+		"print the flags and subcommands as JSON and exit")
+
+	envFileSet := false
+	flag.Func("env-file",
+		"path to .env file for the script; repeat for several, later files overriding earlier ones",
+		func(v string) error {
+			if !envFileSet {
+				c.EnvFiles, envFileSet = nil, true
+			}
+			c.EnvFiles = append(c.EnvFiles, v)
+			return nil
+		})
+	flag.DurationVar(&c.Timeout, "timeout", c.Timeout,
+		"timeout for node invocation (e.g. 30s, 1m)")
+	flag.IntVar(&c.TimeoutStatus, "timeout-status", c.TimeoutStatus,
+		"HTTP status of responses to invocations killed by their timeout, answered with a JSON error (500-599)")
+	flag.StringVar(&c.SchemaFile, "schema", c.SchemaFile,
+		"path to JSON Schema that payloads are validated against (optional)")
+
+	flag.IntVar(&c.Warmup, "warmup", c.Warmup,
+		"number of invocations to run before accepting traffic")
+	flag.StringVar(&c.WarmupPayload, "warmup-payload", c.WarmupPayload,
+		"JSON payload used for warmup invocations")
+
+	flag.DurationVar(&c.ProbeInterval, "probe-interval", c.ProbeInterval,
+		"interval between synthetic health probe invocations reported by /readyz and /metrics (0 disables)")
+	flag.StringVar(&c.ProbePayload, "probe-payload", c.ProbePayload,
+		"JSON payload used for health probes")
+
+	flag.DurationVar(&c.DependencyCheckInterval, "dependency-check-interval", c.DependencyCheckInterval,
+		"how often dependencies declared in --config are rechecked for /readyz")
+
+	flag.IntVar(&c.Concurrency, "concurrency", c.Concurrency,
+		"maximum number of node processes running at once (0 = unlimited)")
+	flag.IntVar(&c.BatchParallelism, "batch-parallelism", c.BatchParallelism,
+		"maximum number of items of one /invoke/batch request in flight at once")
+
+	flag.Func("forward-headers",
+		"comma separated request headers exposed to scripts via "+headersEnvKey+` (default "`+strings.Join(c.ForwardHeaders, ",")+`")`,
+		func(v string) error {
+			c.ForwardHeaders = splitList(v)
+			return nil
+		})
+
+	flag.DurationVar(&c.KeepaliveInterval, "keepalive-interval", c.KeepaliveInterval,
+		"interval between keep-alive pings on streamed responses (0 disables)")
+	flag.Func("raw-content-types",
+		`comma separated request media types piped to the script unparsed, e.g. "image/*,text/csv" (default "`+strings.Join(c.RawContentTypes, ",")+`")`,
+		func(v string) error {
+			c.RawContentTypes = splitList(v)
+			return nil
+		})
+	flag.StringVar(&c.RawResponseType, "raw-response-type", c.RawResponseType,
+		"Content-Type of the output of raw invocations")
+	flag.Func("max-upload-size",
+		fmt.Sprintf("maximum size of a multipart/form-data request, webhook delivery or decompressed gzip request, e.g. 10M (default %d, 0 = unlimited)", c.MaxUploadSize),
+		func(v string) error {
+			n, err := parseByteSize(v)
+			c.MaxUploadSize = n
+			return err
+		})
+	flag.Func("compress-min-size",
+		fmt.Sprintf("gzip JSON responses of at least this size for clients accepting it, e.g. 4K (default %d, 0 disables)", c.CompressMinSize),
+		func(v string) error {
+			n, err := parseByteSize(v)
+			c.CompressMinSize = n
+			return err
+		})
+	flag.IntVar(&c.Connections.Max, "max-connections", c.Connections.Max,
+		"maximum number of open client connections; further ones wait to be accepted (0 = unlimited)")
+	flag.IntVar(&c.Connections.PerIP, "max-connections-per-ip", c.Connections.PerIP,
+		"maximum number of open connections from one client IP; further ones are closed (0 = unlimited)")
+	flag.DurationVar(&c.HTTPIdleTimeout, "http-idle-timeout", c.HTTPIdleTimeout,
+		"how long an idle keep-alive connection is kept open")
+	flag.BoolVar(&c.HTTPKeepAlives, "http-keep-alives", c.HTTPKeepAlives,
+		"reuse client connections for several requests; false closes them after every response")
+	flag.DurationVar(&c.HTTPTimeoutMargin, "http-timeout-margin", c.HTTPTimeoutMargin,
+		"time reading a request and writing its response may take beyond the invocation's timeouts and retries")
+	flag.StringVar(&c.TLS.CertFile, "tls-cert", c.TLS.CertFile,
+		"serve over TLS with this certificate file, letting clients negotiate HTTP/2")
+	flag.StringVar(&c.TLS.KeyFile, "tls-key", c.TLS.KeyFile,
+		"TLS private key file")
+	flag.BoolVar(&c.HTTP2, "http2", c.HTTP2,
+		"let TLS clients negotiate HTTP/2")
+	flag.BoolVar(&c.H2C, "h2c", c.H2C,
+		"accept HTTP/2 without TLS (h2c prior knowledge), for plaintext deployments behind a proxy")
+	flag.StringVar(&c.HTTP3.Listen, "http3-listen", c.HTTP3.Listen,
+		"experimental: also serve HTTP/3 (QUIC) on this UDP address, e.g. :8443")
+	flag.StringVar(&c.HTTP3.CertFile, "http3-cert", c.HTTP3.CertFile,
+		"TLS certificate file of the HTTP/3 listener (default --tls-cert)")
+	flag.StringVar(&c.HTTP3.KeyFile, "http3-key", c.HTTP3.KeyFile,
+		"TLS private key file of the HTTP/3 listener (default --tls-key)")
+	flag.BoolVar(&c.CoercePayload, "coerce-payload", c.CoercePayload,
+		`coerce payloads towards their JSON Schema before validating, e.g. "5" to 5, filling in defaults`)
+	flag.BoolVar(&c.FakeClock, "fake-clock", c.FakeClock,
+		"let requests set the time scripts' Date starts at with the "+clockHeader+" header, for testing; don't enable in production")
+	flag.BoolVar(&c.Deterministic, "deterministic", c.Deterministic,
+		"run scripts with a frozen clock and seeded randomness, returned in the "+clockHeader+" and "+seedHeader+" response headers so resending them replays an invocation; for debugging")
+	flag.StringVar(&c.TenantHeader, "tenant-header", c.TenantHeader,
+		"request header whose value scripts see as the tenant in "+contextEnvKey+", e.g. X-Tenant-Id")
+	flag.BoolVar(&c.TrustPriorityHeader, "trust-priority-header", c.TrustPriorityHeader,
+		"honor "+priorityHeader+" from callers that didn't authenticate, e.g. behind a gateway that sets or strips it")
+	flag.DurationVar(&c.CacheTTL, "cache-ttl", c.CacheTTL,
+		"cache successful outputs keyed by script and payload for this long (0 disables; scripts must be idempotent)")
+	flag.IntVar(&c.CacheSize, "cache-size", c.CacheSize,
+		"maximum number of cached outputs")
+	flag.StringVar(&c.CacheBackend, "cache-backend", c.CacheBackend,
+		"where cached outputs and --store cache entries are kept: memory, or a redis://, postgres:// or sqlite: URL to share them between servers")
+	flag.IntVar(&c.Retry.Attempts, "retry-attempts", c.Retry.Attempts,
+		"total attempts for a failing buffered invocation (1 disables retries)")
+	flag.DurationVar(&c.Retry.Backoff, "retry-backoff", c.Retry.Backoff,
+		"delay before the first retry, doubled after each")
+	flag.Func("retry-on",
+		`comma separated exit codes and "timeout" that are retried (default any failure)`,
+		func(v string) error {
+			c.Retry.On = splitList(v)
+			return nil
+		})
+	flag.IntVar(&c.Breaker.Failures, "breaker-failures", c.Breaker.Failures,
+		"failed invocations of a route within --breaker-window that make it answer 503 for --breaker-cooldown (0 disables)")
+	flag.DurationVar(&c.Breaker.Window, "breaker-window", c.Breaker.Window,
+		"window in which --breaker-failures are counted")
+	flag.DurationVar(&c.Breaker.Cooldown, "breaker-cooldown", c.Breaker.Cooldown,
+		"how long an open circuit rejects invocations before letting a trial through")
+	flag.IntVar(&c.Limits.MaxOldSpaceSize, "node-max-old-space-size", c.Limits.MaxOldSpaceSize,
+		"V8 old-space heap limit per node process, in MiB (0 = node default)")
+	flag.Func("memory-limit",
+		"memory limit per invocation, e.g. 256M (requires --cgroup-parent)",
+		func(v string) error {
+			n, err := parseByteSize(v)
+			c.Limits.Memory = n
+			return err
+		})
+	flag.IntVar(&c.Limits.CPUWeight, "cpu-weight", c.Limits.CPUWeight,
+		"relative CPU weight per invocation, 1-10000 (requires --cgroup-parent)")
+	flag.IntVar(&c.Limits.Pids, "pids-limit", c.Limits.Pids,
+		"maximum processes and threads per invocation (requires --cgroup-parent)")
+	flag.StringVar(&c.Limits.CgroupParent, "cgroup-parent", c.Limits.CgroupParent,
+		"delegated cgroup v2 directory under which per-invocation cgroups are created")
+	flag.Func("max-output-bytes",
+		"maximum stdout buffered per invocation, e.g. 10M (0 = unlimited); see --output-limit-policy",
+		func(v string) error {
+			n, err := parseByteSize(v)
+			c.Limits.MaxOutput = n
+			return err
+		})
+	flag.StringVar(&c.Limits.OutputPolicy, "output-limit-policy", c.Limits.OutputPolicy,
+		"what happens to output over --max-output-bytes: kill the script and answer 502, or truncate it and set "+outputTruncatedHeader)
+	flag.StringVar(&c.Executor, "executor", c.Executor,
+		"where scripts run: local, as child processes, or docker, in a container per invocation or persistent worker")
+	flag.StringVar(&c.Docker.Image, "docker-image", c.Docker.Image,
+		"container image scripts run in with --executor docker; its node should match the host's")
+	flag.StringVar(&c.Docker.Network, "docker-network", c.Docker.Network,
+		"docker network of script containers, e.g. none to keep scripts offline (default: docker's)")
+	flag.Func("docker-mount",
+		"comma separated extra volumes of script containers, as host:path or host:path:ro",
+		func(v string) error {
+			c.Docker.Mounts = splitList(v)
+			return nil
+		})
+	flag.StringVar(&c.DeadLetterDir, "dead-letter-dir", c.DeadLetterDir,
+		"keep invocations that failed after their retries in a SQLite database in this directory, sqlite:FILE, or redis:// or postgres:// to share them between servers, for re-driving through /admin/dead-letters")
+	flag.StringVar(&c.IdempotencyDir, "idempotency-dir", c.IdempotencyDir,
+		"run requests carrying the same "+idempotencyKeyHeader+" once, keeping keys and outputs across restarts in a SQLite database in this directory, sqlite:FILE, or redis:// or postgres:// to share them between servers")
+	flag.DurationVar(&c.IdempotencyTTL, "idempotency-ttl", c.IdempotencyTTL,
+		"how long the output of a request with an "+idempotencyKeyHeader+" is replayed to repeats")
+	flag.Func("callback-allow-hosts",
+		`comma separated host patterns, e.g. "*.example.com", that asynchronous invocations may deliver results to via ?`+callbackParam+`=`,
+		func(v string) error {
+			c.Callbacks.AllowHosts = splitList(v)
+			return nil
+		})
+	flag.StringVar(&c.Callbacks.SecretFile, "callback-secret-file", c.Callbacks.SecretFile,
+		"file holding the secret callback deliveries are signed with; re-read on every delivery")
+	flag.IntVar(&c.Callbacks.Attempts, "callback-attempts", c.Callbacks.Attempts,
+		"maximum number of attempts to deliver a callback")
+	flag.DurationVar(&c.Callbacks.Backoff, "callback-backoff", c.Callbacks.Backoff,
+		"delay before the first callback retry; it doubles after each, up to a minute")
+	flag.StringVar(&c.Signing.Mode, "response-signing", c.Signing.Mode,
+		"sign successful invocation responses: hmac, in the "+responseSignatureHeader+" header, or jws, a detached JWS in "+responseJWSHeader)
+	flag.StringVar(&c.Signing.KeyFile, "response-signing-key-file", c.Signing.KeyFile,
+		"file holding the --response-signing key: the HMAC secret, or a PEM Ed25519, ECDSA P-256 or RSA private key")
+	flag.StringVar(&c.PayloadDecryptionKeyFile, "payload-decryption-key-file", c.PayloadDecryptionKeyFile,
+		"accept JWE payloads sent as "+joseContentType+", decrypted with the PEM RSA or ECDSA P-256 private key, or base64 dir key, in this file")
+	flag.BoolVar(&c.Analytics, "analytics", c.Analytics,
+		"collect per-route payload and response sizes and top-level payload keys, served at /admin/analytics")
+	flag.StringVar(&c.Audit.Sink, "audit-log", c.Audit.Sink,
+		"append a JSON line per invocation to this file, POST them in batches to this http(s) URL, or store them at a redis://, postgres:// or sqlite: URL")
+	flag.StringVar(&c.Audit.Payload, "audit-payload", c.Audit.Payload,
+		"how payloads are recorded in the audit log: hash (SHA-256), full or none")
+	flag.Func("audit-redact",
+		`comma separated payload paths masked in the audit log with --audit-payload=full, e.g. "password,cards.*.number"`,
+		func(v string) error {
+			c.Audit.Redact = splitList(v)
+			return nil
+		})
+	flag.Func("audit-log-max-size",
+		fmt.Sprintf("rotate the --audit-log file once it reaches this size, e.g. 50M (default %d, 0 = never)", c.Audit.MaxSize),
+		func(v string) error {
+			n, err := parseByteSize(v)
+			c.Audit.MaxSize = n
+			return err
+		})
+	flag.IntVar(&c.Audit.MaxFiles, "audit-log-max-files", c.Audit.MaxFiles,
+		"number of rotated --audit-log files kept")
+	flag.StringVar(&c.Sampling.Sink, "sample-sink", c.Sampling.Sink,
+		"forward a sample of payloads and responses as JSON lines to this file, http(s) URL or s3://bucket/prefix")
+	flag.Float64Var(&c.Sampling.Rate, "sample-rate", c.Sampling.Rate,
+		"fraction of invocations forwarded to --sample-sink")
+	flag.Func("sample-redact",
+		`comma separated paths masked in sampled payloads and responses, e.g. "email,cards.*.number"`,
+		func(v string) error {
+			c.Sampling.Redact = splitList(v)
+			return nil
+		})
+	flag.StringVar(&c.NodePath, "node-path", c.NodePath,
+		"node executable scripts run with (default: node from PATH, then nvm and asdf installs)")
+	flag.Func("require-node-version",
+		`refuse to start unless node's version satisfies this range, e.g. ">=20 <23"`,
+		func(v string) error {
+			vc, err := parseVersionConstraint(v)
+			c.RequireNodeVersion = vc
+			return err
+		})
+	flag.StringVar(&c.NodeVersionMismatch, "node-version-mismatch", c.NodeVersionMismatch,
+		"what to do when node is missing or fails --require-node-version: fail or warn")
+	flag.StringVar(&c.PackageJSON, "package-json", c.PackageJSON,
+		"install this package.json's dependencies with npm before serving, pinned by the package-lock.json next to it")
+	flag.StringVar(&c.PackagesDir, "packages-dir", c.PackagesDir,
+		"directory --package-json installs are kept and reused in (default: the user cache directory)")
+	flag.Func("node-require",
+		"comma separated modules preloaded into every script with --require in NODE_OPTIONS, e.g. ./otel.js",
+		func(v string) error {
+			c.NodeRequire = splitList(v)
+			return nil
+		})
+	flag.StringVar(&c.CompileCacheDir, "compile-cache-dir", c.CompileCacheDir,
+		"directory node caches compiled scripts in across invocations (NODE_COMPILE_CACHE, node 22.1 or newer)")
+	flag.BoolVar(&c.Workdir.Isolate, "isolate-workdir", c.Workdir.Isolate,
+		"run each invocation in a fresh temporary working directory, removed afterwards")
+	flag.StringVar(&c.Workdir.Template, "workdir-template", c.Workdir.Template,
+		"directory copied into each invocation's working directory (implies --isolate-workdir)")
+	flag.BoolVar(&c.Sandbox, "sandbox", c.Sandbox,
+		"run scripts under Node's permission model; only the script's directory and --sandbox-allow-* paths are accessible")
+	flag.Func("sandbox-allow-fs-read",
+		"comma separated paths sandboxed scripts may read",
+		func(v string) error {
+			c.SandboxPolicy.AllowFSRead = splitList(v)
+			return nil
+		})
+	flag.Func("sandbox-allow-fs-write",
+		"comma separated paths sandboxed scripts may write",
+		func(v string) error {
+			c.SandboxPolicy.AllowFSWrite = splitList(v)
+			return nil
+		})
+	flag.BoolVar(&c.SandboxPolicy.AllowNet, "sandbox-allow-net", c.SandboxPolicy.AllowNet,
+		"allow sandboxed scripts network access (only enforced by node versions supporting --allow-net)")
+	flag.BoolVar(&c.SandboxPolicy.AllowChildProcess, "sandbox-allow-child-process", c.SandboxPolicy.AllowChildProcess,
+		"allow sandboxed scripts to spawn processes")
+	flag.BoolVar(&c.SandboxPolicy.AllowWorker, "sandbox-allow-worker", c.SandboxPolicy.AllowWorker,
+		"allow sandboxed scripts to start worker threads")
+	flag.BoolVar(&c.EnvClean, "env-clean", c.EnvClean,
+		"pass scripts only PATH, HOME, locale and similar basics of the server environment, plus --env-allowlist")
+	flag.Func("env-allowlist",
+		`comma separated server variables, or patterns like "AWS_*", scripts inherit (implies --env-clean)`,
+		func(v string) error {
+			c.EnvAllowlist = splitList(v)
+			return nil
+		})
+	flag.Func("env-denylist",
+		`comma separated server variables, or patterns like "*_SECRET", withheld from scripts even when allowed`,
+		func(v string) error {
+			c.EnvDenylist = splitList(v)
+			return nil
+		})
+	flag.BoolVar(&c.Store, "store", c.Store,
+		"serve a shared key/value and pub/sub store to scripts on the unix socket in "+storeSocketEnvKey)
+	flag.StringVar(&c.StoreBackend, "store-backend", c.StoreBackend,
+		"where --store keys are kept: memory, sqlite:FILE to keep them across restarts, or redis:// or postgres:// to share them between servers")
+	flag.IntVar(&c.StoreMaxKeys, "store-max-keys", c.StoreMaxKeys,
+		"maximum number of keys in the memory --store-backend (0 = unlimited)")
+	flag.IntVar(&c.StoreCacheSize, "store-cache-size", c.StoreCacheSize,
+		"maximum entries in the --store cache, evicting least recently used (0 disables the cache)")
+	flag.Func("store-cache-max-bytes",
+		fmt.Sprintf("maximum total size of the --store cache, e.g. 64M (default %d, 0 = unlimited)", c.StoreCacheMaxBytes),
+		func(v string) error {
+			n, err := parseByteSize(v)
+			c.StoreCacheMaxBytes = n
+			return err
+		})
+	flag.DurationVar(&c.StoreCacheTTL, "store-cache-ttl", c.StoreCacheTTL,
+		"default and maximum lifetime of --store cache entries (0 disables the cache)")
+	flag.BoolVar(&c.EgressProxy, "egress-proxy", c.EgressProxy,
+		"route script HTTP(S) calls through a local proxy (via HTTP_PROXY) that enforces and logs the --egress-* budget")
+	flag.IntVar(&c.EgressBudget.MaxCalls, "egress-max-calls", c.EgressBudget.MaxCalls,
+		"maximum downstream calls per invocation (0 = unlimited)")
+	flag.DurationVar(&c.EgressBudget.MaxTime, "egress-max-time", c.EgressBudget.MaxTime,
+		"maximum total time in downstream calls per invocation (0 = unlimited)")
+	flag.Func("egress-allow",
+		"comma separated destination host patterns scripts may call, e.g. *.example.com (default any)",
+		func(v string) error {
+			c.EgressBudget.Allow = splitList(v)
+			return nil
+		})
+	flag.DurationVar(&c.StreamWriteTimeout, "stream-write-timeout", c.StreamWriteTimeout,
+		"deadline for each write of a streamed response before the client is considered stalled (0 disables)")
+	flag.StringVar(&c.SlowClientPolicy, "slow-client-policy", c.SlowClientPolicy,
+		"what to do when a streaming client reads slower than the script writes: disconnect or spool (buffer to disk)")
+
+	flag.BoolVar(&c.Persistent, "persistent", c.Persistent,
+		"start the script once and proxy invocations to it over --worker-protocol")
+	flag.DurationVar(&c.PersistentReadyTimeout, "persistent-ready-timeout", c.PersistentReadyTimeout,
+		"how long to wait for a persistent script to become ready")
+	flag.StringVar(&c.WorkerProtocol, "worker-protocol", c.WorkerProtocol,
+		"how persistent scripts are invoked: http (a server on the unix socket in "+socketEnvKey+") or stdio (JSON lines over stdin and stdout, see "+workerClientEnvKey+")")
+	flag.Func("worker-max-rss",
+		fmt.Sprintf("restart a persistent worker, once its invocations in flight finished, when its processes use more memory than this, e.g. 512M (default %d, 0 = unlimited)", c.WorkerRecycle.MaxRSS),
+		func(v string) error {
+			n, err := parseByteSize(v)
+			c.WorkerRecycle.MaxRSS = n
+			return err
+		})
+	flag.Int64Var(&c.WorkerRecycle.MaxRequests, "worker-max-requests", c.WorkerRecycle.MaxRequests,
+		"restart a persistent worker, once its invocations in flight finished, after it served this many (0 = unlimited)")
+	flag.DurationVar(&c.WorkerRecycle.Interval, "worker-check-interval", c.WorkerRecycle.Interval,
+		"how often the memory of persistent workers is checked against --worker-max-rss")
+
+	flag.StringVar(&c.Locality.Region, "region", c.Locality.Region,
+		"region this server runs in, stamped onto logs, metrics, traces, response headers and "+regionEnvKey)
+	flag.StringVar(&c.Locality.Zone, "zone", c.Locality.Zone,
+		"availability zone this server runs in, stamped like --region and passed to scripts as "+zoneEnvKey)
+
+	flag.StringVar(&c.LogLevel, "log-level", c.LogLevel,
+		"info, or error to log only failures")
+	flag.StringVar(&c.AdminToken, "admin-token", c.AdminToken,
+		"bearer token required by the /admin API (prefer the "+envAdminTokenKey+" environment variable)")
+	flag.StringVar(&c.AdminListen, "admin-listen", c.AdminListen,
+		"serve the /admin API on this separate address instead of the main listener (same forms as --listen)")
+	flag.StringVar(&c.DebugListen, "debug-listen", c.DebugListen,
+		"serve pprof profiles and runtime stats of the server on this separate address, e.g. localhost:6060, behind --admin-token if set")
+
+	flag.Func("cors-origins",
+		`comma separated origins browsers may call the invoke endpoints from, e.g. "https://app.example.com,https://*.example.com", or * for any`,
+		func(v string) error {
+			c.CORS.Origins = splitList(v)
+			return nil
+		})
+	flag.Func("cors-methods",
+		fmt.Sprintf("comma separated methods allowed by CORS preflights (default %q)", strings.Join(c.CORS.Methods, ",")),
+		func(v string) error {
+			c.CORS.Methods = splitList(v)
+			return nil
+		})
+	flag.Func("cors-headers",
+		fmt.Sprintf("comma separated request headers allowed by CORS preflights, or * for any (default %q)", strings.Join(c.CORS.Headers, ",")),
+		func(v string) error {
+			c.CORS.Headers = splitList(v)
+			return nil
+		})
+	flag.Func("cors-expose-headers",
+		"comma separated response headers browsers let cross-origin callers read, e.g. X-Request-Id",
+		func(v string) error {
+			c.CORS.ExposeHeaders = splitList(v)
+			return nil
+		})
+	flag.DurationVar(&c.CORS.MaxAge, "cors-max-age", c.CORS.MaxAge,
+		"how long browsers may cache a CORS preflight answer")
+	flag.BoolVar(&c.CORS.Credentials, "cors-credentials", c.CORS.Credentials,
+		"let cross-origin browsers send cookies and HTTP authentication; requires explicit --cors-origins")
+	flag.BoolVar(&c.ScriptUpload, "script-upload", c.ScriptUpload,
+		"accept versioned script uploads into --script-dir at /scripts/<name>, with the same credentials as /admin")
+	flag.Func("fault-routes",
+		`comma separated route names or patterns, e.g. "checkout,billing/*", the /admin API may inject failure and latency into for game days`,
+		func(v string) error {
+			c.FaultRoutes = splitList(v)
+			return nil
+		})
+
+	flag.StringVar(&c.OAuth.TokenURL, "oauth-token-url", c.OAuth.TokenURL,
+		"OAuth2 token endpoint for client-credentials tokens exposed to scripts (optional)")
+	flag.StringVar(&c.OAuth.ClientID, "oauth-client-id", c.OAuth.ClientID,
+		"OAuth2 client ID")
+	flag.StringVar(&c.OAuth.ClientSecret, "oauth-client-secret", c.OAuth.ClientSecret,
+		"OAuth2 client secret (prefer the "+envOAuthClientSecretKey+" environment variable)")
+	flag.StringVar(&c.OAuth.Scopes, "oauth-scopes", c.OAuth.Scopes,
+		"space or comma separated OAuth2 scopes to request")
+	flag.StringVar(&c.OAuth.Audience, "oauth-audience", c.OAuth.Audience,
+		"OAuth2 audience parameter (optional)")
+	flag.StringVar(&c.OAuth.TokenFile, "oauth-token-file", c.OAuth.TokenFile,
+		"also write the current access token to this file (optional)")
+}
+
+func (c *Config) validateFlags() {
+	if c.scriptSources() > 1 {
+		log.Fatal("must provide only one of --script, --script-file, --script-dir or --config")
+	}
+
+	if c.SlowClientPolicy != slowClientDisconnect && c.SlowClientPolicy != slowClientSpool {
+		log.Fatalf("invalid --slow-client-policy %q: must be %s or %s", c.SlowClientPolicy, slowClientDisconnect, slowClientSpool)
+	}
+
+	if c.TimeoutStatus < 500 || c.TimeoutStatus > 599 {
+		log.Fatalf("invalid --timeout-status %d: must be a 5xx status", c.TimeoutStatus)
+	}
+
+	if c.Connections.Max < 0 || c.Connections.PerIP < 0 || c.HTTPIdleTimeout <= 0 || c.HTTPTimeoutMargin <= 0 {
+		log.Fatal("--max-connections and --max-connections-per-ip must not be negative, and --http-idle-timeout and --http-timeout-margin must be positive")
+	}
+
+	if err := c.TLS.validate(); err != nil {
+		log.Fatal(err)
+	}
+	if c.HTTP3.CertFile == "" && c.HTTP3.KeyFile == "" {
+		c.HTTP3.CertFile, c.HTTP3.KeyFile = c.TLS.CertFile, c.TLS.KeyFile
+	}
+	if err := c.HTTP3.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := c.Retry.validate(); err != nil {
+		log.Fatalf("invalid --retry-on: %v", err)
+	}
+
+	if err := c.Breaker.validate(); err != nil || c.Breaker.Window <= 0 || c.Breaker.Cooldown <= 0 {
+		log.Fatal("--breaker-failures must not be negative, and --breaker-window and --breaker-cooldown must be positive")
+	}
+
+	if err := c.Limits.validate(c.Executor == executorLocal); err != nil {
+		log.Fatalf("invalid resource limits: %v", err)
+	}
+
+	switch c.Executor {
+	case executorLocal:
+	case executorDocker:
+		if err := c.Docker.validate(); err != nil {
+			log.Fatalf("invalid docker executor: %v", err)
+		}
+	default:
+		log.Fatalf("invalid --executor %q: must be %s or %s", c.Executor, executorLocal, executorDocker)
+	}
+
+	if c.NodeVersionMismatch != nodeVersionFail && c.NodeVersionMismatch != nodeVersionWarn {
+		log.Fatalf("invalid --node-version-mismatch %q: must be %s or %s", c.NodeVersionMismatch, nodeVersionFail, nodeVersionWarn)
+	}
+
+	if err := c.Callbacks.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := c.Signing.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := c.Audit.validate(); err != nil {
+		log.Fatalf("invalid audit log settings: %v", err)
+	}
+
+	if c.Sampling.Sink != "" {
+		if err := c.Sampling.validate(); err != nil {
+			log.Fatalf("invalid sampling settings: %v", err)
+		}
+	}
+
+	if err := c.Workdir.validate(); err != nil {
+		log.Fatalf("invalid --workdir-template: %v", err)
+	}
+
+	if c.Profile != "" && (c.ConfigFile == "" || !validProfile(c.Profile)) {
+		log.Fatal("--profile requires --config and must be a plain name such as prod")
+	}
+
+	if !validWorkerProtocol(c.WorkerProtocol) {
+		log.Fatalf("invalid --worker-protocol %q: must be %s or %s", c.WorkerProtocol, workerProtocolHTTP, workerProtocolStdio)
+	}
+
+	if err := c.CORS.validate(); err != nil {
+		log.Fatalf("invalid CORS policy: %v", err)
+	}
+
+	if c.WorkerRecycle.MaxRSS < 0 || c.WorkerRecycle.MaxRequests < 0 || c.WorkerRecycle.Interval <= 0 {
+		log.Fatal("--worker-max-rss and --worker-max-requests must not be negative, and --worker-check-interval must be positive")
+	}
+
+	if c.Persistent && c.ScriptDir != "" {
+		log.Fatal("--persistent cannot be combined with --script-dir")
+	}
+
+	if c.ScriptUpload && c.ScriptDir == "" {
+		log.Fatal("--script-upload requires --script-dir")
+	}
+
+	if c.IdempotencyTTL <= 0 {
+		log.Fatal("--idempotency-ttl must be positive")
+	}
+
+	if c.Analytics && c.AdminToken == "" && c.AdminListen == "" {
+		log.Fatal("--analytics requires --admin-token or --admin-listen")
+	}
+
+	if c.ScriptUpload && c.AdminToken == "" && c.AdminListen == "" {
+		log.Fatal("--script-upload requires --admin-token or --admin-listen")
+	}
+
+	if len(c.FaultRoutes) > 0 && c.AdminToken == "" && c.AdminListen == "" {
+		log.Fatal("--fault-routes requires --admin-token or --admin-listen")
+	}
+	for _, p := range c.FaultRoutes {
+		if _, err := path.Match(p, ""); err != nil {
+			log.Fatalf("invalid --fault-routes pattern %q: %v", p, err)
+		}
+	}
+
+	if _, err := newEnvFilter(c.EnvClean, c.EnvAllowlist, c.EnvDenylist); err != nil {
+		log.Fatalf("invalid --env-allowlist or --env-denylist: %v", err)
+	}
+
+	if c.Warmup > 0 && !json.Valid([]byte(c.WarmupPayload)) {
+		log.Fatalf("invalid --warmup-payload: not valid JSON")
+	}
+
+	if c.DependencyCheckInterval <= 0 {
+		log.Fatal("--dependency-check-interval must be positive")
+	}
+
+	if c.ProbeInterval > 0 && !json.Valid([]byte(c.ProbePayload)) {
+		log.Fatalf("invalid --probe-payload: not valid JSON")
+	}
+
+	if err := c.Locality.validate(); err != nil {
+		log.Fatalf("invalid --region or --zone: %v", err)
+	}
+
+	if err := setLogLevel(c.LogLevel); err != nil {
+		log.Fatalf("invalid --log-level: %v", err)
+	}
+
+	if c.OAuth.Enabled() && c.OAuth.ClientID == "" {
+		log.Fatal("--oauth-client-id is required when --oauth-token-url is set")
+	}
+}
+
+// scriptSources counts how many of the mutually exclusive script options
+// are set.
+func (c *Config) scriptSources() int {
+	n := 0
+	for _, v := range []string{c.InlineScript, c.ScriptFile, c.ScriptDir, c.ConfigFile} {
+		if v != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// splitList splits a comma separated option value, dropping empty entries.
+func splitList(v string) []string {
+	var out []string
+	for _, part := range strings.Split(v, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
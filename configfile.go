@@ -0,0 +1,649 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileConfig is the YAML configuration file passed with --config.
+type FileConfig struct {
+	Routes    map[string]RouteConfig `yaml:"routes"`
+	Schedules []ScheduleConfig       `yaml:"schedules"`
+	// Tenants declare further routes in namespaces of their own; see
+	// TenantConfig.
+	Tenants map[string]TenantConfig `yaml:"tenants"`
+	// Scripts is a library of inline snippets served as routes named
+	// after them; see addSnippets.
+	Scripts map[string]string `yaml:"scripts"`
+}
+
+// ScheduleConfig invokes a route on a cron schedule, like a cron entry in
+// the route's triggers, for keeping every schedule in one place:
+//
+//	schedules:
+//	  - cron: "0 3 * * *"
+//	    route: /invoke/cleanup      # or just cleanup
+//	    payload: {older_than: 30}
+//	    jitter: 5m
+type ScheduleConfig struct {
+	Cron     string        `yaml:"cron"`
+	Route    string        `yaml:"route"`
+	Timezone string        `yaml:"timezone"`
+	Payload  any           `yaml:"payload"`
+	Jitter   time.Duration `yaml:"jitter"`
+}
+
+// RouteConfig declares one route. Several routes may share a script file
+// and differ only in the environment they run it with.
+type RouteConfig struct {
+	Script     string `yaml:"script"`
+	ScriptFile string `yaml:"script_file"`
+	// EnvFile is an env file, or a list of them; see loadEnvFiles.
+	EnvFile stringList `yaml:"env_file"`
+	Schema  string     `yaml:"schema"`
+	// ResponseSchema describes the script's output for contract-test.
+	ResponseSchema string `yaml:"response_schema"`
+	// Coerce converts payloads towards the schema before validating
+	// them, e.g. "5" to 5 for an integer property, and fills in defaults.
+	Coerce bool `yaml:"coerce"`
+	// Env holds literal variables added to the script environment.
+	Env map[string]string `yaml:"env"`
+	// SecretFiles maps variable names to files whose contents become the
+	// value; they are read on every invocation so rotated secrets apply
+	// without a restart.
+	SecretFiles map[string]string `yaml:"secret_files"`
+	Persistent  bool              `yaml:"persistent"`
+	// WorkerProtocol is http or stdio; see Worker.
+	WorkerProtocol string         `yaml:"worker_protocol"`
+	Retry          *RetryPolicy   `yaml:"retry"`
+	Breaker        *BreakerPolicy `yaml:"breaker"`
+	// Raw skips JSON parsing and streams every request body to the
+	// script; ContentType is the Content-Type of its output.
+	Raw         bool   `yaml:"raw"`
+	ContentType string `yaml:"content_type"`
+	// StreamEvents turns the script's "@@progress {...}" lines into SSE
+	// events; see eventLine.
+	StreamEvents bool `yaml:"stream_events"`
+	// Encryption is required or script; see Route.Encryption.
+	Encryption string `yaml:"encryption"`
+	// Sandbox enables Node's permission model for this route; paths are
+	// relative to the config file.
+	Sandbox *Sandbox `yaml:"sandbox"`
+	// Workdir runs each invocation in a fresh scratch directory, seeded
+	// from a template relative to the config file.
+	Workdir *Workdir `yaml:"workdir"`
+	// Proxy routes the script's HTTP(S) calls through a forward proxy, or
+	// keeps them off the server's; see RouteProxy.
+	Proxy *RouteProxy `yaml:"proxy"`
+	// Hosts points host names the script resolves at other IP addresses
+	// or names, e.g. api.example.com: 10.0.4.12 to test against staging.
+	Hosts map[string]string `yaml:"hosts"`
+	// Depends declares the URLs, DNS names and environment variables the
+	// script needs; see Dependencies.
+	Depends *Dependencies `yaml:"depends"`
+	// Webhook verifies and normalizes deliveries from a known provider.
+	Webhook *WebhookConfig `yaml:"webhook"`
+	// Dedupe runs each payload with the same key once.
+	Dedupe *DedupeConfig `yaml:"dedupe"`
+	// CORS overrides the server's --cors-* policy when set.
+	CORS *CORSPolicy `yaml:"cors"`
+	// Rules dispatch requests to other routes by header value or webhook
+	// event type. A route with rules may omit its own script, in which
+	// case requests matching no rule are rejected.
+	Rules []RuleConfig `yaml:"rules"`
+	// Pipeline runs the scripts of other routes in turn, each one's
+	// output piped to the next; see PipelineStageConfig.
+	Pipeline []PipelineStageConfig `yaml:"pipeline"`
+	// Timeout, Runtime and Concurrency override the server-wide timeout,
+	// node executable and concurrency limit for this route. Concurrency
+	// can only lower the server-wide limit, not raise it.
+	Timeout     time.Duration `yaml:"timeout"`
+	Runtime     string        `yaml:"runtime"`
+	Concurrency int           `yaml:"concurrency"`
+	// Priority is high, normal or low; see Priority.
+	Priority string `yaml:"priority"`
+	// Experiment assigns callers variants of the script's behavior.
+	Experiment *ExperimentConfig `yaml:"experiment"`
+	// Auth requires a bearer token on the route's endpoints.
+	Auth *AuthConfig `yaml:"auth"`
+	// Transform rewrites payloads before they are validated and outputs
+	// before they are returned.
+	Transform *TransformConfig `yaml:"transform"`
+	// PayloadTemplate wraps payloads in the envelope the script expects;
+	// see PayloadTemplate.
+	PayloadTemplate string `yaml:"payload_template"`
+	// Triggers add cron schedules and queue subscriptions that invoke the
+	// route, and can turn off its HTTP endpoint.
+	Triggers *TriggersConfig `yaml:"triggers"`
+	// Materialize runs the script on a schedule and serves GETs from its
+	// latest output.
+	Materialize *MaterializeConfig `yaml:"materialize"`
+}
+
+// WebhookConfig selects a webhook preset and where its signing secret is
+// read from.
+type WebhookConfig struct {
+	Preset     string `yaml:"preset"`
+	SecretFile string `yaml:"secret_file"`
+	SecretEnv  string `yaml:"secret_env"`
+}
+
+// AuthConfig selects where a route's bearer token is read from, or how
+// its JWTs are verified.
+type AuthConfig struct {
+	TokenFile string     `yaml:"token_file"`
+	TokenEnv  string     `yaml:"token_env"`
+	JWT       *JWTConfig `yaml:"jwt"`
+}
+
+// ExtensionConfig is the manifest entry of a custom trigger or a
+// transform. Beyond kind, the entry is kept undecoded for the kind's
+// factory.
+type ExtensionConfig struct {
+	Kind string
+	node yaml.Node
+}
+
+func (ec ExtensionConfig) MarshalYAML() (any, error) {
+	return &ec.node, nil
+}
+
+func (ec *ExtensionConfig) UnmarshalYAML(value *yaml.Node) error {
+	var head struct {
+		Kind string `yaml:"kind"`
+	}
+	if err := value.Decode(&head); err != nil {
+		return err
+	}
+	ec.Kind, ec.node = head.Kind, *value
+	return nil
+}
+
+// stringList is a YAML string or sequence of strings.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = nil
+		if value.Tag != "!!null" && value.Value != "" {
+			*l = stringList{value.Value}
+		}
+		return nil
+	}
+	var s []string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	*l = s
+	return nil
+}
+
+// RuleConfig routes requests to the route named Route when either Header
+// matches Value, or the webhook event type matches Event. Value and Event
+// are glob patterns.
+type RuleConfig struct {
+	Header string `yaml:"header"`
+	Value  string `yaml:"value"`
+	Event  string `yaml:"event"`
+	Route  string `yaml:"route"`
+}
+
+var routeNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+(/[A-Za-z0-9_.-]+)*$`)
+
+// LoadFileConfig reads the configuration file at path. With a profile, the
+// overlay next to it named after the profile, e.g. config.prod.yaml for
+// config.yaml, is deep-merged over it: mappings are merged key by key,
+// anything else in the overlay replaces the base value, and a null removes
+// the key, so an overlay can drop a route.
+//
+// In strict mode keys that match no field, such as a misspelled "timout",
+// are errors reported with their line numbers like type mismatches are.
+// The entries of custom triggers and transforms are left to their
+// factories to check.
+func LoadFileConfig(path, profile string, strict bool) (*FileConfig, error) {
+	doc, err := loadConfigNode(path, strict)
+	if err != nil {
+		return nil, err
+	}
+	if profile != "" {
+		ext := filepath.Ext(path)
+		overlay, err := loadConfigNode(strings.TrimSuffix(path, ext)+"."+profile+ext, strict)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", profile, err)
+		}
+		doc = mergeConfigNodes(doc, overlay)
+	}
+	var fc FileConfig
+	if err := doc.Decode(&fc); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return &fc, nil
+}
+
+// validProfile reports whether profile can name an overlay file.
+func validProfile(profile string) bool {
+	return routeNamePattern.MatchString(profile) && !strings.Contains(profile, "/")
+}
+
+// loadConfigNode parses the configuration file at path, checking it on its
+// own so errors name the file they are in.
+func loadConfigNode(path string, strict bool) (*yaml.Node, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if doc.Kind == 0 {
+		// An empty file.
+		return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}, nil
+	}
+	var fc FileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(strict)
+	if err := dec.Decode(&fc); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return doc.Content[0], nil
+}
+
+// mergeConfigNodes deep-merges overlay over base; see LoadFileConfig.
+func mergeConfigNodes(base, overlay *yaml.Node) *yaml.Node {
+	if base.Kind != yaml.MappingNode || overlay.Kind != yaml.MappingNode {
+		return overlay
+	}
+	merged := *base
+	merged.Content = slices.Clone(base.Content)
+	for i := 0; i+1 < len(overlay.Content); i += 2 {
+		key, value := overlay.Content[i], overlay.Content[i+1]
+		j := mappingKey(&merged, key.Value)
+		switch {
+		case value.Tag == "!!null" && j >= 0:
+			merged.Content = slices.Delete(merged.Content, j, j+2)
+		case value.Tag == "!!null":
+		case j >= 0:
+			merged.Content[j+1] = mergeConfigNodes(merged.Content[j+1], value)
+		default:
+			merged.Content = append(merged.Content, key, value)
+		}
+	}
+	return &merged
+}
+
+// mappingKey returns the index of key in the mapping node m, or -1.
+func mappingKey(m *yaml.Node, key string) int {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// BuildRoutes turns the declared routes into Routes, sorted by name.
+// Relative paths are resolved against base, the config file's directory.
+func (fc *FileConfig) BuildRoutes(base string) ([]*Route, error) {
+	decls, tenants, err := fc.tenantRoutes(base)
+	if err != nil {
+		return nil, err
+	}
+	if err := addSnippets(decls, fc.Scripts); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(decls))
+	for name := range decls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	routes := make([]*Route, 0, len(names))
+	for _, name := range names {
+		rc := decls[name]
+		if !routeNamePattern.MatchString(name) || name == "batch" || strings.HasPrefix(name, "batch/") {
+			return nil, fmt.Errorf("route %q: invalid name", name)
+		}
+		if rc.Script != "" && rc.ScriptFile != "" {
+			return nil, fmt.Errorf("route %q: must set only one of script or script_file", name)
+		}
+		if rc.Script == "" && rc.ScriptFile == "" && len(rc.Rules) == 0 && rc.Webhook == nil && len(rc.Pipeline) == 0 {
+			return nil, fmt.Errorf("route %q: must set one of script, script_file, rules, webhook or pipeline", name)
+		}
+		if len(rc.Pipeline) > 0 && (rc.Script != "" || rc.ScriptFile != "" || len(rc.Rules) > 0 || rc.Webhook != nil || rc.Persistent) {
+			return nil, fmt.Errorf("route %q: pipeline doesn't combine with script, script_file, rules, webhook or persistent", name)
+		}
+
+		rt := &Route{
+			Name:           name,
+			InlineScript:   rc.Script,
+			ScriptFile:     resolvePath(base, rc.ScriptFile),
+			EnvFiles:       resolvePaths(base, rc.EnvFile),
+			Env:            rc.Env,
+			SecretFiles:    map[string]string{},
+			Persistent:     rc.Persistent,
+			WorkerProtocol: rc.WorkerProtocol,
+			Retry:          rc.Retry,
+			Breaker:        rc.Breaker,
+			Depends:        rc.Depends,
+			Raw:            rc.Raw,
+			Coerce:         rc.Coerce,
+			ContentType:    rc.ContentType,
+			StreamEvents:   rc.StreamEvents,
+			Encryption:     rc.Encryption,
+			Timeout:        rc.Timeout,
+			Tenant:         tenants[name],
+		}
+		if rc.Timeout < 0 {
+			return nil, fmt.Errorf("route %q: timeout must not be negative", name)
+		}
+		switch rc.Encryption {
+		case "", encryptionRequired, encryptionScript:
+		default:
+			return nil, fmt.Errorf("route %q: encryption must be %s or %s", name, encryptionRequired, encryptionScript)
+		}
+		if rc.Encryption != "" && rc.Raw {
+			return nil, fmt.Errorf("route %q: raw routes can't require encryption", name)
+		}
+		if rc.WorkerProtocol != "" && !validWorkerProtocol(rc.WorkerProtocol) {
+			return nil, fmt.Errorf("route %q: worker_protocol must be %s or %s", name, workerProtocolHTTP, workerProtocolStdio)
+		}
+		if rc.Concurrency < 0 {
+			return nil, fmt.Errorf("route %q: concurrency must not be negative", name)
+		}
+		if rc.Concurrency > 0 {
+			rt.slots = newLimiter(rc.Concurrency)
+		}
+		if rt.Priority, err = parsePriority(rc.Priority); err != nil {
+			return nil, fmt.Errorf("route %q: %w", name, err)
+		}
+		if ec := rc.Experiment; ec != nil {
+			if rt.Experiment, err = newExperiment(name, *ec); err != nil {
+				return nil, fmt.Errorf("route %q: experiment: %w", name, err)
+			}
+		}
+		if rc.Runtime != "" {
+			runtime := rc.Runtime
+			if strings.ContainsRune(runtime, filepath.Separator) {
+				runtime = resolvePath(base, runtime)
+			}
+			if _, err := exec.LookPath(runtime); err != nil {
+				return nil, fmt.Errorf("route %q: runtime: %w", name, err)
+			}
+			rt.Runtime = runtime
+		}
+		if ac := rc.Auth; ac != nil {
+			auth, err := newRouteAuth(resolvePath(base, ac.TokenFile), ac.TokenEnv, ac.JWT)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: auth: %w", name, err)
+			}
+			rt.Auth = auth
+		}
+		if sb := rc.Sandbox; sb != nil {
+			resolved := *sb
+			resolved.AllowFSRead = resolvePaths(base, sb.AllowFSRead)
+			resolved.AllowFSWrite = resolvePaths(base, sb.AllowFSWrite)
+			rt.Sandbox = &resolved
+		}
+		if wd := rc.Workdir; wd != nil {
+			resolved := Workdir{Isolate: wd.Isolate, Template: resolvePath(base, wd.Template)}
+			if err := resolved.validate(); err != nil {
+				return nil, fmt.Errorf("route %q: workdir: %w", name, err)
+			}
+			rt.Workdir = &resolved
+		}
+		if rc.Proxy != nil {
+			if err := rc.Proxy.validate(); err != nil {
+				return nil, fmt.Errorf("route %q: proxy: %w", name, err)
+			}
+			rt.Proxy = rc.Proxy
+		}
+		if len(rc.Hosts) > 0 {
+			hosts, err := parseHosts(rc.Hosts)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: hosts: %w", name, err)
+			}
+			rt.Hosts = hosts
+			if p := rt.Proxy; p != nil && !p.Direct {
+				// Mapped hosts are reached directly, as the proxy would
+				// resolve them itself.
+				bypass := *p
+				bypass.NoProxy = slices.Concat(p.NoProxy, slices.Sorted(maps.Keys(hosts)))
+				rt.Proxy = &bypass
+			}
+		}
+		if rc.CORS != nil {
+			p := *rc.CORS
+			if err := p.validate(); err != nil {
+				return nil, fmt.Errorf("route %q: cors: %w", name, err)
+			}
+			rt.CORS = &p
+		}
+		if rc.Retry != nil {
+			if err := rc.Retry.validate(); err != nil {
+				return nil, fmt.Errorf("route %q: %w", name, err)
+			}
+		}
+		if rc.Breaker != nil {
+			if err := rc.Breaker.validate(); err != nil {
+				return nil, fmt.Errorf("route %q: breaker: %w", name, err)
+			}
+		}
+		for k, p := range rc.SecretFiles {
+			rt.SecretFiles[k] = resolvePath(base, p)
+		}
+		if rc.Schema != "" {
+			s, err := LoadSchema(resolvePath(base, rc.Schema))
+			if err != nil {
+				return nil, fmt.Errorf("route %q: invalid schema: %w", name, err)
+			}
+			rt.Schema = s
+		}
+		if rc.ResponseSchema != "" {
+			s, err := LoadSchema(resolvePath(base, rc.ResponseSchema))
+			if err != nil {
+				return nil, fmt.Errorf("route %q: invalid response schema: %w", name, err)
+			}
+			rt.ResponseSchema = s
+		}
+		if wc := rc.Webhook; wc != nil {
+			wh, err := newWebhook(wc.Preset, resolvePath(base, wc.SecretFile), wc.SecretEnv)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: webhook: %w", name, err)
+			}
+			rt.Webhook = wh
+		}
+		if dc := rc.Dedupe; dc != nil {
+			if rc.Raw {
+				return nil, fmt.Errorf("route %q: raw routes can't be deduplicated", name)
+			}
+			if rt.Dedupe, err = newDedupe(*dc); err != nil {
+				return nil, fmt.Errorf("route %q: dedupe: %w", name, err)
+			}
+		}
+		if tc := rc.Transform; tc != nil {
+			var err error
+			if rt.RequestTransforms, err = buildTransforms(tc.Request); err != nil {
+				return nil, fmt.Errorf("route %q: request %w", name, err)
+			}
+			if rt.ResponseTransforms, err = buildTransforms(tc.Response); err != nil {
+				return nil, fmt.Errorf("route %q: response %w", name, err)
+			}
+		}
+		if rc.PayloadTemplate != "" {
+			if rc.Raw {
+				return nil, fmt.Errorf("route %q: payload_template doesn't apply to raw routes", name)
+			}
+			pt, err := ParsePayloadTemplate(name, rc.PayloadTemplate)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: payload_template: %w", name, err)
+			}
+			rt.PayloadTemplate = pt
+		}
+		if tc := rc.Triggers; tc != nil {
+			if !rt.hasScript() {
+				return nil, fmt.Errorf("route %q: triggers require a script", name)
+			}
+			tr, err := tc.build()
+			if err != nil {
+				return nil, fmt.Errorf("route %q: triggers: %w", name, err)
+			}
+			rt.Triggers = tr
+		}
+		files := slices.Concat([]string{rt.ScriptFile}, rt.EnvFiles, resolvePaths(base, []string{rc.Schema, rc.ResponseSchema}))
+		if rc.Webhook != nil {
+			files = append(files, resolvePath(base, rc.Webhook.SecretFile))
+		}
+		var tenantRev string
+		if t := rt.Tenant; t != nil {
+			tenantRev = t.revision
+		}
+		rt.revision = revisionOf([]any{rc, tenantRev}, files...)
+		if mc := rc.Materialize; mc != nil {
+			switch {
+			case !rt.hasScript():
+				return nil, fmt.Errorf("route %q: materialize requires a script", name)
+			case rc.Raw || rc.Webhook != nil || rc.Encryption != "":
+				return nil, fmt.Errorf("route %q: materialize doesn't apply to raw, webhook or encrypted routes", name)
+			case rt.Triggers != nil && rt.Triggers.DisableHTTP:
+				return nil, fmt.Errorf("route %q: materialize requires the http trigger", name)
+			}
+			m, err := mc.build()
+			if err != nil {
+				return nil, fmt.Errorf("route %q: materialize: %w", name, err)
+			}
+			rt.Materialized = m
+		}
+		routes = append(routes, rt)
+	}
+
+	byName := make(map[string]*Route, len(routes))
+	for _, rt := range routes {
+		byName[rt.Name] = rt
+	}
+	for _, rt := range routes {
+		for i, rc := range decls[rt.Name].Rules {
+			if rc.Event != "" && rt.Webhook == nil {
+				return nil, fmt.Errorf("route %q: rule %d: event rules require a webhook", rt.Name, i+1)
+			}
+			rule, err := buildRule(rc, decls, byName)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: rule %d: %w", rt.Name, i+1, err)
+			}
+			rt.Rules = append(rt.Rules, rule)
+		}
+		if stages := decls[rt.Name].Pipeline; len(stages) > 0 {
+			if rt.Pipeline, err = buildPipeline(stages, decls, byName); err != nil {
+				return nil, fmt.Errorf("route %q: pipeline: %w", rt.Name, err)
+			}
+		}
+	}
+	for i, sc := range fc.Schedules {
+		rt, ok := byName[strings.TrimPrefix(sc.Route, "/invoke/")]
+		if !ok {
+			return nil, fmt.Errorf("schedule %d: unknown route %q", i+1, sc.Route)
+		}
+		if !rt.hasScript() {
+			return nil, fmt.Errorf("schedule %d: route %q must run a script", i+1, sc.Route)
+		}
+		ct, err := CronTrigger{Schedule: sc.Cron, Timezone: sc.Timezone, Payload: sc.Payload, Jitter: sc.Jitter}.build()
+		if err != nil {
+			return nil, fmt.Errorf("schedule %d: %w", i+1, err)
+		}
+		if rt.Triggers == nil {
+			rt.Triggers = &Triggers{}
+		}
+		rt.Triggers.Cron = append(rt.Triggers.Cron, ct)
+		rt.revision = revisionOf([]any{rt.revision, sc})
+	}
+	// Dispatching routes and pipelines change along with their targets,
+	// which have neither of their own.
+	for _, rt := range routes {
+		for _, rule := range rt.Rules {
+			rt.revision = revisionOf([]any{rt.revision, rule.Target.revision})
+		}
+		for _, stage := range rt.Pipeline {
+			rt.revision = revisionOf([]any{rt.revision, stage.Route.revision})
+		}
+	}
+	return routes, nil
+}
+
+func buildRule(rc RuleConfig, decls map[string]RouteConfig, routes map[string]*Route) (Rule, error) {
+	rule := Rule{Header: http.CanonicalHeaderKey(rc.Header), Value: rc.Value}
+	switch {
+	case rc.Event != "" && rc.Header == "" && rc.Value == "":
+		rule = Rule{Value: rc.Event}
+	case rc.Event != "" || rc.Header == "" || rc.Value == "":
+		return Rule{}, errors.New("must set either header and value, or event")
+	}
+	if _, err := path.Match(rule.Value, ""); err != nil {
+		return Rule{}, fmt.Errorf("invalid pattern %q: %w", rule.Value, err)
+	}
+	target, ok := routes[rc.Route]
+	if !ok {
+		return Rule{}, fmt.Errorf("unknown route %q", rc.Route)
+	}
+	// Dispatch is a single hop; chained rules would make the effective
+	// script depend on evaluation order across routes.
+	if len(decls[rc.Route].Rules) > 0 || !target.hasScript() {
+		return Rule{}, fmt.Errorf("route %q must run a script and have no rules of its own", rc.Route)
+	}
+	rule.Target = target
+	return rule, nil
+}
+
+// revisionOf identifies a version of a declaration v and the contents of
+// the files it refers to; see routeSet.
+func revisionOf(v any, files ...string) string {
+	h := sha256.New()
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		// Only values decoded from YAML are passed.
+		panic(err)
+	}
+	h.Write(b)
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		data, err := os.ReadFile(f)
+		if err != nil {
+			data = []byte(err.Error())
+		}
+		fmt.Fprintf(h, "\x00%s\x00%d\x00", f, len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func resolvePaths(base string, ps []string) []string {
+	out := make([]string, len(ps))
+	for i, p := range ps {
+		out[i] = resolvePath(base, p)
+	}
+	return out
+}
+
+func resolvePath(base, p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(base, p)
+}
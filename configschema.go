@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// runConfigCommand runs `go-invoke-node config <command>`; the only one is
+// schema, which prints the JSON Schema of the --config file:
+//
+//	go-invoke-node config schema > go-invoke-node.schema.json
+//
+// Editors use it to validate and complete config files, e.g. with a
+// "# yaml-language-server: $schema=go-invoke-node.schema.json" comment, and
+// it lets deployment pipelines check configs before they reach a server.
+func runConfigCommand(args []string) int {
+	if len(args) != 1 || args[0] != "schema" {
+		log.Print("usage: config schema")
+		return exitUsage
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(configSchema()); err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	return 0
+}
+
+// configSchema returns the JSON Schema of FileConfig, derived from the
+// yaml tags of its fields. Like --strict-config, it rejects unknown keys.
+func configSchema() map[string]any {
+	g := schemaGenerator{defs: map[string]any{}}
+	root := g.schema(reflect.TypeFor[FileConfig]())
+	return map[string]any{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title":   "go-invoke-node config file",
+		"$ref":    root["$ref"],
+		"$defs":   g.defs,
+	}
+}
+
+// durationPattern matches what time.ParseDuration accepts.
+const durationPattern = `^-?(0|([0-9]+(\.[0-9]*)?|\.[0-9]+)(ns|us|µs|ms|s|m|h))+$`
+
+var (
+	durationType        = reflect.TypeFor[time.Duration]()
+	stringListType      = reflect.TypeFor[stringList]()
+	extensionType       = reflect.TypeFor[ExtensionConfig]()
+	yamlUnmarshalerType = reflect.TypeFor[yaml.Unmarshaler]()
+)
+
+type schemaGenerator struct {
+	// defs holds the schemas of named structs, referenced by name.
+	defs map[string]any
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]any {
+	switch t {
+	case durationType:
+		// Integers are nanoseconds, as for yaml.v3.
+		return map[string]any{"type": []string{"string", "integer"}, "pattern": durationPattern}
+	case stringListType:
+		return map[string]any{"oneOf": []any{
+			map[string]any{"type": "string"},
+			map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+		}}
+	case extensionType:
+		// Beyond kind, the entry is checked by the kind's factory.
+		return map[string]any{
+			"type":       "object",
+			"properties": map[string]any{"kind": map[string]any{"type": "string"}},
+			"required":   []string{"kind"},
+		}
+	}
+	if reflect.PointerTo(t).Implements(yamlUnmarshalerType) {
+		// Decoded by its own rules.
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if _, ok := g.defs[t.Name()]; !ok {
+			// Reserve the name first, for types that contain themselves.
+			g.defs[t.Name()] = nil
+			g.defs[t.Name()] = g.object(t)
+		}
+		return map[string]any{"$ref": "#/$defs/" + t.Name()}
+	}
+	// Interfaces hold any YAML value.
+	return map[string]any{}
+}
+
+// object returns the schema of the struct t, whose fields are named by
+// their yaml tags or, like yaml.v3 does, their lowercased names.
+func (g *schemaGenerator) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	g.fields(t, props)
+	return map[string]any{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+}
+
+func (g *schemaGenerator) fields(t reflect.Type, props map[string]any) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("yaml")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if opts == "inline" {
+			g.fields(f.Type, props)
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		props[name] = g.schema(f.Type)
+	}
+}
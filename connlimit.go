@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// ConnLimits bounds the connections the server keeps open, so a burst of
+// webhook deliveries queues in the kernel's accept backlog instead of
+// exhausting file descriptors. Zero means unlimited.
+type ConnLimits struct {
+	// Max is the number of open connections; further ones wait to be
+	// accepted until one closes.
+	Max int
+	// PerIP is the number of open connections from one client IP;
+	// further ones are closed right away. Only TCP clients are counted.
+	PerIP int
+}
+
+func (cl ConnLimits) enabled() bool {
+	return cl.Max > 0 || cl.PerIP > 0
+}
+
+// limit wraps ln to enforce cl.
+func (cl ConnLimits) limit(ln net.Listener) net.Listener {
+	if !cl.enabled() {
+		return ln
+	}
+	l := &limitListener{Listener: ln, perIP: cl.PerIP, conns: map[string]int{}, done: make(chan struct{})}
+	if cl.Max > 0 {
+		l.slots = make(chan struct{}, cl.Max)
+	}
+	return l
+}
+
+type limitListener struct {
+	net.Listener
+	slots chan struct{}
+	perIP int
+
+	mu    sync.Mutex
+	conns map[string]int
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		if l.slots != nil {
+			select {
+			case l.slots <- struct{}{}:
+			case <-l.done:
+				return nil, net.ErrClosed
+			}
+		}
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.release("")
+			return nil, err
+		}
+		ip := ""
+		if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok && l.perIP > 0 {
+			ip = addr.IP.String()
+			l.mu.Lock()
+			full := l.conns[ip] >= l.perIP
+			if !full {
+				l.conns[ip]++
+			}
+			l.mu.Unlock()
+			if full {
+				c.Close()
+				l.release("")
+				continue
+			}
+		}
+		return &limitedConn{Conn: c, l: l, ip: ip}, nil
+	}
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// release frees the slot of a closed connection from ip.
+func (l *limitListener) release(ip string) {
+	if ip != "" {
+		l.mu.Lock()
+		if l.conns[ip]--; l.conns[ip] <= 0 {
+			delete(l.conns, ip)
+		}
+		l.mu.Unlock()
+	}
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	l    *limitListener
+	ip   string
+	once sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.l.release(c.ip) })
+	return err
+}
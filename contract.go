@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxContractCases bounds the payloads tried per route.
+	maxContractCases = 200
+	// maxContractDepth bounds how deep recursive schemas are sampled.
+	maxContractDepth = 8
+)
+
+// contractOptions are the flags of `go-invoke-node contract-test`, which
+// checks that scripts honor their schemas instead of starting a server:
+//
+//	go-invoke-node contract-test --config routes.yaml --route orders/create
+//
+// For every route with a payload schema, payloads are generated from it:
+// one with every property, one with only the required ones, and variants
+// of the first with each property at its edges, such as its minimum and
+// maximum, each enum value, empty and longest strings and arrays, or left
+// out when optional. Each is invoked and passes when the script succeeds
+// with JSON output that matches the route's response schema, if it has
+// one. The process exits with status 1 when any payload failed.
+type contractOptions struct {
+	// Route limits the test to one route or script.
+	Route string
+	// ResponseSchema is the response schema of a --script or
+	// --script-file route.
+	ResponseSchema string
+}
+
+func (o *contractOptions) register() {
+	flag.StringVar(&o.Route, "route", o.Route,
+		"contract-test: only test this route with --config, or script with --script-dir")
+	flag.StringVar(&o.ResponseSchema, "response-schema", o.ResponseSchema,
+		"contract-test: JSON Schema the output of --script or --script-file must match")
+}
+
+// contractCase is a generated payload and the edge it exercises.
+type contractCase struct {
+	name    string
+	payload any
+}
+
+// runContractTests tests the routes cfg selects and returns the exit
+// status.
+func runContractTests(cfg Config, inv *Invoker, schema *Schema, o contractOptions) int {
+	routes, err := contractRoutes(cfg, schema, o)
+	if err == nil && len(routes) == 0 {
+		err = errors.New("no routes to test")
+	}
+	if err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	failed := false
+	for _, route := range routes {
+		if route.Schema == nil {
+			fmt.Printf("SKIP  %s: no payload schema\n", route.Name)
+			continue
+		}
+		cases, invalid := contractCases(route.Schema)
+		var passed, failures int
+		for _, c := range cases {
+			if ctx.Err() != nil {
+				return exitFailure
+			}
+			start := time.Now()
+			if err := contractCheck(ctx, inv, route, c.payload); err != nil {
+				failures++
+				b, _ := json.Marshal(c.payload)
+				fmt.Printf("FAIL  %s [%s]: %v\n      payload: %s\n", route.Name, c.name, err, b)
+				continue
+			}
+			passed++
+			infof("ok    %s [%s] (%s)", route.Name, c.name, time.Since(start).Round(time.Millisecond))
+		}
+		summary := fmt.Sprintf("%d passed, %d failed", passed, failures)
+		if invalid > 0 {
+			// Generated values can't satisfy every keyword, e.g. a
+			// pattern; such payloads are dropped rather than reported.
+			summary += fmt.Sprintf(", %d generated payloads didn't match the schema and were skipped", invalid)
+		}
+		status := "ok  "
+		if failures > 0 {
+			status = "FAIL"
+			failed = true
+		}
+		fmt.Printf("%s  %s: %s\n", status, route.Name, summary)
+	}
+	if failed {
+		return exitFailure
+	}
+	return 0
+}
+
+// contractCheck invokes route with payload and checks its output.
+func contractCheck(ctx context.Context, inv *Invoker, route *Route, payload any) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	call := Invocation{
+		Route:        route,
+		Payload:      b,
+		Request:      RequestInfo{ID: newRequestID()},
+		NoCache:      true,
+		NoDeadLetter: true,
+		NoAudit:      true,
+	}
+	res, err := inv.Invoke(ctx, call)
+	if err != nil {
+		return fmt.Errorf("script failed: %v: %s", err, firstLine(string(res.Stderr), ""))
+	}
+	out, err := applyTransforms(route.ResponseTransforms, res.Stdout)
+	if err != nil {
+		return fmt.Errorf("output transform failed: %v", err)
+	}
+	if !json.Valid(out) {
+		return fmt.Errorf("output is not JSON: %.200s", out)
+	}
+	if route.ResponseSchema == nil {
+		return nil
+	}
+	violations, err := route.ResponseSchema.Validate(out)
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		msgs := make([]string, len(violations))
+		for i, v := range violations {
+			msgs[i] = v.Path + ": " + v.Message
+		}
+		return fmt.Errorf("output does not match the response schema: %s", strings.Join(msgs, "; "))
+	}
+	return nil
+}
+
+// contractRoutes lists the routes to test, like oneShotRoute but for every
+// route unless o names one.
+func contractRoutes(cfg Config, schema *Schema, o contractOptions) ([]*Route, error) {
+	if o.Route != "" || (cfg.ScriptDir == "" && cfg.ConfigFile == "") {
+		route, err := oneShotRoute(cfg, schema, o.Route)
+		if err != nil {
+			return nil, err
+		}
+		if o.ResponseSchema != "" {
+			if route.ResponseSchema, err = LoadSchema(o.ResponseSchema); err != nil {
+				return nil, fmt.Errorf("invalid response schema %q: %v", o.ResponseSchema, err)
+			}
+		}
+		return []*Route{route}, nil
+	}
+
+	var out []*Route
+	if cfg.ScriptDir != "" {
+		dir, err := NewScriptDir(cfg.ScriptDir, cfg.EnvFiles, schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid script dir %q: %v", cfg.ScriptDir, err)
+		}
+		names, err := dir.scripts()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			route, err := dir.Resolve(name)
+			if err != nil {
+				return nil, fmt.Errorf("script %q: %v", name, err)
+			}
+			out = append(out, route)
+		}
+		return out, nil
+	}
+
+	fc, err := LoadFileConfig(cfg.ConfigFile, cfg.Profile, cfg.StrictConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	routes, err := fc.BuildRoutes(filepath.Dir(cfg.ConfigFile))
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	for _, route := range routes {
+		if !route.hasScript() || route.Raw {
+			continue
+		}
+		if route.Schema == nil {
+			route.Schema = schema
+		}
+		out = append(out, route)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// contractCases generates the payloads for s, dropping duplicates and
+// those s rejects, of which it returns the count.
+func contractCases(s *Schema) (cases []contractCase, invalid int) {
+	g := &contractGen{open: map[*Schema]bool{}}
+	all := append([]contractCase{
+		{"all properties", g.sample(s, true, 0)},
+		{"required properties only", g.sample(s, false, 0)},
+	}, g.edges(s, 0)...)
+
+	seen := map[string]bool{}
+	for _, c := range all {
+		b, err := json.Marshal(c.payload)
+		if err != nil || seen[string(b)] {
+			continue
+		}
+		seen[string(b)] = true
+		if violations, _ := s.Validate(b); len(violations) > 0 {
+			invalid++
+			continue
+		}
+		if len(cases) < maxContractCases {
+			cases = append(cases, c)
+		}
+	}
+	return cases, invalid
+}
+
+// deref follows s's $ref, if any.
+func deref(s *Schema) *Schema {
+	for range maxContractDepth {
+		if s.Ref == "" {
+			break
+		}
+		target, err := s.resolve()
+		if err != nil {
+			break
+		}
+		s = target
+	}
+	return s
+}
+
+// schemaType returns the type a value for s is generated as.
+func schemaType(s *Schema) string {
+	for _, t := range s.Type {
+		if t != "null" {
+			return t
+		}
+	}
+	if len(s.Type) > 0 {
+		return "null"
+	}
+	if len(s.Properties) > 0 {
+		return "object"
+	}
+	if s.Items != nil {
+		return "array"
+	}
+	return ""
+}
+
+// contractGen generates values for schemas. Recursive schemas are
+// expanded once: optional properties leading back to an object schema
+// being generated are left out.
+type contractGen struct {
+	// open holds the object schemas being generated.
+	open map[*Schema]bool
+}
+
+// enter marks the object schema s as being generated, returning the
+// function that ends that.
+func (g *contractGen) enter(s *Schema) func() {
+	if g.open[s] {
+		return func() {}
+	}
+	g.open[s] = true
+	return func() { delete(g.open, s) }
+}
+
+// sample returns a value s should accept: a default, const or the first
+// enum value when there is one, or else the smallest conforming value,
+// with every property when full and only the required ones otherwise.
+func (g *contractGen) sample(s *Schema, full bool, depth int) any {
+	s = deref(s)
+	if depth > maxContractDepth || s.boolean != nil {
+		return nil
+	}
+	for _, raw := range []json.RawMessage{s.Default, s.Const} {
+		if len(raw) > 0 {
+			var v any
+			json.Unmarshal(raw, &v)
+			return v
+		}
+	}
+	if len(s.Enum) > 0 {
+		var v any
+		json.Unmarshal(s.Enum[0], &v)
+		return v
+	}
+	if schemaType(s) == "" {
+		for _, list := range [][]*Schema{s.AllOf, s.AnyOf, s.OneOf} {
+			if len(list) > 0 {
+				return g.sample(list[0], full, depth+1)
+			}
+		}
+	}
+
+	switch schemaType(s) {
+	case "object":
+		defer g.enter(s)()
+		obj := map[string]any{}
+		for _, name := range s.Required {
+			if ps, ok := s.Properties[name]; ok {
+				obj[name] = g.sample(ps, full, depth+1)
+			} else {
+				obj[name] = nil
+			}
+		}
+		if full {
+			for name, ps := range s.Properties {
+				if _, ok := obj[name]; !ok && !g.open[deref(ps)] {
+					obj[name] = g.sample(ps, full, depth+1)
+				}
+			}
+		}
+		return obj
+	case "array":
+		n := 0
+		if s.MinItems != nil {
+			n = *s.MinItems
+		}
+		if full && n == 0 && (s.MaxItems == nil || *s.MaxItems > 0) {
+			n = 1
+		}
+		arr := make([]any, 0, n)
+		for range n {
+			if s.Items == nil {
+				arr = append(arr, nil)
+				continue
+			}
+			arr = append(arr, g.sample(s.Items, full, depth+1))
+		}
+		return arr
+	case "string":
+		n := 1
+		if s.MinLength != nil {
+			n = *s.MinLength
+		}
+		if s.MaxLength != nil {
+			n = min(n, *s.MaxLength)
+		}
+		return strings.Repeat("a", n)
+	case "integer", "number":
+		lo, hi := numberRange(s, schemaType(s) == "integer")
+		v := math.Max(0, lo)
+		if v > hi {
+			v = hi
+		}
+		if s.MultipleOf != nil && *s.MultipleOf > 0 {
+			v = math.Ceil(v / *s.MultipleOf) * *s.MultipleOf
+		}
+		return v
+	case "boolean":
+		return true
+	}
+	return nil
+}
+
+// numberRange returns the inclusive bounds of a numeric schema, infinite
+// where it has none.
+func numberRange(s *Schema, integer bool) (lo, hi float64) {
+	lo, hi = math.Inf(-1), math.Inf(1)
+	step := math.SmallestNonzeroFloat64
+	if integer {
+		step = 1
+	}
+	if s.Minimum != nil {
+		lo = *s.Minimum
+	}
+	if s.ExclusiveMinimum != nil {
+		lo = math.Max(lo, *s.ExclusiveMinimum+step)
+	}
+	if s.Maximum != nil {
+		hi = *s.Maximum
+	}
+	if s.ExclusiveMaximum != nil {
+		hi = math.Min(hi, *s.ExclusiveMaximum-step)
+	}
+	if integer {
+		lo, hi = math.Ceil(lo), math.Floor(hi)
+	}
+	return lo, hi
+}
+
+// edges returns the values at the edges of what s accepts, besides
+// sample's, labeled with what they exercise.
+func (g *contractGen) edges(s *Schema, depth int) []contractCase {
+	s = deref(s)
+	if depth > maxContractDepth || s.boolean != nil {
+		return nil
+	}
+	var out []contractCase
+	add := func(name string, v any) { out = append(out, contractCase{name, v}) }
+
+	for i, raw := range s.Enum {
+		var v any
+		json.Unmarshal(raw, &v)
+		add(fmt.Sprintf("enum value %d", i+1), v)
+	}
+	if len(s.Type) > 1 && slicesContainsType(s.Type, nil) {
+		add("null", nil)
+	}
+	for i, sub := range append(s.AnyOf[:len(s.AnyOf):len(s.AnyOf)], s.OneOf...) {
+		add(fmt.Sprintf("alternative %d", i+1), g.sample(sub, true, depth+1))
+	}
+	if len(s.Enum) > 0 || len(s.Const) > 0 {
+		return out
+	}
+
+	switch schemaType(s) {
+	case "object":
+		base, _ := g.sample(s, true, depth).(map[string]any)
+		defer g.enter(s)()
+		required := map[string]bool{}
+		for _, name := range s.Required {
+			required[name] = true
+		}
+		names := make([]string, 0, len(s.Properties))
+		for name := range s.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !required[name] {
+				obj := maps.Clone(base)
+				delete(obj, name)
+				add("without "+name, obj)
+			}
+			if g.open[deref(s.Properties[name])] {
+				continue
+			}
+			for _, e := range g.edges(s.Properties[name], depth+1) {
+				obj := maps.Clone(base)
+				if obj == nil {
+					obj = map[string]any{}
+				}
+				obj[name] = e.payload
+				add(name+": "+e.name, obj)
+			}
+		}
+	case "array":
+		if s.MinItems == nil || *s.MinItems == 0 {
+			add("empty array", []any{})
+		}
+		if s.MaxItems != nil && *s.MaxItems > 0 && *s.MaxItems <= 100 {
+			arr := make([]any, *s.MaxItems)
+			for i := range arr {
+				if s.Items != nil {
+					arr[i] = g.sample(s.Items, true, depth+1)
+				}
+			}
+			add("longest array", arr)
+		}
+		if s.Items != nil {
+			for _, e := range g.edges(s.Items, depth+1) {
+				add("item: "+e.name, []any{e.payload})
+			}
+		}
+	case "string":
+		if s.MinLength == nil || *s.MinLength == 0 {
+			add("empty string", "")
+		}
+		if s.MaxLength != nil && *s.MaxLength <= 1<<16 {
+			add("longest string", strings.Repeat("a", *s.MaxLength))
+		}
+		add("non-ASCII string", "ünïcødé ✓")
+	case "integer", "number":
+		integer := schemaType(s) == "integer"
+		lo, hi := numberRange(s, integer)
+		if !math.IsInf(lo, 0) {
+			add("minimum", lo)
+		} else {
+			add("negative", -1.0)
+		}
+		if !math.IsInf(hi, 0) {
+			add("maximum", hi)
+		} else if integer {
+			add("large", float64(1<<53-1))
+		} else {
+			add("large", 1e300)
+		}
+		if !integer {
+			add("fraction", 0.5)
+		}
+	case "boolean":
+		add("false", false)
+	}
+	return out
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSPolicy lets browsers on other origins call the invoke endpoints
+// directly. Requests from the allowed origins get the Access-Control
+// headers, and their preflight OPTIONS requests are answered before auth
+// applies, since browsers send them without credentials. Requests from
+// other origins are served without the headers, so browsers withhold the
+// responses, and their preflights are refused with 403.
+//
+//	cors:
+//	  origins: [https://app.example.com, "https://*.example.com"]
+//	  methods: [POST]
+//	  headers: [Content-Type, Authorization]
+//	  max_age: 1h
+//	  credentials: true
+//
+// A route's policy replaces the server's --cors-* flags; methods and
+// headers left empty fall back to their defaults.
+type CORSPolicy struct {
+	// Origins are scheme://host[:port] origins, optionally with a
+	// wildcard subdomain, or * for any. None disables CORS.
+	Origins []string `yaml:"origins"`
+	Methods []string `yaml:"methods"`
+	// Headers are the request headers scripts may be sent, or * for any.
+	Headers []string `yaml:"headers"`
+	// ExposeHeaders are the response headers, beyond the CORS-safelisted
+	// ones, browsers let callers read.
+	ExposeHeaders []string `yaml:"expose_headers"`
+	// MaxAge is how long browsers may cache a preflight answer.
+	MaxAge time.Duration `yaml:"max_age"`
+	// Credentials lets browsers send cookies and HTTP authentication.
+	Credentials bool `yaml:"credentials"`
+}
+
+func (p *CORSPolicy) enabled() bool {
+	return p != nil && len(p.Origins) > 0
+}
+
+// validate checks p, filling in the default methods and headers.
+func (p *CORSPolicy) validate() error {
+	for _, o := range p.Origins {
+		if o == "*" {
+			if p.Credentials {
+				return errors.New("credentials can't be allowed for every origin")
+			}
+			continue
+		}
+		u, err := url.Parse(strings.Replace(o, "://*.", "://", 1))
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return fmt.Errorf("invalid origin %q: must be scheme://host[:port], with an optional *. subdomain wildcard, or *", o)
+		}
+	}
+	if p.MaxAge < 0 {
+		return errors.New("max_age must not be negative")
+	}
+	if len(p.Methods) == 0 {
+		p.Methods = splitList(defaultCORSMethods)
+	}
+	if len(p.Headers) == 0 {
+		p.Headers = splitList(defaultCORSHeaders)
+	}
+	return nil
+}
+
+// allows reports whether origin may call the route.
+func (p *CORSPolicy) allows(origin string) bool {
+	origin = strings.TrimSuffix(strings.ToLower(origin), "/")
+	for _, o := range p.Origins {
+		o = strings.TrimSuffix(strings.ToLower(o), "/")
+		if o == "*" || o == origin {
+			return true
+		}
+		scheme, domain, ok := strings.Cut(o, "://*.")
+		if !ok {
+			continue
+		}
+		host, ok := strings.CutPrefix(origin, scheme+"://")
+		if ok && strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// handle sets the CORS headers of the response to r, and answers r itself
+// when it is a preflight request, reporting whether it did.
+func (p *CORSPolicy) handle(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if !p.enabled() || origin == "" {
+		return false
+	}
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	if !p.allows(origin) {
+		if preflight {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+		}
+		return preflight
+	}
+	if slices.Contains(p.Origins, "*") {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		if len(p.ExposeHeaders) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(p.ExposeHeaders, ", "))
+		}
+		return false
+	}
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	h.Set("Access-Control-Allow-Methods", strings.Join(p.Methods, ", "))
+	if slices.Contains(p.Headers, "*") {
+		// Echoed, since browsers don't let * cover Authorization.
+		if req := r.Header.Get("Access-Control-Request-Headers"); req != "" {
+			h.Set("Access-Control-Allow-Headers", req)
+		}
+	} else {
+		h.Set("Access-Control-Allow-Headers", strings.Join(p.Headers, ", "))
+	}
+	if p.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// cors returns the policy applying to route.
+func (opts handlerOptions) cors(route *Route) *CORSPolicy {
+	if route.CORS != nil {
+		return route.CORS
+	}
+	return &opts.CORS
+}
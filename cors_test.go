@@ -0,0 +1,213 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCORSPolicyAllows(t *testing.T) {
+	tests := []struct {
+		origins []string
+		origin  string
+		want    bool
+	}{
+		{[]string{"https://app.example.com"}, "https://app.example.com", true},
+		{[]string{"https://app.example.com"}, "HTTPS://App.Example.com", true},
+		{[]string{"https://app.example.com/"}, "https://app.example.com", true},
+		{[]string{"https://app.example.com"}, "https://app.example.com/", true},
+		{[]string{"https://app.example.com"}, "http://app.example.com", false},
+		{[]string{"https://app.example.com"}, "https://app.example.com:8443", false},
+		{[]string{"https://app.example.com"}, "https://app.example.com.evil.com", false},
+		{[]string{"https://app.example.com"}, "https://evilapp.example.com", false},
+		{[]string{"https://app.example.com:8443"}, "https://app.example.com:8443", true},
+		{[]string{"https://app.example.com", "https://admin.example.com"}, "https://admin.example.com", true},
+		{[]string{"https://*.example.com"}, "https://app.example.com", true},
+		{[]string{"https://*.example.com"}, "https://a.b.example.com", true},
+		{[]string{"https://*.example.com"}, "https://example.com", false},
+		{[]string{"https://*.example.com"}, "https://evilexample.com", false},
+		{[]string{"https://*.example.com"}, "https://example.com.evil.com", false},
+		{[]string{"https://*.example.com"}, "http://app.example.com", false},
+		{[]string{"*"}, "https://anything.test", true},
+		{[]string{"*"}, "null", true},
+		{[]string{"https://app.example.com"}, "null", false},
+		{nil, "https://app.example.com", false},
+	}
+	for _, tt := range tests {
+		p := &CORSPolicy{Origins: tt.origins}
+		if got := p.allows(tt.origin); got != tt.want {
+			t.Errorf("%v allows %q = %v, want %v", tt.origins, tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestCORSPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  CORSPolicy
+		wantErr string
+	}{
+		{name: "origins", policy: CORSPolicy{Origins: []string{"https://app.example.com", "http://localhost:3000", "https://*.example.com"}}},
+		{name: "any origin", policy: CORSPolicy{Origins: []string{"*"}}},
+		{name: "credentials", policy: CORSPolicy{Origins: []string{"https://app.example.com"}, Credentials: true}},
+		{name: "credentials for any origin", policy: CORSPolicy{Origins: []string{"*"}, Credentials: true}, wantErr: "credentials"},
+		{name: "no scheme", policy: CORSPolicy{Origins: []string{"app.example.com"}}, wantErr: "invalid origin"},
+		{name: "path", policy: CORSPolicy{Origins: []string{"https://app.example.com/app"}}, wantErr: "invalid origin"},
+		{name: "query", policy: CORSPolicy{Origins: []string{"https://app.example.com?x=1"}}, wantErr: "invalid origin"},
+		{name: "negative max age", policy: CORSPolicy{Origins: []string{"*"}, MaxAge: -time.Second}, wantErr: "max_age"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.validate()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("validate error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			if len(tt.policy.Methods) == 0 || len(tt.policy.Headers) == 0 {
+				t.Errorf("methods %v and headers %v weren't defaulted", tt.policy.Methods, tt.policy.Headers)
+			}
+		})
+	}
+}
+
+func TestCORSPolicyHandle(t *testing.T) {
+	policy := CORSPolicy{
+		Origins:       []string{"https://app.example.com"},
+		Methods:       []string{"POST"},
+		Headers:       []string{"Content-Type", "Authorization"},
+		ExposeHeaders: []string{"X-Request-Id"},
+		MaxAge:        time.Hour,
+		Credentials:   true,
+	}
+	anyHeaders := policy
+	anyHeaders.Origins = []string{"*"}
+	anyHeaders.Headers = []string{"*"}
+	anyHeaders.Credentials = false
+
+	tests := []struct {
+		name      string
+		policy    CORSPolicy
+		method    string
+		headers   map[string]string
+		answered  bool
+		status    int
+		want      map[string]string
+		wantEmpty []string
+	}{{
+		name:      "same origin",
+		policy:    policy,
+		method:    "POST",
+		wantEmpty: []string{"Access-Control-Allow-Origin", "Vary"},
+	}, {
+		name:    "allowed origin",
+		policy:  policy,
+		method:  "POST",
+		headers: map[string]string{"Origin": "https://app.example.com"},
+		want: map[string]string{
+			"Access-Control-Allow-Origin":      "https://app.example.com",
+			"Access-Control-Allow-Credentials": "true",
+			"Access-Control-Expose-Headers":    "X-Request-Id",
+			"Vary":                             "Origin",
+		},
+		wantEmpty: []string{"Access-Control-Allow-Methods", "Access-Control-Max-Age"},
+	}, {
+		name:      "other origin",
+		policy:    policy,
+		method:    "POST",
+		headers:   map[string]string{"Origin": "https://evil.example.com"},
+		want:      map[string]string{"Vary": "Origin"},
+		wantEmpty: []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Credentials"},
+	}, {
+		name:   "preflight",
+		policy: policy,
+		method: "OPTIONS",
+		headers: map[string]string{
+			"Origin":                         "https://app.example.com",
+			"Access-Control-Request-Method":  "POST",
+			"Access-Control-Request-Headers": "content-type",
+		},
+		answered: true,
+		status:   http.StatusNoContent,
+		want: map[string]string{
+			"Access-Control-Allow-Origin":  "https://app.example.com",
+			"Access-Control-Allow-Methods": "POST",
+			"Access-Control-Allow-Headers": "Content-Type, Authorization",
+			"Access-Control-Max-Age":       "3600",
+		},
+		wantEmpty: []string{"Access-Control-Expose-Headers"},
+	}, {
+		name:   "preflight from other origin",
+		policy: policy,
+		method: "OPTIONS",
+		headers: map[string]string{
+			"Origin":                        "https://evil.example.com",
+			"Access-Control-Request-Method": "POST",
+		},
+		answered:  true,
+		status:    http.StatusForbidden,
+		wantEmpty: []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Methods"},
+	}, {
+		// OPTIONS without Access-Control-Request-Method isn't a
+		// preflight, and goes on to the route.
+		name:     "plain OPTIONS",
+		policy:   policy,
+		method:   "OPTIONS",
+		headers:  map[string]string{"Origin": "https://app.example.com"},
+		answered: false,
+		want:     map[string]string{"Access-Control-Allow-Origin": "https://app.example.com"},
+	}, {
+		name:   "any origin and headers",
+		policy: anyHeaders,
+		method: "OPTIONS",
+		headers: map[string]string{
+			"Origin":                         "https://other.test",
+			"Access-Control-Request-Method":  "POST",
+			"Access-Control-Request-Headers": "authorization, x-custom",
+		},
+		answered: true,
+		status:   http.StatusNoContent,
+		want: map[string]string{
+			"Access-Control-Allow-Origin":  "*",
+			"Access-Control-Allow-Headers": "authorization, x-custom",
+		},
+		wantEmpty: []string{"Access-Control-Allow-Credentials"},
+	}, {
+		name:      "disabled",
+		policy:    CORSPolicy{},
+		method:    "OPTIONS",
+		headers:   map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "POST"},
+		wantEmpty: []string{"Access-Control-Allow-Origin", "Vary"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/invoke/r", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			if got := tt.policy.handle(w, r); got != tt.answered {
+				t.Errorf("handle = %v, want %v", got, tt.answered)
+			}
+			if tt.answered && w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			for k, v := range tt.want {
+				if got := w.Header().Get(k); got != v {
+					t.Errorf("%s = %q, want %q", k, got, v)
+				}
+			}
+			for _, k := range tt.wantEmpty {
+				if got := w.Header().Get(k); got != "" {
+					t.Errorf("%s = %q, want none", k, got)
+				}
+			}
+		})
+	}
+}
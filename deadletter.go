@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxDeadLetterStderr bounds the stderr kept with a dead letter.
+const maxDeadLetterStderr = 64 << 10
+
+var deadLetterIDPattern = regexp.MustCompile(`^[0-9]+-[0-9a-f]+$`)
+
+var errDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetters persists invocations that failed after their retries, in a
+// SQLite database or a Redis or PostgreSQL one shared by several servers,
+// so their payloads survive an incident and can be re-driven through the
+// admin API once the cause is fixed. Invocations whose input was streamed or
+// uploaded can't be replayed and are not captured, nor are those whose
+// caller went away.
+type DeadLetters struct {
+	kv KVBackend
+
+	mu       sync.Mutex
+	captured atomic.Int64
+}
+
+// deadLetter is a captured failure.
+type deadLetter struct {
+	ID        string `json:"id"`
+	Route     string `json:"route"`
+	RequestID string `json:"request_id,omitempty"`
+	Trigger   string `json:"trigger,omitempty"`
+	// Payload and Stderr are left out of listings.
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Stderr   string          `json:"stderr,omitempty"`
+	Error    string          `json:"error"`
+	ExitCode *int            `json:"exit_code,omitempty"`
+	Started  time.Time       `json:"started"`
+	Failed   time.Time       `json:"failed"`
+	// Redrives counts failed re-drives.
+	Redrives int `json:"redrives"`
+}
+
+// NewDeadLetters keeps dead letters in the storage named by spec; see
+// openStorage.
+func NewDeadLetters(spec string) (*DeadLetters, error) {
+	kv, err := openStorage(spec, "deadletter")
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetters{kv: kv}, nil
+}
+
+// Capture records the failure of call, which started at started, unless
+// it can't or needn't be re-driven.
+func (d *DeadLetters) Capture(call Invocation, res *Result, err error, started time.Time, canceled bool) {
+	if call.NoDeadLetter || call.Stdin != nil || call.Stdout != nil || len(call.ReadPaths) > 0 || canceled || !json.Valid(call.Payload) {
+		return
+	}
+	dl := &deadLetter{
+		ID:        newRecordID(),
+		Route:     call.Route.Name,
+		RequestID: call.Request.ID,
+		Trigger:   call.Request.Trigger,
+		Payload:   call.Payload,
+		Started:   started.UTC(),
+	}
+	dl.fail(res, err)
+	if err := d.write(dl); err != nil {
+		log.Printf("%s: dead letter: %v", call.Route.Name, err)
+		return
+	}
+	d.captured.Add(1)
+	infof("%s: captured dead letter %s", call.Route.Name, dl.ID)
+}
+
+// newRecordID returns a unique ID for a record, ordered by time.
+func newRecordID() string {
+	var id [4]byte
+	rand.Read(id[:])
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(id[:]))
+}
+
+// fail records the outcome of a failed attempt at dl.
+func (dl *deadLetter) fail(res *Result, err error) {
+	dl.Failed = time.Now().UTC()
+	dl.Error = err.Error()
+	dl.Stderr = string(res.Stderr[:min(len(res.Stderr), maxDeadLetterStderr)])
+	dl.ExitCode = nil
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		code := exit.ExitCode()
+		dl.ExitCode = &code
+	}
+}
+
+// write stores dl.
+func (d *DeadLetters) write(dl *deadLetter) error {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	_, err = d.kv.Put(dl.ID, b, 0, false)
+	return err
+}
+
+// Get returns the dead letter id.
+func (d *DeadLetters) Get(id string) (*deadLetter, error) {
+	if !deadLetterIDPattern.MatchString(id) {
+		return nil, errDeadLetterNotFound
+	}
+	b, err := d.kv.Get(id)
+	if errors.Is(err, errKeyNotFound) {
+		return nil, errDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var dl deadLetter
+	if err := json.Unmarshal(b, &dl); err != nil {
+		return nil, fmt.Errorf("dead letter %s: %w", id, err)
+	}
+	return &dl, nil
+}
+
+// List returns the dead letters of route, or of every route when route is
+// empty, oldest first and without their payloads and stderr.
+func (d *DeadLetters) List(route string) ([]*deadLetter, error) {
+	ids, err := d.kv.Keys("")
+	if err != nil {
+		return nil, err
+	}
+	out := []*deadLetter{}
+	for _, id := range ids {
+		if !deadLetterIDPattern.MatchString(id) {
+			continue
+		}
+		dl, err := d.Get(id)
+		if errors.Is(err, errDeadLetterNotFound) {
+			// Deleted or re-driven meanwhile.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if route != "" && dl.Route != route {
+			continue
+		}
+		dl.Payload, dl.Stderr = nil, ""
+		out = append(out, dl)
+	}
+	slices.SortFunc(out, func(a, b *deadLetter) int { return a.Failed.Compare(b.Failed) })
+	return out, nil
+}
+
+// Delete removes the dead letter id.
+func (d *DeadLetters) Delete(id string) error {
+	if !deadLetterIDPattern.MatchString(id) {
+		return errDeadLetterNotFound
+	}
+	if _, err := d.kv.Get(id); err != nil {
+		if errors.Is(err, errKeyNotFound) {
+			return errDeadLetterNotFound
+		}
+		return err
+	}
+	return d.kv.Delete(id)
+}
+
+// redriveResult is the response to a re-drive.
+type redriveResult struct {
+	ID     string          `json:"id"`
+	OK     bool            `json:"ok"`
+	Output json.RawMessage `json:"output,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// redrive invokes route with the payload of dl. Success deletes dl;
+// failure updates it, keeping it for another try.
+func (d *DeadLetters) redrive(r *http.Request, inv *Invoker, route *Route, dl *deadLetter) (redriveResult, error) {
+	// Re-drives are serialized so that a letter can't be re-driven twice
+	// at once.
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := d.Get(dl.ID); err != nil {
+		return redriveResult{}, err
+	}
+	res, err := inv.Invoke(r.Context(), Invocation{
+		Route:        route,
+		Payload:      dl.Payload,
+		Request:      RequestInfo{ID: dl.RequestID},
+		NoCache:      true,
+		NoDeadLetter: true,
+	})
+	if err == nil {
+		out := redriveResult{ID: dl.ID, OK: true, Output: rawOutput(res.Stdout)}
+		return out, d.Delete(dl.ID)
+	}
+	dl.Redrives++
+	dl.fail(res, err)
+	return redriveResult{ID: dl.ID, Error: err.Error()}, d.write(dl)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/subtle"
+	"math"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// serverStarted is when the process started, for the uptime reported by
+// /debug/runtime.
+var serverStarted = time.Now()
+
+// debugHandler serves diagnostics of the server process itself on
+// --debug-listen, for profiling it under load:
+//
+//	GET /debug/pprof/                 the net/http/pprof index and profiles
+//	GET /debug/pprof/profile?seconds=30
+//	GET /debug/pprof/goroutine?debug=2
+//	GET /debug/runtime                goroutines, memory and GC stats as JSON
+//
+// Scripts run in their own processes and don't show up in the profiles.
+// With --admin-token set, requests need the same bearer token as /admin.
+func debugHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("GET /debug/runtime", serveRuntimeStats)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			got, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="debug"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// runtimeStats is the response of GET /debug/runtime. Byte counts are as
+// in runtime.MemStats.
+type runtimeStats struct {
+	GoVersion  string `json:"go_version"`
+	Uptime     string `json:"uptime"`
+	Goroutines int    `json:"goroutines"`
+	GOMAXPROCS int    `json:"gomaxprocs"`
+	NumCPU     int    `json:"num_cpu"`
+	CgoCalls   int64  `json:"cgo_calls"`
+	// MemoryLimit is the soft limit set by GOMEMLIMIT, if any.
+	MemoryLimit int64 `json:"memory_limit,omitempty"`
+
+	HeapAlloc    uint64 `json:"heap_alloc"`
+	HeapInuse    uint64 `json:"heap_inuse"`
+	HeapIdle     uint64 `json:"heap_idle"`
+	HeapReleased uint64 `json:"heap_released"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	StackInuse   uint64 `json:"stack_inuse"`
+	Sys          uint64 `json:"sys"`
+	TotalAlloc   uint64 `json:"total_alloc"`
+	Mallocs      uint64 `json:"mallocs"`
+	Frees        uint64 `json:"frees"`
+
+	NumGC         uint32     `json:"num_gc"`
+	NextGC        uint64     `json:"next_gc"`
+	LastGC        *time.Time `json:"last_gc,omitempty"`
+	PauseTotal    string     `json:"pause_total"`
+	LastPause     string     `json:"last_pause"`
+	GCCPUFraction float64    `json:"gc_cpu_fraction"`
+}
+
+func serveRuntimeStats(w http.ResponseWriter, r *http.Request) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	s := runtimeStats{
+		GoVersion:    runtime.Version(),
+		Uptime:       time.Since(serverStarted).Round(time.Second).String(),
+		Goroutines:   runtime.NumGoroutine(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		NumCPU:       runtime.NumCPU(),
+		CgoCalls:     runtime.NumCgoCall(),
+		HeapAlloc:    m.HeapAlloc,
+		HeapInuse:    m.HeapInuse,
+		HeapIdle:     m.HeapIdle,
+		HeapReleased: m.HeapReleased,
+		HeapObjects:  m.HeapObjects,
+		StackInuse:   m.StackInuse,
+		Sys:          m.Sys,
+		TotalAlloc:   m.TotalAlloc,
+		Mallocs:      m.Mallocs,
+		Frees:        m.Frees,
+		NumGC:        m.NumGC,
+		NextGC:       m.NextGC,
+		PauseTotal:   time.Duration(m.PauseTotalNs).String(),
+		// The most recent pause is at (NumGC+255)%256.
+		LastPause:     time.Duration(m.PauseNs[(m.NumGC+255)%256]).String(),
+		GCCPUFraction: m.GCCPUFraction,
+	}
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		s.MemoryLimit = limit
+	}
+	if m.LastGC > 0 {
+		t := time.Unix(0, int64(m.LastGC)).UTC()
+		s.LastGC = &t
+	}
+	writeJSON(w, http.StatusOK, s)
+}
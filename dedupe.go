@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dedupeReplay   = "replay"
+	dedupeConflict = "conflict"
+)
+
+var errDuplicate = errors.New("a payload with this dedupe key was already processed")
+
+// DedupeConfig protects scripts that aren't idempotent from webhook
+// providers redelivering events, by running each event once:
+//
+//	dedupe:
+//	  key: $.event.id
+//	  ttl: 72h
+//	  on_duplicate: conflict
+//
+// Key is a dot separated path into the JSON payload, as seen by the
+// script; array elements are selected by index, e.g. $.records.0.id.
+// Payloads whose key was seen within TTL are answered with the first
+// one's output, like repeats of an Idempotency-Key, or with 409 Conflict
+// when OnDuplicate is conflict. The keys are kept in --idempotency-dir,
+// which must be set, with the same guarantees: duplicates arriving while
+// the first payload runs wait for it, and failed invocations don't count.
+// Payloads without the key run every time.
+//
+// Deduplication applies to the route running the script, so with rules
+// it is declared on their targets.
+type DedupeConfig struct {
+	Key string        `yaml:"key"`
+	TTL time.Duration `yaml:"ttl"`
+	// OnDuplicate is replay (the default) or conflict.
+	OnDuplicate string `yaml:"on_duplicate"`
+}
+
+// Dedupe is a built DedupeConfig.
+type Dedupe struct {
+	path fieldPath
+	// ttl is zero for --idempotency-ttl.
+	ttl      time.Duration
+	conflict bool
+}
+
+func newDedupe(dc DedupeConfig) (*Dedupe, error) {
+	paths, err := parsePaths([]string{strings.TrimPrefix(dc.Key, "$.")})
+	if err != nil {
+		return nil, fmt.Errorf("key: %w", err)
+	}
+	if dc.TTL < 0 {
+		return nil, errors.New("ttl must not be negative")
+	}
+	d := &Dedupe{path: paths[0], ttl: dc.TTL}
+	switch dc.OnDuplicate {
+	case "", dedupeReplay:
+	case dedupeConflict:
+		d.conflict = true
+	default:
+		return nil, fmt.Errorf("on_duplicate must be %s or %s", dedupeReplay, dedupeConflict)
+	}
+	return d, nil
+}
+
+// key returns the dedupe key of payload, or false when payload has none.
+// Keys are kept apart from Idempotency-Key values, which can't contain a
+// NUL byte.
+func (d *Dedupe) key(payload []byte) (string, bool) {
+	var v any
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return "", false
+	}
+	for _, seg := range d.path {
+		switch node := v.(type) {
+		case map[string]any:
+			v = node[seg]
+		case []any:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", false
+			}
+			v = node[i]
+		default:
+			return "", false
+		}
+	}
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		if v == "" {
+			return "", false
+		}
+		return "dedupe\x00" + v, true
+	default:
+		b, _ := json.Marshal(v)
+		return "dedupe\x00" + string(b), true
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDedupeKey(t *testing.T) {
+	tests := []struct {
+		path    string
+		payload string
+		want    string
+		wantOK  bool
+	}{
+		{path: "$.event.id", payload: `{"event":{"id":"e1"}}`, want: "dedupe\x00e1", wantOK: true},
+		{path: "event.id", payload: `{"event":{"id":"e1"}}`, want: "dedupe\x00e1", wantOK: true},
+		{path: "$.records.1.id", payload: `{"records":[{"id":1},{"id":2}]}`, want: "dedupe\x002", wantOK: true},
+		{path: "$.id", payload: `{"id":{"b":1,"a":2}}`, want: "dedupe\x00" + `{"a":2,"b":1}`, wantOK: true},
+		{path: "$.id", payload: `{"other":1}`},
+		{path: "$.id", payload: `{"id":""}`},
+		{path: "$.id", payload: `{"id":null}`},
+		{path: "$.records.2.id", payload: `{"records":[{"id":1}]}`},
+		{path: "$.records.x", payload: `{"records":[{"id":1}]}`},
+		{path: "$.id.x", payload: `{"id":"e1"}`},
+		{path: "$.id", payload: `not json`},
+	}
+	for _, tt := range tests {
+		d, err := newDedupe(DedupeConfig{Key: tt.path})
+		if err != nil {
+			t.Fatalf("newDedupe(%q): %v", tt.path, err)
+		}
+		got, ok := d.key([]byte(tt.payload))
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("key(%s) at %s = %q, %v, want %q, %v", tt.payload, tt.path, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestNewDedupe(t *testing.T) {
+	for _, dc := range []DedupeConfig{
+		{Key: "$.id", TTL: -1},
+		{Key: "$.id", OnDuplicate: "drop"},
+	} {
+		if _, err := newDedupe(dc); err == nil {
+			t.Errorf("newDedupe(%+v) accepted an invalid config", dc)
+		}
+	}
+}
+
+const dedupeConfig = `
+routes:
+  replay:
+    script: "process.stdout.write(JSON.stringify({run: Math.random()}))"
+    dedupe:
+      key: $.event.id
+  conflict:
+    script: "process.stdout.write(JSON.stringify({run: Math.random()}))"
+    dedupe:
+      key: $.event.id
+      on_duplicate: conflict
+`
+
+// TestDedupeRoutes checks that redeliveries of an event run the script
+// once, even when the rest of their payload differs.
+func TestDedupeRoutes(t *testing.T) {
+	s := newRouteTest(t, map[string]string{"config.yaml": dedupeConfig}, func(inv *Invoker) {
+		inv.idempotency = newTestIdempotency(t)
+	})
+	first := serveTest(t, s, "/invoke/replay", `{"event":{"id":"e1"},"attempt":1}`, nil)
+	if first.Code != http.StatusOK {
+		t.Fatalf("first delivery: %d %s", first.Code, first.Body)
+	}
+	again := serveTest(t, s, "/invoke/replay", `{"event":{"id":"e1"},"attempt":2}`, nil)
+	if again.Body.String() != first.Body.String() || again.Header().Get(idempotencyReplayedHeader) != "true" {
+		t.Errorf("redelivery got %s (replayed %q), want %s replayed", again.Body, again.Header().Get(idempotencyReplayedHeader), first.Body)
+	}
+	if other := serveTest(t, s, "/invoke/replay", `{"event":{"id":"e2"}}`, nil); other.Body.String() == first.Body.String() {
+		t.Error("another event got the first one's output")
+	}
+	if a, b := serveTest(t, s, "/invoke/replay", `{}`, nil), serveTest(t, s, "/invoke/replay", `{}`, nil); a.Body.String() == b.Body.String() {
+		t.Error("payloads without the key were deduplicated")
+	}
+	// An Idempotency-Key takes precedence over the dedupe key.
+	keyed := serveTest(t, s, "/invoke/replay", `{"event":{"id":"e1"}}`, http.Header{idempotencyKeyHeader: {"k1"}})
+	if keyed.Body.String() == first.Body.String() {
+		t.Error("a request with an Idempotency-Key was answered by the dedupe key")
+	}
+
+	if w := serveTest(t, s, "/invoke/conflict", `{"event":{"id":"e1"}}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("first delivery: %d %s", w.Code, w.Body)
+	}
+	if w := serveTest(t, s, "/invoke/conflict", `{"event":{"id":"e1"},"attempt":2}`, nil); w.Code != http.StatusConflict {
+		t.Errorf("redelivery status = %d, want 409", w.Code)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const dependencyCheckTimeout = 5 * time.Second
+
+// Dependencies are the external requirements a route declares, checked at
+// startup and periodically afterwards so /readyz names the failing one.
+type Dependencies struct {
+	// URLs must answer a GET with a status below 500.
+	URLs []string `yaml:"urls"`
+	// Hosts must resolve in DNS.
+	Hosts []string `yaml:"hosts"`
+	// Env variables must be set, by the server environment, the route's
+	// env or its secret_files.
+	Env []string `yaml:"env"`
+}
+
+// dependencyStatus is the outcome of checking one dependency.
+type dependencyStatus struct {
+	Kind  string `json:"kind"`
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// missingEnv returns the declared variables route would run without.
+func (d *Dependencies) missingEnv(route *Route) []string {
+	var missing []string
+	for _, name := range d.Env {
+		if os.Getenv(name) != "" || route.Env[name] != "" {
+			continue
+		}
+		if _, ok := route.SecretFiles[name]; ok {
+			continue
+		}
+		missing = append(missing, name)
+	}
+	return missing
+}
+
+// DependencyChecker periodically checks the network dependencies of its
+// routes.
+type DependencyChecker struct {
+	interval time.Duration
+	client   *http.Client
+
+	mu     sync.Mutex
+	routes []*Route
+	status map[string][]dependencyStatus
+}
+
+func NewDependencyChecker(interval time.Duration) *DependencyChecker {
+	return &DependencyChecker{
+		interval: interval,
+		client:   &http.Client{Timeout: dependencyCheckTimeout},
+		status:   map[string][]dependencyStatus{},
+	}
+}
+
+// Add registers route, replacing any route of the same name, failing when
+// required environment variables are missing since no amount of waiting
+// will fix that.
+func (c *DependencyChecker) Add(route *Route) error {
+	if missing := route.Depends.missingEnv(route); len(missing) > 0 {
+		return fmt.Errorf("missing required environment variables %v", missing)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routes = slices.DeleteFunc(slices.Clone(c.routes), func(rt *Route) bool { return rt.Name == route.Name })
+	c.routes = append(c.routes, route)
+	return nil
+}
+
+// Remove stops checking the route name.
+func (c *DependencyChecker) Remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routes = slices.DeleteFunc(slices.Clone(c.routes), func(rt *Route) bool { return rt.Name == name })
+	delete(c.status, name)
+}
+
+// Start checks every route once, logging failures, and then rechecks them
+// every interval until ctx is done.
+func (c *DependencyChecker) Start(ctx context.Context) {
+	c.checkAll(ctx)
+	go func() {
+		t := time.NewTicker(c.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				c.checkAll(ctx)
+			}
+		}
+	}()
+}
+
+func (c *DependencyChecker) checkAll(ctx context.Context) {
+	c.mu.Lock()
+	routes := c.routes
+	c.mu.Unlock()
+
+	for _, route := range routes {
+		statuses := c.check(ctx, route.Depends)
+		c.mu.Lock()
+		if !slices.Contains(c.routes, route) {
+			// A reload replaced or removed the route meanwhile.
+			c.mu.Unlock()
+			continue
+		}
+		prev := c.status[route.Name]
+		c.status[route.Name] = statuses
+		c.mu.Unlock()
+
+		for i, st := range statuses {
+			wasOK := i < len(prev) && prev[i].OK
+			if !st.OK && (wasOK || prev == nil) {
+				log.Printf("route %s: dependency %s %s failing: %s", route.Name, st.Kind, st.Name, st.Error)
+			} else if st.OK && prev != nil && !wasOK {
+				log.Printf("route %s: dependency %s %s recovered", route.Name, st.Kind, st.Name)
+			}
+		}
+	}
+}
+
+func (c *DependencyChecker) check(ctx context.Context, d *Dependencies) []dependencyStatus {
+	var out []dependencyStatus
+	for _, u := range d.URLs {
+		out = append(out, result("url", u, c.checkURL(ctx, u)))
+	}
+	for _, h := range d.Hosts {
+		out = append(out, result("host", h, checkHost(ctx, h)))
+	}
+	return out
+}
+
+func result(kind, name string, err error) dependencyStatus {
+	if err != nil {
+		return dependencyStatus{Kind: kind, Name: name, Error: err.Error()}
+	}
+	return dependencyStatus{Kind: kind, Name: name, OK: true}
+}
+
+func (c *DependencyChecker) checkURL(ctx context.Context, u string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+func checkHost(ctx context.Context, host string) error {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ctx, cancel := context.WithTimeout(ctx, dependencyCheckTimeout)
+	defer cancel()
+	_, err := net.DefaultResolver.LookupHost(ctx, host)
+	return err
+}
+
+// Status returns the latest results per route and whether all passed.
+func (c *DependencyChecker) Status() (ok bool, routes map[string][]dependencyStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ok = true
+	routes = make(map[string][]dependencyStatus, len(c.status))
+	for name, statuses := range c.status {
+		routes[name] = statuses
+		for _, st := range statuses {
+			ok = ok && st.OK
+		}
+	}
+	return ok, routes
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dockerRemoveTimeout bounds removing a container left behind by a killed
+// invocation.
+const dockerRemoveTimeout = 10 * time.Second
+
+// dockerHostEnv are variables of the server environment describing the
+// host rather than the script, which aren't passed into containers.
+var dockerHostEnv = map[string]bool{
+	"PATH":     true,
+	"HOME":     true,
+	"HOSTNAME": true,
+	"USER":     true,
+	"SHELL":    true,
+	"PWD":      true,
+}
+
+// DockerConfig runs every invocation, and every persistent worker, in a
+// container of Image for stronger isolation of untrusted scripts than the
+// permission model gives. The script, the paths it is granted and its
+// working directory are bind mounted at the same paths, read-only unless
+// written to, and node runs as the server's user. Mounts adds host:path
+// or host:path:ro volumes; Network is the docker network, docker's
+// default when empty, and none keeps scripts offline. Memory, CPU weight
+// and pids limits are enforced by docker instead of --cgroup-parent.
+//
+// The image's node should match the host's, which flags are detected
+// with. Scripts in containers can't set their response through fd 3.
+type DockerConfig struct {
+	Image   string
+	Network string
+	Mounts  []string
+}
+
+func (c DockerConfig) validate() error {
+	if c.Image == "" {
+		return errors.New("no image")
+	}
+	for _, m := range c.Mounts {
+		parts := strings.Split(m, ":")
+		if len(parts) < 2 || len(parts) > 3 || !filepath.IsAbs(parts[1]) || (len(parts) == 3 && parts[2] != "ro" && parts[2] != "rw") {
+			return fmt.Errorf("mount %q is not host:path[:ro]", m)
+		}
+	}
+	return nil
+}
+
+type dockerExecutor struct {
+	cfg    DockerConfig
+	limits ResourceLimits
+	cli    string
+}
+
+func newDockerExecutor(cfg DockerConfig, limits ResourceLimits) (*dockerExecutor, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	cli, err := exec.LookPath("docker")
+	if err != nil {
+		return nil, err
+	}
+	return &dockerExecutor{cfg: cfg, limits: limits, cli: cli}, nil
+}
+
+func (d *dockerExecutor) Local() bool { return false }
+
+func (d *dockerExecutor) Command(ctx context.Context, spec ExecSpec) (*exec.Cmd, func()) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	name := "invoke-" + hex.EncodeToString(b)
+	args := []string{"run", "--rm", "--interactive", "--init",
+		"--name", name,
+		"--label", "go-invoke-node.route=" + spec.Route.Name,
+		"--user", strconv.Itoa(os.Getuid()) + ":" + strconv.Itoa(os.Getgid()),
+	}
+	if d.cfg.Network != "" {
+		args = append(args, "--network", d.cfg.Network)
+	}
+	if d.limits.Memory > 0 {
+		args = append(args, "--memory", strconv.FormatInt(d.limits.Memory, 10))
+	}
+	if d.limits.CPUWeight > 0 {
+		// cpu.weight defaults to 100 where CPU shares default to 1024.
+		args = append(args, "--cpu-shares", strconv.Itoa(max(d.limits.CPUWeight*1024/100, 2)))
+	}
+	if d.limits.Pids > 0 {
+		args = append(args, "--pids-limit", strconv.Itoa(d.limits.Pids))
+	}
+	args = append(args, d.volumes(spec)...)
+	if spec.Dir != "" {
+		args = append(args, "--workdir", spec.Dir)
+	}
+	// The values are taken from the environment of the docker command, so
+	// they don't show in its command line.
+	seen := map[string]bool{}
+	for _, kv := range spec.Env {
+		k, _, _ := strings.Cut(kv, "=")
+		if k == "" || seen[k] || dockerHostEnv[k] || strings.HasPrefix(k, "DOCKER_") {
+			continue
+		}
+		seen[k] = true
+		args = append(args, "--env", k)
+	}
+	args = append(args, d.cfg.Image, "node")
+	args = append(args, spec.Args...)
+
+	cmd := exec.CommandContext(ctx, d.cli, args...)
+	cmd.Env = spec.Env
+	setProcessGroup(cmd)
+	// Killing the docker command leaves the container running.
+	remove := sync.OnceFunc(func() { d.remove(name) })
+	cmd.Cancel = func() error {
+		remove()
+		return killProcessGroup(cmd.Process)
+	}
+	return cmd, func() {
+		reapProcessGroup(cmd.Process)
+		if cmd.ProcessState == nil || !cmd.ProcessState.Exited() {
+			remove()
+		}
+	}
+}
+
+// volumes returns the bind mounts of spec.
+func (d *dockerExecutor) volumes(spec ExecSpec) []string {
+	mounts := map[string]string{}
+	mount := func(path, mode string) {
+		if path == "" || mounts[path] == "rw" {
+			return
+		}
+		mounts[path] = mode
+	}
+	if f := spec.Route.ScriptFile; f != "" {
+		// Modules next to the script are read too.
+		mount(filepath.Dir(absPath(f)), "ro")
+	}
+	for _, p := range spec.ReadPaths {
+		mount(p, "ro")
+	}
+	for _, p := range spec.WritePaths {
+		mount(p, "rw")
+	}
+	if spec.Dir != "" {
+		mount(spec.Dir, "rw")
+	}
+	var args []string
+	for _, p := range slices.Sorted(maps.Keys(mounts)) {
+		args = append(args, "--volume", p+":"+p+":"+mounts[p])
+	}
+	for _, m := range d.cfg.Mounts {
+		args = append(args, "--volume", m)
+	}
+	return args
+}
+
+// remove stops and removes the container name.
+func (d *dockerExecutor) remove(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerRemoveTimeout)
+	defer cancel()
+	exec.CommandContext(ctx, d.cli, "rm", "--force", name).Run()
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// egressProxyUser is the user name in the per-invocation proxy URL; the
+// password identifies the invocation.
+const egressProxyUser = "invoke"
+
+// EgressBudget limits the downstream calls one invocation may make.
+// Zero values mean unlimited.
+type EgressBudget struct {
+	MaxCalls int
+	// MaxTime bounds the total time spent in downstream calls.
+	MaxTime time.Duration
+	// Allow lists the permitted destination hosts as path.Match
+	// patterns, e.g. "*.example.com". Empty allows any host.
+	Allow []string
+}
+
+// EgressProxy is a local HTTP proxy handed to scripts through HTTP_PROXY
+// and HTTPS_PROXY that enforces each invocation's EgressBudget and
+// records its downstream calls. Only clients honoring the proxy variables
+// are covered; node's built-in fetch does so from Node 24 when
+// NODE_USE_ENV_PROXY=1 is set, which the proxy environment includes.
+type EgressProxy struct {
+	budget    EgressBudget
+	addr      string
+	transport *http.Transport
+	// mappedTransport carries the calls to hosts mapped by the route,
+	// without keeping connections that other routes could pick up.
+	mappedTransport *http.Transport
+
+	mu       sync.Mutex
+	sessions map[string]*egressSession
+}
+
+// egressSession tracks the downstream calls of one invocation.
+type egressSession struct {
+	proxy *EgressProxy
+	token string
+	// upstream, when set, is the route's proxy calls are forwarded
+	// through.
+	upstream *RouteProxy
+	// mapped is the route's host mappings.
+	mapped map[string]string
+
+	mu     sync.Mutex
+	calls  int
+	spent  time.Duration
+	denied int
+	hosts  map[string]int
+}
+
+// egressSessionKey carries the session of a forwarded request to the
+// transport's Proxy func.
+type egressSessionKey struct{}
+
+// StartEgressProxy listens on a loopback port and serves the proxy in the
+// background.
+func StartEgressProxy(budget EgressBudget) (*EgressProxy, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &EgressProxy{
+		budget: budget,
+		addr:   ln.Addr().String(),
+		transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				s, _ := r.Context().Value(egressSessionKey{}).(*egressSession)
+				if s == nil {
+					return nil, nil
+				}
+				return s.upstream.upstream(r.URL)
+			},
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		sessions: map[string]*egressSession{},
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	p.mappedTransport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			s, _ := ctx.Value(egressSessionKey{}).(*egressSession)
+			if s != nil {
+				addr = mapHost(s.mapped, addr)
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		DisableKeepAlives: true,
+	}
+	go http.Serve(ln, p)
+	return p, nil
+}
+
+// Begin opens a session for one invocation of route, whose calls go
+// through its proxy and to its host mappings, if any.
+func (p *EgressProxy) Begin(route *Route) *egressSession {
+	b := make([]byte, 16)
+	rand.Read(b)
+	s := &egressSession{proxy: p, token: hex.EncodeToString(b), upstream: route.Proxy, mapped: route.Hosts, hosts: map[string]int{}}
+	p.mu.Lock()
+	p.sessions[s.token] = s
+	p.mu.Unlock()
+	return s
+}
+
+// Env returns the variables pointing the script's HTTP clients at the
+// proxy.
+func (s *egressSession) Env() []string {
+	u := "http://" + egressProxyUser + ":" + s.token + "@" + s.proxy.addr
+	return []string{
+		"HTTP_PROXY=" + u, "http_proxy=" + u,
+		"HTTPS_PROXY=" + u, "https_proxy=" + u,
+		"NO_PROXY=", "no_proxy=",
+		"NODE_USE_ENV_PROXY=1",
+	}
+}
+
+// End closes the session so its proxy credentials stop working, and
+// returns a one-line summary of the calls made.
+func (s *egressSession) End() string {
+	s.proxy.mu.Lock()
+	delete(s.proxy.sessions, s.token)
+	s.proxy.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hosts := make([]string, 0, len(s.hosts))
+	for h, n := range s.hosts {
+		hosts = append(hosts, fmt.Sprintf("%s=%d", h, n))
+	}
+	sort.Strings(hosts)
+	return fmt.Sprintf("%d calls in %s, %d denied [%s]", s.calls, s.spent.Round(time.Millisecond), s.denied, strings.Join(hosts, " "))
+}
+
+// admit charges one call to host against the budget and returns the time
+// left for it, zero meaning no limit.
+func (s *egressSession) admit(host string) (time.Duration, error) {
+	b := s.proxy.budget
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := func() error {
+		if len(b.Allow) > 0 && !hostAllowed(host, b.Allow) {
+			return fmt.Errorf("destination %s not allowed", host)
+		}
+		if b.MaxCalls > 0 && s.calls >= b.MaxCalls {
+			return fmt.Errorf("call budget of %d exhausted", b.MaxCalls)
+		}
+		if b.MaxTime > 0 && s.spent >= b.MaxTime {
+			return fmt.Errorf("time budget of %s exhausted", b.MaxTime)
+		}
+		return nil
+	}()
+	if err != nil {
+		s.denied++
+		return 0, err
+	}
+	s.calls++
+	s.hosts[host]++
+	if b.MaxTime > 0 {
+		return b.MaxTime - s.spent, nil
+	}
+	return 0, nil
+}
+
+func (s *egressSession) charge(d time.Duration) {
+	s.mu.Lock()
+	s.spent += d
+	s.mu.Unlock()
+}
+
+func hostAllowed(host string, allow []string) bool {
+	for _, pattern := range allow {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *EgressProxy) session(r *http.Request) *egressSession {
+	auth, ok := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return nil
+	}
+	user, token, _ := strings.Cut(string(raw), ":")
+	if user != egressProxyUser {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sessions[token]
+}
+
+func (p *EgressProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := p.session(r)
+	if s == nil {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="invoke"`)
+		http.Error(w, "unknown invocation", http.StatusProxyAuthRequired)
+		return
+	}
+
+	host := r.URL.Hostname()
+	if r.Method == http.MethodConnect {
+		host, _, _ = net.SplitHostPort(r.Host)
+	}
+	remaining, err := s.admit(host)
+	if err != nil {
+		http.Error(w, "egress denied: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	start := time.Now()
+	defer func() { s.charge(time.Since(start)) }()
+
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r, s, remaining)
+		return
+	}
+	p.forward(w, r, s, remaining)
+}
+
+func (p *EgressProxy) forward(w http.ResponseWriter, r *http.Request, s *egressSession, remaining time.Duration) {
+	ctx := context.WithValue(r.Context(), egressSessionKey{}, s)
+	if remaining > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, remaining)
+		defer cancel()
+	}
+	out := r.Clone(ctx)
+	out.RequestURI = ""
+	for _, h := range []string{"Proxy-Authorization", "Proxy-Connection", "Connection", "Keep-Alive", "Te", "Trailer", "Upgrade"} {
+		out.Header.Del(h)
+	}
+
+	transport := p.transport
+	if _, ok := s.mapped[strings.TrimSuffix(strings.ToLower(out.URL.Hostname()), ".")]; ok {
+		transport = p.mappedTransport
+	}
+	resp, err := transport.RoundTrip(out)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, context.DeadlineExceeded) {
+			status = http.StatusGatewayTimeout
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer resp.Body.Close()
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (p *EgressProxy) tunnel(w http.ResponseWriter, r *http.Request, s *egressSession, remaining time.Duration) {
+	via, err := s.upstream.upstream(&url.URL{Scheme: "https", Host: r.Host})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	var upstream net.Conn
+	var upstreamReader io.Reader
+	if via != nil {
+		var br *bufio.Reader
+		upstream, br, err = dialConnect(via, r.Host, 10*time.Second)
+		upstreamReader = br
+	} else {
+		upstream, err = net.DialTimeout("tcp", mapHost(s.mapped, r.Host), 10*time.Second)
+		upstreamReader = upstream
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Printf("egress: hijack: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+	if remaining > 0 {
+		deadline := time.Now().Add(remaining)
+		conn.SetDeadline(deadline)
+		upstream.SetDeadline(deadline)
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, buf)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstreamReader)
+		done <- struct{}{}
+	}()
+	<-done
+}
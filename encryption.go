@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	// joseContentType marks a request body as a JWE in compact
+	// serialization (RFC 7516).
+	joseContentType = "application/jose"
+
+	// decryptionKeyEnvKey passes the key to scripts of routes decrypting
+	// their payloads themselves.
+	decryptionKeyEnvKey = "INVOKE_DECRYPTION_KEY"
+
+	// Route.Encryption modes.
+	encryptionRequired = "required"
+	encryptionScript   = "script"
+)
+
+var errUnsupportedJWE = errors.New("unsupported JWE")
+
+// Decrypter decrypts JWE payloads sent with Content-Type application/jose,
+// so PII stays encrypted past TLS-terminating proxies up to this server.
+// Its key file holds either a PEM private key, RSA for the RSA-OAEP and
+// RSA-OAEP-256 algorithms or ECDSA P-256 for ECDH-ES, or a base64 encoded
+// 128, 192 or 256-bit key for dir. Content is encrypted with A128GCM,
+// A192GCM or A256GCM.
+//
+// Decrypted payloads are handled like plain JSON ones: transformed,
+// validated, cached and audited. Routes with encryption: required reject
+// plain payloads, and those with encryption: script receive the JWE as a
+// JSON string along with the key in INVOKE_DECRYPTION_KEY, leaving the
+// plaintext to the script alone.
+type Decrypter struct {
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdh.PrivateKey
+	dirKey []byte
+	// material is the key file's contents, for encryption: script routes.
+	material string
+}
+
+// NewDecrypter loads the key in path.
+func NewDecrypter(path string) (*Decrypter, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d := &Decrypter{material: strings.TrimSpace(string(b))}
+	if block, _ := pem.Decode(b); block != nil {
+		key, err := parsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			d.rsaKey = k
+		case *ecdsa.PrivateKey:
+			if k.Curve != elliptic.P256() {
+				return nil, fmt.Errorf("%s: ECDSA keys must use P-256", path)
+			}
+			if d.ecKey, err = k.ECDH(); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s: unsupported key type %T", path, key)
+		}
+		return d, nil
+	}
+	s := strings.TrimRight(d.material, "=")
+	if d.dirKey, err = base64.RawStdEncoding.DecodeString(s); err != nil {
+		if d.dirKey, err = base64.RawURLEncoding.DecodeString(s); err != nil {
+			return nil, fmt.Errorf("%s: neither a PEM private key nor a base64 encoded key", path)
+		}
+	}
+	if n := len(d.dirKey); n != 16 && n != 24 && n != 32 {
+		return nil, fmt.Errorf("%s: key must be 128, 192 or 256 bits, not %d", path, 8*n)
+	}
+	return d, nil
+}
+
+// isJWE reports whether the body of r is a JWE.
+func isJWE(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mt == joseContentType
+}
+
+// openPayload returns the payload of the JWE body for route, decrypted
+// unless the script decrypts it. It writes the error response and returns
+// false when the JWE is rejected.
+func openPayload(w http.ResponseWriter, body []byte, route *Route, d *Decrypter) ([]byte, bool) {
+	if d == nil {
+		http.Error(w, "encrypted payloads are not enabled", http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+	if route.Encryption == encryptionScript {
+		b, _ := json.Marshal(strings.TrimSpace(string(body)))
+		return b, true
+	}
+	plain, err := d.decrypt(body)
+	if errors.Is(err, errUnsupportedJWE) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if err != nil {
+		// Details would help probing the key, so they are only logged.
+		infof("%s: invalid encrypted payload: %v", route.Name, err)
+		http.Error(w, "invalid encrypted payload", http.StatusBadRequest)
+		return nil, false
+	}
+	return plain, true
+}
+
+// jweHeader is the protected header of a JWE.
+type jweHeader struct {
+	Alg  string       `json:"alg"`
+	Enc  string       `json:"enc"`
+	Zip  string       `json:"zip"`
+	Crit []string     `json:"crit"`
+	Epk  *ecPublicJWK `json:"epk"`
+	Apu  string       `json:"apu"`
+	Apv  string       `json:"apv"`
+}
+
+type ecPublicJWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// decrypt returns the plaintext of the compact JWE in body.
+func (d *Decrypter) decrypt(body []byte) ([]byte, error) {
+	parts := strings.Split(strings.TrimSpace(string(body)), ".")
+	if len(parts) != 5 {
+		return nil, errors.New("not a compact JWE")
+	}
+	raw := make([][]byte, len(parts))
+	for i, p := range parts {
+		var err error
+		if raw[i], err = base64.RawURLEncoding.DecodeString(p); err != nil {
+			return nil, fmt.Errorf("JWE part %d: %w", i+1, err)
+		}
+	}
+	var h jweHeader
+	if err := json.Unmarshal(raw[0], &h); err != nil {
+		return nil, fmt.Errorf("JWE header: %w", err)
+	}
+	if h.Zip != "" || len(h.Crit) > 0 {
+		return nil, fmt.Errorf("%w: zip and crit are not supported", errUnsupportedJWE)
+	}
+	size := map[string]int{"A128GCM": 16, "A192GCM": 24, "A256GCM": 32}[h.Enc]
+	if size == 0 {
+		return nil, fmt.Errorf("%w: enc %q", errUnsupportedJWE, h.Enc)
+	}
+
+	cek, err := d.contentKey(h, raw[1], size)
+	if err != nil {
+		return nil, err
+	}
+	if len(cek) != size {
+		return nil, fmt.Errorf("content key is %d bits, %s needs %d", 8*len(cek), h.Enc, 8*size)
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw[2]) != gcm.NonceSize() || len(raw[4]) != gcm.Overhead() {
+		return nil, errors.New("invalid JWE IV or tag")
+	}
+	// The additional authenticated data is the encoded protected header.
+	plain, err := gcm.Open(nil, raw[2], append(raw[3], raw[4]...), []byte(parts[0]))
+	if err != nil {
+		return nil, errors.New("JWE decryption failed")
+	}
+	return plain, nil
+}
+
+// contentKey recovers the content encryption key of a JWE with header h
+// and encrypted key ek.
+func (d *Decrypter) contentKey(h jweHeader, ek []byte, size int) ([]byte, error) {
+	switch h.Alg {
+	case "dir":
+		if d.dirKey == nil || len(ek) > 0 {
+			break
+		}
+		return d.dirKey, nil
+	case "RSA-OAEP", "RSA-OAEP-256":
+		if d.rsaKey == nil {
+			break
+		}
+		hash := sha1.New()
+		if h.Alg == "RSA-OAEP-256" {
+			hash = sha256.New()
+		}
+		cek, err := rsa.DecryptOAEP(hash, nil, d.rsaKey, ek, nil)
+		if err != nil {
+			return nil, errors.New("JWE decryption failed")
+		}
+		return cek, nil
+	case "ECDH-ES":
+		if d.ecKey == nil || len(ek) > 0 {
+			break
+		}
+		return d.agreeKey(h, size)
+	}
+	return nil, fmt.Errorf("%w: alg %q with this key", errUnsupportedJWE, h.Alg)
+}
+
+// agreeKey derives the content key of an ECDH-ES JWE in direct key
+// agreement mode, by the Concat KDF of RFC 7518 section 4.6.2.
+func (d *Decrypter) agreeKey(h jweHeader, size int) ([]byte, error) {
+	if h.Epk == nil || h.Epk.Kty != "EC" || h.Epk.Crv != "P-256" {
+		return nil, fmt.Errorf("%w: ECDH-ES needs a P-256 epk", errUnsupportedJWE)
+	}
+	x, errX := base64.RawURLEncoding.DecodeString(h.Epk.X)
+	y, errY := base64.RawURLEncoding.DecodeString(h.Epk.Y)
+	if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+		return nil, errors.New("invalid JWE epk")
+	}
+	pub, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...))
+	if err != nil {
+		return nil, errors.New("invalid JWE epk")
+	}
+	z, err := d.ecKey.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	apu, errU := base64.RawURLEncoding.DecodeString(h.Apu)
+	apv, errV := base64.RawURLEncoding.DecodeString(h.Apv)
+	if errU != nil || errV != nil {
+		return nil, errors.New("invalid JWE apu or apv")
+	}
+	// One SHA-256 round yields the 256 bits A256GCM needs at most.
+	m := sha256.New()
+	m.Write(binary.BigEndian.AppendUint32(nil, 1))
+	m.Write(z)
+	for _, field := range [][]byte{[]byte(h.Enc), apu, apv} {
+		m.Write(binary.BigEndian.AppendUint32(nil, uint32(len(field))))
+		m.Write(field)
+	}
+	m.Write(binary.BigEndian.AppendUint32(nil, uint32(8*size)))
+	return m.Sum(nil)[:size], nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sealJWE encrypts plaintext with cek as a compact JWE with header h and
+// encrypted key ek.
+func sealJWE(t *testing.T, h jweHeader, ek, cek, plaintext []byte) string {
+	t.Helper()
+	hb, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := make([]byte, gcm.NonceSize())
+	rand.Read(iv)
+	protected := b64(hb)
+	sealed := gcm.Seal(nil, iv, plaintext, []byte(protected))
+	ct, tag := sealed[:len(plaintext)], sealed[len(plaintext):]
+	return strings.Join([]string{protected, b64(ek), b64(iv), b64(ct), b64(tag)}, ".")
+}
+
+func randomKey(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func ecJWK(pub *ecdh.PublicKey) *ecPublicJWK {
+	b := pub.Bytes()
+	return &ecPublicJWK{Kty: "EC", Crv: "P-256", X: b64(b[1:33]), Y: b64(b[33:])}
+}
+
+// ecdhJWE encrypts plaintext to recipient with ECDH-ES, as a sender
+// would: the content key is agreed between a fresh ephemeral key and the
+// recipient's, which is symmetric.
+func ecdhJWE(t *testing.T, recipient *ecdh.PublicKey, enc string, plaintext []byte) string {
+	t.Helper()
+	eph, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := map[string]int{"A128GCM": 16, "A192GCM": 24, "A256GCM": 32}[enc]
+	h := jweHeader{Alg: "ECDH-ES", Enc: enc, Apu: b64([]byte("sender")), Apv: b64([]byte("recipient"))}
+	sender := &Decrypter{ecKey: eph}
+	cek, err := sender.agreeKey(jweHeader{Enc: enc, Apu: h.Apu, Apv: h.Apv, Epk: ecJWK(recipient)}, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Epk = ecJWK(eph.PublicKey())
+	return sealJWE(t, h, nil, cek, plaintext)
+}
+
+// TestAgreeKey checks the Concat KDF against the ECDH-ES example of RFC
+// 7518 appendix C.
+func TestAgreeKey(t *testing.T) {
+	d, err := base64.RawURLEncoding.DecodeString("VEmDZpDXXK8p8N0Cndsxs924q6nS1RXFASRl6BfUqdw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := jweHeader{
+		Alg: "ECDH-ES",
+		Enc: "A128GCM",
+		Apu: "QWxpY2U",
+		Apv: "Qm9i",
+		Epk: &ecPublicJWK{
+			Kty: "EC",
+			Crv: "P-256",
+			X:   "gI0GAILBdu7T53akrFmMyGcsF3n5dO7MmwNBHKW5SV0",
+			Y:   "SLW_xSffzlPWrHEVI30DHM_4egVwt3NQqeUD7nMFpps",
+		},
+	}
+	key, err := (&Decrypter{ecKey: bob}).agreeKey(h, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b64(key), "VqqN6vgjbSBcIijNcacQGg"; got != want {
+		t.Errorf("agreed key = %s, want %s", got, want)
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := &Decrypter{dirKey: randomKey(16)}
+	rsaD := &Decrypter{rsaKey: rsaKey}
+	ecD := &Decrypter{ecKey: ecKey}
+	plain := []byte(`{"ssn":"123-45-6789"}`)
+
+	rsaJWE := func(alg, enc string, cek []byte) string {
+		hash := sha1.New()
+		if alg == "RSA-OAEP-256" {
+			hash = sha256.New()
+		}
+		ek, err := rsa.EncryptOAEP(hash, rand.Reader, &rsaKey.PublicKey, cek, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sealJWE(t, jweHeader{Alg: alg, Enc: enc}, ek, cek, plain)
+	}
+	// tamper flips a bit of the decoded JWE part i.
+	tamper := func(jwe string, i int) string {
+		parts := strings.Split(jwe, ".")
+		b, _ := base64.RawURLEncoding.DecodeString(parts[i])
+		b[len(b)-1] ^= 1
+		parts[i] = b64(b)
+		return strings.Join(parts, ".")
+	}
+	dirJWE := sealJWE(t, jweHeader{Alg: "dir", Enc: "A128GCM"}, nil, dir.dirKey, plain)
+
+	tests := []struct {
+		name    string
+		d       *Decrypter
+		jwe     string
+		wantErr string
+		// unsupported is whether the error is errUnsupportedJWE.
+		unsupported bool
+	}{
+		{name: "dir", d: dir, jwe: dirJWE},
+		{name: "dir with whitespace", d: dir, jwe: "\n " + dirJWE + "\r\n"},
+		{name: "dir A256GCM", d: &Decrypter{dirKey: make([]byte, 32)}, jwe: sealJWE(t, jweHeader{Alg: "dir", Enc: "A256GCM"}, nil, make([]byte, 32), plain)},
+		{name: "RSA-OAEP A128GCM", d: rsaD, jwe: rsaJWE("RSA-OAEP", "A128GCM", randomKey(16))},
+		{name: "RSA-OAEP-256 A192GCM", d: rsaD, jwe: rsaJWE("RSA-OAEP-256", "A192GCM", randomKey(24))},
+		{name: "RSA-OAEP-256 A256GCM", d: rsaD, jwe: rsaJWE("RSA-OAEP-256", "A256GCM", randomKey(32))},
+		{name: "ECDH-ES A128GCM", d: ecD, jwe: ecdhJWE(t, ecKey.PublicKey(), "A128GCM", plain)},
+		{name: "ECDH-ES A256GCM", d: ecD, jwe: ecdhJWE(t, ecKey.PublicKey(), "A256GCM", plain)},
+
+		{name: "not compact", d: dir, jwe: "a.b.c", wantErr: "not a compact JWE"},
+		{name: "bad base64", d: dir, jwe: "e30.e30.e30.e30.e30!", wantErr: "JWE part 5"},
+		{name: "bad header", d: dir, jwe: b64([]byte("{")) + "....", wantErr: "JWE header"},
+		{
+			name: "zip", d: dir, unsupported: true,
+			jwe: sealJWE(t, jweHeader{Alg: "dir", Enc: "A128GCM", Zip: "DEF"}, nil, dir.dirKey, plain),
+		},
+		{
+			name: "crit", d: dir, unsupported: true,
+			jwe: sealJWE(t, jweHeader{Alg: "dir", Enc: "A128GCM", Crit: []string{"exp"}}, nil, dir.dirKey, plain),
+		},
+		{
+			name: "CBC enc", d: dir, unsupported: true,
+			jwe: strings.Replace(dirJWE, strings.Split(dirJWE, ".")[0], b64([]byte(`{"alg":"dir","enc":"A128CBC-HS256"}`)), 1),
+		},
+		{name: "alg for another key", d: dir, jwe: rsaJWE("RSA-OAEP", "A128GCM", randomKey(16)), unsupported: true},
+		{name: "dir for an RSA key", d: rsaD, jwe: dirJWE, unsupported: true},
+		{name: "key wrapping", d: dir, jwe: sealJWE(t, jweHeader{Alg: "A128KW", Enc: "A128GCM"}, randomKey(24), dir.dirKey, plain), unsupported: true},
+		{name: "dir with an encrypted key", d: dir, jwe: sealJWE(t, jweHeader{Alg: "dir", Enc: "A128GCM"}, []byte{1}, dir.dirKey, plain), unsupported: true},
+		{
+			name: "content key too long", d: &Decrypter{dirKey: make([]byte, 32)},
+			jwe:     strings.Replace(dirJWE, strings.Split(dirJWE, ".")[0], b64([]byte(`{"alg":"dir","enc":"A128GCM"}`)), 1),
+			wantErr: "content key is 256 bits, A128GCM needs 128",
+		},
+		{name: "tampered header", d: dir, jwe: tamper(dirJWE, 0), wantErr: "JWE header"},
+		{
+			// The protected header is authenticated.
+			name: "replaced header", d: dir, wantErr: "JWE decryption failed",
+			jwe: strings.Replace(dirJWE, strings.Split(dirJWE, ".")[0], b64([]byte(`{"alg":"dir","enc":"A128GCM","kid":"x"}`)), 1),
+		},
+		{name: "tampered ciphertext", d: dir, jwe: tamper(dirJWE, 3), wantErr: "JWE decryption failed"},
+		{name: "tampered tag", d: dir, jwe: tamper(dirJWE, 4), wantErr: "JWE decryption failed"},
+		{name: "other dir key", d: &Decrypter{dirKey: randomKey(16)}, jwe: dirJWE, wantErr: "JWE decryption failed"},
+		{name: "short IV", d: dir, jwe: strings.Replace(dirJWE, "."+strings.Split(dirJWE, ".")[2]+".", "."+b64(randomKey(8))+".", 1), wantErr: "invalid JWE IV or tag"},
+		{name: "tampered encrypted key", d: rsaD, jwe: tamper(rsaJWE("RSA-OAEP", "A128GCM", randomKey(16)), 1), wantErr: "JWE decryption failed"},
+		{name: "ECDH-ES to another key", d: ecD, jwe: ecdhJWE(t, ecdhPublic(t), "A128GCM", plain), wantErr: "JWE decryption failed"},
+		{name: "ECDH-ES without epk", d: ecD, jwe: sealJWE(t, jweHeader{Alg: "ECDH-ES", Enc: "A128GCM"}, nil, randomKey(16), plain), unsupported: true},
+		{
+			name: "ECDH-ES epk off the curve", d: ecD, wantErr: "invalid JWE epk",
+			jwe: sealJWE(t, jweHeader{Alg: "ECDH-ES", Enc: "A128GCM", Epk: &ecPublicJWK{Kty: "EC", Crv: "P-256", X: b64(make([]byte, 32)), Y: b64(make([]byte, 32))}}, nil, randomKey(16), plain),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.d.decrypt([]byte(tt.jwe))
+			switch {
+			case tt.unsupported:
+				if !errors.Is(err, errUnsupportedJWE) {
+					t.Errorf("decrypt error = %v, want errUnsupportedJWE", err)
+				}
+			case tt.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("decrypt error = %v, want %q", err, tt.wantErr)
+				}
+				if errors.Is(err, errUnsupportedJWE) {
+					t.Errorf("decrypt error %v is errUnsupportedJWE", err)
+				}
+			case err != nil:
+				t.Errorf("decrypt: %v", err)
+			case string(got) != string(plain):
+				t.Errorf("decrypt = %s, want %s", got, plain)
+			}
+		})
+	}
+}
+
+func ecdhPublic(t *testing.T) *ecdh.PublicKey {
+	k, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k.PublicKey()
+}
+
+func TestNewDecrypter(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	pkcs8 := func(key any) string {
+		b, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}))
+	}
+	ecDER, _ := x509.MarshalECPrivateKey(p256)
+
+	tests := []struct {
+		name, file string
+		wantErr    string
+	}{
+		{"RSA PKCS#1", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})), ""},
+		{"RSA PKCS#8", pkcs8(rsaKey), ""},
+		{"EC", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER})), ""},
+		{"P-384", pkcs8(p384), "must use P-256"},
+		{"base64", base64.StdEncoding.EncodeToString(randomKey(32)) + "\n", ""},
+		{"base64url unpadded", base64.RawURLEncoding.EncodeToString(randomKey(24)), ""},
+		{"short key", base64.StdEncoding.EncodeToString(randomKey(20)), "not 160"},
+		{"garbage", "not a key!", "neither a PEM private key nor a base64 encoded key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "key")
+			if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			d, err := NewDecrypter(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("NewDecrypter error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewDecrypter: %v", err)
+			}
+			if d.material != strings.TrimSpace(tt.file) {
+				t.Error("key material isn't kept for encryption: script routes")
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// envVar is a variable defined by an env file.
+type envVar struct {
+	key, value string
+}
+
+// loadEnvFiles reads the env files at paths, in order, and returns their
+// variables as KEY=value pairs. Later files override earlier ones, and
+// like node's --env-file, variables scripts inherit from the server's
+// environment take precedence over all of them. Files are read on every
+// call so edits apply to the next invocation.
+func loadEnvFiles(paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	values := map[string]string{}
+	var order []string
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("env file: %w", err)
+		}
+		vars, err := parseEnv(string(data), values, os.LookupEnv)
+		if err != nil {
+			return nil, fmt.Errorf("env file %s: %w", p, err)
+		}
+		for _, v := range vars {
+			if _, ok := values[v.key]; !ok {
+				order = append(order, v.key)
+			}
+			values[v.key] = v.value
+		}
+	}
+	env := make([]string, 0, len(order))
+	for _, k := range order {
+		if v, ok := os.LookupEnv(k); !ok || !childEnvFilter.passes(k+"="+v) {
+			env = append(env, k+"="+values[k])
+		}
+	}
+	return env, nil
+}
+
+// parseEnv parses the contents of an env file:
+//
+//	# comments and blank lines are skipped
+//	export HOST=db.internal      # export is optional
+//	URL=postgres://${HOST}:${PORT:-5432}/app
+//	GREETING="hello\nworld"      # escapes and expansion
+//	LITERAL='$NOT_EXPANDED'
+//	KEY="-----BEGIN KEY-----
+//	...
+//	-----END KEY-----"
+//
+// Unquoted and double-quoted values expand $NAME, ${NAME}, and
+// ${NAME:-default} or ${NAME-default}, looking names up with lookup, then
+// among the variables defined above them, then in inherited, the
+// variables of earlier files; \$ is a literal dollar. Quoted values may
+// span lines.
+func parseEnv(data string, inherited map[string]string, lookup func(string) (string, bool)) ([]envVar, error) {
+	var vars []envVar
+	defined := map[string]string{}
+	get := func(key string) (string, bool) {
+		if v, ok := lookup(key); ok {
+			return v, true
+		}
+		if v, ok := defined[key]; ok {
+			return v, true
+		}
+		v, ok := inherited[key]
+		return v, ok
+	}
+	lines := strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		n := i + 1
+		line := strings.TrimSpace(lines[i])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "export"); ok && rest != "" && (rest[0] == ' ' || rest[0] == '\t') {
+			line = strings.TrimSpace(rest)
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: not KEY=value", n)
+		}
+		key = strings.TrimSpace(key)
+		if !envKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("line %d: invalid name %q", n, key)
+		}
+		value = strings.TrimLeft(value, " \t")
+
+		if value != "" && strings.ContainsRune("\"'`", rune(value[0])) {
+			q := value[0]
+			body := value[1:]
+			end := closingQuote(body, q)
+			for end < 0 && i+1 < len(lines) {
+				i++
+				body += "\n" + lines[i]
+				end = closingQuote(body, q)
+			}
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated %c quote", n, q)
+			}
+			body = body[:end]
+			if q == '"' {
+				body = expandEnv(body, true, get)
+			}
+			value = body
+		} else {
+			for j := 1; j < len(value); j++ {
+				if value[j] == '#' && (value[j-1] == ' ' || value[j-1] == '\t') {
+					value = value[:j]
+					break
+				}
+			}
+			value = expandEnv(strings.TrimSpace(value), false, get)
+		}
+		vars = append(vars, envVar{key, value})
+		defined[key] = value
+	}
+	return vars, nil
+}
+
+// closingQuote returns the index of the quote q ending s, skipping
+// backslash escapes within double quotes, or -1.
+func closingQuote(s string, q byte) int {
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && q == '"':
+			i++
+		case s[i] == q:
+			return i
+		}
+	}
+	return -1
+}
+
+// expandEnv expands variable references in s, and with escapes also the
+// backslash escapes \n, \r and \t; other escaped characters stand for
+// themselves.
+func expandEnv(s string, escapes bool, lookup func(string) (string, bool)) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && (escapes || s[i+1] == '$'):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(s[i])
+			}
+		case c == '$' && i+1 < len(s) && s[i+1] == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				b.WriteString(s[i:])
+				return b.String()
+			}
+			ref := s[i+2 : i+end]
+			i += end
+			name, def, hasDef := ref, "", false
+			if k, d, ok := strings.Cut(ref, ":-"); ok {
+				name, def, hasDef = k, d, true
+				if v, ok := lookup(name); ok && v != "" {
+					b.WriteString(v)
+					continue
+				}
+			} else if k, d, ok := strings.Cut(ref, "-"); ok && envKeyPattern.MatchString(k) {
+				name, def, hasDef = k, d, true
+				if v, ok := lookup(name); ok {
+					b.WriteString(v)
+					continue
+				}
+			}
+			if hasDef {
+				b.WriteString(expandEnv(def, false, lookup))
+				continue
+			}
+			v, _ := lookup(name)
+			b.WriteString(v)
+		case c == '$':
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || 'A' <= s[j] && s[j] <= 'Z' || 'a' <= s[j] && s[j] <= 'z' || j > i+1 && '0' <= s[j] && s[j] <= '9') {
+				j++
+			}
+			if j == i+1 {
+				b.WriteByte(c)
+				continue
+			}
+			v, _ := lookup(s[i+1 : j])
+			b.WriteString(v)
+			i = j - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func lookupIn(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		inherited map[string]string
+		env       map[string]string
+		want      []envVar
+	}{{
+		name: "comments and blank lines",
+		data: "# a comment\n\nA=1\n  # indented\nB=2\n",
+		want: []envVar{{"A", "1"}, {"B", "2"}},
+	}, {
+		name: "export and spacing",
+		data: "export A=1\nexport\tB = 2 \nexporter=3\n",
+		want: []envVar{{"A", "1"}, {"B", "2"}, {"exporter", "3"}},
+	}, {
+		name: "inline comments",
+		data: "A=1 # one\nB=x#y\nC='q # kept' # dropped\n",
+		want: []envVar{{"A", "1"}, {"B", "x#y"}, {"C", "q # kept"}},
+	}, {
+		name: "empty values",
+		data: "A=\nB=\"\"\nC=''\n",
+		want: []envVar{{"A", ""}, {"B", ""}, {"C", ""}},
+	}, {
+		name: "CRLF line endings",
+		data: "A=1\r\nB=\"x\"\r\n",
+		want: []envVar{{"A", "1"}, {"B", "x"}},
+	}, {
+		name: "quoting",
+		data: `A="hello\nworld"` + "\n" + `B='hello\n$A'` + "\n" + "C=`$A`\n" + `D="say \"hi\""` + "\n",
+		want: []envVar{{"A", "hello\nworld"}, {"B", `hello\n$A`}, {"C", "$A"}, {"D", `say "hi"`}},
+	}, {
+		name: "multiline values",
+		data: "KEY=\"-----BEGIN KEY-----\nabc\n-----END KEY-----\"\nNEXT='a\nb'\n",
+		want: []envVar{{"KEY", "-----BEGIN KEY-----\nabc\n-----END KEY-----"}, {"NEXT", "a\nb"}},
+	}, {
+		name: "expansion from earlier lines",
+		data: "HOST=db\nURL=postgres://${HOST}:${PORT:-5432}/$HOST\nQ=\"$URL\"\n",
+		want: []envVar{{"HOST", "db"}, {"URL", "postgres://db:5432/db"}, {"Q", "postgres://db:5432/db"}},
+	}, {
+		name:      "inherited from earlier files",
+		data:      "B=$A-b\n",
+		inherited: map[string]string{"A": "a"},
+		want:      []envVar{{"B", "a-b"}},
+	}, {
+		name:      "environment takes precedence",
+		data:      "A=file\nB=$A\nC=${D}\n",
+		inherited: map[string]string{"D": "inherited"},
+		env:       map[string]string{"A": "env", "D": "env"},
+		want:      []envVar{{"A", "file"}, {"B", "env"}, {"C", "env"}},
+	}, {
+		name: "escaped dollar",
+		data: `A=\$HOME` + "\n" + `B="\${HOME}"` + "\n",
+		want: []envVar{{"A", "$HOME"}, {"B", "${HOME}"}},
+	}, {
+		name: "redefinition",
+		data: "A=1\nA=${A}2\n",
+		want: []envVar{{"A", "1"}, {"A", "12"}},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseEnv(tt.data, tt.inherited, lookupIn(tt.env))
+			if err != nil {
+				t.Fatalf("parseEnv: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseEnv = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseEnvErrors(t *testing.T) {
+	tests := []struct {
+		data, wantErr string
+	}{
+		{"A=1\nNOEQUALS\n", "line 2: not KEY=value"},
+		{"1A=x\n", `line 1: invalid name "1A"`},
+		{"A B=x\n", `line 1: invalid name "A B"`},
+		{"=x\n", `line 1: invalid name ""`},
+		{"A=1\nB=\"open\nstill open\n", "line 2: unterminated \" quote"},
+		{"A='never closed\n", "line 1: unterminated ' quote"},
+	}
+	for _, tt := range tests {
+		_, err := parseEnv(tt.data, nil, lookupIn(nil))
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("parseEnv(%q) error = %v, want %q", tt.data, err, tt.wantErr)
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	env := map[string]string{"A": "a", "EMPTY": "", "A1": "a1", "HOST": "db"}
+	tests := []struct {
+		s       string
+		escapes bool
+		want    string
+	}{
+		{"$A", false, "a"},
+		{"${A}", false, "a"},
+		{"$A1", false, "a1"},
+		{"$1A", false, "$1A"},
+		{"$A.b", false, "a.b"},
+		{"${A}1", false, "a1"},
+		{"$MISSING|${MISSING}", false, "|"},
+		{"${MISSING:-def}", false, "def"},
+		{"${EMPTY:-def}", false, "def"},
+		{"${MISSING-def}", false, "def"},
+		{"${EMPTY-def}", false, ""},
+		{"${MISSING:-$HOST:5432}", false, "db:5432"},
+		{"cost: $", false, "cost: $"},
+		{"$$", false, "$$"},
+		{"${A", false, "${A"},
+		{`\$A`, false, "$A"},
+		{`a\nb`, false, `a\nb`},
+		{`a\nb\tc\rd`, true, "a\nb\tc\rd"},
+		{`\"\\\x`, true, `"\x`},
+		{`trailing\`, true, `trailing\`},
+	}
+	for _, tt := range tests {
+		if got := expandEnv(tt.s, tt.escapes, lookupIn(env)); got != tt.want {
+			t.Errorf("expandEnv(%q, %v) = %q, want %q", tt.s, tt.escapes, got, tt.want)
+		}
+	}
+}
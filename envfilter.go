@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// baseEnv are the server variables passed to scripts even in a clean
+// environment, since node and the programs scripts spawn rely on them.
+// NODE_PATH is set by the server itself for --package-json.
+var baseEnv = []string{"PATH", "HOME", "USER", "LANG", "LANGUAGE", "LC_*", "TZ", "TMPDIR", "NODE_PATH", "SYSTEMROOT"}
+
+// envFilter decides which variables of the server environment scripts
+// inherit. Variables the server or the route set for the script, such as
+// env files, are always passed.
+type envFilter struct {
+	// clean passes only baseEnv and allow; otherwise everything not
+	// denied is passed.
+	clean bool
+	// allow and deny are path.Match patterns of variable names, e.g.
+	// "AWS_*". Denied variables are withheld even when allowed.
+	allow []string
+	deny  []string
+}
+
+// childEnvFilter filters the environment of every node process; see
+// childEnv.
+var childEnvFilter envFilter
+
+func newEnvFilter(clean bool, allow, deny []string) (envFilter, error) {
+	for _, p := range append(allow[:len(allow):len(allow)], deny...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return envFilter{}, fmt.Errorf("pattern %q: %w", p, err)
+		}
+	}
+	return envFilter{clean: clean || len(allow) > 0, allow: allow, deny: deny}, nil
+}
+
+// passes reports whether the server variable kv, KEY=value, is inherited.
+func (f envFilter) passes(kv string) bool {
+	key, _, _ := strings.Cut(kv, "=")
+	if matchName(f.deny, key) {
+		return false
+	}
+	return !f.clean || matchName(baseEnv, key) || matchName(f.allow, key)
+}
+
+func matchName(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
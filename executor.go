@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+)
+
+const (
+	executorLocal  = "local"
+	executorDocker = "docker"
+)
+
+// ExecSpec describes a node process running a route's script.
+type ExecSpec struct {
+	Route *Route
+	// Args is the node command line, without the executable.
+	Args []string
+	Env  []string
+	// Dir is the working directory, the server's when empty.
+	Dir string
+	// ReadPaths are the host paths the process reads besides the route's
+	// own files, and WritePaths those it also writes.
+	ReadPaths  []string
+	WritePaths []string
+}
+
+// Executor starts the node processes of invocations and persistent
+// workers, directly on this host or isolated from it.
+type Executor interface {
+	// Command returns the command starting spec, and a func releasing
+	// whatever the process left behind, called once it exited.
+	Command(ctx context.Context, spec ExecSpec) (*exec.Cmd, func())
+	// Local reports whether the process runs on this host, so it inherits
+	// extra file descriptors and can be placed in a cgroup.
+	Local() bool
+}
+
+func NewExecutor(cfg Config) (Executor, error) {
+	switch cfg.Executor {
+	case executorLocal:
+		return localExecutor{}, nil
+	case executorDocker:
+		return newDockerExecutor(cfg.Docker, cfg.Limits)
+	}
+	return nil, fmt.Errorf("unknown executor %q", cfg.Executor)
+}
+
+// localExecutor runs node as a child process of the server, in a process
+// group of its own.
+type localExecutor struct{}
+
+func (localExecutor) Command(ctx context.Context, spec ExecSpec) (*exec.Cmd, func()) {
+	cmd := exec.CommandContext(ctx, spec.Route.runtime(), spec.Args...)
+	cmd.Dir = spec.Dir
+	cmd.Env = spec.Env
+	setProcessGroup(cmd)
+	return cmd, func() { reapProcessGroup(cmd.Process) }
+}
+
+func (localExecutor) Local() bool { return true }
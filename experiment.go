@@ -0,0 +1,159 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// variantHeader tells the caller which variant served the request.
+const variantHeader = "X-Invoke-Variant"
+
+// ExperimentConfig splits a route's callers between variants of the
+// script's behavior, for A/B tests run on the server:
+//
+//	experiment:
+//	  name: checkout-copy          # defaults to the route name
+//	  variants: {control: 90, short: 10}
+//	  key_header: X-User-Id
+//
+// Variants are weighted, and each caller is assigned one by a hash of
+// their key, so they keep it across requests and servers. Changing the
+// variants or their weights moves some callers to another variant.
+type ExperimentConfig struct {
+	Name     string         `yaml:"name"`
+	Variants map[string]int `yaml:"variants"`
+	// KeyHeader names the request header identifying the caller. Without
+	// it, or when a request lacks it, callers are told apart by their API
+	// key or bearer token, and failing that by their address.
+	KeyHeader string `yaml:"key_header"`
+}
+
+// Experiment is the runtime side of an ExperimentConfig.
+type Experiment struct {
+	Name      string
+	KeyHeader string
+	variants  []string
+	// bounds are the cumulative weights of variants.
+	bounds []uint64
+}
+
+func newExperiment(route string, ec ExperimentConfig) (*Experiment, error) {
+	e := &Experiment{Name: cmp.Or(ec.Name, route), KeyHeader: ec.KeyHeader}
+	if len(ec.Variants) < 2 {
+		return nil, errors.New("must declare at least two variants")
+	}
+	var total uint64
+	for _, v := range slices.Sorted(maps.Keys(ec.Variants)) {
+		w := ec.Variants[v]
+		if v == "" || w < 0 {
+			return nil, fmt.Errorf("variant %q: must be named and weigh 0 or more", v)
+		}
+		total += uint64(w)
+		e.variants = append(e.variants, v)
+		e.bounds = append(e.bounds, total)
+	}
+	if total == 0 {
+		return nil, errors.New("variants must not all weigh 0")
+	}
+	return e, nil
+}
+
+// variant returns the variant of the caller identified by key.
+func (e *Experiment) variant(key string) string {
+	h := fnv.New64a()
+	h.Write([]byte(e.Name))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	n := h.Sum64() % e.bounds[len(e.bounds)-1]
+	i, _ := slices.BinarySearch(e.bounds, n+1)
+	return e.variants[i]
+}
+
+// assign records the experiment's variant for the caller of r in req, for
+// the script's InvocationContext, and in the response. It does nothing on
+// routes without an experiment.
+func (e *Experiment) assign(w http.ResponseWriter, r *http.Request, req *RequestInfo) {
+	if e == nil {
+		return
+	}
+	req.Experiment = e.Name
+	req.Variant = e.variant(callerKey(r, e.KeyHeader))
+	w.Header().Set(variantHeader, req.Variant)
+}
+
+// callerKey identifies the caller of r for experiment assignment.
+func callerKey(r *http.Request, header string) string {
+	if header != "" {
+		if v := r.Header.Get(header); v != "" {
+			return v
+		}
+	}
+	if v := r.Header.Get(apiKeyHeader); v != "" {
+		return v
+	}
+	if v, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && v != "" {
+		return v
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// experimentStats counts the invocations of each experiment variant, for
+// comparing them in metrics.
+type experimentStats struct {
+	mu     sync.Mutex
+	counts map[experimentKey]*experimentCount
+}
+
+type experimentKey struct{ route, experiment, variant string }
+
+type experimentCount struct {
+	invocations, failures int64
+	seconds               float64
+}
+
+func (s *experimentStats) record(call Invocation, err error, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counts == nil {
+		s.counts = map[experimentKey]*experimentCount{}
+	}
+	k := experimentKey{call.Route.Name, call.Request.Experiment, call.Request.Variant}
+	c := s.counts[k]
+	if c == nil {
+		c = &experimentCount{}
+		s.counts[k] = c
+	}
+	c.invocations++
+	if err != nil {
+		c.failures++
+	}
+	c.seconds += d.Seconds()
+}
+
+// snapshot returns the counts sorted by route, experiment and variant.
+func (s *experimentStats) snapshot() (keys []experimentKey, counts []experimentCount) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k := range s.counts {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b experimentKey) int {
+		return cmp.Or(cmp.Compare(a.route, b.route), cmp.Compare(a.experiment, b.experiment), cmp.Compare(a.variant, b.variant))
+	})
+	for _, k := range keys {
+		counts = append(counts, *s.counts[k])
+	}
+	return keys, counts
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+// maxFaultDuration bounds how long an injected fault lasts, so one left
+// behind after a game day expires on its own.
+const maxFaultDuration = 24 * time.Hour
+
+// fault is failure injected into a route's invocations through the admin
+// API until it expires.
+type fault struct {
+	errorRate   float64
+	status      int
+	latency     time.Duration
+	latencyRate float64
+	set         time.Time
+	expires     time.Time
+
+	injected atomic.Int64
+}
+
+// faultError is the failure of an invocation failed by an injected fault.
+type faultError struct {
+	status int
+}
+
+func (e *faultError) Error() string {
+	return fmt.Sprintf("injected fault (%d)", e.status)
+}
+
+// activeFault returns the route's unexpired fault, clearing it once it has
+// expired.
+func (rt *Route) activeFault() *fault {
+	f := rt.fault.Load()
+	if f == nil {
+		return nil
+	}
+	if time.Now().After(f.expires) {
+		if rt.fault.CompareAndSwap(f, nil) {
+			log.Printf("%s: injected fault expired after %s", rt.Name, f.expires.Sub(f.set).Round(time.Second))
+		}
+		return nil
+	}
+	return f
+}
+
+// injectFault delays the invocation and fails it as the route's fault, if
+// any, says. The delay counts towards the invocation's timeout.
+func (rt *Route) injectFault(ctx context.Context) error {
+	f := rt.activeFault()
+	if f == nil {
+		return nil
+	}
+	if f.latency > 0 && rand.Float64() < f.latencyRate {
+		f.injected.Add(1)
+		t := time.NewTimer(f.latency)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	if rand.Float64() < f.errorRate {
+		f.injected.Add(1)
+		return &faultError{status: f.status}
+	}
+	return nil
+}
+
+// adminFault is the body of PUT /admin/routes/{name}/fault, and an entry
+// of GET /admin/faults.
+type adminFault struct {
+	Route     string  `json:"route,omitempty"`
+	ErrorRate float64 `json:"error_rate"`
+	// Status is the response status of failed invocations, 503 when
+	// unset.
+	Status  int    `json:"status,omitempty"`
+	Latency string `json:"latency,omitempty"`
+	// LatencyRate is the share of invocations delayed by Latency, all of
+	// them when unset.
+	LatencyRate *float64 `json:"latency_rate,omitempty"`
+	// Duration is how long the fault lasts, up to maxFaultDuration.
+	Duration string    `json:"duration"`
+	Expires  time.Time `json:"expires,omitzero"`
+	Injected int64     `json:"injected"`
+}
+
+// faultAllowed reports whether name matches one of the --fault-routes
+// patterns.
+func (a *Admin) faultAllowed(name string) bool {
+	for _, p := range a.faultRoutes {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Admin) setFault(w http.ResponseWriter, r *http.Request) {
+	route := a.route(w, r)
+	if route == nil {
+		return
+	}
+	if !a.faultAllowed(route.Name) {
+		http.Error(w, "route is not in --fault-routes", http.StatusForbidden)
+		return
+	}
+	var body adminFault
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		http.Error(w, "invalid fault: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	f, err := body.fault()
+	if err != nil {
+		http.Error(w, "invalid fault: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	route.fault.Store(f)
+	logAdmin(r, "fault injected into %s until %s: error_rate=%g status=%d latency=%s latency_rate=%g",
+		route.Name, f.expires.Format(time.RFC3339), f.errorRate, f.status, f.latency, f.latencyRate)
+	writeJSON(w, http.StatusOK, f.report(route.Name))
+}
+
+// fault validates the requested fault, returning it to start now.
+func (body adminFault) fault() (*fault, error) {
+	d, err := time.ParseDuration(body.Duration)
+	if err != nil || d <= 0 || d > maxFaultDuration {
+		return nil, fmt.Errorf("duration %q: must be a positive duration of at most %s", body.Duration, maxFaultDuration)
+	}
+	f := &fault{errorRate: body.ErrorRate, status: body.Status, latencyRate: 1}
+	if f.errorRate < 0 || f.errorRate > 1 {
+		return nil, fmt.Errorf("error_rate %g: must be between 0 and 1", f.errorRate)
+	}
+	if f.status == 0 {
+		f.status = http.StatusServiceUnavailable
+	}
+	if f.status < 400 || f.status > 599 {
+		return nil, fmt.Errorf("status %d: must be an error status", f.status)
+	}
+	if body.Latency != "" {
+		if f.latency, err = time.ParseDuration(body.Latency); err != nil || f.latency < 0 {
+			return nil, fmt.Errorf("latency %q: must be a duration", body.Latency)
+		}
+	}
+	if body.LatencyRate != nil {
+		f.latencyRate = *body.LatencyRate
+		if f.latencyRate < 0 || f.latencyRate > 1 {
+			return nil, fmt.Errorf("latency_rate %g: must be between 0 and 1", f.latencyRate)
+		}
+	}
+	if f.errorRate == 0 && f.latency == 0 {
+		return nil, fmt.Errorf("must set error_rate or latency")
+	}
+	f.set = time.Now()
+	f.expires = f.set.Add(d)
+	return f, nil
+}
+
+func (f *fault) report(route string) adminFault {
+	s := adminFault{
+		Route:     route,
+		ErrorRate: f.errorRate,
+		Status:    f.status,
+		Duration:  f.expires.Sub(f.set).String(),
+		Expires:   f.expires,
+		Injected:  f.injected.Load(),
+	}
+	if f.latency > 0 {
+		s.Latency = f.latency.String()
+		s.LatencyRate = &f.latencyRate
+	}
+	return s
+}
+
+func (a *Admin) clearFault(w http.ResponseWriter, r *http.Request) {
+	route := a.route(w, r)
+	if route == nil {
+		return
+	}
+	f := route.activeFault()
+	if f == nil || !route.fault.CompareAndSwap(f, nil) {
+		http.Error(w, "route has no fault injected", http.StatusNotFound)
+		return
+	}
+	logAdmin(r, "fault of %s cleared after %d injected", route.Name, f.injected.Load())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getFaults lists the routes with a fault injected.
+func (a *Admin) getFaults(w http.ResponseWriter, r *http.Request) {
+	out := []adminFault{}
+	for _, route := range a.sortedRoutes() {
+		if f := route.activeFault(); f != nil {
+			out = append(out, f.report(route.Name))
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
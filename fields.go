@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// fieldSet is a parsed `fields` query parameter selecting parts of a JSON
+// response. A nil child keeps the whole value of that key.
+//
+// Paths are comma separated and nest with dots or parentheses, so
+// "id,author.name,items(id,price)" keeps id, author.name, and id and price
+// of every element of items.
+type fieldSet map[string]fieldSet
+
+// requestFields parses the fields query parameter of r; it returns nil
+// when the parameter is absent.
+func requestFields(r *http.Request) (fieldSet, error) {
+	v := r.URL.Query().Get("fields")
+	if v == "" {
+		return nil, nil
+	}
+	p := &fieldParser{s: v}
+	fs := fieldSet{}
+	if err := p.list(fs); err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.s) {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.s[p.pos], p.pos)
+	}
+	return fs, nil
+}
+
+type fieldParser struct {
+	s   string
+	pos int
+}
+
+// list parses item (',' item)* into fs.
+func (p *fieldParser) list(fs fieldSet) error {
+	for {
+		if err := p.item(fs); err != nil {
+			return err
+		}
+		if p.pos == len(p.s) || p.s[p.pos] != ',' {
+			return nil
+		}
+		p.pos++
+	}
+}
+
+// item parses name ('.' item | '(' list ')')? into fs.
+func (p *fieldParser) item(fs fieldSet) error {
+	start := p.pos
+	for p.pos < len(p.s) && !strings.ContainsRune(",.()", rune(p.s[p.pos])) {
+		p.pos++
+	}
+	name := strings.TrimSpace(p.s[start:p.pos])
+	if name == "" {
+		return fmt.Errorf("empty field name at offset %d", start)
+	}
+
+	if p.pos == len(p.s) || (p.s[p.pos] != '.' && p.s[p.pos] != '(') {
+		// A bare name keeps everything, even if a sibling path already
+		// selected part of it.
+		fs[name] = nil
+		return nil
+	}
+
+	sub, seen := fs[name]
+	if seen && sub == nil {
+		sub = fieldSet{} // throwaway: the whole value is already kept
+	} else if sub == nil {
+		sub = fieldSet{}
+		fs[name] = sub
+	}
+
+	if p.s[p.pos] == '.' {
+		p.pos++
+		return p.item(sub)
+	}
+	p.pos++
+	if err := p.list(sub); err != nil {
+		return err
+	}
+	if p.pos == len(p.s) || p.s[p.pos] != ')' {
+		return fmt.Errorf("missing ) at offset %d", p.pos)
+	}
+	p.pos++
+	return nil
+}
+
+// apply returns v reduced to the selected fields. Arrays are filtered
+// element-wise and scalars are returned unchanged.
+func (fs fieldSet) apply(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(fs))
+		for k, sub := range fs {
+			val, ok := v[k]
+			if !ok {
+				continue
+			}
+			if sub != nil {
+				val = sub.apply(val)
+			}
+			out[k] = val
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, el := range v {
+			out[i] = fs.apply(el)
+		}
+		return out
+	}
+	return v
+}
+
+// filterOutput applies fs to JSON script output. Output that isn't JSON
+// is returned unchanged.
+func (fs fieldSet) filterOutput(out []byte) []byte {
+	if fs == nil {
+		return out
+	}
+	dec := json.NewDecoder(bytes.NewReader(out))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return out
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(fs.apply(v))
+	return buf.Bytes()
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	genLangGo = "go"
+	genLangTS = "ts"
+
+	defaultGenPackage = "invokeclient"
+)
+
+// genOptions are the flags of `go-invoke-node gen`, which writes a Go
+// client for the routes of a server instead of starting it:
+//
+//	go-invoke-node gen --config routes.yaml --package reports --output client.go
+//
+// Every route becomes a method taking a struct generated from its payload
+// schema, or any for routes without one, and returning the output decoded
+// into a type generated from its response schema, or else the raw JSON.
+// Routes are read from the same --config, --script-dir or --script-file
+// and --schema a server would be started with. Webhook and raw routes are
+// skipped, since their bodies aren't JSON payloads a client composes.
+//
+// With --lang ts it writes TypeScript declarations for script authors
+// instead, see tsGenerator, packed as an npm package when the output ends
+// in .tgz:
+//
+//	go-invoke-node gen --lang ts --config routes.yaml --output types.tgz
+type genOptions struct {
+	Lang string
+	// Package is the Go package, or the npm package name.
+	Package string
+	// Output is the file written, or - for stdout.
+	Output string
+}
+
+func (o *genOptions) register() {
+	flag.StringVar(&o.Lang, "lang", genLangGo,
+		"gen: go for a client, or ts for TypeScript declarations for scripts")
+	flag.StringVar(&o.Package, "package", o.Package,
+		"gen: package name of the generated code (default "+defaultGenPackage+", or "+defaultGenTSPackage+" with --lang ts)")
+	flag.StringVar(&o.Output, "output", o.Output,
+		"gen: file to write the code to, - for stdout; with --lang ts, a .tgz file is an npm package (default -)")
+}
+
+// genRoute is a route the client calls at path.
+type genRoute struct {
+	name     string
+	path     string
+	schema   *Schema
+	response *Schema
+}
+
+// generateClient writes the client for the routes cfg selects and returns
+// the exit status.
+func generateClient(cfg Config, o genOptions) int {
+	var schema *Schema
+	if cfg.SchemaFile != "" {
+		s, err := LoadSchema(cfg.SchemaFile)
+		if err != nil {
+			log.Printf("invalid schema %q: %v", cfg.SchemaFile, err)
+			return exitUsage
+		}
+		schema = s
+	}
+	routes, err := genRoutes(cfg, schema)
+	if err == nil && len(routes) == 0 {
+		err = errors.New("no routes to generate a client for")
+	}
+	if err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+
+	var src []byte
+	switch o.Lang {
+	case genLangGo:
+		if o.Package == "" {
+			o.Package = defaultGenPackage
+		}
+		src, err = newGenerator(o.Package).client(routes)
+	case genLangTS:
+		if o.Package == "" {
+			o.Package = defaultGenTSPackage
+		}
+		src, err = newTSGenerator().declarations(routes)
+		if err == nil && strings.HasSuffix(o.Output, ".tgz") {
+			src, err = npmTarball(o.Package, src)
+		}
+	default:
+		log.Printf("invalid --lang %q: must be %s or %s", o.Lang, genLangGo, genLangTS)
+		return exitUsage
+	}
+	if err != nil {
+		log.Printf("generate %s: %v", o.Lang, err)
+		return exitFailure
+	}
+	if o.Output == "" || o.Output == "-" {
+		os.Stdout.Write(src)
+		return 0
+	}
+	if err := os.WriteFile(o.Output, src, 0o644); err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	return 0
+}
+
+// genRoutes lists the routes served for cfg, sorted by name.
+func genRoutes(cfg Config, schema *Schema) ([]genRoute, error) {
+	var out []genRoute
+	switch {
+	case cfg.ScriptDir != "":
+		dir, err := NewScriptDir(cfg.ScriptDir, cfg.EnvFiles, schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid script dir %q: %v", cfg.ScriptDir, err)
+		}
+		names, err := dir.scripts()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			route, err := dir.Resolve(name)
+			if err != nil {
+				return nil, fmt.Errorf("script %q: %v", name, err)
+			}
+			out = append(out, genRoute{name, "/invoke/" + name, route.Schema, route.ResponseSchema})
+		}
+
+	case cfg.ConfigFile != "":
+		fc, err := LoadFileConfig(cfg.ConfigFile, cfg.Profile, cfg.StrictConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: %v", err)
+		}
+		routes, err := fc.BuildRoutes(filepath.Dir(cfg.ConfigFile))
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: %v", err)
+		}
+		for _, route := range routes {
+			if route.Triggers != nil && route.Triggers.DisableHTTP {
+				continue
+			}
+			if route.Webhook != nil || route.Raw {
+				log.Printf("gen: skipping route %s, which doesn't take JSON payloads", route.Name)
+				continue
+			}
+			if route.Schema == nil {
+				route.Schema = schema
+			}
+			out = append(out, genRoute{route.Name, "/invoke/" + route.Name, route.Schema, route.ResponseSchema})
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+
+	default:
+		out = append(out, genRoute{"default", "/invoke", schema, nil})
+	}
+	return out, nil
+}
+
+// scripts lists the names of the scripts below the root, skipping hidden
+// files and directories like Resolve does.
+func (d *ScriptDir) scripts() ([]string, error) {
+	seen := map[string]bool{}
+	var names []string
+	err := filepath.WalkDir(d.root, func(p string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != d.root && strings.HasPrefix(e.Name(), ".") {
+			if e.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := filepath.Ext(p)
+		if e.IsDir() || !slices.Contains(scriptExtensions, ext) {
+			return nil
+		}
+		rel, err := filepath.Rel(d.root, strings.TrimSuffix(p, ext))
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// generator turns schemas into Go types. Every object schema becomes a
+// named struct; schemas shared between routes, such as --schema, are
+// emitted once.
+type generator struct {
+	pkg   string
+	decls []string
+	named map[*Schema]string
+	used  map[string]bool
+	// resolving guards against $refs cycling without an object in between.
+	resolving map[*Schema]bool
+}
+
+func newGenerator(pkg string) *generator {
+	return &generator{pkg: pkg, named: map[*Schema]string{}, used: map[string]bool{}, resolving: map[*Schema]bool{}}
+}
+
+func (g *generator) client(routes []genRoute) ([]byte, error) {
+	var methods bytes.Buffer
+	methodNames := map[string]bool{"do": true}
+	for _, r := range routes {
+		method := uniqueName(goName(r.name, "Route"), methodNames)
+		in := "any"
+		if r.schema != nil {
+			t, err := g.goType(r.schema, method+"Input", r.schema)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %v", r.name, err)
+			}
+			in = t
+		}
+		fmt.Fprintf(&methods, "\n// %s invokes %s.\n", method, r.path)
+		if r.response == nil {
+			fmt.Fprintf(&methods, "func (c *Client) %s(ctx context.Context, in %s) (json.RawMessage, error) {\n", method, in)
+			fmt.Fprintf(&methods, "\treturn c.do(ctx, %q, in)\n}\n", r.path)
+			continue
+		}
+		out, err := g.goType(r.response, method+"Output", r.response)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: response: %v", r.name, err)
+		}
+		fmt.Fprintf(&methods, "func (c *Client) %s(ctx context.Context, in %s) (%s, error) {\n", method, in, out)
+		fmt.Fprintf(&methods, "\treturn decode[%s](c.do(ctx, %q, in))\n}\n", out, r.path)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, genHeader, g.pkg)
+	b.Write(methods.Bytes())
+	for _, d := range g.decls {
+		b.WriteString(d)
+	}
+	return format.Source(b.Bytes())
+}
+
+// goType returns the Go type for s, emitting the named types it needs. name
+// is used when s is an object; root resolves $refs.
+func (g *generator) goType(s *Schema, name string, root *Schema) (string, error) {
+	if s.Ref != "" {
+		target, err := s.resolve()
+		if err != nil {
+			return "", err
+		}
+		if n, ok := g.named[target]; ok {
+			return n, nil
+		}
+		if g.resolving[target] {
+			return "any", nil
+		}
+		g.resolving[target] = true
+		defer delete(g.resolving, target)
+		if target != s.root {
+			for def, ds := range root.Defs {
+				if ds == target {
+					name = goName(def, "Def")
+				}
+			}
+		}
+		return g.goType(target, name, root)
+	}
+	if s.boolean != nil {
+		return "any", nil
+	}
+
+	types := []string(s.Type)
+	nullable := false
+	if i := slices.Index(types, "null"); i >= 0 && len(types) > 1 {
+		types = append(types[:i:i], types[i+1:]...)
+		nullable = true
+	}
+	if len(types) != 1 {
+		if len(s.Properties) > 0 && len(types) == 0 {
+			types = []string{"object"}
+		} else {
+			return "any", nil
+		}
+	}
+
+	var t string
+	switch types[0] {
+	case "string":
+		t = "string"
+	case "integer":
+		t = "int64"
+	case "number":
+		t = "float64"
+	case "boolean":
+		t = "bool"
+	case "array":
+		elem := "any"
+		if s.Items != nil {
+			var err error
+			if elem, err = g.goType(s.Items, name+"Item", root); err != nil {
+				return "", err
+			}
+		}
+		return "[]" + elem, nil
+	case "object":
+		if len(s.Properties) == 0 {
+			elem := "any"
+			if ap := s.AdditionalProperties; ap != nil && ap.boolean == nil {
+				var err error
+				if elem, err = g.goType(ap, name+"Value", root); err != nil {
+					return "", err
+				}
+			}
+			return "map[string]" + elem, nil
+		}
+		st, err := g.structType(s, name, root)
+		if err != nil {
+			return "", err
+		}
+		t = st
+	default:
+		return "any", nil
+	}
+	if nullable {
+		t = "*" + t
+	}
+	return t, nil
+}
+
+// structType emits a struct for the object schema s, once.
+func (g *generator) structType(s *Schema, name string, root *Schema) (string, error) {
+	if n, ok := g.named[s]; ok {
+		return n, nil
+	}
+	if s.Title != "" {
+		name = goName(s.Title, "Object")
+	}
+	name = uniqueName(name, g.used)
+	g.named[s] = name
+	// Reserve the declaration's place ahead of the nested types generated
+	// for its fields.
+	decl := len(g.decls)
+	g.decls = append(g.decls, "")
+
+	required := map[string]bool{}
+	for _, p := range s.Required {
+		required[p] = true
+	}
+	props := make([]string, 0, len(s.Properties))
+	for p := range s.Properties {
+		props = append(props, p)
+	}
+	sort.Strings(props)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "\n%stype %s struct {\n", docComment(s.Description, "", name+" is generated from a route schema."), name)
+	fields := map[string]bool{}
+	for _, p := range props {
+		ps := s.Properties[p]
+		field := uniqueName(goName(p, "Field"), fields)
+		t, err := g.goType(ps, name+field, root)
+		if err != nil {
+			return "", fmt.Errorf("property %s: %v", p, err)
+		}
+		tag := p
+		if !required[p] {
+			tag += ",omitempty"
+			if nillable := t == "any" || strings.HasPrefix(t, "[]") || strings.HasPrefix(t, "map[") || strings.HasPrefix(t, "*"); !nillable {
+				t = "*" + t
+			}
+		}
+		b.WriteString(docComment(ps.Description, "\t", ""))
+		fmt.Fprintf(&b, "\t%s %s `json:%s`\n", field, t, strconv.Quote(tag))
+	}
+	b.WriteString("}\n")
+	g.decls[decl] = b.String()
+	return name, nil
+}
+
+// docComment renders text as a Go comment indented by indent, or fallback
+// when text is empty.
+func docComment(text, indent, fallback string) string {
+	if text == "" {
+		text = fallback
+	}
+	if text == "" {
+		return ""
+	}
+	var b strings.Builder
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		b.WriteString(strings.TrimRight(indent+"// "+line, " ") + "\n")
+	}
+	return b.String()
+}
+
+// goInitialisms are spelled in capitals, as golint would have them.
+var goInitialisms = map[string]bool{
+	"Api": true, "Http": true, "Id": true, "Ip": true, "Json": true,
+	"Sql": true, "Uri": true, "Url": true, "Uuid": true,
+}
+
+// goName turns s, such as a route name or JSON key, into an exported Go
+// identifier, prefixing fallback when it doesn't start with a letter.
+func goName(s, fallback string) string {
+	var b strings.Builder
+	for _, part := range strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		for _, word := range splitCamel(part) {
+			word = strings.ToUpper(word[:1]) + word[1:]
+			if goInitialisms[word] {
+				word = strings.ToUpper(word)
+			}
+			b.WriteString(word)
+		}
+	}
+	name := b.String()
+	if name == "" || !unicode.IsLetter([]rune(name)[0]) {
+		name = fallback + name
+	}
+	return name
+}
+
+// splitCamel splits lowerCamel words, so userId becomes user and Id.
+func splitCamel(s string) []string {
+	var words []string
+	start := 0
+	for i, r := range s {
+		if i > start && unicode.IsUpper(r) {
+			words = append(words, s[start:i])
+			start = i
+		}
+	}
+	return append(words, s[start:])
+}
+
+// uniqueName returns name, or name with a number appended when it is taken,
+// and marks the result taken.
+func uniqueName(name string, used map[string]bool) string {
+	n := name
+	for i := 2; used[n]; i++ {
+		n = name + strconv.Itoa(i)
+	}
+	used[n] = true
+	return n
+}
+
+const genHeader = `// Code generated by go-invoke-node gen. DO NOT EDIT.
+
+package %s
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Client invokes the routes of a go-invoke-node server.
+type Client struct {
+	// BaseURL is the server's address, such as http://localhost:8080.
+	BaseURL string
+	// Token, when set, is sent as a bearer token.
+	Token string
+	// HTTPClient makes the requests; nil means http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// Error is returned when the server answers with a non-2xx status.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("invoke: %%d %%s", e.StatusCode, e.Message)
+}
+
+func (c *Client) do(ctx context.Context, path string, in any) (json.RawMessage, error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(c.BaseURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(out))}
+	}
+	return out, nil
+}
+
+// decode unmarshals the output of a route with a response schema.
+func decode[T any](out json.RawMessage, err error) (T, error) {
+	var v T
+	if err != nil {
+		return v, err
+	}
+	err = json.Unmarshal(out, &v)
+	return v, err
+}
+`
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// headersEnvKey is the environment variable holding the JSON object of
+// forwarded request headers, keyed by lower-cased header name.
+const headersEnvKey = "INVOKE_HEADERS"
+
+// httpReadHeaderTimeout bounds how long clients may take to send request
+// headers.
+const httpReadHeaderTimeout = 10 * time.Second
+
+// handlerOptions are the settings shared by every invoke endpoint.
+type handlerOptions struct {
+	ForwardHeaders    []string
+	KeepaliveInterval time.Duration
+	BatchParallelism  int
+
+	StreamWriteTimeout time.Duration
+	SlowClientPolicy   string
+
+	// RawContentTypes are request media type patterns whose bodies are
+	// piped to the script unparsed; RawResponseType is the Content-Type
+	// of their output.
+	RawContentTypes []string
+	RawResponseType string
+
+	// MaxUploadSize bounds multipart request bodies and webhook deliveries
+	// (0 = unlimited).
+	MaxUploadSize int64
+
+	// CompressMinSize is the smallest JSON response gzipped for clients
+	// accepting it (0 = never).
+	CompressMinSize int64
+
+	// TenantHeader names the request header whose value is reported as
+	// the tenant in INVOKE_CONTEXT.
+	TenantHeader string
+
+	// TrustPriorityHeader honors X-Invoke-Priority from callers that
+	// didn't authenticate.
+	TrustPriorityHeader bool
+
+	// CoercePayload coerces payloads of every route with a schema, as
+	// Route.Coerce does for a single route.
+	CoercePayload bool
+
+	// FakeClock lets requests set the time scripts see; see requestClock.
+	// Deterministic makes every invocation reproducible; see
+	// makeDeterministic.
+	FakeClock     bool
+	Deterministic bool
+
+	// CORS applies to routes without a policy of their own.
+	CORS CORSPolicy
+
+	Tracer *Tracer
+	// Signer signs successful responses, when enabled.
+	Signer *Signer
+	// Decrypter decrypts JWE payloads, when enabled.
+	Decrypter *Decrypter
+}
+
+func makeInvokeHandler(inv *Invoker, route *Route, opts handlerOptions) http.HandlerFunc {
+	return makeDispatchHandler(inv, route, serveInvoke, opts)
+}
+
+// makeDispatchHandler checks route's auth, verifies webhook deliveries and
+// applies route's rules to pick the route that serves each request. Only
+// the auth of the requested route applies, not that of rule targets, which
+// belong to the same tenant.
+func makeDispatchHandler(inv *Invoker, route *Route, serve serveFunc, opts handlerOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if opts.cors(route).handle(w, r) {
+			return
+		}
+		if route.Tenant != nil {
+			if !route.Tenant.admit(w, r) {
+				return
+			}
+			r = withAuthenticated(r)
+		}
+		if route.Auth != nil {
+			claims, ok := route.Auth.authorize(w, r, route.Name)
+			if !ok {
+				return
+			}
+			r = withAuthenticated(withClaims(r, claims))
+		}
+		var event string
+		if wh := route.Webhook; wh != nil {
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			// Deliveries are read whole before their signature is
+			// checked, so anyone can send one.
+			if opts.MaxUploadSize > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, opts.MaxUploadSize)
+			}
+			body, err := io.ReadAll(r.Body)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "webhook delivery too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				http.Error(w, "failed to read request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			d, err := wh.Receive(r.Header, body)
+			if errors.Is(err, errBadSignature) {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				log.Printf("webhook %s: %v", route.Name, err)
+				http.Error(w, "invalid webhook delivery", http.StatusBadRequest)
+				return
+			}
+			if d.Reply != nil {
+				writeJSON(w, http.StatusOK, d.Reply)
+				return
+			}
+			event = d.Event
+			r.Body = io.NopCloser(bytes.NewReader(wh.Envelope(d)))
+		}
+
+		target := route.dispatch(r.Header, event)
+		if target == nil && route.Webhook != nil {
+			// Acknowledge events nobody handles so providers don't record
+			// failed deliveries and retry them.
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if target == nil {
+			http.Error(w, "no route matches request headers", http.StatusNotFound)
+			return
+		}
+		if route.disabled.Load() || target.disabled.Load() {
+			http.Error(w, "route disabled", http.StatusServiceUnavailable)
+			return
+		}
+		serve(w, r, inv, target, opts)
+	}
+}
+
+func serveInvoke(w http.ResponseWriter, r *http.Request, inv *Invoker, route *Route, opts handlerOptions) {
+	w, r, span := startServerSpan(w, r, opts.Tracer, "invoke "+route.Name)
+	defer span.End()
+	span.SetAttr("invoke.route", route.Name)
+
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && route.Materialized != nil {
+		route.Materialized.serve(w, r, route, opts)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	extendDeadlines(w, inv.budget(route)+inv.cfg.HTTPTimeoutMargin)
+	build := route.build()
+	setBuildHeaders(w, build)
+
+	fields, err := requestFields(r)
+	if err != nil {
+		http.Error(w, "invalid fields: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	pg, err := requestPage(r)
+	if err != nil {
+		http.Error(w, "invalid pagination: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	raw := rawRequest(r, route, opts)
+	if route.Encryption != "" && !isJWE(r) {
+		http.Error(w, "route requires an encrypted payload sent as "+joseContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	var callback *url.URL
+	if v := r.URL.Query().Get(callbackParam); v != "" {
+		if inv.callbacks == nil {
+			http.Error(w, "callbacks are not enabled", http.StatusBadRequest)
+			return
+		}
+		if raw || isMultipart(r) || streamMode(r) != "" {
+			http.Error(w, "callbacks require a JSON payload and a buffered response", http.StatusBadRequest)
+			return
+		}
+		if callback, err = inv.callbacks.target(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	clock, err := requestClock(r, route, opts.FakeClock || opts.Deterministic)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	priority, err := requestPriority(r, route, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h := propagate(r.Header, span)
+	call := Invocation{
+		Route:    route,
+		Env:      forwardedHeadersEnv(h, opts.ForwardHeaders),
+		Request:  requestInfo(w, r, h, opts),
+		NoCache:  noCache(r),
+		Clock:    clock,
+		Priority: priority,
+	}
+	route.Experiment.assign(w, r, &call.Request)
+	if opts.Deterministic {
+		if err := makeDeterministic(w, r, &call); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if raw {
+		// The body goes to the script as-is, without being buffered.
+		call.Stdin = r.Body
+		call.Env = append(call.Env, contentTypeEnvKey+"="+r.Header.Get("Content-Type"))
+	} else if isMultipart(r) {
+		manifest, dir, err := stageMultipart(r, opts.MaxUploadSize)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "invalid multipart upload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The script has exited by the time serveInvoke returns.
+		defer os.RemoveAll(dir)
+		call.Payload = manifest
+		call.ReadPaths = []string{dir}
+	} else {
+		payload, ok := readPayload(w, r, route, opts)
+		if !ok {
+			return
+		}
+		call.Payload = payload
+		if route.Encryption == encryptionScript {
+			call.Env = append(call.Env, decryptionKeyEnvKey+"="+opts.Decrypter.material)
+		}
+	}
+
+	idemKey := r.Header.Get(idempotencyKeyHeader)
+	if inv.idempotency == nil {
+		idemKey = ""
+	}
+	if idemKey != "" {
+		if raw || call.ReadPaths != nil || callback != nil || streamMode(r) != "" {
+			http.Error(w, idempotencyKeyHeader+" requires a JSON payload and a buffered response", http.StatusBadRequest)
+			return
+		}
+		if !validIdempotencyKey(idemKey) {
+			http.Error(w, "invalid "+idempotencyKeyHeader, http.StatusBadRequest)
+			return
+		}
+	}
+	// An Idempotency-Key takes precedence over the route's dedupe key.
+	var dedupe *Dedupe
+	if d := route.Dedupe; d != nil && idemKey == "" && call.ReadPaths == nil {
+		if key, ok := d.key(call.Payload); ok {
+			if callback != nil || streamMode(r) != "" {
+				http.Error(w, "deduplicated payloads require a buffered response", http.StatusBadRequest)
+				return
+			}
+			idemKey, dedupe = key, d
+		}
+	}
+
+	if callback != nil {
+		// The caller doesn't wait, so neither does the invocation.
+		inv.callbacks.Start(context.WithoutCancel(r.Context()), inv, call, callback)
+		writeJSON(w, http.StatusAccepted, map[string]string{"id": call.Request.ID, "status": "accepted"})
+		return
+	}
+
+	if mode := streamMode(r); mode != "" {
+		serveStream(w, r, inv, call, mode, opts)
+		return
+	}
+
+	var res *Result
+	started := time.Now()
+	answer := holdWriteDeadline(w, inv.cfg.HTTPTimeoutMargin)
+	if idemKey != "" {
+		claimed := call.Payload
+		if dedupe != nil {
+			// Redeliveries count as duplicates even when their payloads
+			// differ, e.g. in a delivery attempt counter.
+			claimed = []byte(idemKey)
+		}
+		replay, err := inv.idempotency.Claim(r.Context(), route, idemKey, claimed, inv.idempotencyHold(route))
+		switch {
+		case err != nil && r.Context().Err() != nil:
+			// The client gave up waiting for the request holding the key.
+			return
+		case errors.Is(err, errIdempotencyMismatch):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		case err != nil:
+			log.Printf("%s: idempotency key: %v", route.Name, err)
+			http.Error(w, "idempotency store failed", http.StatusInternalServerError)
+			return
+		}
+		if replay != nil && dedupe != nil && dedupe.conflict {
+			http.Error(w, errDuplicate.Error(), http.StatusConflict)
+			return
+		}
+		if replay != nil {
+			res = replay
+			w.Header().Set(idempotencyReplayedHeader, "true")
+		}
+	}
+	if res == nil {
+		res, err = inv.Invoke(r.Context(), call)
+		if idemKey != "" {
+			if err != nil {
+				inv.idempotency.Release(route, idemKey)
+			} else {
+				var ttl time.Duration
+				if dedupe != nil {
+					ttl = dedupe.ttl
+				}
+				inv.idempotency.Complete(route, idemKey, res, ttl)
+			}
+		}
+	}
+	answer()
+	var stage *stageError
+	if errors.As(err, &stage) {
+		w.Header().Set(pipelineStageHeader, strconv.Itoa(stage.stage))
+		if errors.Is(err, errRouteDisabled) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	if errors.Is(err, errTokenUnavailable) {
+		log.Println(err)
+		http.Error(w, "oauth token unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	var open *circuitOpenError
+	if errors.As(err, &open) {
+		open.reject(w)
+		return
+	}
+	var limit *limitError
+	if errors.As(err, &limit) {
+		log.Printf("node error: %v, stderr: %s", err, res.Stderr)
+		http.Error(w, limit.Error(), limit.status())
+		return
+	}
+	var fault *faultError
+	if errors.As(err, &fault) {
+		infof("%s: %v", route.Name, err)
+		http.Error(w, fault.Error(), fault.status)
+		return
+	}
+	if errors.Is(err, errTimeout) {
+		log.Printf("node error: %v, %s, stderr: %s", err, build, res.Stderr)
+		writeTimeout(w, inv.cfg.TimeoutStatus, route, call, res, err, time.Since(started))
+		return
+	}
+	if err != nil {
+		infof("%s", res.Stdout)
+		log.Printf("node error: %v, %s, stderr: %s", err, build, res.Stderr)
+		msg, cause := "node.js failed: ", err
+		if stage != nil {
+			msg, cause = fmt.Sprintf("node.js failed in pipeline stage %d (%s): ", stage.stage, stage.route), stage.err
+		}
+		http.Error(w, msg+firstLine(string(res.Stderr), cause.Error()), http.StatusInternalServerError)
+		return
+	}
+	infof("%s", res.Stdout)
+	span.SetAttr("invoke.cache.hit", res.Cached)
+
+	stdout := res.Stdout
+	if !raw {
+		if stdout, err = applyTransforms(route.ResponseTransforms, stdout); err != nil {
+			log.Printf("%s: output transform failed: %v", route.Name, err)
+			http.Error(w, "output transform failed", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	_, ws := opts.Tracer.Start(r.Context(), "write response", spanKindInternal)
+	contentType, out := "application/json", stdout
+	switch {
+	case raw:
+		contentType = route.rawResponseType(opts.RawResponseType)
+	case pg != nil:
+		out = pg.apply(stdout, fields)
+	default:
+		out = fields.filterOutput(stdout)
+	}
+	w.Header().Set("Content-Type", contentType)
+	if inv.cache != nil {
+		w.Header().Set("X-Cache", cacheStatus(res.Cached))
+	}
+	if res.Truncated {
+		w.Header().Set(outputTruncatedHeader, strconv.FormatInt(inv.cfg.Limits.MaxOutput, 10))
+	}
+	status := res.Response.apply(w.Header(), http.StatusOK)
+	if bodyAllowed(status) {
+		if err := opts.Signer.sign(w.Header(), out); err != nil {
+			log.Printf("%s: response signing failed: %v", route.Name, err)
+			http.Error(w, "response signing failed", http.StatusInternalServerError)
+			ws.End()
+			return
+		}
+	}
+	switch {
+	case !bodyAllowed(status):
+		w.Header().Del("Content-Type")
+		w.WriteHeader(status)
+	case raw:
+		// Raw output is often already compressed, e.g. images.
+		w.WriteHeader(status)
+		w.Write(out)
+	default:
+		writeCompressed(w, r, status, out, opts.CompressMinSize)
+	}
+	ws.SetAttr("http.response.body.size", len(out))
+	ws.End()
+}
+
+// extendDeadlines gives the request d from now to be read and answered,
+// overriding the server's ReadTimeout and WriteTimeout, which only fit
+// invocations of the server-wide timeout. Streaming responses shorten the
+// write deadline again; see streamWriter.
+func extendDeadlines(w http.ResponseWriter, d time.Duration) {
+	rc := http.NewResponseController(w)
+	deadline := time.Now().Add(d)
+	rc.SetReadDeadline(deadline)
+	rc.SetWriteDeadline(deadline)
+}
+
+// holdWriteDeadline lifts the write deadline while invocations wait for
+// their concurrency slots and run: their budget only starts once they are
+// admitted, however long they queued, and nothing is written meanwhile.
+// The returned answer gives writing the response margin from when it is
+// called.
+func holdWriteDeadline(w http.ResponseWriter, margin time.Duration) (answer func()) {
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	return func() { rc.SetWriteDeadline(time.Now().Add(margin)) }
+}
+
+// readPayload reads the JSON request body, applies the route's request
+// transforms, coerces it when enabled and validates it against the route's
+// schema. It writes the error response and returns false when the payload
+// is rejected.
+func readPayload(w http.ResponseWriter, r *http.Request, route *Route, opts handlerOptions) ([]byte, bool) {
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read request body: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	defer r.Body.Close()
+
+	if isJWE(r) {
+		var ok bool
+		if payload, ok = openPayload(w, payload, route, opts.Decrypter); !ok || route.Encryption == encryptionScript {
+			// The script alone sees the plaintext to transform and
+			// validate.
+			return payload, ok
+		}
+	}
+	if !json.Valid(payload) {
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return nil, false
+	}
+	if payload, err = applyTransforms(route.RequestTransforms, payload); err != nil {
+		http.Error(w, "payload transform failed: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	if route.Schema != nil {
+		if route.Coerce || opts.CoercePayload {
+			if payload, err = route.Schema.Coerce(payload); err != nil {
+				http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+				return nil, false
+			}
+		}
+		violations, err := route.Schema.Validate(payload)
+		if err != nil {
+			http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+			return nil, false
+		}
+		if len(violations) > 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]any{
+				"error":      "payload does not match schema",
+				"violations": violations,
+			})
+			return nil, false
+		}
+	}
+	return payload, true
+}
+
+// forwardedHeadersEnv serializes the allowlisted request headers into the
+// environment variable scripts read when calling downstream services.
+func forwardedHeadersEnv(h http.Header, allow []string) []string {
+	if len(allow) == 0 {
+		return nil
+	}
+	out := map[string]string{}
+	for _, name := range allow {
+		if v := h.Values(name); len(v) > 0 {
+			out[strings.ToLower(name)] = strings.Join(v, ", ")
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	b, _ := json.Marshal(out)
+	return []string{headersEnvKey + "=" + string(b)}
+}
+
+// propagate returns h with traceparent pointing at span, so scripts that
+// forward it continue the trace below the server span.
+func propagate(h http.Header, span *Span) http.Header {
+	if span == nil {
+		return h
+	}
+	h = h.Clone()
+	h.Set("traceparent", span.Traceparent())
+	return h
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+func firstLine(s, fallback string) string {
+	for line := range bytes.SplitSeq([]byte(s), []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) > 0 {
+			return string(line)
+		}
+	}
+	return fallback
+}
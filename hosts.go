@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const hostsEnvKey = "INVOKE_HOSTS"
+
+//go:embed hostsshim.js
+var hostsShim []byte
+
+// parseHosts validates the host mappings of a route, which point host
+// names at an IP address or another host name, like entries of a hosts
+// file, so scripts can be aimed at staging endpoints without code changes.
+// Names are matched case insensitively.
+func parseHosts(hosts map[string]string) (map[string]string, error) {
+	out := make(map[string]string, len(hosts))
+	for name, target := range hosts {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		if !validHostName(name) {
+			return nil, fmt.Errorf("%q is not a host name", name)
+		}
+		if net.ParseIP(target) == nil && !validHostName(strings.TrimSuffix(target, ".")) {
+			return nil, fmt.Errorf("%s: %q is neither an IP address nor a host name", name, target)
+		}
+		out[name] = target
+	}
+	return out, nil
+}
+
+func validHostName(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, c := range label {
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// hostsShimPath writes the preload applying host mappings to node's
+// resolver once, returning its path.
+var hostsShimPath = sync.OnceValues(func() (string, error) {
+	return writeShim("hosts", hostsShim)
+})
+
+// writeShim writes a preloaded script to the cache directory, returning
+// its path. It is named after its content so servers of different versions
+// don't share it.
+func writeShim(name string, content []byte) (string, error) {
+	sum := sha256.Sum256(content)
+	path := filepath.Join(filepath.Dir(tsCacheDir()), name+"-"+hex.EncodeToString(sum[:8])+".js")
+	if b, err := os.ReadFile(path); err == nil && bytes.Equal(b, content) {
+		return path, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return path, nil
+}
+
+// hostsEnv returns the variable handing the mappings to the preload.
+func hostsEnv(hosts map[string]string) string {
+	b, _ := json.Marshal(hosts)
+	return hostsEnvKey + "=" + string(b)
+}
+
+// mapHost returns addr, a host:port, with the host replaced by its
+// mapping, if any.
+func mapHost(hosts map[string]string, addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if target, ok := hosts[strings.TrimSuffix(strings.ToLower(host), ".")]; ok {
+		return net.JoinHostPort(strings.TrimSuffix(target, "."), port)
+	}
+	return addr
+}
@@ -0,0 +1,69 @@
+// Host mappings of go-invoke-node routes, preloaded with --require into
+// scripts of routes setting hosts. It answers dns.lookup, which node's
+// net, http, https and fetch resolve names with, from the JSON object in
+// INVOKE_HOSTS mapping host names to addresses or other host names.
+'use strict';
+
+const dns = require('node:dns');
+const net = require('node:net');
+
+const hosts = JSON.parse(process.env.INVOKE_HOSTS || '{}');
+
+function mapped(hostname) {
+  return hosts[String(hostname).toLowerCase().replace(/\.$/, '')];
+}
+
+function family(options) {
+  switch (options.family) {
+    case 'IPv4': return 4;
+    case 'IPv6': return 6;
+    default: return options.family || 0;
+  }
+}
+
+const lookup = dns.lookup;
+dns.lookup = function (hostname, options, callback) {
+  const target = mapped(hostname);
+  if (target === undefined) {
+    return lookup.apply(this, arguments);
+  }
+  if (typeof options === 'function') {
+    callback = options;
+    options = {};
+  } else if (typeof options === 'number') {
+    options = { family: options };
+  }
+  options = options || {};
+  const fam = net.isIP(target);
+  if (fam === 0) {
+    // Mapped to another name, which is resolved instead.
+    return lookup.call(this, target, options, callback);
+  }
+  process.nextTick(() => {
+    const want = family(options);
+    if (want !== 0 && want !== fam) {
+      const err = new Error(`getaddrinfo ENOTFOUND ${hostname}`);
+      err.code = 'ENOTFOUND';
+      err.hostname = hostname;
+      return callback(err);
+    }
+    if (options.all) {
+      return callback(null, [{ address: target, family: fam }]);
+    }
+    callback(null, target, fam);
+  });
+  return {};
+};
+
+const lookupPromise = dns.promises.lookup;
+dns.promises.lookup = function (hostname, options) {
+  if (mapped(hostname) === undefined) {
+    return lookupPromise.apply(this, arguments);
+  }
+  return new Promise((resolve, reject) => {
+    dns.lookup(hostname, options, (err, address, fam) => {
+      if (err) return reject(err);
+      resolve(Array.isArray(address) ? address : { address, family: fam });
+    });
+  });
+};
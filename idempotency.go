@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKey         = 255
+	// idempotencyPollInterval is how often a repeat waiting for a key
+	// claimed by another server checks whether it completed.
+	idempotencyPollInterval = 500 * time.Millisecond
+	// idempotencyHoldMargin is added to an attempt's timeout to get how
+	// long a pending claim lasts without being renewed.
+	idempotencyHoldMargin = time.Minute
+)
+
+var (
+	errIdempotencyInProgress = errors.New("a request with this Idempotency-Key is in progress")
+	errIdempotencyMismatch   = errors.New("Idempotency-Key was already used with a different payload")
+)
+
+// Idempotency lets clients retry side-effecting invocations safely: a
+// request carrying an Idempotency-Key header runs the script once, and
+// repeats within the TTL get the stored output back instead of running it
+// again. Keys and outputs are kept in a SQLite database, or a Redis or
+// PostgreSQL one shared by several servers, so they survive restarts; a
+// graceful shutdown lets running invocations finish and store their
+// output, so clients retrying across a restart don't cause a second run.
+//
+// A key is claimed before the script starts. Repeats arriving while it
+// runs wait for it and get its output too, so concurrent deliveries of
+// the same webhook run the script once; repeats with another payload are
+// answered with 422. Failed invocations release the claim, letting one of
+// the waiting repeats run instead. The server holding a claim renews it
+// until the invocation ends, however long it queues for a slot, so a
+// claim is only given up once its server crashed.
+type Idempotency struct {
+	kv  KVBackend
+	ttl time.Duration
+
+	mu sync.Mutex
+	// changed holds a channel per claimed record, closed when this server
+	// completes or releases it.
+	changed map[string]chan struct{}
+	// claims are the records this server claimed and still renews.
+	claims map[string]*idempotencyClaim
+}
+
+// idempotencyClaim is a record claimed by this server.
+type idempotencyClaim struct {
+	owner string
+	// mu keeps a renewal from writing the pending record back over the
+	// completed one.
+	mu    sync.Mutex
+	ended bool
+	stop  chan struct{}
+}
+
+// idempotencyRecord is the state of a key.
+type idempotencyRecord struct {
+	Route         string `json:"route"`
+	PayloadSHA256 string `json:"payload_sha256"`
+	Done          bool   `json:"done"`
+	Output        []byte `json:"output,omitempty"`
+	// Response is the status and headers the script set, if any.
+	Response *ScriptResponse `json:"response,omitempty"`
+	Created  time.Time       `json:"created"`
+	// Owner tells the claims of different invocations apart.
+	Owner string `json:"owner,omitempty"`
+}
+
+// NewIdempotency keeps keys in the storage named by spec; see
+// openStorage. Pending claims expire once given up, and completed ones
+// after ttl.
+func NewIdempotency(spec string, ttl time.Duration) (*Idempotency, error) {
+	kv, err := openStorage(spec, "idempotency")
+	if err != nil {
+		return nil, err
+	}
+	return &Idempotency{kv: kv, ttl: ttl, changed: map[string]chan struct{}{}, claims: map[string]*idempotencyClaim{}}, nil
+}
+
+func validIdempotencyKey(key string) bool {
+	return key != "" && len(key) <= maxIdempotencyKey && !strings.ContainsFunc(key, func(r rune) bool { return r < ' ' || r > '~' })
+}
+
+// id returns the storage key of key of route.
+func (s *Idempotency) id(route *Route, key string) string {
+	sum := sha256.Sum256([]byte(route.Name + "\x00" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Claim reserves key of route for an invocation with payload. The claim is
+// renewed for hold at a time until Complete or Release, and lapses hold
+// after its server stopped renewing it. It returns the stored result when the key was already
+// used for the same payload, waiting for the invocation holding the key to
+// finish first, and errIdempotencyMismatch when the request must be
+// rejected. It gives up waiting when ctx is done.
+func (s *Idempotency) Claim(ctx context.Context, route *Route, key string, payload []byte, hold time.Duration) (*Result, error) {
+	sum := sha256.Sum256(payload)
+	id := s.id(route, key)
+	for {
+		replay, err := s.claim(id, route.Name, hex.EncodeToString(sum[:]), hold)
+		if !errors.Is(err, errIdempotencyInProgress) {
+			return replay, err
+		}
+		// Claims of other servers sharing the storage are polled.
+		timer := time.NewTimer(idempotencyPollInterval)
+		select {
+		case <-s.wait(id):
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+// claim makes a single attempt at claiming the record id.
+func (s *Idempotency) claim(id, route, payloadSHA256 string, hold time.Duration) (*Result, error) {
+	rec := &idempotencyRecord{
+		Route:         route,
+		PayloadSHA256: payloadSHA256,
+		Created:       time.Now().UTC(),
+		Owner:         newRecordID(),
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	for range 2 {
+		_, err := s.kv.Put(id, b, hold, true)
+		if err == nil {
+			c := &idempotencyClaim{owner: rec.Owner, stop: make(chan struct{})}
+			s.mu.Lock()
+			s.claims[id] = c
+			s.mu.Unlock()
+			go s.renew(id, c, hold)
+			return nil, nil
+		}
+		if !errors.Is(err, errKeyExists) {
+			return nil, err
+		}
+		prev, err := s.read(id)
+		if errors.Is(err, errKeyNotFound) {
+			// Expired or released meanwhile.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if prev.PayloadSHA256 != rec.PayloadSHA256 {
+			return nil, errIdempotencyMismatch
+		}
+		if !prev.Done {
+			return nil, errIdempotencyInProgress
+		}
+		return &Result{Stdout: prev.Output, Response: prev.Response}, nil
+	}
+	return nil, errIdempotencyInProgress
+}
+
+// renew extends the claim c on the record id by hold every third of hold
+// until it ends, or until the record turns out to belong to another
+// claim, e.g. after the store was unreachable for longer than hold.
+func (s *Idempotency) renew(id string, c *idempotencyClaim, hold time.Duration) {
+	t := time.NewTicker(hold / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-c.stop:
+			return
+		}
+		c.mu.Lock()
+		lost, err := s.renewLocked(id, c, hold)
+		c.mu.Unlock()
+		if err != nil {
+			log.Printf("idempotency key %s: renew claim: %v", id, err)
+		}
+		if lost {
+			return
+		}
+		// Otherwise the store may be back before the claim lapses.
+	}
+}
+
+// renewLocked extends the claim c once, reporting whether it was lost or
+// ended instead.
+func (s *Idempotency) renewLocked(id string, c *idempotencyClaim, hold time.Duration) (lost bool, err error) {
+	if c.ended {
+		return true, nil
+	}
+	rec, err := s.read(id)
+	if errors.Is(err, errKeyNotFound) || err == nil && (rec.Owner != c.owner || rec.Done) {
+		return true, errors.New("claim was lost")
+	}
+	if err != nil {
+		return false, err
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return false, err
+	}
+	_, err = s.kv.Put(id, b, hold, false)
+	return false, err
+}
+
+// end stops renewing this server's claim on the record id, if any, and
+// returns it locked, for the caller to unlock once it wrote the record.
+func (s *Idempotency) end(id string) *idempotencyClaim {
+	s.mu.Lock()
+	c := s.claims[id]
+	delete(s.claims, id)
+	s.mu.Unlock()
+	if c == nil {
+		return &idempotencyClaim{}
+	}
+	close(c.stop)
+	c.mu.Lock()
+	c.ended = true
+	return c
+}
+
+// wait returns a channel closed once this server completes or releases
+// the record id.
+func (s *Idempotency) wait(id string) <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := s.changed[id]
+	if ch == nil {
+		ch = make(chan struct{})
+		s.changed[id] = ch
+	}
+	return ch
+}
+
+// notify wakes the repeats waiting for the record id.
+func (s *Idempotency) notify(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ch := s.changed[id]; ch != nil {
+		close(ch)
+		delete(s.changed, id)
+	}
+}
+
+// Complete stores the result of the invocation that claimed key, for ttl
+// or, when zero, --idempotency-ttl.
+func (s *Idempotency) Complete(route *Route, key string, res *Result, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = s.ttl
+	}
+	id := s.id(route, key)
+	c := s.end(id)
+	defer c.mu.Unlock()
+	rec, err := s.read(id)
+	if err == nil {
+		rec.Done, rec.Output, rec.Response = true, res.Stdout, res.Response
+		var b []byte
+		if b, err = json.Marshal(rec); err == nil {
+			_, err = s.kv.Put(id, b, ttl, false)
+		}
+	}
+	if err != nil {
+		log.Printf("%s: idempotency key: %v", route.Name, err)
+	}
+	s.notify(id)
+}
+
+// Release gives up the claim on key after the invocation failed.
+func (s *Idempotency) Release(route *Route, key string) {
+	id := s.id(route, key)
+	c := s.end(id)
+	defer c.mu.Unlock()
+	if err := s.kv.Delete(id); err != nil {
+		log.Printf("%s: idempotency key: %v", route.Name, err)
+	}
+	s.notify(id)
+}
+
+func (s *Idempotency) read(id string) (*idempotencyRecord, error) {
+	b, err := s.kv.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	var rec idempotencyRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// idempotencyHold is how long a claim on a key of route outlives its last
+// renewal: long enough for one attempt, so a claim isn't given up while a
+// slow store delays renewals, and not much longer, so a crashed server's
+// claims lapse soon.
+func (inv *Invoker) idempotencyHold(route *Route) time.Duration {
+	return inv.timeoutFor(route) + idempotencyHoldMargin
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestIdempotency(t *testing.T) *Idempotency {
+	t.Helper()
+	s, err := NewIdempotency(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.kv.Close() })
+	return s
+}
+
+func TestIdempotencyClaim(t *testing.T) {
+	ctx := context.Background()
+	route := &Route{Name: "orders"}
+	// complete stores the first invocation's output for ttl, and waits
+	// for it to expire.
+	complete := func(ttl time.Duration) func(*Idempotency) {
+		return func(s *Idempotency) {
+			s.Complete(route, "k", &Result{Stdout: []byte("done")}, ttl)
+			time.Sleep(2 * ttl)
+		}
+	}
+	tests := []struct {
+		name string
+		// first runs after the first claim of key k with payload {"a":1}.
+		first   func(s *Idempotency)
+		key     string
+		payload string
+		want    string
+		wantErr error
+	}{
+		{name: "replay", first: complete(0), key: "k", payload: `{"a":1}`, want: "done"},
+		{name: "other payload", first: complete(0), key: "k", payload: `{"a":2}`, wantErr: errIdempotencyMismatch},
+		{name: "other payload while pending", first: func(*Idempotency) {}, key: "k", payload: `{"a":2}`, wantErr: errIdempotencyMismatch},
+		{name: "other key", first: func(*Idempotency) {}, key: "k2", payload: `{"a":1}`},
+		{name: "released", first: func(s *Idempotency) { s.Release(route, "k") }, key: "k", payload: `{"a":1}`},
+		{name: "expired", first: complete(time.Millisecond), key: "k", payload: `{"a":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestIdempotency(t)
+			if replay, err := s.Claim(ctx, route, "k", []byte(`{"a":1}`), time.Minute); replay != nil || err != nil {
+				t.Fatalf("first Claim = %v, %v", replay, err)
+			}
+			tt.first(s)
+			replay, err := s.Claim(ctx, route, tt.key, []byte(tt.payload), time.Minute)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Claim = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tt.want == "" && replay != nil:
+				t.Errorf("Claim replayed %q, want the key claimed", replay.Stdout)
+			case tt.want != "" && (replay == nil || string(replay.Stdout) != tt.want):
+				t.Errorf("Claim = %v, want %q replayed", replay, tt.want)
+			}
+		})
+	}
+}
+
+// TestIdempotencyConcurrentClaims checks that of concurrent deliveries of
+// the same request one runs and the others get its output.
+func TestIdempotencyConcurrentClaims(t *testing.T) {
+	s := newTestIdempotency(t)
+	route := &Route{Name: "orders"}
+	var runs atomic.Int32
+	var wg sync.WaitGroup
+	outputs := make([]string, 8)
+	for i := range outputs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replay, err := s.Claim(context.Background(), route, "k", []byte(`{}`), time.Minute)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if replay == nil {
+				runs.Add(1)
+				time.Sleep(20 * time.Millisecond)
+				replay = &Result{Stdout: []byte("ran")}
+				s.Complete(route, "k", replay, 0)
+			}
+			outputs[i] = string(replay.Stdout)
+		}()
+	}
+	wg.Wait()
+	if n := runs.Load(); n != 1 {
+		t.Errorf("%d runs, want 1", n)
+	}
+	for i, out := range outputs {
+		if out != "ran" {
+			t.Errorf("delivery %d got %q", i, out)
+		}
+	}
+}
+
+// TestIdempotencyReleaseWakesRepeat checks that a failed invocation lets a
+// waiting repeat run instead.
+func TestIdempotencyReleaseWakesRepeat(t *testing.T) {
+	s := newTestIdempotency(t)
+	route := &Route{Name: "orders"}
+	if _, err := s.Claim(context.Background(), route, "k", []byte(`{}`), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	claimed := make(chan error)
+	go func() {
+		replay, err := s.Claim(context.Background(), route, "k", []byte(`{}`), time.Minute)
+		if err == nil && replay != nil {
+			err = errors.New("repeat got a replay")
+		}
+		claimed <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.Release(route, "k")
+	select {
+	case err := <-claimed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the repeat never claimed the released key")
+	}
+}
+
+// TestIdempotencyClaimOutlivesQueue runs with a concurrency of 1 whose
+// slot is held past the claim's hold time: the queued invocation keeps
+// its claim, so a retry waits for it instead of running the script again.
+func TestIdempotencyClaimOutlivesQueue(t *testing.T) {
+	s := newTestIdempotency(t)
+	route := &Route{Name: "orders"}
+	slots := newLimiter(1)
+	slots.Acquire(context.Background(), priorityNormal)
+	const hold = 60 * time.Millisecond
+
+	var runs atomic.Int32
+	deliver := func() (*Result, error) {
+		replay, err := s.Claim(context.Background(), route, "k", []byte(`{}`), hold)
+		if err != nil || replay != nil {
+			return replay, err
+		}
+		slots.Acquire(context.Background(), priorityNormal)
+		defer slots.Release()
+		runs.Add(1)
+		res := &Result{Stdout: []byte("ran")}
+		s.Complete(route, "k", res, 0)
+		return res, nil
+	}
+
+	first := make(chan *Result)
+	go func() {
+		res, err := deliver()
+		if err != nil {
+			t.Error(err)
+		}
+		first <- res
+	}()
+	waitQueued(t, slots, 1)
+	time.Sleep(5 * hold)
+
+	retry := make(chan *Result)
+	go func() {
+		res, err := deliver()
+		if err != nil {
+			t.Error(err)
+		}
+		retry <- res
+	}()
+	time.Sleep(2 * hold)
+	if _, _, queued := slots.Stats(); queued != 1 {
+		t.Fatalf("%d invocations queued, want the first only", queued)
+	}
+	slots.Release()
+	for _, ch := range []chan *Result{first, retry} {
+		if res := <-ch; res == nil || string(res.Stdout) != "ran" {
+			t.Errorf("result %v, want ran", res)
+		}
+	}
+	if n := runs.Load(); n != 1 {
+		t.Errorf("the script ran %d times, want once", n)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errCanceled marks an attempt canceled through the debug API.
+var errCanceled = errors.New("invocation canceled by an operator")
+
+// inflight tracks the running attempts so operators can see what a hung
+// server is busy with and cancel what won't finish on its own. Only
+// attempts that got their concurrency slots are listed; queued invocations
+// are in the admin settings' counts.
+type inflight struct {
+	mu     sync.Mutex
+	nextID uint64
+	calls  map[uint64]*inflightCall
+}
+
+type inflightCall struct {
+	id      uint64
+	route   string
+	request string
+	started time.Time
+	cancel  context.CancelCauseFunc
+
+	pid            atomic.Int64
+	stdout, stderr atomic.Int64
+}
+
+// inflightReport is an entry of GET /debug/invocations. PID is the worker's
+// for persistent routes, and output is only counted for scripts spawned
+// per invocation.
+type inflightReport struct {
+	ID          string    `json:"id"`
+	Route       string    `json:"route"`
+	RequestID   string    `json:"request_id,omitempty"`
+	PID         int64     `json:"pid,omitempty"`
+	Started     time.Time `json:"started"`
+	Age         string    `json:"age"`
+	StdoutBytes int64     `json:"stdout_bytes"`
+	StderrBytes int64     `json:"stderr_bytes"`
+}
+
+func newInflight() *inflight {
+	return &inflight{calls: map[uint64]*inflightCall{}}
+}
+
+// begin registers an attempt of call. The returned context is canceled by
+// Cancel; done must be called once the attempt finished.
+func (f *inflight) begin(ctx context.Context, call Invocation) (context.Context, *inflightCall, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	c := &inflightCall{
+		route:   call.Route.Name,
+		request: call.Request.ID,
+		started: time.Now(),
+		cancel:  cancel,
+	}
+	f.mu.Lock()
+	f.nextID++
+	c.id = f.nextID
+	f.calls[c.id] = c
+	f.mu.Unlock()
+	return ctx, c, func() {
+		f.mu.Lock()
+		delete(f.calls, c.id)
+		f.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// List returns the running attempts, oldest first.
+func (f *inflight) List() []inflightReport {
+	now := time.Now()
+	f.mu.Lock()
+	out := make([]inflightReport, 0, len(f.calls))
+	for _, c := range f.calls {
+		out = append(out, inflightReport{
+			ID:          strconv.FormatUint(c.id, 10),
+			Route:       c.route,
+			RequestID:   c.request,
+			PID:         c.pid.Load(),
+			Started:     c.started.UTC(),
+			Age:         now.Sub(c.started).Round(time.Millisecond).String(),
+			StdoutBytes: c.stdout.Load(),
+			StderrBytes: c.stderr.Load(),
+		})
+	}
+	f.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
+
+// Cancel stops the attempt with id, killing its script, and reports
+// whether it was running.
+func (f *inflight) Cancel(id string) bool {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return false
+	}
+	f.mu.Lock()
+	c := f.calls[n]
+	f.mu.Unlock()
+	if c == nil {
+		return false
+	}
+	c.cancel(errCanceled)
+	return true
+}
+
+// canceled wraps err with errCanceled when ctx, the attempt's context, was
+// canceled through Cancel.
+func canceled(ctx context.Context, err error) error {
+	if err != nil && errors.Is(context.Cause(ctx), errCanceled) {
+		return fmt.Errorf("%w: %v", errCanceled, err)
+	}
+	return err
+}
+
+// countingWriter counts the bytes written through it into n.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// orphanWaitDelay bounds how long output is still read after the
+	// script exited, in case children it left behind hold its stdout.
+	orphanWaitDelay = time.Second
+	// reapTimeout bounds how long the stragglers of an invocation are
+	// killed and reaped for.
+	reapTimeout = 5 * time.Second
+)
+
+// errTokenUnavailable is returned when the script needs an OAuth token but
+// none could be obtained.
+var errTokenUnavailable = errors.New("oauth token unavailable")
+
+// Invoker runs scripts, one node process per invocation.
+type Invoker struct {
+	cfg    Config
+	tokens *TokenManager
+	slots  *limiter
+	tracer *Tracer
+	cache  *resultCache
+	egress *EgressProxy
+	store  *Store
+	// breakers fast-fail routes whose script keeps failing.
+	breakers *Breakers
+	// triggerStats counts invocations started by triggers.
+	triggerStats triggerStats
+	// timeouts counts attempts killed by their timeout.
+	timeouts timeoutStats
+	// workerRecycles counts persistent workers replaced by --worker-max-rss
+	// and --worker-max-requests.
+	workerRecycles recycleStats
+	// experimentStats counts the invocations of experiment variants.
+	experimentStats experimentStats
+	// timeout is the per-attempt timeout, adjustable at runtime.
+	timeout atomic.Int64
+	// sandbox holds the node flags detected for sandboxed routes.
+	sandbox sandboxFlags
+	// deadLetters, when set, keeps failed invocations for re-driving.
+	deadLetters *DeadLetters
+	// audit, when set, records every invocation.
+	audit *Auditor
+	// sampler, when set, forwards a sample of invocations for offline
+	// analysis.
+	sampler *Sampler
+	// analytics, when set, collects the size and shape of traffic.
+	analytics *Analytics
+	// idempotency, when set, deduplicates requests by Idempotency-Key.
+	idempotency *Idempotency
+	// callbacks, when set, runs invocations asynchronously for clients
+	// passing a callback URL.
+	callbacks *Callbacks
+	// inflight lists the running attempts for the debug API.
+	inflight *inflight
+	// packages, when set, is the node_modules installed for
+	// --package-json.
+	packages string
+	// sdk, when set, is the node_modules holding the go-invoke package.
+	sdk string
+	// typescript runs .ts scripts.
+	typescript typeScript
+	// nodeEnv is added to the environment of every node process.
+	nodeEnv nodeEnv
+	// executor starts the node processes.
+	executor Executor
+	// tenants are the tenants owning configured routes, for metrics;
+	// reloads replace them.
+	tenants atomic.Pointer[[]*Tenant]
+	// reloads counts config reloads for metrics.
+	reloads reloadStats
+}
+
+// Invocation is a single request to run the script.
+type Invocation struct {
+	Route   *Route
+	Payload []byte
+	// Stdin, when set, is streamed to the script instead of Payload. Such
+	// invocations are neither cached nor retried.
+	Stdin io.Reader
+	// ReadPaths are extra paths the script must be able to read, such as
+	// staged uploads, even when sandboxed.
+	ReadPaths []string
+	// Env holds extra KEY=value pairs added to the child environment.
+	Env []string
+	// Request identifies what the invocation is for in the script's
+	// INVOKE_CONTEXT.
+	Request RequestInfo
+	// Stdout, when set, receives the script output as it is produced
+	// instead of it being buffered into the Result.
+	Stdout io.Writer
+	// NoCache skips the cache lookup; a successful result is still stored.
+	NoCache bool
+	// NoDeadLetter skips capturing a failure as a dead letter, for
+	// synthetic invocations and re-drives.
+	NoDeadLetter bool
+	// NoAudit leaves synthetic invocations out of the audit log,
+	// sampling and analytics.
+	NoAudit bool
+	// Clock, when set, is the current time the script's Date starts at,
+	// and Deterministic freezes it there and seeds the script's randomness
+	// with Seed. Such invocations are not cached.
+	Clock         time.Time
+	Deterministic bool
+	Seed          uint64
+	// Admitted, when set, is called each time an attempt has taken its
+	// concurrency slots.
+	Admitted func()
+	// Priority orders the invocation among those waiting for a slot.
+	Priority Priority
+	// Timeout, when set, overrides the per-attempt timeout of Route, for
+	// pipeline stages.
+	Timeout time.Duration
+}
+
+// stdin returns the reader the script's input is taken from.
+func (call Invocation) stdin() io.Reader {
+	if call.Stdin != nil {
+		return call.Stdin
+	}
+	return bytes.NewReader(call.Payload)
+}
+
+// Result holds the output of a single script invocation.
+type Result struct {
+	Stdout []byte
+	Stderr []byte
+	// Response, when set, is the status and headers the script asked for.
+	Response *ScriptResponse
+	// Truncated is set when Stdout was cut at the output limit.
+	Truncated bool
+	// Cached is set when Stdout came from the result cache.
+	Cached bool
+}
+
+func NewInvoker(cfg Config, tokens *TokenManager, tracer *Tracer, egress *EgressProxy, store *Store) *Invoker {
+	inv := &Invoker{
+		cfg:    cfg,
+		tokens: tokens,
+		slots:  newLimiter(cfg.Concurrency),
+		tracer: tracer,
+		cache:  newResultCache(cfg.CacheSize, cfg.CacheTTL),
+		egress: egress,
+		store:  store,
+
+		breakers: newBreakers(cfg.Breaker),
+		inflight: newInflight(),
+		nodeEnv:  newNodeEnv(cfg),
+		executor: localExecutor{},
+	}
+	inv.SetTimeout(cfg.Timeout)
+	return inv
+}
+
+// Timeout returns the current per-attempt timeout.
+func (inv *Invoker) Timeout() time.Duration {
+	return time.Duration(inv.timeout.Load())
+}
+
+// SetTimeout changes the timeout of invocations started from now on.
+func (inv *Invoker) SetTimeout(d time.Duration) {
+	inv.timeout.Store(int64(d))
+}
+
+// timeoutFor returns the per-attempt timeout of route: its own, or the
+// current server-wide one.
+func (inv *Invoker) timeoutFor(route *Route) time.Duration {
+	if route.Timeout > 0 {
+		return route.Timeout
+	}
+	return inv.Timeout()
+}
+
+// budget bounds how long an invocation of route runs once admitted:
+// every attempt its retry policy allows and the backoff between them, or
+// for pipelines, that of every stage.
+func (inv *Invoker) budget(route *Route) time.Duration {
+	if route.Pipeline == nil {
+		return inv.attemptsBudget(route, inv.timeoutFor(route))
+	}
+	var d time.Duration
+	for _, stage := range route.Pipeline {
+		timeout := inv.timeoutFor(stage.Route)
+		if stage.Timeout > 0 {
+			timeout = stage.Timeout
+		}
+		d += inv.attemptsBudget(stage.Route, timeout)
+	}
+	if route.Timeout > 0 {
+		d = min(d, route.Timeout)
+	}
+	return d
+}
+
+// attemptsBudget is how long route's attempts of timeout each may take,
+// retries included.
+func (inv *Invoker) attemptsBudget(route *Route, timeout time.Duration) time.Duration {
+	policy := inv.cfg.Retry
+	if route.Retry != nil {
+		policy = *route.Retry
+	}
+	d := timeout
+	backoff := policy.Backoff
+	for range max(policy.Attempts, 1) - 1 {
+		d += timeout + backoff
+		backoff *= 2
+	}
+	return d
+}
+
+// Invoke runs node with payload on stdin, bounded by the configured timeout.
+// It waits for a free slot when the concurrency limit is reached. The
+// returned Result is never nil; on failure it carries whatever output was
+// captured. Buffered invocations are answered from the result cache when
+// it is enabled, failures are captured as dead letters when that is, and
+// every invocation is recorded in the audit log when there is one.
+func (inv *Invoker) Invoke(ctx context.Context, call Invocation) (*Result, error) {
+	if t := call.Route.Tenant; t != nil {
+		call.Request.Tenant = t.Name
+	}
+	started := time.Now()
+	res, err := inv.invoke(ctx, call)
+	if call.Route.StreamEvents && call.Stdout == nil {
+		res.Stdout = stripEventLines(res.Stdout)
+	}
+	if call.Request.Variant != "" {
+		inv.experimentStats.record(call, err, time.Since(started))
+	}
+	if err != nil && inv.deadLetters != nil {
+		inv.deadLetters.Capture(call, res, err, started, ctx.Err() != nil)
+	}
+	if inv.audit != nil && !call.NoAudit {
+		inv.audit.Record(call, res, err, started, ctx.Err() != nil)
+	}
+	if inv.sampler != nil && !call.NoAudit {
+		inv.sampler.Record(call, res, err, started)
+	}
+	if inv.analytics != nil && !call.NoAudit {
+		inv.analytics.Record(call, res, err)
+	}
+	return res, err
+}
+
+func (inv *Invoker) invoke(ctx context.Context, call Invocation) (*Result, error) {
+	if call.Route.Pipeline != nil {
+		return inv.runPipeline(ctx, call)
+	}
+	if inv.cache == nil || call.Stdout != nil || call.Stdin != nil || !call.Clock.IsZero() || call.Deterministic {
+		return inv.runRetrying(ctx, call)
+	}
+	key := cacheKey(call)
+	if !call.NoCache {
+		if out, ok := inv.cache.Get(key); ok {
+			return &Result{Stdout: out, Cached: true}, nil
+		}
+	}
+	res, err := inv.runRetrying(ctx, call)
+	if err == nil && res.Response == nil && !res.Truncated {
+		inv.cache.Put(key, res.Stdout)
+	}
+	return res, err
+}
+
+// runRetrying runs call, repeating it with exponential backoff while the
+// route's retry policy and circuit breaker allow.
+func (inv *Invoker) runRetrying(ctx context.Context, call Invocation) (*Result, error) {
+	policy := inv.cfg.Retry
+	if call.Route.Retry != nil {
+		policy = *call.Route.Retry
+	}
+	attempts := max(policy.Attempts, 1)
+	if call.Stdout != nil || call.Stdin != nil {
+		attempts = 1
+	}
+
+	backoff := policy.Backoff
+	var res *Result
+	var err error
+	for attempt := 1; ; attempt++ {
+		if berr := inv.breakers.Allow(call.Route); berr != nil {
+			if attempt == 1 {
+				return &Result{}, berr
+			}
+			return res, err
+		}
+		res, err = inv.run(ctx, call)
+		if errors.Is(err, errTimeout) {
+			inv.timeouts.record(call.Route.Name)
+		}
+		inv.breakers.Record(ctx, call.Route, err)
+		if err == nil || attempt >= attempts || !policy.retryable(err) {
+			return res, err
+		}
+		infof("%s: attempt %d/%d failed: %v; retrying in %s", call.Route.Name, attempt, attempts, err, backoff)
+		select {
+		case <-ctx.Done():
+			return res, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (inv *Invoker) run(ctx context.Context, call Invocation) (*Result, error) {
+	_, qs := inv.tracer.Start(ctx, "queue", spanKindInternal)
+	// The route's own slot, then its tenant's, are taken first so
+	// invocations waiting on them don't hold server-wide slots other
+	// routes could use.
+	if rs := call.Route.slots; rs != nil {
+		if err := rs.Acquire(ctx, call.Priority); err != nil {
+			qs.RecordError(err)
+			qs.End()
+			return &Result{}, err
+		}
+		defer rs.Release()
+	}
+	if t := call.Route.Tenant; t != nil && t.slots != nil {
+		if err := t.slots.Acquire(ctx, call.Priority); err != nil {
+			qs.RecordError(err)
+			qs.End()
+			return &Result{}, err
+		}
+		defer t.slots.Release()
+	}
+	err := inv.slots.Acquire(ctx, call.Priority)
+	qs.RecordError(err)
+	qs.End()
+	if err != nil {
+		return &Result{}, err
+	}
+	defer inv.slots.Release()
+	if call.Admitted != nil {
+		call.Admitted()
+	}
+
+	ctx, running, done := inv.inflight.begin(ctx, call)
+	defer done()
+
+	if pt := call.Route.PayloadTemplate; pt != nil && call.Stdin == nil {
+		payload, err := pt.render(call)
+		if err != nil {
+			return &Result{}, err
+		}
+		call.Payload = payload
+	}
+
+	timeout := inv.timeoutFor(call.Route)
+	if call.Timeout > 0 {
+		timeout = call.Timeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := call.Route.injectFault(ctx); err != nil {
+		return &Result{}, canceled(ctx, timedOut(ctx, timeout, err))
+	}
+
+	env := call.Env
+	if inv.tokens != nil {
+		tok, err := inv.tokens.Token(ctx)
+		if err != nil {
+			return &Result{}, fmt.Errorf("%w: %v", errTokenUnavailable, err)
+		}
+		env = append(env[:len(env):len(env)], tokenEnvKey+"="+tok)
+	}
+
+	if inv.egress != nil {
+		sess := inv.egress.Begin(call.Route)
+		defer func() {
+			infof("%s: egress: %s", call.Route.Name, sess.End())
+		}()
+		env = append(env[:len(env):len(env)], sess.Env()...)
+	}
+
+	if inv.store != nil {
+		env = append(env[:len(env):len(env)], inv.store.Env()...)
+	}
+	env = append(env[:len(env):len(env)], inv.cfg.Locality.Env()...)
+	deadline, _ := ctx.Deadline()
+	env = append(env, inv.contextEnv(call, deadline))
+
+	if call.Route.worker != nil {
+		running.pid.Store(int64(call.Route.worker.pid()))
+		wctx, ws := inv.tracer.Start(ctx, "worker request", spanKindClient)
+		res, err := call.Route.worker.Do(wctx, call, env)
+		err = canceled(ctx, timedOut(ctx, timeout, err))
+		ws.RecordError(err)
+		ws.End()
+		return res, err
+	}
+
+	routeEnv, err := call.Route.environ()
+	if err != nil {
+		return &Result{}, err
+	}
+
+	var workdir string
+	if wd := inv.workdirFor(call.Route); wd != nil {
+		if workdir, err = wd.create(); err != nil {
+			return &Result{}, fmt.Errorf("create working directory: %w", err)
+		}
+		defer os.RemoveAll(workdir)
+		env = append(env[:len(env):len(env)], workdirEnvKey+"="+workdir, "TMPDIR="+workdir)
+	}
+
+	preloads, simEnv, err := call.simulation()
+	if err != nil {
+		return &Result{}, err
+	}
+	env = append(env[:len(env):len(env)], simEnv...)
+	spec, err := inv.nodeSpec(call.Route, append(call.ReadPaths[:len(call.ReadPaths):len(call.ReadPaths)], preloads...), workdir)
+	if err != nil {
+		return &Result{}, err
+	}
+	for _, p := range preloads {
+		spec.Args = append([]string{"--require", p}, spec.Args...)
+	}
+
+	var response *os.File
+	if call.Stdout == nil && inv.executor.Local() {
+		if response, err = openScriptResponse(); err != nil {
+			return &Result{}, err
+		}
+		defer response.Close()
+		env = append(env[:len(env):len(env)], fmt.Sprintf("%s=%d", responseFDEnvKey, responseFD))
+	}
+	spec.Env = inv.nodeEnv.apply(append(append(childEnv(), routeEnv...), env...))
+	cmd, release := inv.executor.Command(ctx, spec)
+	cmd.Stdin = call.stdin()
+	if response != nil {
+		cmd.ExtraFiles = []*os.File{response}
+	}
+
+	var cg *cgroup
+	if inv.executor.Local() && inv.cfg.Limits.usesCgroup() {
+		if cg, err = inv.cfg.Limits.newCgroup(); err != nil {
+			return &Result{}, fmt.Errorf("create cgroup: %w", err)
+		}
+		defer cg.Remove()
+		cg.apply(cmd)
+	}
+
+	var errBuf bytes.Buffer
+	outBuf := outputBuffer{max: inv.cfg.Limits.MaxOutput}
+	if inv.cfg.Limits.OutputPolicy == outputLimitKill {
+		outBuf.onExceed = func() { killProcessGroup(cmd.Process) }
+	}
+	var stdout io.Writer = &outBuf
+	if call.Stdout != nil {
+		stdout = call.Stdout
+	}
+	cmd.Stdout = countingWriter{stdout, &running.stdout}
+	cmd.Stderr = countingWriter{&errBuf, &running.stderr}
+
+	_, ss := inv.tracer.Start(ctx, "spawn", spanKindInternal)
+	err = cmd.Start()
+	ss.RecordError(err)
+	ss.End()
+	if err != nil {
+		return &Result{}, err
+	}
+
+	running.pid.Store(int64(cmd.Process.Pid))
+	_, es := inv.tracer.Start(ctx, "execute", spanKindInternal)
+	es.SetAttr("process.pid", cmd.Process.Pid)
+	err = cmd.Wait()
+	go release()
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// The script succeeded; a child it left running kept stdout open
+		// and is killed with the rest of the group.
+		infof("%s: script exited leaving children behind", call.Route.Name)
+		err = nil
+	}
+	err = canceled(ctx, timedOut(ctx, timeout, err))
+	if err != nil {
+		err = limitExceeded(cg, errBuf.Bytes(), err)
+	}
+	if outBuf.exceeded && outBuf.onExceed != nil {
+		err = &limitError{resource: "output", err: fmt.Errorf("stdout over %d bytes: %v", outBuf.max, err)}
+	}
+	es.RecordError(err)
+	es.SetAttr("process.exit.code", cmd.ProcessState.ExitCode())
+	es.End()
+
+	res := &Result{Stdout: outBuf.Bytes(), Stderr: errBuf.Bytes(), Truncated: outBuf.exceeded}
+	if err == nil && response != nil {
+		res.Response, err = readScriptResponse(response)
+	}
+	return res, err
+}
+
+// nodeSpec returns the node process running route in workdir, the
+// server's working directory when empty, including the flags enforcing
+// the sandbox. The script may also read readPaths, and read and write
+// workdir. The environment is left to the caller.
+func (inv *Invoker) nodeSpec(route *Route, readPaths []string, workdir string) (ExecSpec, error) {
+	var args []string
+	readPaths = append(readPaths[:len(readPaths):len(readPaths)], inv.nodeEnv.readPaths()...)
+	if inv.store != nil {
+		// Let sandboxed scripts load the store client.
+		readPaths = append(readPaths[:len(readPaths):len(readPaths)], inv.store.dir)
+	}
+	if inv.packages != "" {
+		readPaths = append(readPaths[:len(readPaths):len(readPaths)], inv.packages)
+	}
+	if inv.sdk != "" {
+		readPaths = append(readPaths[:len(readPaths):len(readPaths)], inv.sdk)
+	}
+	if route.Hosts != nil {
+		shim, err := hostsShimPath()
+		if err != nil {
+			return ExecSpec{}, fmt.Errorf("hosts: %w", err)
+		}
+		args = append(args, "--require", shim)
+		readPaths = append(readPaths[:len(readPaths):len(readPaths)], shim)
+	}
+	script := route.args()
+	if route.ScriptFile != "" && isTypeScript(route.ScriptFile) {
+		flags, file, err := inv.typescript.prepare(route, inv.packages)
+		if err != nil {
+			return ExecSpec{}, fmt.Errorf("typescript: %w", err)
+		}
+		args = append(args, flags...)
+		if file != script[len(script)-1] {
+			// Let sandboxed scripts load their transpiled code.
+			readPaths = append(readPaths[:len(readPaths):len(readPaths)], filepath.Dir(file))
+			script[len(script)-1] = file
+		}
+	}
+
+	var writePaths []string
+	if inv.nodeEnv.compileCache != "" {
+		writePaths = append(writePaths, inv.nodeEnv.compileCache)
+	}
+	if workdir != "" {
+		readPaths = append(readPaths[:len(readPaths):len(readPaths)], workdir)
+		writePaths = append(writePaths, workdir)
+	}
+
+	sb := route.Sandbox
+	if sb == nil && inv.cfg.Sandbox {
+		sb = &inv.cfg.SandboxPolicy
+	}
+	if sb != nil {
+		flags, err := inv.sandbox.get(route.runtime())
+		if err != nil {
+			return ExecSpec{}, fmt.Errorf("sandbox: %w", err)
+		}
+		args = append(args, sb.args(route, flags, readPaths, writePaths)...)
+	}
+	return ExecSpec{
+		Route:      route,
+		Args:       append(args, script...),
+		Dir:        workdir,
+		ReadPaths:  readPaths,
+		WritePaths: writePaths,
+	}, nil
+}
+
+// timedOut wraps err with errTimeout when ctx, the per-attempt context,
+// hit its deadline.
+func timedOut(ctx context.Context, timeout time.Duration, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &timeoutError{timeout: timeout, err: err}
+	}
+	return err
+}
+
+// limitExceeded wraps err in a limitError when the process was stopped by
+// one of its resource limits.
+func limitExceeded(cg *cgroup, stderr []byte, err error) error {
+	if cg != nil {
+		if res := cg.exceeded(); res != "" {
+			return &limitError{resource: res, err: err}
+		}
+	}
+	if heapExhausted(stderr) {
+		return &limitError{resource: "memory", err: err}
+	}
+	return err
+}
+
+// Warmup runs n invocations of route with payload so module resolution and JIT
+// costs are paid before the server accepts traffic. Failures are logged
+// but do not prevent startup.
+func (inv *Invoker) Warmup(ctx context.Context, route *Route, n int, payload []byte) {
+	for i := range n {
+		start := time.Now()
+		res, err := inv.Invoke(ctx, Invocation{Route: route, Payload: payload, NoDeadLetter: true, NoAudit: true})
+		if err != nil {
+			log.Printf("warmup %d/%d failed: %v, stderr: %s", i+1, n, err, res.Stderr)
+			continue
+		}
+		infof("warmup %d/%d done in %s", i+1, n, time.Since(start))
+	}
+}
+
+// childEnv returns the server environment minus credentials that only the
+// server itself needs and the variables childEnvFilter withholds.
+func childEnv() []string {
+	env := os.Environ()
+	out := env[:0:0]
+	for _, kv := range env {
+		if strings.HasPrefix(kv, envOAuthClientSecretKey+"=") || !childEnvFilter.passes(kv) {
+			continue
+		}
+		out = append(out, kv)
+	}
+	return out
+}
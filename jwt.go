@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jwksTimeout = 10 * time.Second
+	// defaultJWKSCacheTTL is how long fetched keys are used before being
+	// fetched again.
+	defaultJWKSCacheTTL = 10 * time.Minute
+	// jwksRefetchInterval bounds how often tokens signed by an unknown key
+	// make the keys be fetched again, e.g. after the issuer rotated them.
+	jwksRefetchInterval = 30 * time.Second
+	defaultJWTLeeway    = time.Minute
+)
+
+// JWTConfig verifies bearer tokens as JWTs signed by an OIDC provider or
+// other issuer, locally, against the keys published at its JWKS URL:
+//
+//	auth:
+//	  jwt:
+//	    issuer: https://login.example.com/
+//	    audience: orders-api
+//	    claims: [sub, email, groups]
+//
+// Without jwks_url, the keys are found through the issuer's OpenID
+// Connect discovery document. Tokens must be signed with RS256, RS384,
+// RS512, ES256, ES384 or EdDSA, be unexpired, and name the issuer and one
+// of the audiences. The listed claims, only sub by default, are passed to
+// the script in INVOKE_CONTEXT's claims and to payload templates as
+// .Claims.
+type JWTConfig struct {
+	Issuer   string     `yaml:"issuer"`
+	Audience stringList `yaml:"audience"`
+	JWKSURL  string     `yaml:"jwks_url"`
+	Claims   stringList `yaml:"claims"`
+	// Leeway allows for clock skew in checking exp and nbf, a minute by
+	// default.
+	Leeway       time.Duration `yaml:"leeway"`
+	JWKSCacheTTL time.Duration `yaml:"jwks_cache_ttl"`
+}
+
+// jwtVerifier checks the tokens of one route.
+type jwtVerifier struct {
+	issuer   string
+	audience []string
+	claims   []string
+	leeway   time.Duration
+	keys     *jwksCache
+}
+
+func newJWTVerifier(c JWTConfig) (*jwtVerifier, error) {
+	if c.Issuer == "" || len(c.Audience) == 0 {
+		return nil, errors.New("jwt: issuer and audience are required")
+	}
+	if c.Leeway < 0 || c.JWKSCacheTTL < 0 {
+		return nil, errors.New("jwt: leeway and jwks_cache_ttl must not be negative")
+	}
+	v := &jwtVerifier{
+		issuer:   c.Issuer,
+		audience: c.Audience,
+		claims:   c.Claims,
+		leeway:   c.Leeway,
+		keys: &jwksCache{
+			url:    c.JWKSURL,
+			issuer: c.Issuer,
+			ttl:    c.JWKSCacheTTL,
+			client: &http.Client{Timeout: jwksTimeout},
+		},
+	}
+	if len(v.claims) == 0 {
+		v.claims = []string{"sub"}
+	}
+	if v.leeway == 0 {
+		v.leeway = defaultJWTLeeway
+	}
+	if v.keys.ttl == 0 {
+		v.keys.ttl = defaultJWKSCacheTTL
+	}
+	return v, nil
+}
+
+// errJWKSUnavailable wraps failures to fetch the keys, which are the
+// server's problem rather than the token's.
+var errJWKSUnavailable = errors.New("JWKS unavailable")
+
+// verify checks token and returns its forwarded claims.
+func (v *jwtVerifier) verify(ctx context.Context, token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a JWT")
+	}
+	var header struct {
+		Alg  string   `json:"alg"`
+		Kid  string   `json:"kid"`
+		Crit []string `json:"crit"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	if len(header.Crit) > 0 {
+		return nil, errors.New("crit header is not supported")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+	key, err := v.keys.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWS(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("claims: %w", err)
+	}
+	if iss, _ := claims["iss"].(string); iss != v.issuer {
+		return nil, fmt.Errorf("issuer %q is not %q", iss, v.issuer)
+	}
+	if !slices.ContainsFunc(audiences(claims["aud"]), func(a string) bool { return slices.Contains(v.audience, a) }) {
+		return nil, errors.New("audience not accepted")
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("exp is required")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(v.leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+
+	out := map[string]any{}
+	for _, name := range v.claims {
+		if c, ok := claims[name]; ok {
+			out[name] = c
+		}
+	}
+	return out, nil
+}
+
+func decodeSegment(s string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// audiences returns the aud claim, a string or an array of them.
+func audiences(aud any) []string {
+	switch a := aud.(type) {
+	case string:
+		return []string{a}
+	case []any:
+		var out []string
+		for _, v := range a {
+			if s, ok := v.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// verifyJWS checks the signature sig of input, made with alg, which must
+// suit key.
+func verifyJWS(alg string, key crypto.PublicKey, input, sig []byte) error {
+	var h hash.Hash
+	switch alg {
+	case "RS256", "ES256":
+		h = sha256.New()
+	case "RS384", "ES384":
+		h = sha512.New384()
+	case "RS512":
+		h = sha512.New()
+	case "EdDSA":
+	default:
+		return fmt.Errorf("alg %q is not accepted", alg)
+	}
+	var digest []byte
+	if h != nil {
+		h.Write(input)
+		digest = h.Sum(nil)
+	}
+	ok := false
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			hashes := map[string]crypto.Hash{"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512}
+			ok = rsa.VerifyPKCS1v15(k, hashes[alg], digest, sig) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg == map[int]string{32: "ES256", 48: "ES384"}[size] && len(sig) == 2*size {
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			ok = ecdsa.Verify(k, digest, r, s)
+		}
+	case ed25519.PublicKey:
+		ok = alg == "EdDSA" && ed25519.Verify(k, input, sig)
+	}
+	if !ok {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// jwksCache holds an issuer's signing keys by key ID. Keys are fetched
+// without holding mu, by one caller at a time; the others wait for that
+// fetch when they have no key to go on, and otherwise keep using the keys
+// they have.
+type jwksCache struct {
+	// url is the JWKS URL, found through the issuer's discovery document
+	// when unset.
+	url    string
+	issuer string
+	ttl    time.Duration
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	tried   time.Time
+	// fetching is closed once the fetch in flight, if any, is done.
+	fetching chan struct{}
+	// err is why the last fetch failed.
+	err error
+}
+
+// key returns the key kid, fetching the keys when they are stale or kid is
+// unknown, at most every jwksRefetchInterval.
+func (c *jwksCache) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	_, known := c.keys[kid]
+	done := c.fetching
+	if done == nil && (!known || time.Since(c.fetched) > c.ttl) && time.Since(c.tried) > jwksRefetchInterval {
+		done = make(chan struct{})
+		c.fetching, c.tried = done, time.Now()
+		// The fetch outlives callers that give up on it.
+		go c.fetch(context.WithoutCancel(ctx), c.url, done)
+	}
+	c.mu.Unlock()
+	if done != nil && !known {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keys == nil {
+		return nil, fmt.Errorf("%w: %v", errJWKSUnavailable, c.err)
+	}
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(c.keys) == 1 {
+		for _, key := range c.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// fetch replaces the keys with those currently published at url, or found
+// through discovery when url is empty, and closes done.
+func (c *jwksCache) fetch(ctx context.Context, url string, done chan struct{}) {
+	keys, url, err := c.load(ctx, url)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if url != "" {
+		c.url = url
+	}
+	if err != nil {
+		c.err = err
+		if c.keys != nil {
+			// Keep using the keys fetched last.
+			log.Printf("jwks %s: %v", c.url, err)
+		}
+	} else {
+		c.keys, c.fetched, c.err = keys, time.Now(), nil
+	}
+	c.fetching = nil
+	close(done)
+}
+
+// load fetches the keys published at url, discovering url when empty, and
+// returns them with url.
+func (c *jwksCache) load(ctx context.Context, url string) (map[string]crypto.PublicKey, string, error) {
+	if url == "" {
+		var doc struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := c.get(ctx, strings.TrimSuffix(c.issuer, "/")+"/.well-known/openid-configuration", &doc); err != nil {
+			return nil, "", fmt.Errorf("discovery: %w", err)
+		}
+		if doc.JWKSURI == "" {
+			return nil, "", errors.New("discovery document has no jwks_uri")
+		}
+		url = doc.JWKSURI
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := c.get(ctx, url, &set); err != nil {
+		return nil, url, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, url, errors.New("no usable signing keys")
+	}
+	return keys, url, nil
+}
+
+func (c *jwksCache) get(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// jwk is a public JSON Web Key.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, errN := b64.DecodeString(k.N)
+		e, errE := b64.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curve := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384()}[k.Crv]
+		x, errX := b64.DecodeString(k.X)
+		y, errY := b64.DecodeString(k.Y)
+		if curve == nil || errX != nil || errY != nil {
+			return nil, errors.New("invalid EC key")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return key, nil
+	case "OKP":
+		x, err := b64.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid OKP key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
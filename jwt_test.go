@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testKeys are a signing key of each supported type.
+type testKeys struct {
+	rsa  *rsa.PrivateKey
+	p256 *ecdsa.PrivateKey
+	p384 *ecdsa.PrivateKey
+	ed   ed25519.PrivateKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	t.Helper()
+	var k testKeys
+	var err error
+	if k.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if k.p256, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if k.p384, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if _, k.ed, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// signJWS signs input with key as alg does.
+func signJWS(t *testing.T, alg string, key crypto.Signer, input []byte) []byte {
+	t.Helper()
+	hashes := map[string]crypto.Hash{
+		"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+		"ES256": crypto.SHA256, "ES384": crypto.SHA384,
+	}
+	var digest []byte
+	switch hashes[alg] {
+	case crypto.SHA256:
+		d := sha256.Sum256(input)
+		digest = d[:]
+	case crypto.SHA384:
+		d := sha512.Sum384(input)
+		digest = d[:]
+	case crypto.SHA512:
+		d := sha512.Sum512(input)
+		digest = d[:]
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err := rsa.SignPKCS1v15(rand.Reader, k, hashes[alg], digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig := make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+		return sig
+	case ed25519.PrivateKey:
+		return ed25519.Sign(k, input)
+	}
+	t.Fatalf("unsupported key %T", key)
+	return nil
+}
+
+func TestVerifyJWS(t *testing.T) {
+	keys := newTestKeys(t)
+	other := newTestKeys(t)
+	input := []byte("header.claims")
+	tests := []struct {
+		name    string
+		alg     string
+		signer  crypto.Signer
+		signAlg string
+		key     crypto.PublicKey
+		tamper  func([]byte) []byte
+		wantErr string
+	}{
+		{name: "RS256", alg: "RS256", signer: keys.rsa, key: &keys.rsa.PublicKey},
+		{name: "RS384", alg: "RS384", signer: keys.rsa, key: &keys.rsa.PublicKey},
+		{name: "RS512", alg: "RS512", signer: keys.rsa, key: &keys.rsa.PublicKey},
+		{name: "ES256", alg: "ES256", signer: keys.p256, key: &keys.p256.PublicKey},
+		{name: "ES384", alg: "ES384", signer: keys.p384, key: &keys.p384.PublicKey},
+		{name: "EdDSA", alg: "EdDSA", signer: keys.ed, key: keys.ed.Public()},
+
+		{name: "none", alg: "none", signer: keys.rsa, signAlg: "RS256", key: &keys.rsa.PublicKey, wantErr: `alg "none" is not accepted`},
+		{name: "HMAC", alg: "HS256", signer: keys.rsa, signAlg: "RS256", key: &keys.rsa.PublicKey, wantErr: `alg "HS256" is not accepted`},
+		{name: "ES512", alg: "ES512", signer: keys.p384, signAlg: "ES384", key: &keys.p384.PublicKey, wantErr: "not accepted"},
+		{name: "other key", alg: "RS256", signer: other.rsa, key: &keys.rsa.PublicKey, wantErr: "invalid signature"},
+		{name: "other hash", alg: "RS256", signer: keys.rsa, signAlg: "RS384", key: &keys.rsa.PublicKey, wantErr: "invalid signature"},
+		{name: "EC alg for RSA key", alg: "ES256", signer: keys.p256, key: &keys.rsa.PublicKey, wantErr: "invalid signature"},
+		{name: "RSA alg for EC key", alg: "RS256", signer: keys.rsa, key: &keys.p256.PublicKey, wantErr: "invalid signature"},
+		{name: "ES256 for P-384 key", alg: "ES256", signer: keys.p256, key: &keys.p384.PublicKey, wantErr: "invalid signature"},
+		{name: "EdDSA alg for RSA key", alg: "EdDSA", signer: keys.ed, key: &keys.rsa.PublicKey, wantErr: "invalid signature"},
+		{name: "RSA alg for Ed25519 key", alg: "RS256", signer: keys.rsa, key: keys.ed.Public(), wantErr: "invalid signature"},
+		{
+			name: "tampered signature", alg: "ES256", signer: keys.p256, key: &keys.p256.PublicKey,
+			tamper:  func(sig []byte) []byte { sig[0] ^= 1; return sig },
+			wantErr: "invalid signature",
+		},
+		{
+			name: "truncated signature", alg: "ES256", signer: keys.p256, key: &keys.p256.PublicKey,
+			tamper:  func(sig []byte) []byte { return sig[:len(sig)-1] },
+			wantErr: "invalid signature",
+		},
+		{
+			name: "empty signature", alg: "EdDSA", signer: keys.ed, key: keys.ed.Public(),
+			tamper:  func([]byte) []byte { return nil },
+			wantErr: "invalid signature",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signAlg := tt.signAlg
+			if signAlg == "" {
+				signAlg = tt.alg
+			}
+			sig := signJWS(t, signAlg, tt.signer, input)
+			if tt.tamper != nil {
+				sig = tt.tamper(sig)
+			}
+			err := verifyJWS(tt.alg, tt.key, input, sig)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verifyJWS: %v", err)
+				}
+				if err := verifyJWS(tt.alg, tt.key, []byte("header.other"), sig); err == nil {
+					t.Error("verifyJWS accepted the signature for other input")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verifyJWS error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// publicJWK returns the JWK of key.
+func publicJWK(kid string, key crypto.PublicKey) jwk {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return jwk{Kty: "RSA", Kid: kid, N: b64(k.N.Bytes()), E: b64(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return jwk{Kty: "EC", Kid: kid, Crv: k.Curve.Params().Name, X: b64(k.X.FillBytes(make([]byte, size))), Y: b64(k.Y.FillBytes(make([]byte, size)))}
+	case ed25519.PublicKey:
+		return jwk{Kty: "OKP", Kid: kid, Crv: "Ed25519", X: b64(k)}
+	}
+	panic("unsupported key")
+}
+
+// jwksServer is an issuer publishing its keys through OpenID Connect
+// discovery.
+type jwksServer struct {
+	*httptest.Server
+	keys    atomic.Pointer[[]jwk]
+	fail    atomic.Bool
+	fetches atomic.Int64
+	// gate, when set, holds key requests until it is closed.
+	gate chan struct{}
+}
+
+func newJWKSServer(t *testing.T, keys ...jwk) *jwksServer {
+	s := &jwksServer{}
+	s.keys.Store(&keys)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"jwks_uri": s.URL + "/keys"})
+	})
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		if s.gate != nil {
+			<-s.gate
+		}
+		if s.fail.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": *s.keys.Load()})
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestJWKSCache(t *testing.T) {
+	keys := newTestKeys(t)
+	rsaKey, ecKey, edKey := &keys.rsa.PublicKey, &keys.p256.PublicKey, keys.ed.Public()
+	ctx := context.Background()
+	// stale makes the keys due for refetching.
+	stale := func(c *jwksCache) {
+		c.fetched = time.Now().Add(-2 * c.ttl)
+		c.tried = time.Now().Add(-2 * jwksRefetchInterval)
+	}
+	// settle waits for the fetch in flight, if any.
+	settle := func(c *jwksCache) {
+		c.mu.Lock()
+		done := c.fetching
+		c.mu.Unlock()
+		if done != nil {
+			<-done
+		}
+	}
+
+	t.Run("discovery", func(t *testing.T) {
+		srv := newJWKSServer(t, publicJWK("rsa", rsaKey), publicJWK("ec", ecKey), publicJWK("ed", edKey))
+		c := &jwksCache{issuer: srv.URL + "/", ttl: time.Hour, client: srv.Client()}
+		for kid, want := range map[string]crypto.PublicKey{"rsa": rsaKey, "ec": ecKey, "ed": edKey} {
+			got, err := c.key(ctx, kid)
+			if err != nil {
+				t.Fatalf("key %s: %v", kid, err)
+			}
+			if !got.(interface{ Equal(crypto.PublicKey) bool }).Equal(want) {
+				t.Errorf("key %s doesn't match the published one", kid)
+			}
+		}
+		if c.url != srv.URL+"/keys" {
+			t.Errorf("url = %q, want the discovered jwks_uri", c.url)
+		}
+		if n := srv.fetches.Load(); n != 1 {
+			t.Errorf("%d fetches, want 1", n)
+		}
+	})
+
+	t.Run("unusable keys are skipped", func(t *testing.T) {
+		enc := publicJWK("enc", rsaKey)
+		enc.Use = "enc"
+		bad := publicJWK("bad", ecKey)
+		bad.Y = bad.X
+		srv := newJWKSServer(t, enc, bad, jwk{Kty: "oct", Kid: "hmac"}, publicJWK("sig", edKey))
+		c := &jwksCache{url: srv.URL + "/keys", ttl: time.Hour, client: srv.Client()}
+		if _, err := c.key(ctx, "sig"); err != nil {
+			t.Fatalf("key sig: %v", err)
+		}
+		for _, kid := range []string{"enc", "bad", "hmac"} {
+			if _, err := c.key(ctx, kid); err == nil {
+				t.Errorf("key %s was accepted", kid)
+			}
+		}
+	})
+
+	t.Run("no usable keys", func(t *testing.T) {
+		srv := newJWKSServer(t, jwk{Kty: "oct", Kid: "hmac"})
+		c := &jwksCache{url: srv.URL + "/keys", ttl: time.Hour, client: srv.Client()}
+		if _, err := c.key(ctx, "hmac"); !errors.Is(err, errJWKSUnavailable) {
+			t.Errorf("key error = %v, want errJWKSUnavailable", err)
+		}
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		srv := newJWKSServer(t)
+		srv.fail.Store(true)
+		c := &jwksCache{url: srv.URL + "/keys", ttl: time.Hour, client: srv.Client()}
+		if _, err := c.key(ctx, "rsa"); !errors.Is(err, errJWKSUnavailable) {
+			t.Errorf("key error = %v, want errJWKSUnavailable", err)
+		}
+		// Until the next attempt, callers still learn the keys are
+		// unavailable rather than that theirs is unknown.
+		if _, err := c.key(ctx, "rsa"); !errors.Is(err, errJWKSUnavailable) {
+			t.Errorf("key error before refetching = %v, want errJWKSUnavailable", err)
+		}
+		if n := srv.fetches.Load(); n != 1 {
+			t.Errorf("%d fetches, want 1", n)
+		}
+	})
+
+	t.Run("fetches are shared and don't hold up known keys", func(t *testing.T) {
+		srv := newJWKSServer(t, publicJWK("old", rsaKey))
+		c := &jwksCache{url: srv.URL + "/keys", ttl: time.Hour, client: srv.Client()}
+		if _, err := c.key(ctx, "old"); err != nil {
+			t.Fatal(err)
+		}
+		srv.keys.Store(&[]jwk{publicJWK("old", rsaKey), publicJWK("new", ecKey)})
+		srv.gate = make(chan struct{})
+		stale(c)
+
+		errs := make(chan error)
+		for range 3 {
+			go func() {
+				_, err := c.key(ctx, "new")
+				errs <- err
+			}()
+		}
+		for srv.fetches.Load() < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		known := make(chan error)
+		go func() {
+			_, err := c.key(ctx, "old")
+			known <- err
+		}()
+		select {
+		case err := <-known:
+			if err != nil {
+				t.Errorf("key old during a fetch: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("key old waited for the fetch")
+		}
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, err := c.key(canceled, "new"); !errors.Is(err, context.Canceled) {
+			t.Errorf("key of a canceled caller = %v, want context.Canceled", err)
+		}
+
+		close(srv.gate)
+		for range 3 {
+			if err := <-errs; err != nil {
+				t.Errorf("key new after the fetch: %v", err)
+			}
+		}
+		if n := srv.fetches.Load(); n != 2 {
+			t.Errorf("%d fetches, want 2", n)
+		}
+	})
+
+	t.Run("missing kid with a single key", func(t *testing.T) {
+		srv := newJWKSServer(t, publicJWK("only", edKey))
+		c := &jwksCache{url: srv.URL + "/keys", ttl: time.Hour, client: srv.Client()}
+		if _, err := c.key(ctx, ""); err != nil {
+			t.Errorf("key: %v", err)
+		}
+		srv.keys.Store(&[]jwk{publicJWK("one", edKey), publicJWK("two", rsaKey)})
+		stale(c)
+		if _, err := c.key(ctx, ""); err == nil {
+			t.Error("a key was picked among several")
+		}
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		srv := newJWKSServer(t, publicJWK("old", rsaKey))
+		c := &jwksCache{url: srv.URL + "/keys", ttl: time.Hour, client: srv.Client()}
+		if _, err := c.key(ctx, "old"); err != nil {
+			t.Fatal(err)
+		}
+		srv.keys.Store(&[]jwk{publicJWK("new", ecKey)})
+
+		// Unknown keys are refetched at most every jwksRefetchInterval.
+		if _, err := c.key(ctx, "new"); err == nil {
+			t.Error("key new found without refetching")
+		}
+		c.tried = time.Now().Add(-2 * jwksRefetchInterval)
+		if _, err := c.key(ctx, "new"); err != nil {
+			t.Errorf("key new after the refetch interval: %v", err)
+		}
+		if _, err := c.key(ctx, "old"); err == nil {
+			t.Error("key old still used after it was rotated out")
+		}
+		if n := srv.fetches.Load(); n != 2 {
+			t.Errorf("%d fetches, want 2", n)
+		}
+	})
+
+	t.Run("known keys are refetched after the TTL", func(t *testing.T) {
+		srv := newJWKSServer(t, publicJWK("k", rsaKey))
+		c := &jwksCache{url: srv.URL + "/keys", ttl: time.Hour, client: srv.Client()}
+		for range 3 {
+			if _, err := c.key(ctx, "k"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := srv.fetches.Load(); n != 1 {
+			t.Errorf("%d fetches within the TTL, want 1", n)
+		}
+		stale(c)
+		if _, err := c.key(ctx, "k"); err != nil {
+			t.Fatal(err)
+		}
+		settle(c)
+		if n := srv.fetches.Load(); n != 2 {
+			t.Errorf("%d fetches after the TTL, want 2", n)
+		}
+	})
+
+	t.Run("failed refetch keeps the keys", func(t *testing.T) {
+		srv := newJWKSServer(t, publicJWK("k", rsaKey))
+		c := &jwksCache{url: srv.URL + "/keys", ttl: time.Hour, client: srv.Client()}
+		if _, err := c.key(ctx, "k"); err != nil {
+			t.Fatal(err)
+		}
+		srv.fail.Store(true)
+		stale(c)
+		if _, err := c.key(ctx, "k"); err != nil {
+			t.Errorf("key during a failing refetch: %v", err)
+		}
+		settle(c)
+		if _, err := c.key(ctx, "k"); err != nil {
+			t.Errorf("key after a failed refetch: %v", err)
+		}
+		if _, err := c.key(ctx, "unknown"); err == nil || errors.Is(err, errJWKSUnavailable) {
+			t.Errorf("key unknown error = %v, want an unknown key", err)
+		}
+	})
+}
+
+func TestJWTVerify(t *testing.T) {
+	keys := newTestKeys(t)
+	srv := newJWKSServer(t, publicJWK("k", &keys.p256.PublicKey))
+	v, err := newJWTVerifier(JWTConfig{Issuer: srv.URL, Audience: stringList{"api", "other"}, Claims: stringList{"sub", "email"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.keys.client = srv.Client()
+	token := func(header, claims map[string]any) string {
+		h, _ := json.Marshal(header)
+		c, _ := json.Marshal(claims)
+		input := b64(h) + "." + b64(c)
+		return input + "." + b64(signJWS(t, "ES256", keys.p256, []byte(input)))
+	}
+	header := map[string]any{"alg": "ES256", "kid": "k"}
+	exp := time.Now().Add(time.Hour).Unix()
+	valid := map[string]any{"iss": srv.URL, "aud": "api", "exp": exp, "sub": "user", "email": "u@example.com", "role": "admin"}
+	with := func(key string, value any) map[string]any {
+		c := map[string]any{}
+		for k, v := range valid {
+			c[k] = v
+		}
+		if value == nil {
+			delete(c, key)
+		} else {
+			c[key] = value
+		}
+		return c
+	}
+
+	got, err := v.verify(context.Background(), token(header, valid))
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if len(got) != 2 || got["sub"] != "user" || got["email"] != "u@example.com" {
+		t.Errorf("claims = %v, want sub and email", got)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{"audience list", token(header, with("aud", []any{"x", "other"})), ""},
+		{"within leeway", token(header, with("exp", time.Now().Add(-30*time.Second).Unix())), ""},
+		{"not a JWT", "a.b", "not a JWT"},
+		{"wrong issuer", token(header, with("iss", "https://evil.example.com")), "issuer"},
+		{"wrong audience", token(header, with("aud", []any{"x"})), "audience not accepted"},
+		{"no exp", token(header, with("exp", nil)), "exp is required"},
+		{"expired", token(header, with("exp", time.Now().Add(-2*time.Minute).Unix())), "token expired"},
+		{"not yet valid", token(header, with("nbf", time.Now().Add(2*time.Minute).Unix())), "not valid yet"},
+		{"crit", token(map[string]any{"alg": "ES256", "kid": "k", "crit": []string{"b64"}}, valid), "crit"},
+		{"unknown key", token(map[string]any{"alg": "ES256", "kid": "x"}, valid), "unknown key"},
+		{"alg mismatch", token(map[string]any{"alg": "RS256", "kid": "k"}, valid), "invalid signature"},
+	}
+	for _, tt := range tests {
+		_, err := v.verify(context.Background(), tt.token)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: verify: %v", tt.name, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: verify error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
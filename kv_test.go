@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestKVBackends runs the same operations against each backend, Redis's
+// against a fake server.
+func TestKVBackends(t *testing.T) {
+	backends := []struct {
+		name string
+		open func(t *testing.T) KVBackend
+	}{
+		{"memory", func(t *testing.T) KVBackend { return newMemoryKV(0) }},
+		{"sqlite", func(t *testing.T) KVBackend {
+			kv, err := openStorage(t.TempDir(), "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return kv
+		}},
+		{"redis", func(t *testing.T) KVBackend {
+			kv, err := openStorage(newFakeRedis(t, "").url(""), "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return kv
+		}},
+	}
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			kv := b.open(t)
+			defer kv.Close()
+
+			if _, err := kv.Get("a"); !errors.Is(err, errKeyNotFound) {
+				t.Errorf("Get of a missing key = %v, want errKeyNotFound", err)
+			}
+			if created, err := kv.Put("a", []byte("1"), 0, true); !created || err != nil {
+				t.Fatalf("Put = %v, %v, want created", created, err)
+			}
+			if _, err := kv.Put("a", []byte("2"), 0, true); !errors.Is(err, errKeyExists) {
+				t.Errorf("creating an existing key = %v, want errKeyExists", err)
+			}
+			if created, err := kv.Put("a", []byte("3"), 0, false); created || err != nil {
+				t.Errorf("overwriting = %v, %v, want not created", created, err)
+			}
+			if v, err := kv.Get("a"); string(v) != "3" || err != nil {
+				t.Errorf("Get = %q, %v, want 3", v, err)
+			}
+
+			// Keys that would be awkward as file names round-trip.
+			for _, key := range []string{"../x", ".hidden", "a/b", "sp ace", "%2F"} {
+				if _, err := kv.Put(key, []byte(key), 0, true); err != nil {
+					t.Fatalf("Put %q: %v", key, err)
+				}
+				if v, err := kv.Get(key); string(v) != key || err != nil {
+					t.Errorf("Get %q = %q, %v", key, v, err)
+				}
+			}
+			keys, err := kv.Keys("a")
+			slices.Sort(keys)
+			if err != nil || !slices.Equal(keys, []string{"a", "a/b"}) {
+				t.Errorf("Keys(a) = %q, %v, want [a a/b]", keys, err)
+			}
+			if n, err := kv.Len(); n != 6 || err != nil {
+				t.Errorf("Len = %d, %v, want 6", n, err)
+			}
+
+			if _, err := kv.Put("ttl", []byte("x"), 20*time.Millisecond, true); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(40 * time.Millisecond)
+			if _, err := kv.Get("ttl"); !errors.Is(err, errKeyNotFound) {
+				t.Errorf("Get of an expired key = %v, want errKeyNotFound", err)
+			}
+			if created, err := kv.Put("ttl", []byte("y"), 0, true); !created || err != nil {
+				t.Errorf("creating over an expired key = %v, %v, want created", created, err)
+			}
+
+			if err := kv.Delete("a"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := kv.Get("a"); !errors.Is(err, errKeyNotFound) {
+				t.Errorf("Get after Delete = %v, want errKeyNotFound", err)
+			}
+			if err := kv.Delete("a"); err != nil {
+				t.Errorf("deleting a missing key = %v", err)
+			}
+		})
+	}
+}
+
+func TestSQLiteKV(t *testing.T) {
+	dir := t.TempDir()
+	open := func(namespace string) KVBackend {
+		kv, err := openStorage(dir, namespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { kv.Close() })
+		return kv
+	}
+	a, b := open("a"), open("b")
+	if _, err := a.Put("k", []byte("a"), 0, true); err != nil {
+		t.Fatal(err)
+	}
+	// Namespaces sharing the database don't see each other's keys.
+	if _, err := b.Put("k", []byte("b"), 0, true); err != nil {
+		t.Errorf("Put in another namespace: %v", err)
+	}
+	if keys, _ := b.Keys(""); len(keys) != 1 {
+		t.Errorf("namespace b has keys %q, want k only", keys)
+	}
+	if _, err := a.Put("gone", []byte("v"), time.Millisecond, false); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := a.(*sqlKV).sweep(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := a.Len(); n != 1 {
+		t.Errorf("Len after the sweep = %d, want 1", n)
+	}
+
+	// Keys survive a restart.
+	a.Close()
+	if v, err := open("a").Get("k"); string(v) != "a" || err != nil {
+		t.Errorf("Get after reopening = %q, %v, want a", v, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, sqliteFile)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenKVBackend(t *testing.T) {
+	dir := t.TempDir()
+	for _, spec := range []string{"memory", "", "sqlite:" + filepath.Join(dir, "kv.db")} {
+		kv, err := openKVBackend(spec, 0)
+		if err != nil {
+			t.Errorf("openKVBackend(%q): %v", spec, err)
+			continue
+		}
+		kv.Close()
+	}
+	if _, err := openKVBackend(dir, 0); err == nil {
+		t.Error("a bare directory was accepted as the store backend")
+	}
+}
+
+func TestSQLQuery(t *testing.T) {
+	q := `SELECT value FROM t WHERE a = ? AND b = ?`
+	if got := (&sqlKV{dialect: sqliteDialect}).query(q); got != q {
+		t.Errorf("sqlite query = %q", got)
+	}
+	if got, want := (&sqlKV{dialect: postgresDialect}).query(q), `SELECT value FROM t WHERE a = $1 AND b = $2`; got != want {
+		t.Errorf("postgres query = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// limiter bounds the number of node processes running at once. A limit
+// of zero means unlimited. The limit can be changed while in use. Waiters
+// are queued by priority; see Priority.
+type limiter struct {
+	mu      sync.Mutex
+	limit   int
+	active  int
+	waiters [len(priorities)][]chan struct{}
+}
+
+func newLimiter(limit int) *limiter {
+	return &limiter{limit: limit}
+}
+
+// Acquire blocks until a slot is free or ctx is done. Slots are handed to
+// waiters of higher priority p first.
+func (l *limiter) Acquire(ctx context.Context, p Priority) error {
+	l.mu.Lock()
+	if l.limit <= 0 || l.active < l.limit {
+		l.active++
+		l.mu.Unlock()
+		return nil
+	}
+	q := p.queue()
+	ready := make(chan struct{})
+	l.waiters[q] = append(l.waiters[q], ready)
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for i, w := range l.waiters[q] {
+			if w == ready {
+				l.waiters[q] = append(l.waiters[q][:i], l.waiters[q][i+1:]...)
+				return ctx.Err()
+			}
+		}
+		// The slot was handed to us while we were giving up; pass it on.
+		l.active--
+		l.wakeLocked()
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot acquired with Acquire.
+func (l *limiter) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.wakeLocked()
+}
+
+// SetLimit changes the limit, waking waiters if it grew.
+func (l *limiter) SetLimit(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = n
+	l.wakeLocked()
+}
+
+// Stats returns the current limit, running count, and queue depth.
+func (l *limiter) Stats() (limit, active, queued int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, q := range l.waiters {
+		queued += len(q)
+	}
+	return l.limit, l.active, queued
+}
+
+// Queued returns the queue depth of each priority, in the order of
+// priorities.
+func (l *limiter) Queued() (depth [len(priorities)]int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, q := range l.waiters {
+		depth[i] = len(q)
+	}
+	return depth
+}
+
+func (l *limiter) wakeLocked() {
+	for q := range l.waiters {
+		for len(l.waiters[q]) > 0 && (l.limit <= 0 || l.active < l.limit) {
+			w := l.waiters[q][0]
+			l.waiters[q] = l.waiters[q][1:]
+			l.active++
+			close(w)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// waitQueued waits until n invocations queue at l.
+func waitQueued(t *testing.T, l *limiter, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, _, queued := l.Stats(); queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d invocations never queued", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLimiterPriority(t *testing.T) {
+	tests := []struct {
+		name string
+		// arrivals are the priorities of the waiters, in arrival order.
+		arrivals []Priority
+		// want is the order the waiters are served in, by arrival index.
+		want []int
+	}{
+		{"arrival order", []Priority{priorityNormal, priorityNormal, priorityNormal}, []int{0, 1, 2}},
+		{"high first", []Priority{priorityLow, priorityNormal, priorityHigh}, []int{2, 1, 0}},
+		{"low last", []Priority{priorityLow, priorityHigh, priorityLow, priorityNormal, priorityHigh}, []int{1, 4, 3, 0, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLimiter(1)
+			if err := l.Acquire(context.Background(), priorityLow); err != nil {
+				t.Fatal(err)
+			}
+			served := make(chan int)
+			for i, p := range tt.arrivals {
+				go func() {
+					if err := l.Acquire(context.Background(), p); err != nil {
+						t.Error(err)
+					}
+					served <- i
+				}()
+				waitQueued(t, l, i+1)
+			}
+			if got := l.Queued(); got[priorityHigh.queue()]+got[priorityNormal.queue()]+got[priorityLow.queue()] != len(tt.arrivals) {
+				t.Errorf("queue depths %v don't add up to %d", got, len(tt.arrivals))
+			}
+
+			var order []int
+			for range tt.arrivals {
+				l.Release()
+				order = append(order, <-served)
+				if _, active, _ := l.Stats(); active != 1 {
+					t.Fatalf("%d active after a handoff, want 1", active)
+				}
+			}
+			if !slices.Equal(order, tt.want) {
+				t.Errorf("served %v, want %v", order, tt.want)
+			}
+			l.Release()
+			if _, active, queued := l.Stats(); active != 0 || queued != 0 {
+				t.Errorf("%d active and %d queued at the end, want none", active, queued)
+			}
+		})
+	}
+}
+
+func TestLimiterCancel(t *testing.T) {
+	l := newLimiter(1)
+	l.Acquire(context.Background(), priorityNormal)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- l.Acquire(ctx, priorityHigh) }()
+	waitQueued(t, l, 1)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Acquire = %v, want context.Canceled", err)
+	}
+	if _, active, queued := l.Stats(); active != 1 || queued != 0 {
+		t.Errorf("%d active and %d queued after giving up, want 1 and 0", active, queued)
+	}
+
+	// A slot freed later goes to the next waiter, not the one that gave
+	// up.
+	go func() { done <- l.Acquire(context.Background(), priorityLow) }()
+	waitQueued(t, l, 1)
+	l.Release()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	l.Release()
+	if _, active, _ := l.Stats(); active != 0 {
+		t.Errorf("%d active, want 0", active)
+	}
+}
+
+// TestLimiterCancelRace checks that a slot handed to a waiter as it gives
+// up is passed on rather than leaked.
+func TestLimiterCancelRace(t *testing.T) {
+	for range 20 {
+		l := newLimiter(1)
+		l.Acquire(context.Background(), priorityNormal)
+		ctx, cancel := context.WithCancel(context.Background())
+		first := make(chan error)
+		go func() { first <- l.Acquire(ctx, priorityHigh) }()
+		waitQueued(t, l, 1)
+		second := make(chan error)
+		go func() { second <- l.Acquire(context.Background(), priorityLow) }()
+		waitQueued(t, l, 2)
+
+		// Release the slot while the first waiter, having given up, waits
+		// for the lock to leave the queue, so the slot is handed to it.
+		l.mu.Lock()
+		cancel()
+		time.Sleep(5 * time.Millisecond)
+		l.active--
+		l.wakeLocked()
+		l.mu.Unlock()
+		if err := <-first; err == nil {
+			l.Release()
+		}
+		select {
+		case err := <-second:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the slot given up was never passed on")
+		}
+		l.Release()
+		if _, active, queued := l.Stats(); active != 0 || queued != 0 {
+			t.Fatalf("%d active and %d queued at the end, want none", active, queued)
+		}
+	}
+}
+
+func TestLimiterSetLimit(t *testing.T) {
+	l := newLimiter(1)
+	l.Acquire(context.Background(), priorityNormal)
+	served := make(chan Priority)
+	arrivals := []Priority{priorityLow, priorityLow, priorityHigh}
+	for i, p := range arrivals {
+		go func() {
+			l.Acquire(context.Background(), p)
+			served <- p
+		}()
+		waitQueued(t, l, i+1)
+	}
+
+	// Growing the limit by one admits the high priority waiter only.
+	l.SetLimit(2)
+	if p := <-served; p != priorityHigh {
+		t.Errorf("served %s first, want high", p)
+	}
+	if _, _, queued := l.Stats(); queued != 2 {
+		t.Errorf("%d queued, want 2", queued)
+	}
+	// No limit admits the rest.
+	l.SetLimit(0)
+	<-served
+	<-served
+	if _, active, queued := l.Stats(); active != 4 || queued != 0 {
+		t.Errorf("%d active and %d queued, want 4 and 0", active, queued)
+	}
+	for range 10 {
+		if err := l.Acquire(context.Background(), priorityLow); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRequestPriority(t *testing.T) {
+	route := &Route{Name: "r", Priority: priorityLow}
+	tests := []struct {
+		name    string
+		header  string
+		authed  bool
+		trust   bool
+		want    Priority
+		wantErr bool
+	}{
+		{name: "route priority", want: priorityLow},
+		{name: "authenticated", header: "high", authed: true, want: priorityHigh},
+		{name: "anonymous", header: "high", want: priorityLow},
+		{name: "anonymous trusted", header: "high", trust: true, want: priorityHigh},
+		{name: "normal", header: "normal", authed: true, want: priorityNormal},
+		{name: "invalid", header: "urgent", authed: true, wantErr: true},
+		{name: "invalid from anonymous", header: "urgent", want: priorityLow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/invoke/r", nil)
+			if tt.header != "" {
+				r.Header.Set(priorityHeader, tt.header)
+			}
+			if tt.authed {
+				r = withAuthenticated(r)
+			}
+			got, err := requestPriority(r, route, handlerOptions{TrustPriorityHeader: tt.trust})
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("requestPriority = %s, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("requestPriority = %s, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+}
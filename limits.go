@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ResourceLimits constrain each node process so one heavy payload can't
+// take down the host. Memory, CPU weight and pids are enforced through a
+// cgroup v2 created per invocation below CgroupParent, which must be a
+// cgroup delegated to this server.
+type ResourceLimits struct {
+	// MaxOldSpaceSize is passed to node as --max-old-space-size in
+	// NODE_OPTIONS, in MiB.
+	MaxOldSpaceSize int
+	// Memory is the memory.max of the invocation cgroup, in bytes.
+	Memory int64
+	// CPUWeight is the cpu.weight of the invocation cgroup (1-10000).
+	CPUWeight int
+	// Pids is the pids.max of the invocation cgroup.
+	Pids int
+
+	CgroupParent string
+
+	// MaxOutput caps the stdout buffered per invocation, in bytes, and
+	// OutputPolicy says what happens beyond it: outputLimitKill kills the
+	// script and fails the invocation, outputLimitTruncate discards the
+	// rest and marks the response truncated. Persistent workers are capped
+	// on the response they send; outputLimitKill fails the invocation but
+	// leaves the worker serving others. Streamed invocations aren't
+	// capped.
+	MaxOutput    int64
+	OutputPolicy string
+}
+
+const (
+	outputLimitKill     = "kill"
+	outputLimitTruncate = "truncate"
+
+	// outputTruncatedHeader is set to the output limit on responses whose
+	// output was truncated.
+	outputTruncatedHeader = "X-Output-Truncated"
+)
+
+// usesCgroup reports whether any limit needs a per-invocation cgroup.
+func (l ResourceLimits) usesCgroup() bool {
+	return l.Memory > 0 || l.CPUWeight > 0 || l.Pids > 0
+}
+
+// validate checks the limits; cgroups is set when this server enforces
+// them with cgroups of its own rather than leaving that to the executor.
+func (l ResourceLimits) validate(cgroups bool) error {
+	if cgroups && l.usesCgroup() && l.CgroupParent == "" {
+		return errors.New("memory, CPU and pids limits require --cgroup-parent")
+	}
+	if l.CPUWeight < 0 || l.CPUWeight > 10000 {
+		return fmt.Errorf("cpu weight %d out of range 1-10000", l.CPUWeight)
+	}
+	if l.OutputPolicy != outputLimitKill && l.OutputPolicy != outputLimitTruncate {
+		return fmt.Errorf("output limit policy %q is neither %s nor %s", l.OutputPolicy, outputLimitKill, outputLimitTruncate)
+	}
+	return nil
+}
+
+// limitError reports that an invocation was killed, or failed, because it
+// exceeded a resource limit.
+type limitError struct {
+	resource string
+	err      error
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("%s limit exceeded: %v", e.resource, e.err)
+}
+
+func (e *limitError) Unwrap() error { return e.err }
+
+// status maps the exhausted resource to the response status: memory is
+// the payload's fault (507), runaway output a bad response from the script
+// (502), and anything else is treated as the server being temporarily out
+// of capacity (503).
+func (e *limitError) status() int {
+	switch e.resource {
+	case "memory":
+		return http.StatusInsufficientStorage
+	case "output":
+		return http.StatusBadGateway
+	}
+	return http.StatusServiceUnavailable
+}
+
+// outputBuffer buffers the stdout of an invocation up to max bytes, 0
+// meaning unlimited. Output beyond that is discarded and exceeded set,
+// calling onExceed the first time.
+type outputBuffer struct {
+	bytes.Buffer
+	max      int64
+	exceeded bool
+	onExceed func()
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if b.max > 0 {
+		if room := max(b.max-int64(b.Len()), 0); int64(n) > room {
+			p = p[:room]
+			if !b.exceeded {
+				b.exceeded = true
+				if b.onExceed != nil {
+					b.onExceed()
+				}
+			}
+		}
+	}
+	b.Buffer.Write(p)
+	// Discarded output is reported written, so the script isn't blocked
+	// on a full pipe.
+	return n, nil
+}
+
+// heapExhausted reports whether node aborted after hitting its V8 heap
+// limit.
+func heapExhausted(stderr []byte) bool {
+	return strings.Contains(string(stderr), "JavaScript heap out of memory")
+}
+
+// parseByteSize parses a byte count with an optional K, M or G suffix
+// (powers of 1024).
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"), strings.HasSuffix(s, "k"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"), strings.HasSuffix(s, "m"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"), strings.HasSuffix(s, "g"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
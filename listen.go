@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	listenSystemd = "systemd"
+	// sdListenFDsStart is the first file descriptor passed by systemd.
+	sdListenFDsStart = 3
+)
+
+// listen opens the listener described by addr:
+//
+//	unix:///run/invoke.sock  a unix socket created with mode perm
+//	systemd                  the first socket passed via LISTEN_FDS
+//	host:port, tcp://host:port
+//
+// An empty addr uses systemd's socket when one was passed, and port
+// otherwise.
+func listen(addr string, port int, perm os.FileMode) (net.Listener, error) {
+	if addr == "" {
+		if os.Getenv("LISTEN_FDS") != "" {
+			addr = listenSystemd
+		} else {
+			addr = fmt.Sprintf(":%d", port)
+		}
+	}
+
+	switch {
+	case addr == listenSystemd:
+		return systemdListener()
+	case strings.HasPrefix(addr, "unix://"):
+		return listenUnix(strings.TrimPrefix(addr, "unix://"), perm)
+	}
+	return net.Listen("tcp", strings.TrimPrefix(addr, "tcp://"))
+}
+
+// listenUnix creates a unix socket at path, replacing a stale socket left
+// by a previous run. The socket file is removed when the listener closes.
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// systemdListener returns the socket passed by systemd socket activation.
+func systemdListener() (net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || n < 1 {
+		return nil, errors.New("no socket passed by systemd (LISTEN_PID/LISTEN_FDS)")
+	}
+	// Scripts must not believe the sockets were meant for them.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(sdListenFDsStart, "systemd")
+	defer f.Close()
+	return net.FileListener(f)
+}
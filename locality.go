@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// regionEnvKey and zoneEnvKey tell scripts where the server runs, e.g.
+	// to pick the nearest replica of a downstream service.
+	regionEnvKey = "INVOKE_REGION"
+	zoneEnvKey   = "INVOKE_ZONE"
+
+	regionHeader = "X-Invoke-Region"
+	zoneHeader   = "X-Invoke-Zone"
+)
+
+// Locality identifies where a server of a globally deployed fleet runs.
+// When set, it is stamped onto log lines, /metrics, trace resources,
+// response headers and the script environment, so telemetry can be
+// segmented by region and a response traced back to the zone that served
+// it.
+type Locality struct {
+	Region string
+	Zone   string
+}
+
+func (l Locality) validate() error {
+	for _, v := range []string{l.Region, l.Zone} {
+		if strings.ContainsAny(v, " \t\r\n\"") {
+			return fmt.Errorf("%q must not contain whitespace or quotes", v)
+		}
+	}
+	return nil
+}
+
+// Env returns the script environment variables for l.
+func (l Locality) Env() []string {
+	var env []string
+	if l.Region != "" {
+		env = append(env, regionEnvKey+"="+l.Region)
+	}
+	if l.Zone != "" {
+		env = append(env, zoneEnvKey+"="+l.Zone)
+	}
+	return env
+}
+
+// logPrefix returns the prefix of every log line, e.g.
+// "region=eu-west-1 zone=eu-west-1a ".
+func (l Locality) logPrefix() string {
+	var b strings.Builder
+	if l.Region != "" {
+		b.WriteString("region=" + l.Region + " ")
+	}
+	if l.Zone != "" {
+		b.WriteString("zone=" + l.Zone + " ")
+	}
+	return b.String()
+}
+
+// labels returns the Prometheus labels for l, e.g.
+// `region="eu-west-1",zone="eu-west-1a"`.
+func (l Locality) labels() string {
+	var labels []string
+	if l.Region != "" {
+		labels = append(labels, "region="+strconv.Quote(l.Region))
+	}
+	if l.Zone != "" {
+		labels = append(labels, "zone="+strconv.Quote(l.Zone))
+	}
+	return strings.Join(labels, ",")
+}
+
+// resource returns the OpenTelemetry resource attributes for l.
+func (l Locality) resource() map[string]string {
+	attrs := map[string]string{}
+	if l.Region != "" {
+		attrs["cloud.region"] = l.Region
+	}
+	if l.Zone != "" {
+		attrs["cloud.availability_zone"] = l.Zone
+	}
+	return attrs
+}
+
+// stamp sets the locality response headers on everything next serves.
+func (l Locality) stamp(next http.Handler) http.Handler {
+	if l.Region == "" && l.Zone == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.Region != "" {
+			w.Header().Set(regionHeader, l.Region)
+		}
+		if l.Zone != "" {
+			w.Header().Set(zoneHeader, l.Zone)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
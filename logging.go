@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// Log levels. At logLevelError only failures are logged; routine output
+// such as script stdout is dropped.
+const (
+	logLevelInfo  = "info"
+	logLevelError = "error"
+)
+
+// quiet is set while the log level is error.
+var quiet atomic.Bool
+
+func setLogLevel(level string) error {
+	switch level {
+	case logLevelInfo:
+		quiet.Store(false)
+	case logLevelError:
+		quiet.Store(true)
+	default:
+		return fmt.Errorf("unknown log level %q (want %s or %s)", level, logLevelInfo, logLevelError)
+	}
+	return nil
+}
+
+func currentLogLevel() string {
+	if quiet.Load() {
+		return logLevelError
+	}
+	return logLevelInfo
+}
+
+// infof logs routine, per-invocation information.
+func infof(format string, args ...any) {
+	if !quiet.Load() {
+		log.Printf(format, args...)
+	}
+}
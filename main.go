@@ -1,194 +1,658 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
-	"strconv"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
-)
 
-const (
-	defaultPort       = 8080
-	defaultEnvFile    = ""
-	defaultTimeout    = 30 * time.Second
-	defaultInline     = ""
-	defaultScriptFile = ""
-
-	envPortKey       = "PORT"
-	envInlineKey     = "SCRIPT"
-	envScriptFileKey = "SCRIPT_FILE"
-	envEnvFileKey    = "ENV_FILE"
-	envTimeoutKey    = "TIMEOUT_DURATION"
+	"github.com/quic-go/quic-go/http3"
 )
 
-type Config struct {
-	Port         int
-	InlineScript string
-	ScriptFile   string
-	EnvFile      string
-	Timeout      time.Duration
-}
+func main() {
+	// `run` performs a single invocation instead of serving, `gen` writes
+	// a client for the routes, `contract-test` checks scripts against
+	// their schemas, `replay` re-invokes recorded invocations, `completion`
+	// prints a shell completion script, `config schema` the JSON Schema
+	// of the config file and `sdk` writes the scripts' go-invoke package;
+	// see runOptions, genOptions, contractOptions, replayOptions,
+	// writeCompletion, runConfigCommand and runSDKCommand.
+	var subcommand string
+	if len(os.Args) > 1 {
+		subcommand = os.Args[1]
+	}
+	switch subcommand {
+	case "config":
+		os.Exit(runConfigCommand(os.Args[2:]))
+	case "sdk":
+		os.Exit(runSDKCommand(os.Args[2:]))
+	}
+	oneShot := subcommand == "run"
+	generate := subcommand == "gen"
+	contractTest := subcommand == "contract-test"
+	replay := subcommand == "replay"
+	completion := subcommand == "completion"
+	var runOpts runOptions
+	var genOpts genOptions
+	var contractOpts contractOptions
+	var replayOpts replayOptions
+	switch {
+	case oneShot:
+		runOpts.register()
+	case generate:
+		genOpts.register()
+	case contractTest:
+		contractOpts.register()
+	case replay:
+		replayOpts.register()
+	}
+	if oneShot || generate || contractTest || replay || completion {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 
-func (c *Config) LoadEnv() {
-	if v := os.Getenv(envPortKey); v != "" {
-		p, err := strconv.Atoi(v)
+	cfg := Config{
+		Port:          defaultPort,
+		Listen:        defaultListen,
+		ListenMode:    defaultListenMode,
+		InlineScript:  defaultInline,
+		ScriptFile:    defaultScriptFile,
+		ScriptDir:     defaultScriptDir,
+		ConfigFile:    defaultConfigFile,
+		EnvFiles:      splitList(defaultEnvFile),
+		Timeout:       defaultTimeout,
+		TimeoutStatus: defaultTimeoutStatus,
+		SchemaFile:    defaultSchemaFile,
+		StrictConfig:  defaultStrictConfig,
+		Profile:       defaultProfile,
+		WarmupPayload: defaultWarmupPayload,
+		ProbeInterval: defaultProbeInterval,
+		ProbePayload:  defaultProbePayload,
+
+		DependencyCheckInterval: defaultDependencyCheckInterval,
+
+		Concurrency:      defaultConcurrency,
+		BatchParallelism: defaultBatchParallelism,
+		ForwardHeaders:   splitList(defaultForwardHeaders),
+
+		KeepaliveInterval: defaultKeepaliveInterval,
+
+		RawContentTypes: splitList(defaultRawContentTypes),
+		RawResponseType: defaultRawResponseType,
+		MaxUploadSize:   defaultMaxUploadSize,
+		CompressMinSize: defaultCompressMinSize,
+		CoercePayload:   defaultCoercePayload,
+		TenantHeader:    defaultTenantHeader,
+		FakeClock:       defaultFakeClock,
+		Deterministic:   defaultDeterministic,
+
+		TrustPriorityHeader: defaultTrustPriorityHeader,
+
+		Connections: ConnLimits{
+			Max:   defaultMaxConnections,
+			PerIP: defaultMaxConnectionsPerIP,
+		},
+		HTTPIdleTimeout: defaultHTTPIdleTimeout,
+		HTTPKeepAlives:  defaultHTTPKeepAlives,
+
+		HTTPTimeoutMargin: defaultHTTPTimeoutMargin,
+
+		TLS: TLSConfig{
+			CertFile: defaultTLSCert,
+			KeyFile:  defaultTLSKey,
+		},
+		HTTP2: defaultHTTP2,
+		H2C:   defaultH2C,
+		HTTP3: HTTP3Config{
+			Listen:   defaultHTTP3Listen,
+			CertFile: defaultHTTP3Cert,
+			KeyFile:  defaultHTTP3Key,
+		},
+
+		CacheTTL:     defaultCacheTTL,
+		CacheSize:    defaultCacheSize,
+		CacheBackend: defaultCacheBackend,
+
+		Retry: RetryPolicy{
+			Attempts: defaultRetryAttempts,
+			Backoff:  defaultRetryBackoff,
+			On:       splitList(defaultRetryOn),
+		},
+
+		Breaker: BreakerPolicy{
+			Failures: defaultBreakerFailures,
+			Window:   defaultBreakerWindow,
+			Cooldown: defaultBreakerCooldown,
+		},
+
+		Limits: ResourceLimits{
+			MaxOldSpaceSize: defaultNodeMaxOldSpaceSize,
+			CPUWeight:       defaultCPUWeight,
+			Pids:            defaultPidsLimit,
+			CgroupParent:    defaultCgroupParent,
+			OutputPolicy:    defaultOutputLimitPolicy,
+		},
+		Executor: defaultExecutor,
+		Docker:   DockerConfig{Image: defaultDockerImage},
+
+		DeadLetterDir: defaultDeadLetterDir,
+
+		IdempotencyDir: defaultIdempotencyDir,
+		IdempotencyTTL: defaultIdempotencyTTL,
+
+		Callbacks: CallbackConfig{
+			AllowHosts: splitList(defaultCallbackAllowHosts),
+			SecretFile: defaultCallbackSecretFile,
+			Attempts:   defaultCallbackAttempts,
+			Backoff:    defaultCallbackBackoff,
+		},
+		Signing: SigningConfig{
+			Mode:    defaultResponseSigning,
+			KeyFile: defaultResponseSigningKeyFile,
+		},
+		PayloadDecryptionKeyFile: defaultPayloadDecryptionKeyFile,
+
+		Analytics: defaultAnalytics,
+
+		Audit: AuditConfig{
+			Payload:  defaultAuditPayload,
+			Redact:   splitList(defaultAuditRedact),
+			MaxSize:  defaultAuditLogMaxSize,
+			MaxFiles: defaultAuditLogMaxFiles,
+		},
+		Sampling: SamplingConfig{
+			Sink:   defaultSampleSink,
+			Rate:   defaultSampleRate,
+			Redact: splitList(defaultSampleRedact),
+		},
+
+		NodePath:            defaultNodePath,
+		NodeVersionMismatch: defaultNodeVersionMismatch,
+		PackageJSON:         defaultPackageJSON,
+		PackagesDir:         defaultPackagesDir,
+		NodeRequire:         splitList(defaultNodeRequire),
+		CompileCacheDir:     defaultCompileCacheDir,
+
+		Workdir: Workdir{
+			Isolate:  defaultIsolateWorkdir,
+			Template: defaultWorkdirTemplate,
+		},
+
+		Sandbox: defaultSandbox,
+
+		EnvClean: defaultEnvClean,
+
+		EgressProxy: defaultEgressProxy,
+
+		Store:              defaultStore,
+		StoreBackend:       defaultStoreBackend,
+		StoreMaxKeys:       defaultStoreMaxKeys,
+		StoreCacheSize:     defaultStoreCacheSize,
+		StoreCacheMaxBytes: defaultStoreCacheMaxBytes,
+		StoreCacheTTL:      defaultStoreCacheTTL,
+
+		StreamWriteTimeout: defaultStreamWriteTimeout,
+		SlowClientPolicy:   defaultSlowClientPolicy,
+
+		Persistent:             defaultPersistent,
+		PersistentReadyTimeout: defaultPersistentReadyTimeout,
+		WorkerProtocol:         defaultWorkerProtocol,
+		WorkerRecycle: WorkerRecycle{
+			MaxRSS:      defaultWorkerMaxRSS,
+			MaxRequests: defaultWorkerMaxRequests,
+			Interval:    defaultWorkerCheckInterval,
+		},
+
+		Locality: Locality{
+			Region: defaultRegion,
+			Zone:   defaultZone,
+		},
+
+		LogLevel:     defaultLogLevel,
+		AdminListen:  defaultAdminListen,
+		DebugListen:  defaultDebugListen,
+		ScriptUpload: defaultScriptUpload,
+
+		CORS: CORSPolicy{
+			Origins: splitList(defaultCORSOrigins),
+			Methods: splitList(defaultCORSMethods),
+			Headers: splitList(defaultCORSHeaders),
+			MaxAge:  defaultCORSMaxAge,
+		},
+	}
+
+	cfg.LoadEnv()
+	defaults := cfg
+	cfg.LoadFlags()
+	log.SetPrefix(cfg.Locality.logPrefix())
+	metricLabels = cfg.Locality.labels()
+	if cfg.HelpJSON {
+		os.Exit(writeHelpJSON(os.Stdout, defaults))
+	}
+	if completion {
+		os.Exit(writeCompletion(os.Stdout, defaults, flag.Arg(0)))
+	}
+	if cfg.scriptSources() != 1 {
+		log.Fatalf("must provide exactly one of --script, --script-file, --script-dir or --config (or via %s, %s, %s, %s environment variables)", envInlineKey, envScriptFileKey, envScriptDirKey, envConfigFileKey)
+	}
+	if generate {
+		// Generating a client needs neither node nor the server's
+		// dependencies.
+		os.Exit(generateClient(cfg, genOpts))
+	}
+	if cfg.Check {
+		os.Exit(runCheck(cfg))
+	}
+	setupNode(cfg)
+	filter, err := newEnvFilter(cfg.EnvClean, cfg.EnvAllowlist, cfg.EnvDenylist)
+	if err != nil {
+		log.Fatalf("invalid --env-allowlist or --env-denylist: %v", err)
+	}
+	childEnvFilter = filter
+
+	var packages string
+	if cfg.PackageJSON != "" {
+		modules, err := installPackages(cfg.PackageJSON, cfg.PackagesDir)
 		if err != nil {
-			log.Fatalf("invalid %s %q: %v", envPortKey, v, err)
+			log.Fatalf("packages: %v", err)
 		}
-		c.Port = p
+		prependNodePath(modules)
+		packages = modules
+	}
+	sdk, err := sdkModules()
+	if err != nil {
+		log.Printf("warning: the %s package is not available to scripts: %v", sdkPackage, err)
+	} else {
+		appendNodePath(sdk)
 	}
 
-	if v := os.Getenv(envInlineKey); v != "" {
-		c.InlineScript = v
+	var schema *Schema
+	if cfg.SchemaFile != "" {
+		s, err := LoadSchema(cfg.SchemaFile)
+		if err != nil {
+			log.Fatalf("invalid schema %q: %v", cfg.SchemaFile, err)
+		}
+		schema = s
 	}
 
-	if v := os.Getenv(envScriptFileKey); v != "" {
-		c.ScriptFile = v
+	if cfg.Executor == executorLocal && cfg.Limits.usesCgroup() {
+		if err := cfg.Limits.enableCgroupControllers(); err != nil {
+			log.Fatalf("resource limits: %v", err)
+		}
 	}
 
-	if c.InlineScript != "" && c.ScriptFile != "" {
-		log.Fatalf("must provide only one of %s or %s, not both", envInlineKey, envScriptFileKey)
+	var tokens *TokenManager
+	if cfg.OAuth.Enabled() {
+		tokens = NewTokenManager(cfg.OAuth)
+		if err := tokens.Start(context.Background()); err != nil {
+			log.Fatalf("oauth: %v", err)
+		}
 	}
 
-	if v := os.Getenv(envEnvFileKey); v != "" {
-		c.EnvFile = v
+	tracer, err := NewTracerFromEnv(cfg.Locality)
+	if err != nil {
+		log.Fatalf("tracing: %v", err)
 	}
 
-	if v := os.Getenv(envTimeoutKey); v != "" {
-		d, err := time.ParseDuration(v)
-		if err != nil {
-			log.Fatalf("invalid %s %q: %v", envTimeoutKey, v, err)
+	signer, err := NewSigner(cfg.Signing)
+	if err != nil {
+		log.Fatalf("response signing: %v", err)
+	}
+	var decrypter *Decrypter
+	if cfg.PayloadDecryptionKeyFile != "" {
+		if decrypter, err = NewDecrypter(cfg.PayloadDecryptionKeyFile); err != nil {
+			log.Fatalf("payload decryption: %v", err)
 		}
-		c.Timeout = d
 	}
-}
 
-func (c *Config) LoadFlags() {
-	flag.IntVar(&c.Port, "port", c.Port, "port to listen on")
+	opts := handlerOptions{
+		ForwardHeaders:    cfg.ForwardHeaders,
+		KeepaliveInterval: cfg.KeepaliveInterval,
+		BatchParallelism:  cfg.BatchParallelism,
+
+		StreamWriteTimeout: cfg.StreamWriteTimeout,
+		SlowClientPolicy:   cfg.SlowClientPolicy,
+
+		RawContentTypes: cfg.RawContentTypes,
+		RawResponseType: cfg.RawResponseType,
+		MaxUploadSize:   cfg.MaxUploadSize,
+		CompressMinSize: cfg.CompressMinSize,
+		CoercePayload:   cfg.CoercePayload,
+		TenantHeader:    cfg.TenantHeader,
+		FakeClock:       cfg.FakeClock,
+		Deterministic:   cfg.Deterministic,
+		CORS:            cfg.CORS,
+
+		TrustPriorityHeader: cfg.TrustPriorityHeader,
+
+		Tracer:    tracer,
+		Signer:    signer,
+		Decrypter: decrypter,
+	}
 
-	flag.StringVar(&c.InlineScript, "script", c.InlineScript,
-		"inline JavaScript to evaluate (mutually exclusive with --script-file)")
-	flag.StringVar(&c.ScriptFile, "script-file", c.ScriptFile,
-		"path to JavaScript file to run (mutually exclusive with --script)")
+	var egress *EgressProxy
+	if cfg.EgressProxy {
+		egress, err = StartEgressProxy(cfg.EgressBudget)
+		if err != nil {
+			log.Fatalf("egress proxy: %v", err)
+		}
+	}
 
-	flag.StringVar(&c.EnvFile, "env-file", c.EnvFile,
-		"path to .env file for the script (optional)")
-	flag.DurationVar(&c.Timeout, "timeout", c.Timeout,
-		"timeout for node invocation (e.g. 30s, 1m)")
+	var store *Store
+	if cfg.Store {
+		cache := newResultCache(cfg.StoreCacheSize, cfg.StoreCacheTTL)
+		if cache != nil {
+			cache.maxBytes = cfg.StoreCacheMaxBytes
+		}
+		if err := cache.share(cfg.CacheBackend, "storecache"); err != nil {
+			log.Fatalf("store cache backend: %v", err)
+		}
+		kv, err := openKVBackend(cfg.StoreBackend, cfg.StoreMaxKeys)
+		if err != nil {
+			log.Fatalf("store backend: %v", err)
+		}
+		store, err = StartStore(kv, cache)
+		if err != nil {
+			log.Fatalf("store: %v", err)
+		}
+	}
 
-	flag.Parse()
+	inv := NewInvoker(cfg, tokens, tracer, egress, store)
+	if err := inv.cache.share(cfg.CacheBackend, "cache"); err != nil {
+		log.Fatalf("cache backend: %v", err)
+	}
+	inv.packages = packages
+	inv.sdk = sdk
+	if inv.executor, err = NewExecutor(cfg); err != nil {
+		log.Fatalf("executor: %v", err)
+	}
+	if cfg.DeadLetterDir != "" {
+		if inv.deadLetters, err = NewDeadLetters(cfg.DeadLetterDir); err != nil {
+			log.Fatalf("dead letters: %v", err)
+		}
+	}
+	if cfg.IdempotencyDir != "" {
+		if inv.idempotency, err = NewIdempotency(cfg.IdempotencyDir, cfg.IdempotencyTTL); err != nil {
+			log.Fatalf("idempotency: %v", err)
+		}
+	}
+	if cfg.Audit.Sink != "" {
+		if inv.audit, err = NewAuditor(cfg.Audit); err != nil {
+			log.Fatalf("audit log: %v", err)
+		}
+	}
+	if cfg.Sampling.Sink != "" {
+		if inv.sampler, err = NewSampler(cfg.Sampling); err != nil {
+			log.Fatalf("sampling: %v", err)
+		}
+	}
+	if cfg.Analytics {
+		inv.analytics = NewAnalytics()
+	}
+	if cfg.Callbacks.Enabled() {
+		inv.callbacks = NewCallbacks(cfg.Callbacks)
+	}
+	if oneShot || contractTest || replay {
+		var code int
+		switch {
+		case oneShot:
+			code = runOnce(cfg, inv, schema, runOpts)
+		case contractTest:
+			code = runContractTests(cfg, inv, schema, contractOpts)
+		default:
+			code = runReplay(cfg, inv, schema, replayOpts)
+		}
+		inv.audit.Close()
+		inv.sampler.Close()
+		if store != nil {
+			store.Close()
+		}
+		tracer.Shutdown()
+		os.Exit(code)
+	}
 
-	if c.InlineScript != "" && c.ScriptFile != "" {
-		log.Fatal("must provide only one of --script or --script-file, not both")
+	var prober *Prober
+	if cfg.ProbeInterval > 0 {
+		prober = NewProber(inv, cfg.ProbeInterval, []byte(cfg.ProbePayload))
 	}
-}
 
-func main() {
-	cfg := Config{
-		Port:         defaultPort,
-		InlineScript: defaultInline,
-		ScriptFile:   defaultScriptFile,
-		EnvFile:      defaultEnvFile,
-		Timeout:      defaultTimeout,
+	var deps *DependencyChecker
+	if cfg.ConfigFile != "" {
+		deps = NewDependencyChecker(cfg.DependencyCheckInterval)
 	}
 
-	cfg.LoadEnv()
-	cfg.LoadFlags()
-	if (cfg.InlineScript == "") == (cfg.ScriptFile == "") {
-		log.Fatalf("must provide exactly one of --script or --script-file (or via %s, %s environment variables)", envInlineKey, envScriptFileKey)
+	var admin *Admin
+	if cfg.AdminToken != "" || cfg.AdminListen != "" {
+		admin = NewAdmin(inv, cfg.AdminToken)
+		admin.faultRoutes = cfg.FaultRoutes
 	}
 
-	addr := fmt.Sprintf(":%d", cfg.Port)
-	log.Printf("Starting server on %s (timeout=%s)…", addr, cfg.Timeout)
+	// ctx ends on SIGINT or SIGTERM, stopping triggers and the server.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/invoke", makeInvokeHandler(cfg))
+	mux.HandleFunc("/metrics", makeMetricsHandler(inv, prober, deps))
+	mux.HandleFunc("/readyz", makeReadyHandler(prober, deps))
 
-	server := &http.Server{
-		Addr:         addr,
-		Handler:      mux,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 60 * time.Second,
-		IdleTimeout:  120 * time.Second,
-	}
+	switch {
+	case cfg.ScriptDir != "":
+		dir, err := NewScriptDir(cfg.ScriptDir, cfg.EnvFiles, schema)
+		if err != nil {
+			log.Fatalf("invalid script dir %q: %v", cfg.ScriptDir, err)
+		}
+		if cfg.Warmup > 0 {
+			log.Printf("--warmup is ignored with --script-dir")
+		}
+		if prober != nil {
+			log.Printf("--probe-interval is ignored with --script-dir")
+		}
+		if cfg.Sandbox {
+			if _, err := inv.sandbox.get(nodeBinary); err != nil {
+				log.Fatalf("sandbox: %v", err)
+			}
+		}
+		// Batches for a script are posted to /invoke/batch/<name>.
+		mux.HandleFunc("/invoke/batch/", makeScriptDirHandler(inv, dir, "/invoke/batch/", serveBatch, opts))
+		mux.HandleFunc("/invoke/", makeScriptDirHandler(inv, dir, "/invoke/", serveInvoke, opts))
+		if admin != nil {
+			admin.dir = dir
+		}
+		if cfg.ScriptUpload {
+			admin.Handle("/scripts/", NewScriptStore(dir, inv))
+		}
 
-	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
-		log.Fatalf("server error: %v", err)
+	case cfg.ConfigFile != "":
+		fc, err := LoadFileConfig(cfg.ConfigFile, cfg.Profile, cfg.StrictConfig)
+		if err != nil {
+			log.Fatalf("invalid config: %v", err)
+		}
+		routes, err := fc.BuildRoutes(filepath.Dir(cfg.ConfigFile))
+		if err != nil {
+			log.Fatalf("invalid config: %v", err)
+		}
+		if len(routes) == 0 {
+			log.Fatalf("config %s declares no routes", cfg.ConfigFile)
+		}
+		set := newRouteSet(ctx, cfg, inv, store, schema, prober, deps, admin, opts)
+		if _, err := set.apply(routes); err != nil {
+			log.Fatal(err)
+		}
+		mux.Handle("/invoke/", set)
+		if admin != nil {
+			admin.reload = set.reload
+		}
+		go set.reloadOnHangup(ctx)
+		deps.Start(ctx)
+
+	default:
+		route := &Route{
+			Name:         "default",
+			InlineScript: cfg.InlineScript,
+			ScriptFile:   cfg.ScriptFile,
+			EnvFiles:     cfg.EnvFiles,
+			Schema:       schema,
+		}
+		if err := prepareRoute(context.Background(), cfg, inv, prober, route); err != nil {
+			log.Fatalf("route %s: %v", route.Name, err)
+		}
+		if admin != nil {
+			admin.Add(route)
+		}
+		mux.HandleFunc("/invoke", makeInvokeHandler(inv, route, opts))
+		mux.HandleFunc("/invoke/batch", makeBatchHandler(inv, route, opts))
 	}
-}
 
-func makeInvokeHandler(cfg Config) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
+	var adminServer *http.Server
+	switch {
+	case admin != nil && cfg.AdminListen != "":
+		aln, err := listen(cfg.AdminListen, 0, cfg.ListenMode)
+		if err != nil {
+			log.Fatalf("admin listen: %v", err)
 		}
+		adminServer = &http.Server{Handler: cfg.Locality.stamp(admin.Handler()), ReadTimeout: 10 * time.Second}
+		go func() {
+			if err := adminServer.Serve(aln); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("admin server error: %v", err)
+			}
+		}()
+		log.Printf("admin API on %s", aln.Addr())
+	case admin != nil:
+		mux.Handle("/admin/", admin.Handler())
+		mux.Handle("/scripts/", admin.Handler())
+		mux.Handle("/debug/", admin.Handler())
+	}
 
-		payload, err := io.ReadAll(r.Body)
+	var debugServer *http.Server
+	if cfg.DebugListen != "" {
+		dln, err := listen(cfg.DebugListen, 0, cfg.ListenMode)
 		if err != nil {
-			http.Error(w, "failed to read request body: "+err.Error(), http.StatusBadRequest)
-			return
+			log.Fatalf("debug listen: %v", err)
 		}
-		defer r.Body.Close()
+		// CPU profiles and traces take as long as they are asked to, so
+		// only the headers are bounded.
+		debugServer = &http.Server{Handler: debugHandler(cfg.AdminToken), ReadHeaderTimeout: httpReadHeaderTimeout}
+		go func() {
+			if err := debugServer.Serve(dln); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("debug server error: %v", err)
+			}
+		}()
+		log.Printf("debug endpoints on %s", dln.Addr())
+	}
 
-		if !json.Valid(payload) {
-			http.Error(w, "invalid JSON payload", http.StatusBadRequest)
-			return
+	ln, err := listen(cfg.Listen, cfg.Port, cfg.ListenMode)
+	if err != nil {
+		log.Fatalf("listen: %v", err)
+	}
+	log.Printf("Starting server on %s (timeout=%s)…", ln.Addr(), cfg.Timeout)
+	ln = cfg.Connections.limit(ln)
+
+	handler := cfg.Locality.stamp(decompressRequests(cfg.MaxUploadSize, mux))
+	var h3 *http3.Server
+	if cfg.HTTP3.Listen != "" {
+		if h3, err = startHTTP3(cfg.HTTP3, handler); err != nil {
+			log.Fatalf("http3: %v", err)
 		}
+		handler = advertiseHTTP3(h3, handler)
+	}
 
-		ctx, cancel := context.WithTimeout(r.Context(), cfg.Timeout)
-		defer cancel()
-
-		args := []string{}
+	// Invocation endpoints extend the read and write timeouts to their
+	// route's budget; see extendDeadlines.
+	server := &http.Server{
+		Handler:           handler,
+		Protocols:         serverProtocols(cfg),
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ReadTimeout:       cfg.Timeout + cfg.HTTPTimeoutMargin,
+		WriteTimeout:      cfg.Timeout + cfg.HTTPTimeoutMargin,
+		IdleTimeout:       cfg.HTTPIdleTimeout,
+	}
+	server.SetKeepAlivesEnabled(cfg.HTTPKeepAlives)
 
-		if cfg.EnvFile != "" {
-			args = append(args, "--env-file", cfg.EnvFile)
+	go func() {
+		<-ctx.Done()
+		log.Printf("shutting down…")
+		sctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+		defer cancel()
+		// Shutdown closes the listener, which also removes a unix socket.
+		server.Shutdown(sctx)
+		if adminServer != nil {
+			adminServer.Shutdown(sctx)
 		}
-
-		if cfg.InlineScript != "" {
-			args = append(args, "-e", cfg.InlineScript)
-		} else {
-			args = append(args, cfg.ScriptFile)
+		if debugServer != nil {
+			// Profiles being taken aren't waited for.
+			debugServer.Close()
 		}
-
-		cmd := exec.CommandContext(ctx, "node", args...)
-		cmd.Stdin = bytes.NewReader(payload)
-
-		var outBuf, errBuf bytes.Buffer
-		cmd.Stdout = &outBuf
-		cmd.Stderr = &errBuf
-
-		if err := cmd.Run(); err != nil {
-			log.Println(outBuf.String())
-			log.Printf("node error: %v, stderr: %s", err, errBuf.String())
-			http.Error(w,
-				"node.js failed: "+firstLine(errBuf.String(), err.Error()),
-				http.StatusInternalServerError,
-			)
-			return
+		if h3 != nil {
+			h3.Shutdown(sctx)
 		}
-		log.Println(outBuf.String())
+	}()
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write(outBuf.Bytes())
+	serve := server.Serve
+	if cfg.TLS.enabled() {
+		serve = func(ln net.Listener) error { return server.ServeTLS(ln, cfg.TLS.CertFile, cfg.TLS.KeyFile) }
+	}
+	if err := serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("server error: %v", err)
+	}
+	if inv.callbacks != nil && !inv.callbacks.Wait(cfg.Timeout) {
+		log.Printf("abandoning asynchronous invocations still running")
 	}
+	inv.audit.Close()
+	inv.sampler.Close()
+	if store != nil {
+		store.Close()
+	}
+	tracer.Shutdown()
 }
 
-func firstLine(s, fallback string) string {
-	for line := range bytes.SplitSeq([]byte(s), []byte{'\n'}) {
-		if len(bytes.TrimSpace(line)) > 0 {
-			return string(line)
+// prepareRoute starts the route's persistent worker, if any, runs the
+// configured warmup invocations and registers the route for health probes
+// until ctx is done. Routes that only dispatch to others are left alone.
+func prepareRoute(ctx context.Context, cfg Config, inv *Invoker, prober *Prober, route *Route) error {
+	if route.Dedupe != nil && inv.idempotency == nil {
+		return errors.New("dedupe requires --idempotency-dir")
+	}
+	if !route.hasScript() {
+		return nil
+	}
+	if err := checkRuntime(cfg, route); err != nil {
+		return err
+	}
+	if b := route.build(); b != nil {
+		log.Printf("route %s: %s", route.Name, b)
+	}
+	spec, err := inv.nodeSpec(route, nil, "")
+	if err != nil {
+		return err
+	}
+	if cfg.Persistent || route.Persistent {
+		if inv.workdirFor(route) != nil {
+			log.Printf("route %s: working directory isolation does not apply to persistent workers", route.Name)
+		}
+		protocol := cfg.WorkerProtocol
+		if route.WorkerProtocol != "" {
+			protocol = route.WorkerProtocol
+		}
+		w, err := StartWorker(spec, inv.nodeEnv, inv.executor, protocol, cfg.PersistentReadyTimeout)
+		if err != nil {
+			return fmt.Errorf("persistent worker: %w", err)
 		}
+		w.limits = cfg.Limits
+		w.recycleOn(cfg.WorkerRecycle, &inv.workerRecycles)
+		route.worker = w
+	}
+	if cfg.Warmup > 0 {
+		inv.Warmup(ctx, route, cfg.Warmup, []byte(cfg.WarmupPayload))
+	}
+	if prober != nil {
+		prober.Add(ctx, route)
 	}
-	return fallback
+	return nil
 }
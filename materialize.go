@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	materializedAtHeader    = "X-Materialized-At"
+	materializedStaleHeader = "X-Materialized-Stale"
+)
+
+// MaterializeConfig makes a route "materialized": the server invokes its
+// script on a schedule and answers GETs of /invoke/<name> straight from
+// the latest output, for expensive results such as dashboard aggregations
+// that many callers read:
+//
+//	materialize:
+//	  schedule: "@every 5m"
+//	  timezone: Europe/Berlin    # default: the server's
+//	  payload: {window: 24h}     # default: {}
+//	  stale_after: 15m
+//
+// The script also runs once at startup. Responses carry Last-Modified,
+// Age, X-Materialized-At and X-Materialized-Stale, which is true once the
+// output is older than StaleAfter or, without it, when the latest refresh
+// failed; failed refreshes keep serving the previous output. Until the
+// first refresh succeeded, GETs are answered 503. POSTs invoke the script
+// as usual, without updating the materialized output.
+type MaterializeConfig struct {
+	Schedule   string        `yaml:"schedule"`
+	Timezone   string        `yaml:"timezone"`
+	Payload    any           `yaml:"payload"`
+	Jitter     time.Duration `yaml:"jitter"`
+	StaleAfter time.Duration `yaml:"stale_after"`
+}
+
+// materialized holds a materialized route's schedule and latest output.
+type materialized struct {
+	cron       *cronTrigger
+	staleAfter time.Duration
+
+	mu                  sync.Mutex
+	out                 []byte
+	at, next            time.Time
+	refreshes, failures int64
+	lastErr             error
+}
+
+// materializedStatus is a materialized route's state as reported by the
+// admin API.
+type materializedStatus struct {
+	Route       string    `json:"route"`
+	Schedule    string    `json:"schedule"`
+	Timezone    string    `json:"timezone"`
+	RefreshedAt time.Time `json:"refreshed_at,omitzero"`
+	Next        time.Time `json:"next,omitzero"`
+	Stale       bool      `json:"stale"`
+	Refreshes   int64     `json:"refreshes"`
+	Failures    int64     `json:"failures"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// build compiles c.
+func (c MaterializeConfig) build() (*materialized, error) {
+	if c.Schedule == "" {
+		return nil, errors.New("schedule is required")
+	}
+	if c.StaleAfter < 0 {
+		return nil, errors.New("stale_after must not be negative")
+	}
+	ct, err := CronTrigger{Schedule: c.Schedule, Timezone: c.Timezone, Payload: c.Payload, Jitter: c.Jitter}.build()
+	if err != nil {
+		return nil, err
+	}
+	return &materialized{cron: ct, staleAfter: c.StaleAfter}, nil
+}
+
+// startMaterialized refreshes route's materialized output now and then on
+// its schedule until ctx is done. The payload is checked against the
+// route's schema first.
+func startMaterialized(ctx context.Context, inv *Invoker, route *Route) error {
+	m := route.Materialized
+	if _, err := triggerPayload(inv, route, m.cron.payload); err != nil {
+		return fmt.Errorf("materialize: %w", err)
+	}
+	log.Printf("route %s: materialized on %q", route.Name, m.cron.spec)
+	go func() {
+		for {
+			m.refresh(ctx, inv, route)
+			next := m.cron.schedule.Next(time.Now().In(m.cron.loc))
+			m.mu.Lock()
+			m.next = next
+			m.mu.Unlock()
+			delay := time.Until(next)
+			if m.cron.jitter > 0 {
+				delay += rand.N(m.cron.jitter)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+	}()
+	return nil
+}
+
+// refresh invokes route and keeps its output when it succeeded.
+func (m *materialized) refresh(ctx context.Context, inv *Invoker, route *Route) {
+	out, err := invokeTriggered(ctx, inv, route, "materialize", m.cron.payload, func() {})
+	if err == nil {
+		if out, err = applyTransforms(route.ResponseTransforms, out); err != nil {
+			log.Printf("route %s: materialize: output transform failed: %v", route.Name, err)
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refreshes++
+	m.lastErr = err
+	if err != nil {
+		m.failures++
+		return
+	}
+	m.out, m.at = out, time.Now()
+}
+
+// adopt serves old's output until m's first refresh, so recycling the
+// route on reload doesn't interrupt GETs.
+func (m *materialized) adopt(old *materialized) {
+	old.mu.Lock()
+	out, at := old.out, old.at
+	old.mu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.out, m.at = out, at
+}
+
+// stale reports whether the output is stale; m.mu must be held.
+func (m *materialized) stale() bool {
+	if m.staleAfter > 0 {
+		return time.Since(m.at) > m.staleAfter
+	}
+	return m.lastErr != nil
+}
+
+// serve answers a GET or HEAD with the materialized output.
+func (m *materialized) serve(w http.ResponseWriter, r *http.Request, route *Route, opts handlerOptions) {
+	fields, err := requestFields(r)
+	if err != nil {
+		http.Error(w, "invalid fields: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.mu.Lock()
+	out, at, stale := m.out, m.at, m.stale()
+	m.mu.Unlock()
+	if out == nil {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "materialized output not available yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Last-Modified", at.UTC().Format(http.TimeFormat))
+	h.Set("Age", strconv.Itoa(int(time.Since(at).Seconds())))
+	h.Set(materializedAtHeader, at.UTC().Format(time.RFC3339))
+	h.Set(materializedStaleHeader, strconv.FormatBool(stale))
+	if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !at.Truncate(time.Second).After(t) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	out = fields.filterOutput(out)
+	h.Set("Content-Type", "application/json")
+	if err := opts.Signer.sign(h, out); err != nil {
+		log.Printf("%s: response signing failed: %v", route.Name, err)
+		http.Error(w, "response signing failed", http.StatusInternalServerError)
+		return
+	}
+	writeCompressed(w, r, http.StatusOK, out, opts.CompressMinSize)
+}
+
+// status reports m, the materialization of route.
+func (m *materialized) status(route string) materializedStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := materializedStatus{
+		Route:       route,
+		Schedule:    m.cron.spec,
+		Timezone:    m.cron.loc.String(),
+		RefreshedAt: m.at,
+		Next:        m.next,
+		Stale:       m.out != nil && m.stale(),
+		Refreshes:   m.refreshes,
+		Failures:    m.failures,
+	}
+	if m.lastErr != nil {
+		st.LastError = m.lastErr.Error()
+	}
+	return st
+}
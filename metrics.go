@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// metricSample is one value of a metric with its label set, e.g.
+// `route="foo"`.
+type metricSample struct {
+	labels string
+	value  any
+}
+
+// metricLabels holds labels added to every sample, identifying the
+// server's locality.
+var metricLabels string
+
+// makeMetricsHandler serves GET /metrics in the Prometheus text exposition
+// format.
+func makeMetricsHandler(inv *Invoker, prober *Prober, deps *DependencyChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		if inv.cache != nil {
+			hits, misses, entries := inv.cache.Stats()
+			writeMetric(w, "invoke_cache_hits_total", "counter", "Invocations answered from the result cache.", hits)
+			writeMetric(w, "invoke_cache_misses_total", "counter", "Cacheable invocations not found in the result cache.", misses)
+			writeMetric(w, "invoke_cache_entries", "gauge", "Results currently held in the cache.", entries)
+		}
+
+		if store := inv.store; store != nil {
+			if keys, err := store.Keys(); err == nil {
+				writeMetric(w, "invoke_store_keys", "gauge", "Keys held in the script store.", keys)
+			}
+			if c := store.cache; c != nil {
+				hits, misses, entries := c.Stats()
+				bytes, evictions := c.Usage()
+				writeMetric(w, "invoke_store_cache_hits_total", "counter", "Script cache lookups that found a value.", hits)
+				writeMetric(w, "invoke_store_cache_misses_total", "counter", "Script cache lookups that found nothing.", misses)
+				writeMetric(w, "invoke_store_cache_entries", "gauge", "Entries held in the script cache.", entries)
+				writeMetric(w, "invoke_store_cache_bytes", "gauge", "Size of the keys and values in the script cache.", bytes)
+				writeMetric(w, "invoke_store_cache_evictions_total", "counter", "Entries evicted to keep the script cache within its limits.", evictions)
+			}
+		}
+
+		if dl := inv.deadLetters; dl != nil {
+			writeMetric(w, "invoke_dead_letters_captured_total", "counter", "Failed invocations captured as dead letters.", dl.captured.Load())
+		}
+
+		if cb := inv.callbacks; cb != nil {
+			writeMetric(w, "invoke_callbacks_delivered_total", "counter", "Results of asynchronous invocations delivered to their callback URL.", cb.delivered.Load())
+			writeMetric(w, "invoke_callbacks_failed_total", "counter", "Results of asynchronous invocations that could not be delivered.", cb.failed.Load())
+		}
+
+		if a := inv.audit; a != nil {
+			writeMetric(w, "invoke_audit_records_total", "counter", "Audit records written to the audit sink.", a.recorded.Load())
+			writeMetric(w, "invoke_audit_records_dropped_total", "counter", "Audit records dropped because the audit queue was full.", a.dropped.Load())
+			writeMetric(w, "invoke_audit_records_failed_total", "counter", "Audit records the audit sink failed to store.", a.failed.Load())
+		}
+
+		if s := inv.sampler; s != nil {
+			writeMetric(w, "invoke_samples_total", "counter", "Sampled invocations written to the sampling sink.", s.recorded.Load())
+			writeMetric(w, "invoke_samples_dropped_total", "counter", "Sampled invocations dropped because the sampling queue was full.", s.dropped.Load())
+			writeMetric(w, "invoke_samples_failed_total", "counter", "Sampled invocations the sampling sink failed to store.", s.failed.Load())
+		}
+
+		var depth []metricSample
+		for i, n := range inv.slots.Queued() {
+			depth = append(depth, metricSample{"priority=" + strconv.Quote(priorities[i].String()), n})
+		}
+		writeSamples(w, "invoke_queue_depth", "gauge", "Invocations waiting for a server-wide concurrency slot, by priority.", depth...)
+
+		if s := &inv.reloads; s.enabled {
+			writeSamples(w, "invoke_reloads_total", "counter", "Config reloads, by whether they were applied.",
+				metricSample{`result="ok"`, s.ok.Load()}, metricSample{`result="failed"`, s.failed.Load()})
+			writeSamples(w, "invoke_reload_routes_total", "counter", "Routes reloads kept serving, recycled, added and removed.",
+				metricSample{`action="kept"`, s.kept.Load()}, metricSample{`action="recycled"`, s.recycled.Load()},
+				metricSample{`action="added"`, s.added.Load()}, metricSample{`action="removed"`, s.removed.Load()})
+			writeMetric(w, "invoke_reload_duration_seconds", "gauge", "Time the latest reload took to start the recycled and added routes.", time.Duration(s.duration.Load()).Seconds())
+			writeMetric(w, "invoke_reload_drain_seconds", "gauge", "Time the invocations of the routes replaced by the latest reload took to finish.", time.Duration(s.drain.Load()).Seconds())
+			if t := s.lastSuccess.Load(); t > 0 {
+				writeMetric(w, "invoke_reload_last_success_timestamp_seconds", "gauge", "When the config was last reloaded.", t)
+			}
+		}
+
+		if tenants := inv.tenants.Load(); tenants != nil && len(*tenants) > 0 {
+			var requests, throttled, unauthorized, active []metricSample
+			for _, t := range *tenants {
+				labels := "tenant=" + strconv.Quote(t.Name)
+				requests = append(requests, metricSample{labels, t.requests.Load()})
+				throttled = append(throttled, metricSample{labels, t.throttled.Load()})
+				unauthorized = append(unauthorized, metricSample{labels, t.unauthorized.Load()})
+				if t.slots != nil {
+					_, running, _ := t.slots.Stats()
+					active = append(active, metricSample{labels, running})
+				}
+			}
+			writeSamples(w, "invoke_tenant_requests_total", "counter", "Requests to the tenant's routes.", requests...)
+			writeSamples(w, "invoke_tenant_throttled_total", "counter", "Requests rejected for exceeding the tenant's rate.", throttled...)
+			writeSamples(w, "invoke_tenant_unauthorized_total", "counter", "Requests rejected for lacking one of the tenant's API keys.", unauthorized...)
+			if len(active) > 0 {
+				writeSamples(w, "invoke_tenant_active", "gauge", "Invocations of the tenant running, for tenants with a concurrency quota.", active...)
+			}
+		}
+
+		if breakers := inv.breakers.Status(); len(breakers) > 0 {
+			var state, trips []metricSample
+			for _, name := range sortedRoutes(breakers) {
+				st := breakers[name]
+				labels := "route=" + strconv.Quote(name)
+				open := 0
+				switch st.State {
+				case breakerOpen:
+					open = 1
+				case breakerHalfOpen:
+					open = 2
+				}
+				state = append(state, metricSample{labels, open})
+				trips = append(trips, metricSample{labels, st.Trips})
+			}
+			writeSamples(w, "invoke_breaker_state", "gauge", "Circuit breaker state of the route: 0 closed, 1 open, 2 half-open.", state...)
+			writeSamples(w, "invoke_breaker_trips_total", "counter", "Times the route's circuit was opened.", trips...)
+		}
+
+		if routes, counts := inv.timeouts.snapshot(); len(routes) > 0 {
+			samples := make([]metricSample, len(routes))
+			for i, route := range routes {
+				samples[i] = metricSample{"route=" + strconv.Quote(route), counts[i]}
+			}
+			writeSamples(w, "invoke_timeouts_total", "counter", "Attempts killed by their timeout, retried ones included.", samples...)
+		}
+
+		if keys, counts, rss := inv.workerRecycles.snapshot(); len(keys) > 0 || len(rss) > 0 {
+			recycles := make([]metricSample, len(keys))
+			for i, k := range keys {
+				recycles[i] = metricSample{fmt.Sprintf("route=%q,reason=%q", k.route, k.reason), counts[i]}
+			}
+			var sizes []metricSample
+			for _, route := range slices.Sorted(maps.Keys(rss)) {
+				sizes = append(sizes, metricSample{"route=" + strconv.Quote(route), rss[route]})
+			}
+			writeSamples(w, "invoke_worker_recycles_total", "counter", "Persistent workers restarted by --worker-max-rss or --worker-max-requests.", recycles...)
+			writeSamples(w, "invoke_worker_rss_bytes", "gauge", "Memory of the persistent worker's processes when last checked.", sizes...)
+		}
+
+		if keys, counts := inv.triggerStats.snapshot(); len(keys) > 0 {
+			var invocations, failures []metricSample
+			for i, k := range keys {
+				labels := fmt.Sprintf("route=%q,kind=%q", k.route, k.kind)
+				invocations = append(invocations, metricSample{labels, counts[i].invocations})
+				failures = append(failures, metricSample{labels, counts[i].failures})
+			}
+			writeSamples(w, "invoke_trigger_invocations_total", "counter", "Invocations started by cron, queue and custom triggers.", invocations...)
+			writeSamples(w, "invoke_trigger_failures_total", "counter", "Triggered invocations that were rejected or failed.", failures...)
+		}
+
+		if keys, counts := inv.experimentStats.snapshot(); len(keys) > 0 {
+			var invocations, failures, seconds []metricSample
+			for i, k := range keys {
+				labels := fmt.Sprintf("route=%q,experiment=%q,variant=%q", k.route, k.experiment, k.variant)
+				invocations = append(invocations, metricSample{labels, counts[i].invocations})
+				failures = append(failures, metricSample{labels, counts[i].failures})
+				seconds = append(seconds, metricSample{labels, counts[i].seconds})
+			}
+			writeSamples(w, "invoke_experiment_invocations_total", "counter", "Invocations of each experiment variant.", invocations...)
+			writeSamples(w, "invoke_experiment_failures_total", "counter", "Invocations of each experiment variant that failed.", failures...)
+			writeSamples(w, "invoke_experiment_duration_seconds_total", "counter", "Time spent invoking each experiment variant.", seconds...)
+		}
+
+		if prober != nil {
+			_, routes := prober.Status()
+			var up, latency, failures []metricSample
+			for _, name := range sortedRoutes(routes) {
+				st := routes[name]
+				labels := "route=" + strconv.Quote(name)
+				ok := 0
+				if st.OK {
+					ok = 1
+				}
+				up = append(up, metricSample{labels, ok})
+				latency = append(latency, metricSample{labels, st.Latency.Seconds()})
+				failures = append(failures, metricSample{labels, st.Failures})
+			}
+			writeSamples(w, "invoke_probe_up", "gauge", "Whether the last health probe of the route succeeded.", up...)
+			writeSamples(w, "invoke_probe_duration_seconds", "gauge", "Duration of the last health probe.", latency...)
+			writeSamples(w, "invoke_probe_failures_total", "counter", "Failed health probes.", failures...)
+		}
+
+		if deps != nil {
+			_, routes := deps.Status()
+			var up []metricSample
+			for _, name := range sortedRoutes(routes) {
+				for _, st := range routes[name] {
+					labels := fmt.Sprintf("route=%q,kind=%q,name=%q", name, st.Kind, st.Name)
+					ok := 0
+					if st.OK {
+						ok = 1
+					}
+					up = append(up, metricSample{labels, ok})
+				}
+			}
+			writeSamples(w, "invoke_dependency_up", "gauge", "Whether the last check of a declared dependency succeeded.", up...)
+		}
+	}
+}
+
+func writeMetric(w io.Writer, name, typ, help string, value any) {
+	writeSamples(w, name, typ, help, metricSample{value: value})
+}
+
+func writeSamples(w io.Writer, name, typ, help string, samples ...metricSample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	for _, s := range samples {
+		switch {
+		case metricLabels == "":
+		case s.labels == "":
+			s.labels = metricLabels
+		default:
+			s.labels += "," + metricLabels
+		}
+		if s.labels != "" {
+			fmt.Fprintf(w, "%s{%s} %v\n", name, s.labels, s.value)
+		} else {
+			fmt.Fprintf(w, "%s %v\n", name, s.value)
+		}
+	}
+}
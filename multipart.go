@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxMultipartFieldSize bounds non-file form fields, which are held in
+// memory for the manifest.
+const maxMultipartFieldSize = 1 << 20
+
+// uploadManifest is the payload scripts receive for multipart requests.
+// Files are staged in a temporary directory that is removed once the
+// invocation finishes.
+type uploadManifest struct {
+	Fields map[string][]string `json:"fields"`
+	Files  []uploadedFile      `json:"files"`
+}
+
+type uploadedFile struct {
+	Field       string `json:"field"`
+	Filename    string `json:"filename"`
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+func isMultipart(r *http.Request) bool {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mt == "multipart/form-data"
+}
+
+// stageMultipart streams the file parts of r into a new temporary
+// directory and returns the JSON manifest describing them. The caller
+// removes dir; it is also removed here on error.
+func stageMultipart(r *http.Request, maxSize int64) (manifest []byte, dir string, err error) {
+	if maxSize > 0 {
+		r.Body = http.MaxBytesReader(nil, r.Body, maxSize)
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", err
+	}
+	staging, err := os.MkdirTemp("", "invoke-upload-*")
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(staging)
+		}
+	}()
+
+	m := uploadManifest{Fields: map[string][]string{}, Files: []uploadedFile{}}
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		if part.FileName() == "" {
+			b, err := io.ReadAll(io.LimitReader(part, maxMultipartFieldSize+1))
+			if err != nil {
+				return nil, "", err
+			}
+			if len(b) > maxMultipartFieldSize {
+				return nil, "", fmt.Errorf("field %q too large", part.FormName())
+			}
+			m.Fields[part.FormName()] = append(m.Fields[part.FormName()], string(b))
+			continue
+		}
+
+		// Prefix with the index so identically named files don't collide.
+		name := fmt.Sprintf("%d-%s", len(m.Files), safeFilename(part.FileName()))
+		path := filepath.Join(staging, name)
+		size, err := writeFile(path, part)
+		if err != nil {
+			return nil, "", err
+		}
+		m.Files = append(m.Files, uploadedFile{
+			Field:       part.FormName(),
+			Filename:    part.FileName(),
+			Path:        path,
+			Size:        size,
+			ContentType: part.Header.Get("Content-Type"),
+		})
+	}
+
+	manifest, err = json.Marshal(m)
+	return manifest, staging, err
+}
+
+func writeFile(path string, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// safeFilename reduces a client supplied file name to a harmless base
+// name.
+func safeFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == '/' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "." || name == ".." || name == "" {
+		return "file"
+	}
+	return name
+}
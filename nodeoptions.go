@@ -0,0 +1,183 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	nodeOptionsEnvKey  = "NODE_OPTIONS"
+	compileCacheEnvKey = "NODE_COMPILE_CACHE"
+)
+
+// repeatableNodeOptions may be given several times, so the server's are
+// added to the user's instead of replacing them.
+var repeatableNodeOptions = map[string]bool{
+	"--require":             true,
+	"--import":              true,
+	"--loader":              true,
+	"--experimental-loader": true,
+}
+
+// nodeOptionAliases maps short spellings to the long ones.
+var nodeOptionAliases = map[string]string{"-r": "--require"}
+
+// nodeOptionConflicts remembers the conflicts already warned about, as the
+// environment is composed for every invocation.
+var nodeOptionConflicts sync.Map
+
+// nodeEnv is what the server adds to the environment of every node
+// process: NODE_OPTIONS entries for its features, composed with the
+// NODE_OPTIONS of the server or route environment, and the compile cache.
+// Where both set an option that can't be repeated, the server's wins and
+// the conflict is logged once.
+type nodeEnv struct {
+	options      []string
+	compileCache string
+}
+
+func newNodeEnv(cfg Config) nodeEnv {
+	var n nodeEnv
+	if size := cfg.Limits.MaxOldSpaceSize; size > 0 {
+		n.options = append(n.options, "--max-old-space-size="+strconv.Itoa(size))
+	}
+	for _, m := range cfg.NodeRequire {
+		n.options = append(n.options, "--require="+preloadPath(m))
+	}
+	if cfg.CompileCacheDir != "" {
+		n.compileCache = absPath(cfg.CompileCacheDir)
+	}
+	return n
+}
+
+// preloadPath makes a preloaded file absolute, as scripts may run in
+// their own working directory; package names are left alone.
+func preloadPath(m string) string {
+	if strings.HasPrefix(m, ".") || filepath.IsAbs(m) {
+		return absPath(m)
+	}
+	return m
+}
+
+// readPaths returns what sandboxed scripts must be able to read for the
+// managed options to work.
+func (n nodeEnv) readPaths() []string {
+	var paths []string
+	for _, o := range n.options {
+		if m, ok := strings.CutPrefix(o, "--require="); ok && filepath.IsAbs(m) {
+			paths = append(paths, m)
+		}
+	}
+	if n.compileCache != "" {
+		paths = append(paths, n.compileCache)
+	}
+	return paths
+}
+
+// apply returns env with NODE_OPTIONS composed and the compile cache set.
+// Like exec, it takes the last of repeated variables.
+func (n nodeEnv) apply(env []string) []string {
+	if len(n.options) == 0 && n.compileCache == "" {
+		return env
+	}
+	out := make([]string, 0, len(env)+2)
+	var user string
+	for _, kv := range env {
+		if v, ok := strings.CutPrefix(kv, nodeOptionsEnvKey+"="); ok {
+			user = v
+			continue
+		}
+		out = append(out, kv)
+	}
+	if opts := composeNodeOptions(user, n.options); opts != "" {
+		out = append(out, nodeOptionsEnvKey+"="+opts)
+	}
+	if n.compileCache != "" {
+		out = append(out, compileCacheEnvKey+"="+n.compileCache)
+	}
+	return out
+}
+
+// composeNodeOptions merges the managed options into the user's
+// NODE_OPTIONS value.
+func composeNodeOptions(user string, managed []string) string {
+	set := map[string]string{}
+	for _, o := range managed {
+		name, value := splitNodeOption(o)
+		set[name] = value
+	}
+	var out []string
+	args := splitNodeOptions(user)
+	for i := 0; i < len(args); i++ {
+		name, value := splitNodeOption(args[i])
+		entry := []string{args[i]}
+		// "--require x" is spelled with the value as its own word.
+		if !strings.Contains(args[i], "=") && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+			value = args[i+1]
+			entry = append(entry, value)
+			i++
+		}
+		if managedValue, ok := set[name]; ok && !repeatableNodeOptions[name] {
+			if managedValue != value {
+				msg := strings.Join(entry, " ") + " in " + nodeOptionsEnvKey + " is overridden by " + name + "=" + managedValue
+				if _, warned := nodeOptionConflicts.LoadOrStore(msg, true); !warned {
+					log.Printf("warning: %s", msg)
+				}
+			}
+			continue
+		}
+		out = append(out, entry...)
+	}
+	out = append(out, managed...)
+	for i, o := range out {
+		if strings.ContainsAny(o, " \t\"\\") {
+			out[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(o) + `"`
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// splitNodeOption returns the canonical name of an option and its value.
+func splitNodeOption(o string) (name, value string) {
+	name, value, _ = strings.Cut(o, "=")
+	if long, ok := nodeOptionAliases[name]; ok {
+		name = long
+	}
+	// V8 accepts underscores in its option names.
+	return strings.ReplaceAll(name, "_", "-"), value
+}
+
+// splitNodeOptions splits a NODE_OPTIONS value into words the way node
+// does: on spaces, with double quoted parts kept together.
+func splitNodeOptions(s string) []string {
+	var words []string
+	var word strings.Builder
+	inWord, quoted := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(s):
+			i++
+			word.WriteByte(s[i])
+		case c == '"':
+			quoted = !quoted
+			inWord = true
+		case !quoted && (c == ' ' || c == '\t'):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
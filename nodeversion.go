@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Node version mismatch policies.
+const (
+	nodeVersionFail = "fail"
+	nodeVersionWarn = "warn"
+)
+
+// nodeBinary is the node executable scripts run with unless their route
+// sets a runtime; resolved at startup by findNode.
+var nodeBinary = "node"
+
+// findNode returns the node executable: path when set, a directory-less
+// path being looked up in PATH. Otherwise node from PATH, falling back to
+// the version managers' installs, since servers started by an init system
+// rarely see the PATH a login shell would set up:
+//
+//   - nvm: $NVM_BIN, else the version aliased as default under $NVM_DIR
+//     (~/.nvm), else its newest install
+//   - asdf: the newest install under $ASDF_DATA_DIR (~/.asdf)
+func findNode(path string) (string, error) {
+	if path != "" {
+		return exec.LookPath(path)
+	}
+	if p, err := exec.LookPath("node"); err == nil {
+		return p, nil
+	}
+	home, _ := os.UserHomeDir()
+	var candidates []string
+	if bin := os.Getenv("NVM_BIN"); bin != "" {
+		candidates = append(candidates, filepath.Join(bin, "node"))
+	}
+	nvmDir := envOr("NVM_DIR", filepath.Join(home, ".nvm"))
+	nvmVersions := filepath.Join(nvmDir, "versions", "node")
+	if alias, err := os.ReadFile(filepath.Join(nvmDir, "alias", "default")); err == nil {
+		if v := newestInstall(nvmVersions, strings.TrimSpace(string(alias))); v != "" {
+			candidates = append(candidates, filepath.Join(nvmVersions, v, "bin", "node"))
+		}
+	}
+	if v := newestInstall(nvmVersions, ""); v != "" {
+		candidates = append(candidates, filepath.Join(nvmVersions, v, "bin", "node"))
+	}
+	asdfVersions := filepath.Join(envOr("ASDF_DATA_DIR", filepath.Join(home, ".asdf")), "installs", "nodejs")
+	if v := newestInstall(asdfVersions, ""); v != "" {
+		candidates = append(candidates, filepath.Join(asdfVersions, v, "bin", "node"))
+	}
+	for _, c := range candidates {
+		if p, err := exec.LookPath(c); err == nil {
+			return p, nil
+		}
+	}
+	return "", errors.New("node not found in PATH or nvm and asdf installs")
+}
+
+// envOr returns the value of the environment variable key, or def when
+// it is empty.
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// newestInstall returns the name of the newest version directory in dir
+// matching prefix, e.g. "20" or "v20.11", or "" when there is none.
+func newestInstall(dir, prefix string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	want, _ := parseNodeVersion(prefix)
+	var best string
+	var bestV []int
+	for _, e := range entries {
+		v, err := parseNodeVersion(e.Name())
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		if prefix != "" && (len(want) == 0 || len(v) < len(want) || slices.Compare(v[:len(want)], want) != 0) {
+			continue
+		}
+		if bestV == nil || slices.Compare(v, bestV) > 0 {
+			best, bestV = e.Name(), v
+		}
+	}
+	return best
+}
+
+// nodeVersion runs `node --version` and returns its output, e.g.
+// "v20.11.1".
+func nodeVersion(node string) (string, error) {
+	out, err := exec.Command(node, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("%s --version: %w", node, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// parseNodeVersion parses "v20.11.1", or a prefix of it such as "20",
+// into its numeric components.
+func parseNodeVersion(s string) ([]int, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if s == "" {
+		return nil, errors.New("empty version")
+	}
+	// Drop pre-release and build suffixes, e.g. -nightly.
+	s, _, _ = strings.Cut(s, "-")
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("invalid version %q", s)
+	}
+	v := make([]int, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version %q", s)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+// VersionConstraint is a node version range such as ">=20 <23": comparators
+// separated by spaces must all hold, and alternatives separated by || are
+// tried in turn. A comparator only looks at the components it names, so
+// "<=22" admits 22.9.0 and "20" (or "=20") any 20.x.y.
+type VersionConstraint struct {
+	spec string
+	alts [][]versionComparator
+}
+
+type versionComparator struct {
+	op      string
+	version []int
+}
+
+func parseVersionConstraint(spec string) (*VersionConstraint, error) {
+	c := &VersionConstraint{spec: spec}
+	for alt := range strings.SplitSeq(spec, "||") {
+		var cmps []versionComparator
+		for _, f := range strings.Fields(alt) {
+			op := strings.TrimRight(f, "v0123456789.")
+			switch op {
+			case "", "=", ">", ">=", "<", "<=":
+			default:
+				return nil, fmt.Errorf("invalid comparator %q", f)
+			}
+			v, err := parseNodeVersion(f[len(op):])
+			if err != nil {
+				return nil, err
+			}
+			cmps = append(cmps, versionComparator{op: op, version: v})
+		}
+		if len(cmps) == 0 {
+			return nil, fmt.Errorf("invalid version constraint %q", spec)
+		}
+		c.alts = append(c.alts, cmps)
+	}
+	return c, nil
+}
+
+// Allows reports whether version, as printed by `node --version`,
+// satisfies c.
+func (c *VersionConstraint) Allows(version string) bool {
+	v, err := parseNodeVersion(version)
+	if err != nil {
+		return false
+	}
+	v = append(v, 0, 0, 0)[:3]
+	for _, cmps := range c.alts {
+		if !slices.ContainsFunc(cmps, func(cmp versionComparator) bool { return !cmp.allows(v) }) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cmp versionComparator) allows(v []int) bool {
+	d := slices.Compare(v[:len(cmp.version)], cmp.version)
+	switch cmp.op {
+	case ">":
+		return d > 0
+	case ">=":
+		return d >= 0
+	case "<":
+		return d < 0
+	case "<=":
+		return d <= 0
+	}
+	return d == 0
+}
+
+func (c *VersionConstraint) String() string { return c.spec }
+
+// checkNode verifies the version of the node executable at path against
+// c, which may be nil, and returns the version.
+func checkNode(path string, c *VersionConstraint) (string, error) {
+	version, err := nodeVersion(path)
+	if err != nil {
+		return "", err
+	}
+	if c != nil && !c.Allows(version) {
+		return version, fmt.Errorf("%s is %s, which does not satisfy %q", path, version, c)
+	}
+	return version, nil
+}
+
+// setupNode resolves the server's node executable into nodeBinary and
+// logs its version. A failed check stops the server, or with the warn
+// policy only logs a warning. Without --node-path or
+// --require-node-version, a missing node is only warned about, since
+// routes may set their own runtime.
+func setupNode(cfg Config) {
+	node, err := findNode(cfg.NodePath)
+	if err != nil {
+		if cfg.NodePath == "" && cfg.RequireNodeVersion == nil {
+			log.Printf("warning: %v", err)
+			return
+		}
+		nodeCheckFailed(cfg, err)
+		return
+	}
+	nodeBinary = node
+	version, err := checkNode(node, cfg.RequireNodeVersion)
+	if err != nil {
+		nodeCheckFailed(cfg, err)
+		return
+	}
+	log.Printf("node %s at %s", version, node)
+}
+
+// checkRuntime verifies a route's own runtime like setupNode does the
+// server's, returning the error rather than stopping the server.
+func checkRuntime(cfg Config, route *Route) error {
+	if route.Runtime == "" || cfg.RequireNodeVersion == nil {
+		return nil
+	}
+	_, err := checkNode(route.Runtime, cfg.RequireNodeVersion)
+	if err != nil && cfg.NodeVersionMismatch == nodeVersionWarn {
+		log.Printf("warning: route %s: %v", route.Name, err)
+		return nil
+	}
+	return err
+}
+
+func nodeCheckFailed(cfg Config, err error) {
+	if cfg.NodeVersionMismatch == nodeVersionWarn {
+		log.Printf("warning: %v", err)
+		return
+	}
+	log.Fatal(err)
+}
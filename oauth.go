@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tokenEnvKey is the environment variable scripts read the current
+	// access token from.
+	tokenEnvKey = "OAUTH_ACCESS_TOKEN"
+
+	// tokenRefreshSkew is how long before expiry a token is refreshed.
+	tokenRefreshSkew = time.Minute
+	// tokenRetryInterval is how long to wait after a failed refresh.
+	tokenRetryInterval = 10 * time.Second
+)
+
+// OAuthConfig configures client-credentials token acquisition.
+type OAuthConfig struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       string
+	Audience     string
+	TokenFile    string
+}
+
+func (c OAuthConfig) Enabled() bool {
+	return c.TokenURL != ""
+}
+
+// TokenManager obtains OAuth2 client-credentials tokens and keeps them
+// fresh so scripts can use them without implementing their own caching.
+type TokenManager struct {
+	cfg    OAuthConfig
+	client *http.Client
+
+	mu     sync.RWMutex
+	token  string
+	expiry time.Time
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func NewTokenManager(cfg OAuthConfig) *TokenManager {
+	return &TokenManager{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Start fetches the initial token and refreshes it in the background
+// until ctx is cancelled.
+func (m *TokenManager) Start(ctx context.Context) error {
+	if err := m.refresh(ctx); err != nil {
+		return err
+	}
+	go m.loop(ctx)
+	return nil
+}
+
+func (m *TokenManager) loop(ctx context.Context) {
+	for {
+		wait := m.untilRefresh()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if err := m.refresh(ctx); err != nil {
+			log.Printf("oauth token refresh failed: %v", err)
+		}
+	}
+}
+
+func (m *TokenManager) untilRefresh() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.token == "" {
+		return tokenRetryInterval
+	}
+	d := time.Until(m.expiry) - tokenRefreshSkew
+	if d < tokenRetryInterval {
+		return tokenRetryInterval
+	}
+	return d
+}
+
+// Token returns the current access token, fetching a new one when the
+// cached token has expired.
+func (m *TokenManager) Token(ctx context.Context) (string, error) {
+	m.mu.RLock()
+	tok, exp := m.token, m.expiry
+	m.mu.RUnlock()
+	if tok != "" && time.Now().Before(exp) {
+		return tok, nil
+	}
+	if err := m.refresh(ctx); err != nil {
+		return "", err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.token, nil
+}
+
+func (m *TokenManager) refresh(ctx context.Context) error {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if m.cfg.Scopes != "" {
+		form.Set("scope", strings.Join(strings.FieldsFunc(m.cfg.Scopes, isScopeSep), " "))
+	}
+	if m.cfg.Audience != "" {
+		form.Set("audience", m.cfg.Audience)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(m.cfg.ClientID), url.QueryEscape(m.cfg.ClientSecret))
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("token request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return fmt.Errorf("decode token response: %w", err)
+	}
+	if tr.AccessToken == "" {
+		return errors.New("token response has no access_token")
+	}
+
+	expiry := time.Now().Add(time.Hour)
+	if tr.ExpiresIn > 0 {
+		expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+
+	if m.cfg.TokenFile != "" {
+		if err := writeFileAtomic(m.cfg.TokenFile, []byte(tr.AccessToken), 0o600); err != nil {
+			return fmt.Errorf("write token file: %w", err)
+		}
+	}
+
+	m.mu.Lock()
+	m.token, m.expiry = tr.AccessToken, expiry
+	m.mu.Unlock()
+	return nil
+}
+
+func isScopeSep(r rune) bool {
+	return r == ',' || r == ' '
+}
+
+// writeFileAtomic writes data to a temp file beside path and renames it
+// into place so readers never observe a partial write.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const defaultDedupTTL = 24 * time.Hour
+
+// outboxRecord is the state of a deduplicated queue message, kept in the
+// store's key/value backend under outbox/<route>/<topic>/<id>.
+type outboxRecord struct {
+	// State is claimed while the message is being processed, result once
+	// the output was stored but not yet published, and done after.
+	State  string          `json:"state"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+const (
+	outboxClaimed = "claimed"
+	outboxResult  = "result"
+	outboxDone    = "done"
+)
+
+// handle invokes the route with msg and publishes its output to the
+// result topic, if any. With a dedup key, messages are processed exactly
+// once across redeliveries and servers sharing the store's backend: each
+// is claimed by its key before being invoked, and its output is written
+// to the backend, as an outbox, before being published, so a message
+// whose result was stored but not published is only published again.
+// A failed invocation gives the claim up for a redelivery to retry.
+func (q *queueTrigger) handle(msg []byte) {
+	if q.DedupKey == "" {
+		out, err := q.invoke(msg)
+		if err == nil {
+			q.publish(out)
+		}
+		return
+	}
+	id, ok := dedupID(msg, q.DedupKey)
+	if !ok {
+		log.Printf("route %s: queue %q: message without %s processed without deduplication", q.route, q.Topic, q.DedupKey)
+		out, err := q.invoke(msg)
+		if err == nil {
+			q.publish(out)
+		}
+		return
+	}
+	key := "outbox/" + q.route + "/" + q.Topic + "/" + id
+	kv := q.store.kv
+	claim, _ := json.Marshal(outboxRecord{State: outboxClaimed})
+	_, err := kv.Put(key, claim, q.DedupTTL, true)
+	if errors.Is(err, errKeyExists) {
+		q.redelivered(key, id)
+		return
+	}
+	if err != nil {
+		// Without the claim the message could be processed twice.
+		log.Printf("route %s: queue %q: message %s dropped: outbox: %v", q.route, q.Topic, id, err)
+		return
+	}
+
+	out, err := q.invoke(msg)
+	if err != nil {
+		kv.Delete(key)
+		return
+	}
+	if q.ResultTopic == "" {
+		q.setOutbox(key, outboxRecord{State: outboxDone})
+		return
+	}
+	result, err := compactJSON(out)
+	if err != nil {
+		log.Printf("route %s: queue %q: result of message %s not published: %v", q.route, q.Topic, id, err)
+		q.setOutbox(key, outboxRecord{State: outboxDone})
+		return
+	}
+	if err := q.setOutbox(key, outboxRecord{State: outboxResult, Result: result}); err != nil {
+		return
+	}
+	q.store.Publish(q.ResultTopic, append(result, '\n'))
+	q.setOutbox(key, outboxRecord{State: outboxDone})
+}
+
+// redelivered handles a message whose key was already claimed: its stored
+// result is published if that hadn't happened yet, and it is otherwise
+// skipped.
+func (q *queueTrigger) redelivered(key, id string) {
+	b, err := q.store.kv.Get(key)
+	if err != nil {
+		log.Printf("route %s: queue %q: duplicate message %s skipped: outbox: %v", q.route, q.Topic, id, err)
+		return
+	}
+	var rec outboxRecord
+	if err := json.Unmarshal(b, &rec); err != nil || rec.State != outboxResult || q.ResultTopic == "" {
+		infof("route %s: queue %q: duplicate message %s skipped", q.route, q.Topic, id)
+		return
+	}
+	q.store.Publish(q.ResultTopic, append(rec.Result, '\n'))
+	q.setOutbox(key, outboxRecord{State: outboxDone})
+}
+
+func (q *queueTrigger) setOutbox(key string, rec outboxRecord) error {
+	b, _ := json.Marshal(rec)
+	_, err := q.store.kv.Put(key, b, q.DedupTTL, false)
+	if err != nil {
+		log.Printf("route %s: queue %q: outbox: %v", q.route, q.Topic, err)
+	}
+	return err
+}
+
+// publish sends out to the result topic, if any.
+func (q *queueTrigger) publish(out []byte) {
+	if q.ResultTopic == "" {
+		return
+	}
+	result, err := compactJSON(out)
+	if err != nil {
+		log.Printf("route %s: queue %q: result not published: %v", q.route, q.Topic, err)
+		return
+	}
+	q.store.Publish(q.ResultTopic, append(result, '\n'))
+}
+
+func compactJSON(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, b); err != nil {
+		return nil, fmt.Errorf("output is not JSON: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// dedupID returns the value of the top-level field of msg, a string or a
+// number, identifying it for deduplication.
+func dedupID(msg []byte, field string) (string, bool) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(msg, &fields) != nil {
+		return "", false
+	}
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(fields[field]))
+	dec.UseNumber()
+	if dec.Decode(&v) != nil {
+		return "", false
+	}
+	switch v := v.(type) {
+	case string:
+		return v, v != ""
+	case json.Number:
+		return v.String(), true
+	}
+	return "", false
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// installTimeout bounds how long npm may take to install packages.
+const installTimeout = 10 * time.Minute
+
+// installPackages installs the dependencies declared by the package.json at
+// manifest into a node_modules directory managed below dir, so images
+// don't need their own install step, and returns its path. Scripts find
+// the packages through NODE_PATH.
+//
+// The install is keyed by the contents of package.json and the
+// package-lock.json next to it: a restart with unchanged files reuses the
+// previous install, and a change installs afresh beside it. With a
+// lockfile, npm ci installs exactly the locked versions and fails when the
+// lockfile doesn't match package.json; without one, npm install resolves
+// the versions, with a warning. Dev dependencies are left out. npm's output
+// is logged and kept in install.log next to node_modules.
+//
+// npm runs in a copy of the two files, so file: dependencies must be
+// absolute paths.
+func installPackages(manifest, dir string) (string, error) {
+	pkg, err := os.ReadFile(manifest)
+	if err != nil {
+		return "", err
+	}
+	lock, err := os.ReadFile(filepath.Join(filepath.Dir(manifest), "package-lock.json"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	if dir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return "", fmt.Errorf("no --packages-dir and %v", err)
+		}
+		dir = filepath.Join(cache, "go-invoke-node", "packages")
+	}
+	sum := sha256.Sum256([]byte(string(pkg) + "\x00" + string(lock)))
+	target := filepath.Join(dir, hex.EncodeToString(sum[:8]))
+	modules := filepath.Join(target, "node_modules")
+	if _, err := os.Stat(modules); err == nil {
+		log.Printf("packages: using the install in %s", target)
+		return modules, nil
+	}
+
+	npm, err := findNPM()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	// Installs happen in a scratch directory renamed into place once
+	// complete, so an interrupted one is never reused.
+	tmp, err := os.MkdirTemp(dir, ".install-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.WriteFile(filepath.Join(tmp, "package.json"), pkg, 0o644); err != nil {
+		return "", err
+	}
+	args := []string{"ci", "--omit=dev", "--no-audit", "--no-fund"}
+	if lock == nil {
+		log.Printf("packages: warning: no package-lock.json next to %s, versions aren't locked", manifest)
+		args[0] = "install"
+	} else if err := os.WriteFile(filepath.Join(tmp, "package-lock.json"), lock, 0o644); err != nil {
+		return "", err
+	}
+	logFile, err := os.Create(filepath.Join(tmp, "install.log"))
+	if err != nil {
+		return "", err
+	}
+	defer logFile.Close()
+
+	log.Printf("packages: running npm %s for %s", strings.Join(args, " "), manifest)
+	start := time.Now()
+	cmd := exec.Command(npm, args...)
+	cmd.Dir = tmp
+	cmd.Stdout = io.MultiWriter(logFile, logWriter("npm: "))
+	cmd.Stderr = cmd.Stdout
+	cmd.WaitDelay = orphanWaitDelay
+	timer := time.AfterFunc(installTimeout, func() { cmd.Process.Kill() })
+	err = cmd.Run()
+	timer.Stop()
+	if err != nil {
+		return "", fmt.Errorf("npm %s: %v", args[0], err)
+	}
+
+	if err := os.Rename(tmp, target); err != nil {
+		// Another server sharing dir may have finished the same install
+		// first.
+		if _, serr := os.Stat(modules); serr != nil {
+			return "", err
+		}
+	}
+	log.Printf("packages: installed into %s in %s", target, time.Since(start).Round(time.Millisecond))
+	return modules, nil
+}
+
+// findNPM returns the npm next to the node scripts run with, or else npm
+// from PATH.
+func findNPM() (string, error) {
+	if filepath.IsAbs(nodeBinary) {
+		if p := filepath.Join(filepath.Dir(nodeBinary), "npm"); fileExists(p) {
+			return p, nil
+		}
+	}
+	return exec.LookPath("npm")
+}
+
+func fileExists(p string) bool {
+	info, err := os.Stat(p)
+	return err == nil && !info.IsDir()
+}
+
+// prependNodePath makes the packages in modules resolvable from every
+// script, ahead of any NODE_PATH the server was started with.
+func prependNodePath(modules string) {
+	if prev := os.Getenv("NODE_PATH"); prev != "" {
+		modules += string(os.PathListSeparator) + prev
+	}
+	os.Setenv("NODE_PATH", modules)
+}
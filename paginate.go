@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// page selects a slice of an array result, requested with
+// ?limit=N&offset=M or with the opaque ?cursor= returned by a previous
+// page.
+type page struct {
+	Limit  int `json:"l"`
+	Offset int `json:"o"`
+}
+
+// pageEnvelope wraps a page of an array result.
+type pageEnvelope struct {
+	Items      []json.RawMessage `json:"items"`
+	Total      int               `json:"total"`
+	Offset     int               `json:"offset"`
+	Limit      int               `json:"limit"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+// requestPage parses the pagination parameters of r; it returns nil when
+// the client didn't ask for a page.
+func requestPage(r *http.Request) (*page, error) {
+	q := r.URL.Query()
+	if c := q.Get("cursor"); c != "" {
+		b, err := base64.RawURLEncoding.DecodeString(c)
+		if err != nil {
+			return nil, errors.New("invalid cursor")
+		}
+		var p page
+		if err := json.Unmarshal(b, &p); err != nil || p.Limit <= 0 || p.Offset < 0 {
+			return nil, errors.New("invalid cursor")
+		}
+		return &p, nil
+	}
+
+	if q.Get("limit") == "" {
+		if q.Get("offset") != "" {
+			return nil, errors.New("offset requires limit")
+		}
+		return nil, nil
+	}
+	p := &page{}
+	var err error
+	if p.Limit, err = strconv.Atoi(q.Get("limit")); err != nil || p.Limit <= 0 {
+		return nil, errors.New("limit must be a positive integer")
+	}
+	if v := q.Get("offset"); v != "" {
+		if p.Offset, err = strconv.Atoi(v); err != nil || p.Offset < 0 {
+			return nil, errors.New("offset must be a non-negative integer")
+		}
+	}
+	return p, nil
+}
+
+// apply returns the requested page of out, a JSON array, in a
+// pageEnvelope with fields applied to each item. Output that isn't an
+// array is only filtered.
+func (p *page) apply(out []byte, fields fieldSet) []byte {
+	var items []json.RawMessage
+	if err := json.Unmarshal(out, &items); err != nil {
+		return fields.filterOutput(out)
+	}
+
+	start := min(p.Offset, len(items))
+	// Limits near MaxInt would overflow start+Limit.
+	end := start + min(p.Limit, len(items)-start)
+	env := pageEnvelope{
+		Items:  make([]json.RawMessage, 0, end-start),
+		Total:  len(items),
+		Offset: p.Offset,
+		Limit:  p.Limit,
+	}
+	for _, item := range items[start:end] {
+		env.Items = append(env.Items, bytes.TrimSpace(fields.filterOutput(item)))
+	}
+	if end < len(items) {
+		b, _ := json.Marshal(page{Limit: p.Limit, Offset: end})
+		env.NextCursor = base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(env)
+	return buf.Bytes()
+}
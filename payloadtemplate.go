@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"text/template"
+	"time"
+)
+
+// PayloadTemplate reshapes a route's payload right before it is written to
+// the script, so scripts expecting an envelope can be served unchanged:
+//
+//	payload_template: |
+//	  {"event": {{.Body}}, "meta": {"route": {{json .Route}}, "receivedAt": {{json .Now}}}}
+//
+// Validation, caching, idempotency and dead letters all see the payload as
+// the client sent it; the template is rendered again for every attempt. The
+// result must be JSON. Streamed payloads are passed through untouched.
+type PayloadTemplate struct {
+	tmpl *template.Template
+}
+
+// payloadTemplateData is what a payload template is executed with.
+type payloadTemplateData struct {
+	// Body is the JSON payload, to be inserted as is.
+	Body      string
+	Route     string
+	RequestID string
+	Tenant    string
+	Trigger   string
+	// Claims are the forwarded claims of the caller's JWT, if any.
+	Claims map[string]any
+	// Now is the current time in RFC 3339 format.
+	Now string
+}
+
+var payloadTemplateFuncs = template.FuncMap{
+	// json encodes a value, e.g. to quote a string.
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func ParsePayloadTemplate(name, text string) (*PayloadTemplate, error) {
+	t, err := template.New(name).Option("missingkey=error").Funcs(payloadTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &PayloadTemplate{t}, nil
+}
+
+// render returns the payload call's script receives.
+func (p *PayloadTemplate) render(call Invocation) ([]byte, error) {
+	var buf bytes.Buffer
+	err := p.tmpl.Execute(&buf, payloadTemplateData{
+		Body:      string(call.Payload),
+		Route:     call.Route.Name,
+		RequestID: call.Request.ID,
+		Tenant:    call.Request.Tenant,
+		Trigger:   call.Request.Trigger,
+		Claims:    call.Request.Claims,
+		Now:       time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("payload template: %w", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("payload template: output is not JSON: %.200s", buf.Bytes())
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// pipelineStageHeader names the failed stage of a pipeline in error
+// responses.
+const pipelineStageHeader = "X-Pipeline-Stage"
+
+// PipelineStageConfig is a stage of a pipeline route: the route whose
+// script runs, and a timeout overriding that route's own.
+//
+//	routes:
+//	  etl:
+//	    pipeline:
+//	      - route: extract
+//	        timeout: 30s
+//	      - route: transform
+//	      - route: load
+//
+// Like shell pipes, each stage's output is the next one's input, unchanged;
+// the last stage's output, status and headers are the response. Stages run
+// with the settings of their routes, such as env, runtime, sandbox, retry
+// and persistent workers, and are cached like them; the pipeline route's
+// schema, transforms, auth and tenant apply to the requests it serves, and
+// its timeout, when set, bounds the whole pipeline.
+type PipelineStageConfig struct {
+	Route   string        `yaml:"route"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// PipelineStage is a built PipelineStageConfig.
+type PipelineStage struct {
+	Route *Route
+	// Timeout overrides the per-attempt timeout of Route when set.
+	Timeout time.Duration
+}
+
+// stageError is the failure of a stage of a pipeline.
+type stageError struct {
+	// stage counts from 1.
+	stage int
+	route string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return fmt.Sprintf("pipeline stage %d (%s): %v", e.stage, e.route, e.err)
+}
+
+func (e *stageError) Unwrap() error { return e.err }
+
+func buildPipeline(stages []PipelineStageConfig, decls map[string]RouteConfig, routes map[string]*Route) ([]PipelineStage, error) {
+	if len(stages) < 2 {
+		return nil, errors.New("must have at least two stages")
+	}
+	out := make([]PipelineStage, len(stages))
+	for i, sc := range stages {
+		target, ok := routes[sc.Route]
+		if !ok {
+			return nil, fmt.Errorf("stage %d: unknown route %q", i+1, sc.Route)
+		}
+		if len(decls[sc.Route].Rules) > 0 || !target.hasScript() {
+			return nil, fmt.Errorf("stage %d: route %q must run a script and have no rules of its own", i+1, sc.Route)
+		}
+		if target.Webhook != nil {
+			return nil, fmt.Errorf("stage %d: route %q is a webhook", i+1, sc.Route)
+		}
+		if sc.Timeout < 0 {
+			return nil, fmt.Errorf("stage %d: timeout must not be negative", i+1)
+		}
+		out[i] = PipelineStage{Route: target, Timeout: sc.Timeout}
+	}
+	return out, nil
+}
+
+// runPipeline runs the stages of call's pipeline route in turn, each with
+// the previous one's output as payload. It returns the last stage's result
+// or, wrapped in a stageError, the first failure.
+func (inv *Invoker) runPipeline(ctx context.Context, call Invocation) (*Result, error) {
+	if call.Route.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, call.Route.Timeout)
+		defer cancel()
+	}
+	stages := call.Route.Pipeline
+	res := &Result{}
+	for i, stage := range stages {
+		sc := call
+		sc.Route = stage.Route
+		sc.Timeout = stage.Timeout
+		if i > 0 {
+			sc.Payload, sc.Stdin, sc.ReadPaths = res.Stdout, nil, nil
+		}
+		if i < len(stages)-1 {
+			sc.Stdout = nil
+		}
+		if stage.Route.disabled.Load() {
+			return &Result{}, &stageError{stage: i + 1, route: stage.Route.Name, err: errRouteDisabled}
+		}
+		var err error
+		if res, err = inv.invoke(ctx, sc); err != nil {
+			return res, &stageError{stage: i + 1, route: stage.Route.Name, err: err}
+		}
+		if i < len(stages)-1 && res.Truncated {
+			return res, &stageError{stage: i + 1, route: stage.Route.Name, err: errors.New("output truncated at the output limit")}
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// stdinScript runs a JavaScript expression of the JSON payload p and
+// writes its value as the output.
+func stdinScript(expr string) string {
+	return `let d = ''; process.stdin.on('data', c => d += c).on('end', () => { const p = JSON.parse(d); process.stdout.write(JSON.stringify(` + expr + `)) })`
+}
+
+func TestBuildPipeline(t *testing.T) {
+	const stages = `
+routes:
+  a:
+    script: "0"
+  b:
+    script: "0"
+  router:
+    rules:
+      - header: X-Kind
+        value: a
+        route: a
+  hook:
+    script: "0"
+    webhook:
+      preset: github
+      secret_env: WEBHOOK_SECRET
+`
+	t.Setenv("WEBHOOK_SECRET", "s")
+	tests := []struct {
+		name     string
+		pipeline string
+		wantErr  string
+	}{
+		{"valid", "[{route: a, timeout: 1s}, {route: b}]", ""},
+		{"one stage", "[{route: a}]", "at least two stages"},
+		{"unknown route", "[{route: a}, {route: c}]", `stage 2: unknown route "c"`},
+		{"rules", "[{route: router}, {route: a}]", "must run a script"},
+		{"pipeline", "[{route: a}, {route: etl}]", "must run a script"},
+		{"webhook", "[{route: a}, {route: hook}]", "is a webhook"},
+		{"negative timeout", "[{route: a}, {route: b, timeout: -1s}]", "timeout must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fc FileConfig
+			if err := yaml.Unmarshal([]byte(stages+"  etl:\n    pipeline: "+tt.pipeline+"\n"), &fc); err != nil {
+				t.Fatal(err)
+			}
+			routes, err := fc.BuildRoutes(t.TempDir())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, rt := range routes {
+					if rt.Name == "etl" && (len(rt.Pipeline) != 2 || rt.Pipeline[0].Timeout != time.Second) {
+						t.Errorf("stages = %+v", rt.Pipeline)
+					}
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("BuildRoutes = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPipelineRoutes(t *testing.T) {
+	config := `
+routes:
+  double:
+    script: "` + strings.ReplaceAll(stdinScript("p * 2"), `"`, `\"`) + `"
+  inc:
+    script: "` + strings.ReplaceAll(stdinScript("p + 1"), `"`, `\"`) + `"
+  fail:
+    script: "process.exit(3)"
+  slow:
+    script: "setTimeout(() => process.stdout.write('1'), 2000)"
+  etl:
+    pipeline:
+      - route: double
+      - route: inc
+      - route: double
+  broken:
+    pipeline:
+      - route: double
+      - route: fail
+      - route: inc
+  stalled:
+    pipeline:
+      - route: double
+      - route: slow
+        timeout: 100ms
+`
+	s := newRouteTest(t, map[string]string{"config.yaml": config}, nil)
+
+	w := serveTest(t, s, "/invoke/etl", `3`, nil)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "14" {
+		t.Errorf("etl(3) = %d %s, want 14", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantStage  string
+	}{
+		{"/invoke/broken", http.StatusInternalServerError, "2"},
+		// The stage's timeout overrides its route's.
+		{"/invoke/stalled", http.StatusGatewayTimeout, "2"},
+	}
+	for _, tt := range tests {
+		started := time.Now()
+		w := serveTest(t, s, tt.path, `3`, nil)
+		if w.Code != tt.wantStatus || w.Header().Get(pipelineStageHeader) != tt.wantStage {
+			t.Errorf("%s = %d with stage %q, want %d in stage %s", tt.path, w.Code, w.Header().Get(pipelineStageHeader), tt.wantStatus, tt.wantStage)
+		}
+		if elapsed := time.Since(started); elapsed > time.Second {
+			t.Errorf("%s took %v", tt.path, elapsed)
+		}
+	}
+}
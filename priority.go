@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// priorityHeader lets a request override its route's priority.
+const priorityHeader = "X-Invoke-Priority"
+
+// Priority orders invocations waiting for a concurrency slot: once a limit
+// is reached, freed slots go to waiting high priority invocations first,
+// then normal, then low ones, each in arrival order. Running invocations
+// are never interrupted. The zero value is normal.
+type Priority int8
+
+const (
+	priorityLow    Priority = -1
+	priorityNormal Priority = 0
+	priorityHigh   Priority = 1
+)
+
+// priorities lists every priority, highest first, in the order limiters
+// serve their queues.
+var priorities = [...]Priority{priorityHigh, priorityNormal, priorityLow}
+
+// queue returns the index of p in priorities.
+func (p Priority) queue() int {
+	return int(priorityHigh - p)
+}
+
+func (p Priority) String() string {
+	switch p {
+	case priorityHigh:
+		return "high"
+	case priorityLow:
+		return "low"
+	}
+	return "normal"
+}
+
+func parsePriority(s string) (Priority, error) {
+	switch s {
+	case "high":
+		return priorityHigh, nil
+	case "normal", "":
+		return priorityNormal, nil
+	case "low":
+		return priorityLow, nil
+	}
+	return 0, fmt.Errorf("unknown priority %q, want high, normal or low", s)
+}
+
+// requestPriority returns the priority of r's invocations of route: the
+// X-Invoke-Priority header, or else the route's. Only callers that passed
+// the route's auth or tenant key may set the header, unless
+// --trust-priority-header is set, so anonymous callers can't jump ahead
+// of latency-sensitive routes; the header of others is ignored.
+func requestPriority(r *http.Request, route *Route, opts handlerOptions) (Priority, error) {
+	v := r.Header.Get(priorityHeader)
+	if v == "" || !opts.TrustPriorityHeader && !authenticated(r) {
+		return route.Priority, nil
+	}
+	p, err := parsePriority(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", priorityHeader, err)
+	}
+	return p, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Prober periodically runs a synthetic invocation of each route so
+// script-level breakage, such as expired credentials or a dead downstream,
+// shows up in readiness and metrics before users hit it.
+type Prober struct {
+	inv      *Invoker
+	interval time.Duration
+	payload  []byte
+
+	mu     sync.Mutex
+	status map[string]*probeStatus
+}
+
+// probeStatus is the outcome of the most recent probes of one route.
+type probeStatus struct {
+	OK        bool          `json:"ok"`
+	Error     string        `json:"error,omitempty"`
+	Latency   time.Duration `json:"latency_ns"`
+	LastRun   time.Time     `json:"last_run"`
+	Successes int64         `json:"successes"`
+	Failures  int64         `json:"failures"`
+}
+
+func NewProber(inv *Invoker, interval time.Duration, payload []byte) *Prober {
+	return &Prober{
+		inv:      inv,
+		interval: interval,
+		payload:  payload,
+		status:   map[string]*probeStatus{},
+	}
+}
+
+// Add starts probing route until ctx is done. The route counts as not
+// ready until its first probe succeeds, unless it replaces a route of the
+// same name on reload, which keeps that one's status meanwhile.
+func (p *Prober) Add(ctx context.Context, route *Route) {
+	p.mu.Lock()
+	if p.status[route.Name] == nil {
+		p.status[route.Name] = &probeStatus{}
+	}
+	p.mu.Unlock()
+
+	go func() {
+		t := time.NewTicker(p.interval)
+		defer t.Stop()
+		for {
+			p.probe(ctx, route)
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// Remove stops counting the route name, whose probes were stopped.
+func (p *Prober) Remove(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.status, name)
+}
+
+func (p *Prober) probe(ctx context.Context, route *Route) {
+	start := time.Now()
+	res, err := p.inv.Invoke(ctx, Invocation{Route: route, Payload: p.payload, NoCache: true, NoDeadLetter: true, NoAudit: true})
+	latency := time.Since(start)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := p.status[route.Name]
+	if st == nil || ctx.Err() != nil {
+		// The route was removed or replaced meanwhile.
+		return
+	}
+	if st.OK && err != nil {
+		log.Printf("probe of %s failing: %v, stderr: %s", route.Name, err, res.Stderr)
+	} else if !st.OK && err == nil && st.Failures > 0 {
+		log.Printf("probe of %s recovered", route.Name)
+	}
+	st.OK, st.Latency, st.LastRun, st.Error = err == nil, latency, start, ""
+	if err != nil {
+		st.Failures++
+		st.Error = firstLine(string(res.Stderr), err.Error())
+	} else {
+		st.Successes++
+	}
+}
+
+// Status returns a snapshot of every route's probe status and whether all
+// of them are passing.
+func (p *Prober) Status() (ready bool, routes map[string]probeStatus) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ready = true
+	routes = make(map[string]probeStatus, len(p.status))
+	for name, st := range p.status {
+		routes[name] = *st
+		ready = ready && st.OK
+	}
+	return ready, routes
+}
+
+// makeReadyHandler serves GET /readyz: 200 while every probe and
+// dependency check passes, 503 with the details otherwise. Without probes
+// or declared dependencies the server is always ready.
+func makeReadyHandler(p *Prober, deps *DependencyChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ready := true
+		body := map[string]any{}
+		if p != nil {
+			ok, routes := p.Status()
+			ready = ready && ok
+			body["routes"] = routes
+		}
+		if deps != nil {
+			ok, routes := deps.Status()
+			ready = ready && ok
+			body["dependencies"] = routes
+		}
+		body["ready"] = ready
+
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, body)
+	}
+}
+
+// sortedRoutes returns the keys of a per-route map in order, for stable
+// metrics output.
+func sortedRoutes[V any](routes map[string]V) []string {
+	names := make([]string, 0, len(routes))
+	for name := range routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
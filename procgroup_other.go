@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.WaitDelay = orphanWaitDelay
+}
+
+func killProcessGroup(p *os.Process) error { return p.Kill() }
+
+func reapProcessGroup(p *os.Process) {}
@@ -0,0 +1,54 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// setProcessGroup starts cmd in a process group of its own, led by the
+// node process, and makes canceling cmd kill the whole group so children
+// the script spawned don't outlive a timeout.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.Cancel = func() error { return killProcessGroup(cmd.Process) }
+	cmd.WaitDelay = orphanWaitDelay
+}
+
+// killProcessGroup kills the process group led by p.
+func killProcessGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
+
+// reapProcessGroup kills whatever is left of the group led by p after p
+// exited, until the group is gone. Stragglers reparented to this process,
+// as happens when it runs as PID 1 in a container, are reaped too.
+func reapProcessGroup(p *os.Process) {
+	deadline := time.Now().Add(reapTimeout)
+	for {
+		if err := syscall.Kill(-p.Pid, syscall.SIGKILL); errors.Is(err, syscall.ESRCH) {
+			return
+		}
+		for {
+			// Only the group's members are waited for, so exec.Cmd.Wait
+			// of other invocations isn't raced.
+			pid, err := syscall.Wait4(-p.Pid, nil, syscall.WNOHANG, nil)
+			if pid <= 0 || err != nil {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			log.Printf("process group %d still has members %s after SIGKILL", p.Pid, reapTimeout)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
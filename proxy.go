@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// RouteProxy sends a route's outbound HTTP(S) calls through a forward
+// proxy, such as a corporate one, by setting HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY for its script; Direct instead clears whatever proxy the server
+// environment names, for scripts that only reach internal services. Like
+// the egress proxy, it covers clients honoring those variables, which
+// includes node's fetch when NODE_USE_ENV_PROXY=1 is set, as it is here.
+// With the egress proxy enabled, the egress proxy forwards the calls
+// through it.
+type RouteProxy struct {
+	HTTP    string   `yaml:"http"`
+	HTTPS   string   `yaml:"https"`
+	NoProxy []string `yaml:"no_proxy"`
+	Direct  bool     `yaml:"direct"`
+}
+
+func (p *RouteProxy) validate() error {
+	if p.Direct {
+		if p.HTTP != "" || p.HTTPS != "" || len(p.NoProxy) > 0 {
+			return errors.New("direct excludes http, https and no_proxy")
+		}
+		return nil
+	}
+	if p.HTTP == "" && p.HTTPS == "" {
+		return errors.New("must set http, https or direct")
+	}
+	for _, raw := range []string{p.HTTP, p.HTTPS} {
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			return err
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%q is not an http(s) proxy URL", raw)
+		}
+	}
+	return nil
+}
+
+// env returns the proxy variables of the route's script, in both the
+// upper and lower case spellings clients look for.
+func (p *RouteProxy) env() []string {
+	if p.Direct {
+		return []string{"HTTP_PROXY=", "http_proxy=", "HTTPS_PROXY=", "https_proxy=", "NO_PROXY=", "no_proxy="}
+	}
+	noProxy := strings.Join(p.NoProxy, ",")
+	return []string{
+		"HTTP_PROXY=" + p.HTTP, "http_proxy=" + p.HTTP,
+		"HTTPS_PROXY=" + p.HTTPS, "https_proxy=" + p.HTTPS,
+		"NO_PROXY=" + noProxy, "no_proxy=" + noProxy,
+		"NODE_USE_ENV_PROXY=1",
+	}
+}
+
+// upstream returns the proxy a request to u goes through, nil meaning
+// none.
+func (p *RouteProxy) upstream(u *url.URL) (*url.URL, error) {
+	if p == nil || p.Direct {
+		return nil, nil
+	}
+	cfg := httpproxy.Config{HTTPProxy: p.HTTP, HTTPSProxy: p.HTTPS, NoProxy: strings.Join(p.NoProxy, ",")}
+	return cfg.ProxyFunc()(u)
+}
+
+// dialConnect opens a tunnel to addr through the proxy at proxyURL.
+func dialConnect(proxyURL *url.URL, addr string, timeout time.Duration) (net.Conn, *bufio.Reader, error) {
+	host := proxyURL.Host
+	if proxyURL.Port() == "" {
+		host = net.JoinHostPort(proxyURL.Hostname(), map[string]string{"http": "80", "https": "443"}[proxyURL.Scheme])
+	}
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if proxyURL.Scheme == "https" {
+		tc := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = tc
+	}
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: http.Header{}}
+	if u := proxyURL.User; u != nil {
+		pass, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pass)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, nil, fmt.Errorf("proxy %s: CONNECT %s: %s", proxyURL.Host, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, br, nil
+}
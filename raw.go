@@ -0,0 +1,38 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path"
+)
+
+// contentTypeEnvKey tells scripts in raw mode the Content-Type of the
+// body on their stdin.
+const contentTypeEnvKey = "INVOKE_CONTENT_TYPE"
+
+// rawRequest reports whether the body of r is piped to the script as-is:
+// always for raw routes, and otherwise when its media type matches one of
+// the configured raw content types.
+func rawRequest(r *http.Request, route *Route, opts handlerOptions) bool {
+	if route.Raw {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, pattern := range opts.RawContentTypes {
+		if ok, _ := path.Match(pattern, mt); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// rawResponseType returns the Content-Type of raw output for the route.
+func (rt *Route) rawResponseType(fallback string) string {
+	if rt.ContentType != "" {
+		return rt.ContentType
+	}
+	return fallback
+}
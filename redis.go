@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// redisKeyPrefix namespaces the server's keys in a shared database;
+	// each store's are below invoke:<namespace>:.
+	redisKeyPrefix = "invoke:"
+	redisTimeout   = 5 * time.Second
+	redisMaxIdle   = 8
+)
+
+// redisKV is a KVBackend on a Redis server (6.2 or newer), speaking RESP
+// over a small pool of connections. Key limits are left to the server's
+// maxmemory policy.
+type redisKV struct {
+	// prefix is put before every key.
+	prefix   string
+	addr     string
+	user     string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func newRedisKV(u *url.URL, namespace string) (*redisKV, error) {
+	r := &redisKV{prefix: redisKeyPrefix + namespace + ":", addr: u.Host}
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		r.user = u.User.Username()
+		r.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+		r.db = n
+	}
+	if _, err := r.do("PING"); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *redisKV) Get(key string) ([]byte, error) {
+	v, err := r.do("GET", r.prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, errKeyNotFound
+	}
+	return v.([]byte), nil
+}
+
+func (r *redisKV) Put(key string, value []byte, ttl time.Duration, create bool) (bool, error) {
+	args := []string{"SET", r.prefix + key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	}
+	if create {
+		v, err := r.do(append(args, "NX")...)
+		if err != nil {
+			return false, err
+		}
+		if v == nil {
+			return false, errKeyExists
+		}
+		return true, nil
+	}
+	// GET returns the previous value, telling creation from update.
+	old, err := r.do(append(args, "GET")...)
+	if err != nil {
+		return false, err
+	}
+	return old == nil, nil
+}
+
+func (r *redisKV) Delete(key string) error {
+	_, err := r.do("DEL", r.prefix+key)
+	return err
+}
+
+// Len counts the keys with SCAN, so it is linear in the size of the
+// database.
+func (r *redisKV) Len() (int, error) {
+	n := 0
+	err := r.scan("", func(string) { n++ })
+	return n, err
+}
+
+// Keys lists the keys with SCAN, so it is linear in the size of the
+// database.
+func (r *redisKV) Keys(prefix string) ([]string, error) {
+	var keys []string
+	err := r.scan(prefix, func(key string) { keys = append(keys, key) })
+	return keys, err
+}
+
+// scan calls fn with every key starting with prefix.
+func (r *redisKV) scan(prefix string, fn func(key string)) error {
+	pattern := redisGlobEscaper.Replace(r.prefix+prefix) + "*"
+	cursor := "0"
+	for {
+		v, err := r.do("SCAN", cursor, "MATCH", pattern, "COUNT", "1000")
+		if err != nil {
+			return err
+		}
+		reply, ok := v.([]any)
+		if !ok || len(reply) != 2 {
+			return errors.New("redis: unexpected SCAN reply")
+		}
+		keys, _ := reply[1].([]any)
+		for _, k := range keys {
+			if k, ok := k.([]byte); ok {
+				fn(strings.TrimPrefix(string(k), r.prefix))
+			}
+		}
+		c, _ := reply[0].([]byte)
+		if cursor = string(c); cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+// redisGlobEscaper quotes the characters special in SCAN patterns.
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func (r *redisKV) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range r.idle {
+		c.conn.Close()
+	}
+	r.idle = nil
+	return nil
+}
+
+// do sends one command and returns its reply: nil, string, int64, []byte
+// or []any. Error replies are returned as redisError.
+func (r *redisKV) do(args ...string) (any, error) {
+	c, err := r.conn()
+	if err != nil {
+		return nil, err
+	}
+	v, err := c.roundTrip(args)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		// The connection may be out of sync with the protocol.
+		c.conn.Close()
+		return nil, err
+	}
+	r.release(c)
+	return v, err
+}
+
+func (r *redisKV) conn() (*redisConn, error) {
+	r.mu.Lock()
+	if n := len(r.idle); n > 0 {
+		c := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mu.Unlock()
+		return c, nil
+	}
+	r.mu.Unlock()
+
+	nc, err := net.DialTimeout("tcp", r.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: nc, r: bufio.NewReader(nc)}
+	var setup [][]string
+	if r.password != "" {
+		if r.user != "" {
+			setup = append(setup, []string{"AUTH", r.user, r.password})
+		} else {
+			setup = append(setup, []string{"AUTH", r.password})
+		}
+	}
+	if r.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(r.db)})
+	}
+	for _, cmd := range setup {
+		if _, err := c.roundTrip(cmd); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (r *redisKV) release(c *redisConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.idle) >= redisMaxIdle {
+		c.conn.Close()
+		return
+	}
+	r.idle = append(r.idle, c)
+}
+
+func (c *redisConn) roundTrip(args []string) (any, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			// Errors nested in arrays only come from transactions, which
+			// aren't used.
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a Redis server knowing the commands redisKV sends.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	values   map[string]fakeRedisValue
+	commands [][]string
+	conns    int
+}
+
+type fakeRedisValue struct {
+	value   string
+	expires time.Time
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, password: password, values: map[string]fakeRedisValue{}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns++
+			f.mu.Unlock()
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) url(path string) string {
+	return "redis://" + f.ln.Addr().String() + path
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	authed := f.password == ""
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, args)
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authed = args[len(args)-1] == f.password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		default:
+			reply = f.exec(cmd, args[1:])
+		}
+		f.mu.Unlock()
+		if _, err := io.WriteString(c, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) exec(cmd string, args []string) string {
+	live := func(key string) (fakeRedisValue, bool) {
+		v, ok := f.values[key]
+		if ok && !v.expires.IsZero() && !time.Now().Before(v.expires) {
+			delete(f.values, key)
+			return v, false
+		}
+		return v, ok
+	}
+	bulk := func(v fakeRedisValue, ok bool) string {
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v.value), v.value)
+	}
+	switch cmd {
+	case "PING", "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		return bulk(live(args[0]))
+	case "SET":
+		old, exists := live(args[0])
+		v := fakeRedisValue{value: args[1]}
+		var nx, get bool
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "PX":
+				ms, _ := strconv.Atoi(args[i+1])
+				v.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+				i++
+			case "NX":
+				nx = true
+			case "GET":
+				get = true
+			}
+		}
+		if nx && exists {
+			return "$-1\r\n"
+		}
+		f.values[args[0]] = v
+		if get {
+			return bulk(old, exists)
+		}
+		return "+OK\r\n"
+	case "DEL":
+		_, ok := f.values[args[0]]
+		delete(f.values, args[0])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "SCAN":
+		// Pages of two keys, to exercise the cursor.
+		var keys []string
+		for k := range f.values {
+			if _, ok := live(k); ok && globMatch(args[2], k) {
+				keys = append(keys, k)
+			}
+		}
+		slices.Sort(keys)
+		start, _ := strconv.Atoi(args[0])
+		end, next := min(start+2, len(keys)), strconv.Itoa(start+2)
+		if end == len(keys) {
+			next = "0"
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "*2\r\n$%d\r\n%s\r\n*%d\r\n", len(next), next, end-start)
+		for _, k := range keys[start:end] {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(k), k)
+		}
+		return b.String()
+	}
+	return "-ERR unknown command '" + cmd + "'\r\n"
+}
+
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	var n int
+	if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		var size int
+		if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+// globMatch matches s against a SCAN pattern of literals, backslash
+// escapes, ? and *.
+func globMatch(pattern, s string) bool {
+	for pattern != "" {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		case '\\':
+			pattern = pattern[1:]
+			fallthrough
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
+
+func openTestRedis(t *testing.T, spec, namespace string) KVBackend {
+	t.Helper()
+	kv, err := openStorage(spec, namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { kv.Close() })
+	return kv
+}
+
+func TestRedisKV(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	a := openTestRedis(t, "redis://:secret@"+f.ln.Addr().String()+"/2", "a")
+	b := openTestRedis(t, "redis://:secret@"+f.ln.Addr().String()+"/2", "b")
+
+	if _, err := a.Put("k*", []byte("1"), 0, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Put("kx", []byte("2"), 0, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Put("k*", []byte("3"), 0, true); err != nil {
+		t.Errorf("Put in another namespace: %v", err)
+	}
+	f.mu.Lock()
+	_, stored := f.values["invoke:a:k*"]
+	f.mu.Unlock()
+	if !stored {
+		t.Error("key not stored below invoke:a:")
+	}
+	// Glob characters in prefixes are matched literally.
+	if keys, err := a.Keys("k*"); err != nil || !slices.Equal(keys, []string{"k*"}) {
+		t.Errorf("Keys(k*) = %q, %v, want [k*]", keys, err)
+	}
+
+	f.mu.Lock()
+	var auths, selects int
+	for _, cmd := range f.commands {
+		switch cmd[0] {
+		case "AUTH":
+			auths++
+		case "SELECT":
+			if cmd[1] != "2" {
+				t.Errorf("SELECT %s, want 2", cmd[1])
+			}
+			selects++
+		}
+	}
+	conns := f.conns
+	f.mu.Unlock()
+	// Each connection authenticates and selects the database once, and
+	// is reused for later commands.
+	if auths != conns || selects != conns || conns != 2 {
+		t.Errorf("%d AUTH and %d SELECT on %d connections, want one each on 2", auths, selects, conns)
+	}
+}
+
+func TestRedisKVErrors(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	if _, err := openStorage("redis://:wrong@"+f.ln.Addr().String(), "a"); err == nil {
+		t.Error("wrong password accepted")
+	}
+	if _, err := openStorage(f.url("/x"), "a"); err == nil {
+		t.Error("non-numeric database accepted")
+	}
+
+	kv := openTestRedis(t, "redis://:secret@"+f.ln.Addr().String(), "a").(*redisKV)
+	// Error replies leave the connection usable.
+	if _, err := kv.do("NOPE"); !errors.As(err, new(redisError)) {
+		t.Errorf("unknown command = %v, want a redisError", err)
+	}
+	if _, err := kv.Put("k", []byte("v"), 0, false); err != nil {
+		t.Fatalf("Put after an error reply: %v", err)
+	}
+
+	// A connection the server closed is dropped, not reused.
+	kv.mu.Lock()
+	for _, c := range kv.idle {
+		c.conn.Close()
+	}
+	kv.mu.Unlock()
+	if _, err := kv.Get("k"); err == nil {
+		t.Error("Get on a closed connection succeeded")
+	}
+	if v, err := kv.Get("k"); string(v) != "v" || err != nil {
+		t.Errorf("Get on a new connection = %q, %v, want v", v, err)
+	}
+}
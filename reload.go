@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// routeSet serves the routes of a --config server and replaces them when
+// the config is reloaded, on SIGHUP or POST /admin/reload.
+//
+// Reloads only recycle the routes that changed: those whose declaration,
+// script file, env files, schemas, webhook secret or tenant settings
+// differ, and routes dispatching to them. The others keep their
+// persistent workers, cached results, circuit breakers, queue
+// subscriptions and schedules. Changes to modules a script requires are
+// not noticed.
+//
+// A recycled route's replacement is started, including its persistent
+// worker and warmup invocations, before it takes over, so requests never
+// wait for a cold start; the old route's invocations in flight finish
+// before its worker is stopped. When any route fails to start, the reload
+// is abandoned and the current routes keep serving.
+type routeSet struct {
+	cfg    Config
+	inv    *Invoker
+	store  *Store
+	schema *Schema
+	prober *Prober
+	deps   *DependencyChecker
+	admin  *Admin
+	opts   handlerOptions
+	// ctx bounds the routes' triggers, probes and refreshes.
+	ctx context.Context
+
+	handlers atomic.Pointer[map[string]http.Handler]
+
+	// mu serializes reloads.
+	mu   sync.Mutex
+	live map[string]*liveRoute
+}
+
+// liveRoute is a route being served.
+type liveRoute struct {
+	*Route
+	// ctx ends when the route is replaced or removed.
+	ctx  context.Context
+	stop context.CancelFunc
+}
+
+// reloadReport names the routes a reload kept, recycled, added and
+// removed.
+type reloadReport struct {
+	Kept     []string `json:"kept"`
+	Recycled []string `json:"recycled"`
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Duration string   `json:"duration"`
+}
+
+func (r *reloadReport) String() string {
+	return fmt.Sprintf("%d routes kept, %d recycled, %d added, %d removed in %s",
+		len(r.Kept), len(r.Recycled), len(r.Added), len(r.Removed), r.Duration)
+}
+
+func newRouteSet(ctx context.Context, cfg Config, inv *Invoker, store *Store, schema *Schema, prober *Prober, deps *DependencyChecker, admin *Admin, opts handlerOptions) *routeSet {
+	s := &routeSet{
+		cfg:    cfg,
+		inv:    inv,
+		store:  store,
+		schema: schema,
+		prober: prober,
+		deps:   deps,
+		admin:  admin,
+		opts:   opts,
+		ctx:    ctx,
+		live:   map[string]*liveRoute{},
+	}
+	s.handlers.Store(&map[string]http.Handler{})
+	inv.reloads.enabled = true
+	return s
+}
+
+func (s *routeSet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h, ok := (*s.handlers.Load())[r.URL.Path]; ok {
+		h.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// reloadOnHangup reloads the config on every SIGHUP until ctx is done.
+func (s *routeSet) reloadOnHangup(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		if report, err := s.reload(); err != nil {
+			log.Printf("reload failed, keeping the current routes: %v", err)
+		} else {
+			log.Printf("config reloaded: %s", report)
+		}
+	}
+}
+
+// reload reads the config file again and applies it.
+func (s *routeSet) reload() (*reloadReport, error) {
+	start := time.Now()
+	report, err := s.load()
+	s.inv.reloads.record(report, err, time.Since(start))
+	return report, err
+}
+
+func (s *routeSet) load() (*reloadReport, error) {
+	fc, err := LoadFileConfig(s.cfg.ConfigFile, s.cfg.Profile, s.cfg.StrictConfig)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := fc.BuildRoutes(filepath.Dir(s.cfg.ConfigFile))
+	if err != nil {
+		return nil, err
+	}
+	if len(routes) == 0 {
+		return nil, errors.New("config declares no routes")
+	}
+	return s.apply(routes)
+}
+
+// apply makes routes the ones served, starting those that are new or
+// changed and retiring those they replace.
+func (s *routeSet) apply(routes []*Route) (*reloadReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start := time.Now()
+
+	tenants := map[string]*Tenant{}
+	for _, lr := range s.live {
+		if t := lr.Tenant; t != nil {
+			tenants[t.Name] = t
+		}
+	}
+	report := &reloadReport{Kept: []string{}, Recycled: []string{}, Added: []string{}, Removed: []string{}}
+	next := make(map[string]*liveRoute, len(routes))
+	var started []*liveRoute
+	for _, route := range routes {
+		old := s.live[route.Name]
+		if old != nil && old.revision == route.revision {
+			next[route.Name] = old
+			report.Kept = append(report.Kept, route.Name)
+			continue
+		}
+		if t := route.Tenant; t != nil {
+			// Unchanged tenants keep their rate and quota state.
+			if live := tenants[t.Name]; live != nil && live.revision == t.revision {
+				route.Tenant = live
+			}
+		}
+		lr, err := s.start(route)
+		if err != nil {
+			for _, lr := range started {
+				lr.retire()
+			}
+			return nil, fmt.Errorf("route %s: %w", route.Name, err)
+		}
+		started = append(started, lr)
+		next[route.Name] = lr
+		if old != nil {
+			report.Recycled = append(report.Recycled, route.Name)
+		} else {
+			report.Added = append(report.Added, route.Name)
+		}
+	}
+	// New routes dispatch to the served instance of their targets.
+	for _, lr := range started {
+		for i, rule := range lr.Rules {
+			lr.Rules[i].Target = next[rule.Target.Name].Route
+		}
+		for i, stage := range lr.Pipeline {
+			lr.Pipeline[i].Route = next[stage.Route.Name].Route
+		}
+	}
+
+	var retired []*liveRoute
+	for name, old := range s.live {
+		lr := next[name]
+		if lr == old {
+			continue
+		}
+		// Stop the old route's triggers before the new ones start, so
+		// schedules don't fire twice.
+		old.stop()
+		retired = append(retired, old)
+		if lr == nil {
+			report.Removed = append(report.Removed, name)
+			if s.admin != nil {
+				s.admin.Remove(name)
+			}
+			if s.prober != nil {
+				s.prober.Remove(name)
+			}
+			s.deps.Remove(name)
+			continue
+		}
+		lr.disabled.Store(old.disabled.Load())
+		lr.fault.Store(old.fault.Load())
+		if lr.Materialized != nil && old.Materialized != nil {
+			lr.Materialized.adopt(old.Materialized)
+		}
+		s.inv.breakers.Reset(name)
+	}
+	for _, lr := range started {
+		s.activate(lr)
+	}
+
+	handlers := make(map[string]http.Handler, 2*len(next))
+	var live []*Tenant
+	for _, name := range sortedRoutes(next) {
+		lr := next[name]
+		if t := lr.Tenant; t != nil && !slices.Contains(live, t) {
+			live = append(live, t)
+		}
+		if lr.Triggers != nil && lr.Triggers.DisableHTTP {
+			continue
+		}
+		handlers["/invoke/"+name] = makeInvokeHandler(s.inv, lr.Route, s.opts)
+		// Webhook signatures cover a single delivery, so batching
+		// doesn't apply.
+		if lr.Webhook == nil {
+			handlers["/invoke/batch/"+name] = makeBatchHandler(s.inv, lr.Route, s.opts)
+		}
+	}
+	s.handlers.Store(&handlers)
+	s.inv.tenants.Store(&live)
+	s.live = next
+
+	go s.drain(retired)
+	sort.Strings(report.Removed)
+	report.Duration = time.Since(start).Round(time.Millisecond).String()
+	return report, nil
+}
+
+// start checks route and starts its worker and warmup, without serving it
+// yet.
+func (s *routeSet) start(route *Route) (*liveRoute, error) {
+	if route.Schema == nil {
+		route.Schema = s.schema
+	}
+	if route.Encryption != "" && s.opts.Decrypter == nil {
+		return nil, errors.New("encryption requires --payload-decryption-key-file")
+	}
+	if route.Depends != nil {
+		if missing := route.Depends.missingEnv(route); len(missing) > 0 {
+			return nil, fmt.Errorf("missing required environment variables %v", missing)
+		}
+	}
+	if route.Triggers != nil {
+		if err := checkTriggers(s.inv, s.store, route); err != nil {
+			return nil, err
+		}
+	}
+	if m := route.Materialized; m != nil {
+		if _, err := triggerPayload(s.inv, route, m.cron.payload); err != nil {
+			return nil, fmt.Errorf("materialize: %w", err)
+		}
+	}
+	ctx, stop := context.WithCancel(s.ctx)
+	lr := &liveRoute{Route: route, ctx: ctx, stop: stop}
+	if err := prepareRoute(ctx, s.cfg, s.inv, nil, route); err != nil {
+		stop()
+		return nil, err
+	}
+	return lr, nil
+}
+
+// activate registers a started route and starts its probes and triggers.
+func (s *routeSet) activate(lr *liveRoute) {
+	route := lr.Route
+	if s.admin != nil {
+		s.admin.Add(route)
+	}
+	if route.Depends != nil {
+		// The environment was checked by start.
+		s.deps.Add(route)
+	}
+	if s.prober != nil && route.hasScript() {
+		s.prober.Add(lr.ctx, route)
+	}
+	if route.Triggers != nil {
+		if err := startTriggers(lr.ctx, s.inv, s.store, route); err != nil {
+			log.Printf("route %s: %v", route.Name, err)
+		}
+	}
+	if route.Materialized != nil {
+		if err := startMaterialized(lr.ctx, s.inv, route); err != nil {
+			log.Printf("route %s: %v", route.Name, err)
+		}
+	}
+	if route.Triggers == nil || !route.Triggers.DisableHTTP {
+		log.Printf("route /invoke/%s", route.Name)
+	}
+}
+
+// retire stops the route's triggers and its worker once the invocations
+// in flight finished.
+func (lr *liveRoute) retire() {
+	lr.stop()
+	if lr.worker != nil {
+		lr.worker.Retire()
+	}
+}
+
+// drain retires routes replaced or removed by a reload, recording how long
+// their invocations in flight took to finish.
+func (s *routeSet) drain(routes []*liveRoute) {
+	if len(routes) == 0 {
+		return
+	}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, lr := range routes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lr.retire()
+		}()
+	}
+	wg.Wait()
+	s.inv.reloads.drain.Store(int64(time.Since(start)))
+	infof("%d replaced routes drained in %s", len(routes), time.Since(start).Round(time.Millisecond))
+}
+
+// reloadStats counts reloads for /metrics.
+type reloadStats struct {
+	// enabled is set for --config servers, which can reload.
+	enabled bool
+
+	ok, failed                     atomic.Int64
+	kept, recycled, added, removed atomic.Int64
+	duration, drain                atomic.Int64
+	lastSuccess                    atomic.Int64
+}
+
+func (s *reloadStats) record(report *reloadReport, err error, d time.Duration) {
+	s.duration.Store(int64(d))
+	if err != nil {
+		s.failed.Add(1)
+		return
+	}
+	s.ok.Add(1)
+	s.kept.Add(int64(len(report.Kept)))
+	s.recycled.Add(int64(len(report.Recycled)))
+	s.added.Add(int64(len(report.Added)))
+	s.removed.Add(int64(len(report.Removed)))
+	s.lastSuccess.Store(time.Now().Unix())
+}
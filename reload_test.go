@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const reloadConfig = `
+routes:
+  echo:
+    script: "require(process.env.INVOKE_WORKER_CLIENT)(async p => p)"
+    persistent: true
+  upper:
+    script_file: upper.js
+    persistent: true
+  router:
+    rules:
+      - header: X-Kind
+        value: upper
+        route: upper
+  nightly:
+    script_file: nightly.js
+`
+
+const upperScript = `require(process.env.INVOKE_WORKER_CLIENT)(async p => String(p).toUpperCase())`
+
+// newReloadTest writes the files of a config to a temporary directory and
+// serves it with a routeSet.
+func newReloadTest(t *testing.T, files map[string]string) *routeSet {
+	t.Helper()
+	return newRouteTest(t, files, nil)
+}
+
+// newRouteTest is newReloadTest with setup, when non-nil, configuring the
+// invoker before the routes are loaded.
+func newRouteTest(t *testing.T, files map[string]string, setup func(*Invoker)) *routeSet {
+	t.Helper()
+	if _, err := exec.LookPath("node"); err != nil {
+		t.Skip("node not found")
+	}
+	dir := t.TempDir()
+	writeTestFiles(t, dir, files)
+	cfg := Config{
+		ConfigFile:             filepath.Join(dir, "config.yaml"),
+		Timeout:                5 * time.Second,
+		TimeoutStatus:          defaultTimeoutStatus,
+		WorkerProtocol:         workerProtocolStdio,
+		PersistentReadyTimeout: defaultPersistentReadyTimeout,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	inv := NewInvoker(cfg, nil, nil, nil, nil)
+	if setup != nil {
+		setup(inv)
+	}
+	s := newRouteSet(ctx, cfg, inv, nil, nil, nil, NewDependencyChecker(0), nil, handlerOptions{})
+	t.Cleanup(func() {
+		cancel()
+		for _, lr := range s.live {
+			lr.retire()
+		}
+	})
+	if _, err := s.reload(); err != nil {
+		t.Fatalf("initial load: %v", err)
+	}
+	return s
+}
+
+// serveTest sends a POST of body to the handler s serves at path.
+func serveTest(t *testing.T, s *routeSet, path, body string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	h := (*s.handlers.Load())[path]
+	if h == nil {
+		t.Fatalf("nothing is served at %s", path)
+	}
+	r := httptest.NewRequest("POST", path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func reloadFiles() map[string]string {
+	return map[string]string{
+		"config.yaml": reloadConfig,
+		"upper.js":    upperScript,
+		"nightly.js":  `process.stdout.write("{}")`,
+	}
+}
+
+func TestReloadRecyclesChangedRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes map[string]string
+		want    reloadReport
+	}{{
+		name: "unchanged",
+		want: reloadReport{Kept: []string{"echo", "nightly", "router", "upper"}},
+	}, {
+		name:    "script file changed",
+		changes: map[string]string{"upper.js": upperScript + ";"},
+		// router dispatches to upper.
+		want: reloadReport{Kept: []string{"echo", "nightly"}, Recycled: []string{"router", "upper"}},
+	}, {
+		name: "inline script changed",
+		changes: map[string]string{"config.yaml": strings.Replace(reloadConfig,
+			"async p => p", "async () => ({})", 1)},
+		want: reloadReport{Kept: []string{"nightly", "router", "upper"}, Recycled: []string{"echo"}},
+	}, {
+		name: "declaration changed",
+		changes: map[string]string{"config.yaml": strings.Replace(reloadConfig,
+			"script_file: nightly.js", "script_file: nightly.js\n    timeout: 1s", 1)},
+		want: reloadReport{Kept: []string{"echo", "router", "upper"}, Recycled: []string{"nightly"}},
+	}, {
+		name: "rule changed",
+		changes: map[string]string{"config.yaml": strings.Replace(reloadConfig,
+			"value: upper", "value: shout", 1)},
+		want: reloadReport{Kept: []string{"echo", "nightly", "upper"}, Recycled: []string{"router"}},
+	}, {
+		name: "routes added and removed",
+		changes: map[string]string{"config.yaml": strings.Replace(reloadConfig,
+			"  nightly:\n    script_file: nightly.js\n", "  hourly:\n    script_file: nightly.js\n", 1)},
+		want: reloadReport{Kept: []string{"echo", "router", "upper"}, Added: []string{"hourly"}, Removed: []string{"nightly"}},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newReloadTest(t, reloadFiles())
+			before := maps.Clone(s.live)
+			writeTestFiles(t, filepath.Dir(s.cfg.ConfigFile), tt.changes)
+
+			report, err := s.reload()
+			if err != nil {
+				t.Fatalf("reload: %v", err)
+			}
+			for _, c := range []struct {
+				what      string
+				got, want []string
+			}{
+				{"kept", report.Kept, tt.want.Kept},
+				{"recycled", report.Recycled, tt.want.Recycled},
+				{"added", report.Added, tt.want.Added},
+				{"removed", report.Removed, tt.want.Removed},
+			} {
+				if !slices.Equal(c.got, c.want) && len(c.got)+len(c.want) > 0 {
+					t.Errorf("%s routes = %v, want %v", c.what, c.got, c.want)
+				}
+			}
+
+			for _, name := range tt.want.Kept {
+				old, lr := before[name], s.live[name]
+				if lr != old {
+					t.Errorf("kept route %s was replaced", name)
+					continue
+				}
+				if old.worker != nil && old.worker.ctx.Err() != nil {
+					t.Errorf("kept route %s's worker was stopped", name)
+				}
+			}
+			for _, name := range tt.want.Recycled {
+				old, lr := before[name], s.live[name]
+				if lr == old {
+					t.Errorf("recycled route %s was kept", name)
+					continue
+				}
+				if old.ctx.Err() == nil {
+					t.Errorf("recycled route %s's triggers weren't stopped", name)
+				}
+				if old.worker != nil && lr.worker == old.worker {
+					t.Errorf("recycled route %s kept its worker", name)
+				}
+				// Cached results are keyed by revision, so the old
+				// script's don't answer for the new one.
+				if cacheKey(Invocation{Route: lr.Route}) == cacheKey(Invocation{Route: old.Route}) {
+					t.Errorf("recycled route %s shares cached results with its predecessor", name)
+				}
+			}
+			for _, name := range tt.want.Added {
+				if s.live[name] == nil {
+					t.Errorf("added route %s isn't served", name)
+				}
+			}
+			for _, name := range tt.want.Removed {
+				if s.live[name] != nil {
+					t.Errorf("removed route %s is still served", name)
+				}
+				if before[name].ctx.Err() == nil {
+					t.Errorf("removed route %s's triggers weren't stopped", name)
+				}
+			}
+
+			// Dispatching routes use the served instance of their
+			// targets, whether or not those were recycled.
+			for _, rule := range s.live["router"].Rules {
+				if lr := s.live[rule.Target.Name]; rule.Target != lr.Route {
+					t.Errorf("router dispatches to a retired instance of %s", rule.Target.Name)
+				}
+			}
+			handlers := *s.handlers.Load()
+			for name := range s.live {
+				if handlers["/invoke/"+name] == nil {
+					t.Errorf("route %s has no handler", name)
+				}
+			}
+			if len(handlers) != 2*len(s.live) {
+				t.Errorf("%d handlers for %d routes", len(handlers), len(s.live))
+			}
+		})
+	}
+}
+
+func TestFailedReloadKeepsRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes map[string]string
+		wantErr string
+	}{{
+		name:    "invalid config",
+		changes: map[string]string{"config.yaml": "routes: [\n"},
+		wantErr: "parse",
+	}, {
+		name:    "no routes",
+		changes: map[string]string{"config.yaml": "routes: {}\n"},
+		wantErr: "no routes",
+	}, {
+		name: "unknown rule target",
+		changes: map[string]string{"config.yaml": strings.Replace(reloadConfig,
+			"route: upper", "route: lower", 1)},
+		wantErr: `unknown route "lower"`,
+	}, {
+		// The route starts after echo was already restarted, which
+		// must be undone.
+		name: "route fails to start",
+		changes: map[string]string{
+			"config.yaml": strings.Replace(strings.Replace(reloadConfig,
+				"async p => p", "async () => ({})", 1),
+				"script_file: upper.js", "script_file: upper.js\n    encryption: required", 1),
+		},
+		wantErr: "encryption requires --payload-decryption-key-file",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newReloadTest(t, reloadFiles())
+			before := maps.Clone(s.live)
+			handlers := s.handlers.Load()
+			writeTestFiles(t, filepath.Dir(s.cfg.ConfigFile), tt.changes)
+
+			_, err := s.reload()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("reload error = %v, want one containing %q", err, tt.wantErr)
+			}
+			if !maps.Equal(s.live, before) {
+				t.Errorf("live routes changed: got %v, want %v", slices.Sorted(maps.Keys(s.live)), slices.Sorted(maps.Keys(before)))
+			}
+			for name, lr := range s.live {
+				if lr.ctx.Err() != nil {
+					t.Errorf("route %s was stopped", name)
+				}
+				if lr.worker != nil && lr.worker.ctx.Err() != nil {
+					t.Errorf("route %s's worker was stopped", name)
+				}
+			}
+			if s.handlers.Load() != handlers {
+				t.Error("handlers were replaced")
+			}
+			if got := s.inv.reloads.failed.Load(); got != 1 {
+				t.Errorf("failed reloads = %d, want 1", got)
+			}
+		})
+	}
+}
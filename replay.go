@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxAuditLine bounds the audit records read, whose payloads are as large
+// as the requests'.
+const maxAuditLine = 64 << 20
+
+// maxReplayDiffLines bounds the outputs diffed line by line; longer ones
+// are only reported as changed.
+const maxReplayDiffLines = 2000
+
+// replayOptions are the flags of `go-invoke-node replay`, which re-invokes
+// recorded invocations instead of starting a server:
+//
+//	go-invoke-node replay --config routes.yaml --source audit.log --route orders/create
+//	go-invoke-node replay --config routes.yaml --source dead-letters --candidate orders-v2.js
+//
+// The source is an --audit-log file, whose records only hold payloads with
+// --audit-payload full, or a --dead-letter-dir, either a directory or a
+// storage URL. Neither records the script's output, so without
+// --candidate each entry is compared by whether it succeeded. With
+// --candidate, each entry is invoked against both the current script and
+// the candidate, and their outputs are diffed; JSON outputs are compared
+// with their keys sorted. The process exits with status 1 when any entry
+// changed.
+type replayOptions struct {
+	Source string
+	// Route limits the replay to the entries of one route.
+	Route string
+	// Since limits the replay to entries this recent.
+	Since time.Duration
+	Limit int
+	// Candidate is a script file the entries are also invoked against.
+	Candidate string
+}
+
+func (o *replayOptions) register() {
+	flag.StringVar(&o.Source, "source", o.Source,
+		"replay: audit log file, or dead-letter directory or storage URL, to replay")
+	flag.StringVar(&o.Route, "route", o.Route,
+		"replay: only replay the entries of this route")
+	flag.DurationVar(&o.Since, "since", o.Since,
+		"replay: only replay entries recorded within this duration")
+	flag.IntVar(&o.Limit, "limit", o.Limit,
+		"replay: replay at most this many entries, the most recent ones (0 for all)")
+	flag.StringVar(&o.Candidate, "candidate", o.Candidate,
+		"replay: script file to invoke the entries against besides the current script, diffing their outputs")
+}
+
+// replayEntry is a recorded invocation, from either source.
+type replayEntry struct {
+	// ID is the request ID of an audit record or the ID of a dead letter.
+	ID      string
+	Route   string
+	Trigger string
+	Time    time.Time
+	// Payload is nil when the source didn't record it.
+	Payload json.RawMessage
+	// Status is the recorded outcome: ok, error or canceled.
+	Status string
+}
+
+// replayOutcome is the result of invoking an entry's payload.
+type replayOutcome struct {
+	status string
+	err    error
+	output []byte
+}
+
+// runReplay replays the entries o selects and returns the exit status.
+func runReplay(cfg Config, inv *Invoker, schema *Schema, o replayOptions) int {
+	if o.Source == "" {
+		log.Print("replay: --source is required")
+		return exitUsage
+	}
+	entries, err := replayEntries(o)
+	if err != nil {
+		log.Printf("replay: %v", err)
+		return exitUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	routes := map[string]*Route{}
+	candidates := map[string]*Route{}
+	var same, changed, skipped int
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return exitFailure
+		}
+		if e.Payload == nil {
+			skipped++
+			infof("skip  %s %s: payload not recorded", e.Route, e.ID)
+			continue
+		}
+		route, err := replayRoute(routes, cfg, schema, e.Route, "")
+		var candidateRoute *Route
+		if err == nil && o.Candidate != "" {
+			candidateRoute, err = replayRoute(candidates, cfg, schema, e.Route, o.Candidate)
+		}
+		if err != nil {
+			skipped++
+			fmt.Printf("SKIP  %s %s: %v\n", e.Route, e.ID, err)
+			continue
+		}
+
+		current := replayInvoke(ctx, inv, route, e)
+		if o.Candidate == "" {
+			if current.status == e.Status {
+				same++
+				infof("same  %s %s: %s", e.Route, e.ID, current.status)
+				continue
+			}
+			changed++
+			fmt.Printf("CHANGED  %s %s: %s, was %s\n", e.Route, e.ID, current.describe(), e.Status)
+			continue
+		}
+
+		candidate := replayInvoke(ctx, inv, candidateRoute, e)
+		if current.status == candidate.status && string(canonicalOutput(current.output)) == string(canonicalOutput(candidate.output)) {
+			same++
+			infof("same  %s %s: %s", e.Route, e.ID, current.status)
+			continue
+		}
+		changed++
+		fmt.Printf("CHANGED  %s %s: current %s, candidate %s\n", e.Route, e.ID, current.describe(), candidate.describe())
+		fmt.Printf("      payload: %s\n", e.Payload)
+		for _, line := range diffLines(canonicalOutput(current.output), canonicalOutput(candidate.output)) {
+			fmt.Printf("      %s\n", line)
+		}
+	}
+	summary := fmt.Sprintf("%d replayed: %d same, %d changed", same+changed, same, changed)
+	if skipped > 0 {
+		summary += fmt.Sprintf(", %d skipped", skipped)
+	}
+	fmt.Println(summary)
+	if changed > 0 {
+		return exitFailure
+	}
+	return 0
+}
+
+// replayRoute returns the route name of the entries, built like
+// oneShotRoute once per name and, with candidate, running that script
+// instead.
+func replayRoute(built map[string]*Route, cfg Config, schema *Schema, name, candidate string) (*Route, error) {
+	if route := built[name]; route != nil {
+		return route, nil
+	}
+	route, err := oneShotRoute(cfg, schema, name)
+	if err != nil {
+		return nil, err
+	}
+	if candidate != "" {
+		route.InlineScript, route.ScriptFile = "", candidate
+	}
+	built[name] = route
+	return route, nil
+}
+
+// replayInvoke invokes route with the payload of e, which was already
+// transformed when it was recorded.
+func replayInvoke(ctx context.Context, inv *Invoker, route *Route, e replayEntry) replayOutcome {
+	call := Invocation{
+		Route:        route,
+		Payload:      e.Payload,
+		Request:      RequestInfo{ID: newRequestID(), Trigger: e.Trigger},
+		NoCache:      true,
+		NoDeadLetter: true,
+		NoAudit:      true,
+	}
+	res, err := inv.Invoke(ctx, call)
+	if err == nil {
+		res.Stdout, err = applyTransforms(route.ResponseTransforms, res.Stdout)
+	}
+	if err != nil {
+		status := "error"
+		if errors.Is(err, context.Canceled) {
+			status = "canceled"
+		}
+		return replayOutcome{status: status, err: err, output: res.Stdout}
+	}
+	return replayOutcome{status: "ok", output: res.Stdout}
+}
+
+func (r replayOutcome) describe() string {
+	if r.err != nil {
+		return fmt.Sprintf("%s (%v)", r.status, r.err)
+	}
+	return r.status
+}
+
+// replayEntries reads the entries of o.Source, oldest first, keeping those
+// o selects.
+func replayEntries(o replayOptions) ([]replayEntry, error) {
+	deadLetters := isStorageURL(o.Source)
+	if !deadLetters {
+		fi, err := os.Stat(o.Source)
+		if err != nil {
+			return nil, err
+		}
+		deadLetters = fi.IsDir()
+	}
+	var entries []replayEntry
+	var err error
+	if deadLetters {
+		entries, err = deadLetterEntries(o.Source)
+	} else {
+		entries, err = auditEntries(o.Source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return selectReplayEntries(o, entries), nil
+}
+
+// selectReplayEntries returns the entries o selects.
+func selectReplayEntries(o replayOptions, entries []replayEntry) []replayEntry {
+	var out []replayEntry
+	for _, e := range entries {
+		if o.Route != "" && e.Route != o.Route {
+			continue
+		}
+		if o.Since > 0 && time.Since(e.Time) > o.Since {
+			continue
+		}
+		out = append(out, e)
+	}
+	if o.Limit > 0 && len(out) > o.Limit {
+		out = out[len(out)-o.Limit:]
+	}
+	return out
+}
+
+// auditEntries reads the records of an audit log file.
+func auditEntries(path string) ([]replayEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []replayEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, maxAuditLine)
+	for n := 1; sc.Scan(); n++ {
+		if len(strings.TrimSpace(sc.Text())) == 0 {
+			continue
+		}
+		var rec auditRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		e := replayEntry{
+			ID:      rec.RequestID,
+			Route:   rec.Route,
+			Trigger: rec.Trigger,
+			Time:    rec.Time,
+			Status:  rec.Status,
+		}
+		// Payloads that couldn't be recorded are replaced by a string
+		// saying so; see Auditor.redacted.
+		if p := string(rec.Payload); p != "" && p != `"(not JSON)"` && p != `"(not redactable)"` {
+			e.Payload = rec.Payload
+		}
+		out = append(out, e)
+	}
+	return out, sc.Err()
+}
+
+// deadLetterEntries reads the dead letters in the storage named by spec,
+// which are failures.
+func deadLetterEntries(spec string) ([]replayEntry, error) {
+	d, err := NewDeadLetters(spec)
+	if err != nil {
+		return nil, err
+	}
+	list, err := d.List("")
+	if err != nil {
+		return nil, err
+	}
+	var out []replayEntry
+	for _, item := range list {
+		dl, err := d.Get(item.ID)
+		if errors.Is(err, errDeadLetterNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, replayEntry{
+			ID:      dl.ID,
+			Route:   dl.Route,
+			Trigger: dl.Trigger,
+			Time:    dl.Failed,
+			Payload: dl.Payload,
+			Status:  "error",
+		})
+	}
+	return out, nil
+}
+
+// canonicalOutput returns out indented with its keys sorted when it is
+// JSON, so outputs differing only in formatting or key order compare
+// equal, and out unchanged otherwise.
+func canonicalOutput(out []byte) []byte {
+	var v any
+	if err := json.Unmarshal(out, &v); err != nil {
+		return out
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return out
+	}
+	return b
+}
+
+// diffLines returns the lines removed from a, prefixed with -, and added
+// in b, prefixed with +, by their longest common subsequence.
+func diffLines(a, b []byte) []string {
+	x, y := outputLines(a), outputLines(b)
+	if len(x) > maxReplayDiffLines || len(y) > maxReplayDiffLines {
+		return []string{fmt.Sprintf("(outputs of %d and %d lines differ)", len(x), len(y))}
+	}
+	// lcs[i][j] is the length of the common subsequence of x[i:] and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var out []string
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			i++
+			j++
+		case j == len(y) || (i < len(x) && lcs[i+1][j] >= lcs[i][j+1]):
+			out = append(out, "- "+x[i])
+			i++
+		default:
+			out = append(out, "+ "+y[j])
+			j++
+		}
+	}
+	return out
+}
+
+func outputLines(out []byte) []string {
+	if len(out) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	// responseFD is the file descriptor scripts write their response
+	// status and headers to; INVOKE_RESPONSE_FD names it.
+	responseFD        = 3
+	responseFDEnvKey  = "INVOKE_RESPONSE_FD"
+	maxScriptResponse = 64 << 10
+)
+
+// scriptResponseForbidden are the headers the server frames the response
+// with, which scripts can't set.
+var scriptResponseForbidden = map[string]bool{
+	"Connection":        true,
+	"Content-Encoding":  true,
+	"Content-Length":    true,
+	"Keep-Alive":        true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// ScriptResponse is the status and headers a script asked its HTTP
+// response to have, by writing a JSON object to file descriptor 3:
+//
+//	require("fs").writeSync(3, JSON.stringify({status: 201, headers: {Location: "/orders/1"}}))
+//
+// so it can answer with redirects, caching headers or successes other
+// than 200; stdout remains the body. Header values are strings or arrays
+// of strings. Only scripts spawned per invocation get the descriptor, not
+// persistent workers, and results carrying a ScriptResponse aren't put in
+// the result cache.
+type ScriptResponse struct {
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+}
+
+// openScriptResponse creates the file handed to the script as its
+// response descriptor. It is unlinked right away, so only the script and
+// the server can reach it.
+func openScriptResponse() (*os.File, error) {
+	f, err := os.CreateTemp("", "invoke-response-*")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	return f, nil
+}
+
+// readScriptResponse parses what the script wrote to f, returning nil when
+// it wrote nothing.
+func readScriptResponse(f *os.File) (*ScriptResponse, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(io.LimitReader(f, maxScriptResponse+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(b))) == 0 {
+		return nil, nil
+	}
+	if len(b) > maxScriptResponse {
+		return nil, fmt.Errorf("response metadata exceeds %d bytes", maxScriptResponse)
+	}
+	var raw struct {
+		Status  int                        `json:"status"`
+		Headers map[string]json.RawMessage `json:"headers"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("response metadata: %v", err)
+	}
+	if raw.Status != 0 && (raw.Status < 200 || raw.Status > 599) {
+		return nil, fmt.Errorf("response metadata: status %d out of range 200-599", raw.Status)
+	}
+	sr := &ScriptResponse{Status: raw.Status, Header: http.Header{}}
+	for name, v := range raw.Headers {
+		name = http.CanonicalHeaderKey(name)
+		if scriptResponseForbidden[name] {
+			return nil, fmt.Errorf("response metadata: header %s can't be set", name)
+		}
+		var values []string
+		var one string
+		if err := json.Unmarshal(v, &one); err == nil {
+			values = []string{one}
+		} else if err := json.Unmarshal(v, &values); err != nil {
+			return nil, fmt.Errorf("response metadata: header %s must be a string or an array of strings", name)
+		}
+		for _, value := range values {
+			if strings.ContainsAny(value, "\r\n") {
+				return nil, errors.New("response metadata: header " + name + " contains a line break")
+			}
+			sr.Header.Add(name, value)
+		}
+	}
+	return sr, nil
+}
+
+// apply sets the headers on h and returns the response status, status
+// unless the script chose one.
+func (sr *ScriptResponse) apply(h http.Header, status int) int {
+	if sr == nil {
+		return status
+	}
+	for name, values := range sr.Header {
+		h[name] = values
+	}
+	if sr.Status != 0 {
+		return sr.Status
+	}
+	return status
+}
+
+// bodyAllowed reports whether a response with status may have a body.
+func bodyAllowed(status int) bool {
+	return status != http.StatusNoContent && status != http.StatusNotModified
+}
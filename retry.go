@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// retryOnTimeout is the RetryPolicy.On entry matching timed-out attempts.
+const retryOnTimeout = "timeout"
+
+// errTimeout marks an attempt killed by the invocation timeout.
+var errTimeout = errors.New("script timed out")
+
+// RetryPolicy reruns buffered invocations that fail transiently. Streamed
+// invocations are never retried since their output has already been sent.
+type RetryPolicy struct {
+	// Attempts is the total number of runs, including the first.
+	Attempts int `yaml:"attempts"`
+	// Backoff is the delay before the first retry; it doubles after each.
+	Backoff time.Duration `yaml:"backoff"`
+	// On lists the exit codes, and "timeout", that are retried. Empty
+	// means any script failure.
+	On []string `yaml:"on"`
+}
+
+func (p RetryPolicy) validate() error {
+	for _, v := range p.On {
+		if v == retryOnTimeout {
+			continue
+		}
+		if _, err := strconv.Atoi(v); err != nil {
+			return fmt.Errorf("retry on %q: must be an exit code or %q", v, retryOnTimeout)
+		}
+	}
+	return nil
+}
+
+// retryable reports whether err is a script failure the policy retries.
+// Failures outside the script, such as spawn errors or a missing OAuth
+// token, and exceeded resource limits are never retried.
+func (p RetryPolicy) retryable(err error) bool {
+	// The same payload would exhaust its limits again.
+	var limit *limitError
+	if errors.As(err, &limit) {
+		return false
+	}
+	if errors.Is(err, errTimeout) {
+		return len(p.On) == 0 || slices.Contains(p.On, retryOnTimeout)
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return len(p.On) == 0 || slices.Contains(p.On, strconv.Itoa(exit.ExitCode()))
+	}
+	var status *workerStatusError
+	return errors.As(err, &status) && len(p.On) == 0
+}
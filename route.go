@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Route is a script exposed over HTTP together with the settings it runs
+// with.
+type Route struct {
+	// Name identifies the route in logs and responses.
+	Name string
+	// InlineScript and ScriptFile are mutually exclusive.
+	InlineScript string
+	ScriptFile   string
+	// EnvFiles are read into the script environment in order; see
+	// loadEnvFiles.
+	EnvFiles []string
+	Schema   *Schema
+	// ResponseSchema describes the output; it is only checked by
+	// contract-test.
+	ResponseSchema *Schema
+	// Coerce converts payloads towards Schema before validation.
+	Coerce bool
+	// RequestTransforms rewrite JSON payloads before validation, and
+	// ResponseTransforms the buffered output; see TransformConfig.
+	RequestTransforms  []Transform
+	ResponseTransforms []Transform
+	// PayloadTemplate, when set, reshapes payloads for the script.
+	PayloadTemplate *PayloadTemplate
+	// Timeout overrides the server-wide per-attempt timeout when set.
+	Timeout time.Duration
+	// Priority is the priority of the route's invocations, unless a
+	// request overrides it.
+	Priority Priority
+	// Runtime is the node executable the script runs with; empty means
+	// node from PATH.
+	Runtime string
+
+	// Env and SecretFiles add route-specific variables to the script
+	// environment; see RouteConfig.
+	Env         map[string]string
+	SecretFiles map[string]string
+	Persistent  bool
+	// WorkerProtocol overrides the server-wide persistent worker protocol
+	// when set.
+	WorkerProtocol string
+	// Retry overrides the server-wide retry policy when set.
+	Retry *RetryPolicy
+	// Breaker overrides the server-wide circuit breaker policy when set.
+	Breaker *BreakerPolicy
+	// Workdir, when set, overrides the server-wide working directory
+	// isolation.
+	Workdir *Workdir
+	// Sandbox, when set, runs the script under Node's permission model
+	// with these allowlists instead of the server-wide ones.
+	Sandbox *Sandbox
+	// Raw pipes request bodies to the script unparsed, and ContentType
+	// overrides the Content-Type of their output.
+	Raw         bool
+	ContentType string
+	// StreamEvents makes the script's "@@<event> <data>" lines events of
+	// SSE responses; see eventLine.
+	StreamEvents bool
+	// Encryption, when set, rejects payloads that aren't JWEs: required
+	// has them decrypted by the server, script by the script; see
+	// Decrypter.
+	Encryption string
+	// Proxy, when set, overrides the HTTP proxy the script's calls go
+	// through.
+	Proxy *RouteProxy
+	// Hosts maps host names the script resolves to other addresses; see
+	// parseHosts.
+	Hosts map[string]string
+	// Depends lists external requirements reported by /readyz.
+	Depends *Dependencies
+
+	// Webhook, when set, authenticates requests and rewrites them into
+	// the normalized webhook envelope before rules are applied.
+	Webhook *Webhook
+	// Dedupe, when set, runs each payload with the same key once.
+	Dedupe *Dedupe
+	// CORS overrides the server-wide CORS policy when set.
+	CORS *CORSPolicy
+
+	// Rules are checked in order before the route's own script runs.
+	Rules []Rule
+
+	// Pipeline, when set, runs the scripts of other routes in turn
+	// instead of a script of the route's own; see PipelineStageConfig.
+	Pipeline []PipelineStage
+
+	// Auth, when set, requires a bearer token on the route's endpoints.
+	Auth *RouteAuth
+
+	// Tenant, when set, is the tenant whose API keys, rate and
+	// concurrency quotas apply to the route.
+	Tenant *Tenant
+
+	// Experiment, when set, assigns each caller a variant the script
+	// behaves by.
+	Experiment *Experiment
+
+	// slots, when set, caps the route's concurrent invocations below the
+	// server-wide limit.
+	slots *limiter
+
+	// Triggers, when set, invoke the route on a schedule or from a queue.
+	Triggers *Triggers
+
+	// Materialized, when set, refreshes the route's output on a schedule
+	// and serves GETs from it.
+	Materialized *materialized
+
+	// revision identifies the route's declaration and files; reloads
+	// recycle the route when it changed. It is empty outside --config.
+	revision string
+
+	// worker, when set, serves invocations from a long-lived process
+	// instead of spawning node per request.
+	worker *Worker
+
+	// disabled is toggled through the admin API; disabled routes answer
+	// 503.
+	disabled atomic.Bool
+	// fault is injected through the admin API; see Admin.faultRoutes.
+	fault atomic.Pointer[fault]
+}
+
+// runtime returns the executable the route's script runs with.
+func (rt *Route) runtime() string {
+	if rt.Runtime != "" {
+		return rt.Runtime
+	}
+	return nodeBinary
+}
+
+// args returns the node command line that runs the route's script. Paths
+// are made absolute, since the script may run in its own working
+// directory.
+func (rt *Route) args() []string {
+	args := []string{}
+	if rt.InlineScript != "" {
+		args = append(args, "-e", rt.InlineScript)
+	} else {
+		args = append(args, absPath(rt.ScriptFile))
+	}
+	return args
+}
+
+// absPath returns p as an absolute path, or p itself when that fails.
+func absPath(p string) string {
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+	return p
+}
+
+// environ returns the route-specific KEY=value pairs, reading env and
+// secret files fresh each time.
+func (rt *Route) environ() ([]string, error) {
+	if len(rt.EnvFiles) == 0 && len(rt.Env) == 0 && len(rt.SecretFiles) == 0 && rt.Proxy == nil && rt.Hosts == nil {
+		return nil, nil
+	}
+	env, err := loadEnvFiles(rt.EnvFiles)
+	if err != nil {
+		return nil, err
+	}
+	if rt.Proxy != nil {
+		env = append(env, rt.Proxy.env()...)
+	}
+	if rt.Hosts != nil {
+		env = append(env, hostsEnv(rt.Hosts))
+	}
+	for k, v := range rt.Env {
+		env = append(env, k+"="+v)
+	}
+	for k, path := range rt.SecretFiles {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read secret %s: %w", k, err)
+		}
+		env = append(env, k+"="+strings.TrimRight(string(b), "\r\n"))
+	}
+	return env, nil
+}
+
+// Rule sends requests whose Header value, or webhook event type when
+// Header is empty, matches Value to Target instead of the route's own
+// script, for providers that deliver every event type to a single URL.
+type Rule struct {
+	Header string
+	// Value is a path.Match pattern, so "pull_request*" matches
+	// pull_request and pull_request_review.
+	Value  string
+	Target *Route
+}
+
+func (r Rule) matches(h http.Header, event string) bool {
+	if r.Header == "" {
+		ok, _ := path.Match(r.Value, event)
+		return ok && event != ""
+	}
+	for _, v := range h.Values(r.Header) {
+		if ok, _ := path.Match(r.Value, strings.TrimSpace(v)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch returns the route that serves a request with headers h and
+// webhook event type event: the target of the first matching rule,
+// otherwise rt itself. It returns nil when no rule matches and rt has no
+// script of its own.
+func (rt *Route) dispatch(h http.Header, event string) *Route {
+	for _, rule := range rt.Rules {
+		if rule.matches(h, event) {
+			return rule.Target
+		}
+	}
+	if !rt.hasScript() && rt.Pipeline == nil {
+		return nil
+	}
+	return rt
+}
+
+// hasScript reports whether the route runs a script itself rather than
+// only dispatching to others.
+func (rt *Route) hasScript() bool {
+	return rt.InlineScript != "" || rt.ScriptFile != ""
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// processGroupRSS returns the resident set size of the processes in the
+// process group pgid, in bytes.
+func processGroupRSS(pgid int) (int64, error) {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return 0, err
+	}
+	page := int64(os.Getpagesize())
+	var total int64
+	for _, path := range stats {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			// The process exited meanwhile.
+			continue
+		}
+		// The command name in parentheses may contain spaces.
+		i := strings.LastIndexByte(string(b), ')')
+		if i < 0 {
+			continue
+		}
+		// Fields after the name: state ppid pgrp ... with rss the 22nd.
+		fields := strings.Fields(string(b[i+1:]))
+		if len(fields) < 22 || fields[2] != strconv.Itoa(pgid) {
+			continue
+		}
+		pages, _ := strconv.ParseInt(fields[21], 10, 64)
+		total += pages * page
+	}
+	return total, nil
+}
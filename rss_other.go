@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func processGroupRSS(int) (int64, error) {
+	return 0, errors.New("memory monitoring is only supported on Linux")
+}
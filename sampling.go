@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sampleBatchSize     = 1000
+	sampleFlushInterval = 30 * time.Second
+)
+
+// SamplingConfig enables forwarding a random sample of invocations, payload
+// and response, to an analytics sink for offline training and monitoring.
+// Sink is a file, an http(s) URL receiving batches as JSON lines, e.g. a
+// Kafka REST bridge or a log shipper, or s3://bucket/prefix storing every
+// batch as an object. Rate is the fraction of invocations sampled; the
+// fields at Redact are masked in both payload and response.
+type SamplingConfig struct {
+	Sink   string
+	Rate   float64
+	Redact []string
+}
+
+func (c SamplingConfig) validate() error {
+	if c.Rate <= 0 || c.Rate > 1 {
+		return fmt.Errorf("rate %g is not in (0, 1]", c.Rate)
+	}
+	if len(c.Redact) > 0 {
+		if _, err := parsePaths(c.Redact); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sampleRecord is one sampled invocation.
+type sampleRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Route     string    `json:"route"`
+	Trigger   string    `json:"trigger,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	// Payload and Response are JSON, or a string when the script didn't
+	// read or write JSON. Response is left out for failed invocations.
+	Payload  json.RawMessage `json:"payload"`
+	Response json.RawMessage `json:"response,omitempty"`
+	// Status is ok or error.
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	Cached     bool    `json:"cached,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// Sampler forwards a sample of invocations to the sampling sink. Like the
+// audit log it queues records and writes them in batches from the
+// background, so sampled invocations don't wait on the sink.
+type Sampler struct {
+	*recordQueue
+	rate   float64
+	redact Transform
+}
+
+func NewSampler(c SamplingConfig) (*Sampler, error) {
+	s := &Sampler{rate: c.Rate}
+	if len(c.Redact) > 0 {
+		paths, err := parsePaths(c.Redact)
+		if err != nil {
+			return nil, err
+		}
+		s.redact = &maskTransform{paths: paths, with: "***"}
+	}
+	var sink auditSink
+	switch {
+	case strings.HasPrefix(c.Sink, "s3://"):
+		s3, err := newS3Sink(c.Sink)
+		if err != nil {
+			return nil, err
+		}
+		sink = s3
+	case isHTTPURL(c.Sink):
+		sink = &httpAuditSink{url: c.Sink, client: &http.Client{Timeout: 10 * time.Second}}
+	default:
+		f, err := openAuditFile(c.Sink, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		sink = f
+	}
+	s.recordQueue = newRecordQueue("sampling", sink, sampleBatchSize, sampleFlushInterval)
+	return s, nil
+}
+
+// Record queues call, which started at started and ended with res and err,
+// when it is picked for the sample. Streamed invocations are never
+// sampled.
+func (s *Sampler) Record(call Invocation, res *Result, err error, started time.Time) {
+	if call.Stdin != nil || call.Stdout != nil || mathrand.Float64() >= s.rate {
+		return
+	}
+	rec := sampleRecord{
+		Time:       started.UTC(),
+		RequestID:  call.Request.ID,
+		Route:      call.Route.Name,
+		Trigger:    call.Request.Trigger,
+		Tenant:     call.Request.Tenant,
+		Payload:    s.redacted(call.Payload),
+		Status:     "ok",
+		Cached:     res.Cached,
+		DurationMS: float64(time.Since(started).Microseconds()) / 1000,
+	}
+	if err != nil {
+		rec.Status = "error"
+		rec.Error = err.Error()
+	} else {
+		rec.Response = s.redacted(bytes.TrimSpace(res.Stdout))
+	}
+	s.add(rec)
+}
+
+// redacted returns b with the redacted fields masked, or b as a string when
+// it isn't JSON.
+func (s *Sampler) redacted(b []byte) json.RawMessage {
+	if !json.Valid(b) {
+		q, _ := json.Marshal(string(b))
+		return q
+	}
+	if s.redact == nil {
+		return b
+	}
+	out, err := applyTransforms([]Transform{s.redact}, b)
+	if err != nil {
+		return json.RawMessage(`"(not redactable)"`)
+	}
+	return out
+}
+
+// Close writes the queued records and closes the sink.
+func (s *Sampler) Close() {
+	if s == nil {
+		return
+	}
+	s.recordQueue.close()
+}
+
+// s3Sink stores every batch as a JSON lines object below
+// prefix/YYYY/MM/DD/HH/, signed with the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN credentials for AWS_REGION.
+// AWS_ENDPOINT_URL points it at an S3 compatible store instead, addressed
+// path style.
+type s3Sink struct {
+	bucket, prefix string
+	// endpoint is the URL objects are put below, bucket included.
+	endpoint string
+	region   string
+
+	accessKey, secretKey, sessionToken string
+
+	client *http.Client
+}
+
+func newS3Sink(sink string) (*s3Sink, error) {
+	u, err := url.Parse(sink)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s: no bucket", sink)
+	}
+	s := &s3Sink{
+		bucket:       u.Host,
+		prefix:       strings.Trim(u.Path, "/"),
+		region:       cmp.Or(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("s3 sink needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if ep := cmp.Or(os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL")); ep != "" {
+		s.endpoint = strings.TrimRight(ep, "/") + "/" + s.bucket
+	} else {
+		s.endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", s.bucket, s.region)
+	}
+	return s, nil
+}
+
+func (s *s3Sink) write(batch [][]byte) error {
+	body := append(bytes.Join(batch, []byte{'\n'}), '\n')
+	now := time.Now().UTC()
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	key := fmt.Sprintf("%s/%d-%x.ndjson", now.Format("2006/01/02/15"), now.UnixNano(), suffix)
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+	req, err := http.NewRequest(http.MethodPut, s.endpoint+"/"+s3Escape(key), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	sum := sha256.Sum256(body)
+	signV4(req, hex.EncodeToString(sum[:]), s.accessKey, s.secretKey, s.region, "s3", now)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var msg bytes.Buffer
+		msg.ReadFrom(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("put s3://%s/%s: %s %s", s.bucket, key, resp.Status, bytes.TrimSpace(msg.Bytes()))
+	}
+	return nil
+}
+
+func (s *s3Sink) close() error { return nil }
+
+// signV4 adds AWS Signature Version 4 headers to req, whose body has the
+// hex SHA-256 payloadHash. Every header already set is signed.
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	creq := strings.Join([]string{req.Method, path, req.URL.Query().Encode(), canonical.String(), signed, payloadHash}, "\n")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	sum := sha256.Sum256([]byte(creq))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{day, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x",
+		accessKey, scope, signed, hmacSHA256(key, toSign)))
+}
+
+// s3Escape percent-encodes an object key the way S3 signs it: everything
+// but unreserved characters and slashes.
+func s3Escape(key string) string {
+	var b strings.Builder
+	for _, c := range []byte(key) {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
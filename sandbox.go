@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+// Sandbox runs scripts under Node's permission model, so untrusted
+// scripts can only read and write the allowlisted paths and can't spawn
+// processes or workers unless allowed. The script's own directory is
+// always readable so it can load its modules.
+type Sandbox struct {
+	AllowFSRead       []string `yaml:"allow_fs_read"`
+	AllowFSWrite      []string `yaml:"allow_fs_write"`
+	AllowNet          bool     `yaml:"allow_net"`
+	AllowChildProcess bool     `yaml:"allow_child_process"`
+	AllowWorker       bool     `yaml:"allow_worker"`
+}
+
+// nodeFlags is the set of command line flags the installed node accepts.
+type nodeFlags map[string]bool
+
+var nodeFlagPattern = regexp.MustCompile(`(?m)^\s+(--[a-z][a-z0-9-]*)`)
+
+// detectNodeFlags lists the flags in `runtime --help`, so the sandbox can
+// use whichever spelling of the permission flags that node version
+// supports.
+func detectNodeFlags(runtime string) (nodeFlags, error) {
+	out, err := exec.Command(runtime, "--help").Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s --help: %w", runtime, err)
+	}
+	flags := nodeFlags{}
+	for _, m := range nodeFlagPattern.FindAllSubmatch(out, -1) {
+		flags[string(m[1])] = true
+	}
+	return flags, nil
+}
+
+// args returns the node flags enforcing the sandbox for route, with
+// extraRead and extraWrite added to the readable and writable paths.
+func (sb *Sandbox) args(route *Route, flags nodeFlags, extraRead, extraWrite []string) []string {
+	args := []string{"--experimental-permission"}
+	if flags["--permission"] {
+		args = []string{"--permission"}
+	}
+
+	read := append(sb.AllowFSRead[:len(sb.AllowFSRead):len(sb.AllowFSRead)], extraRead...)
+	if route.ScriptFile != "" {
+		read = append(read, filepath.Dir(route.ScriptFile))
+	}
+	for _, p := range read {
+		args = append(args, "--allow-fs-read="+absPath(p))
+	}
+	write := append(sb.AllowFSWrite[:len(sb.AllowFSWrite):len(sb.AllowFSWrite)], extraWrite...)
+	for _, p := range write {
+		args = append(args, "--allow-fs-write="+absPath(p))
+	}
+	if sb.AllowNet && flags["--allow-net"] {
+		args = append(args, "--allow-net")
+	}
+	if sb.AllowChildProcess {
+		args = append(args, "--allow-child-process")
+	}
+	if sb.AllowWorker {
+		args = append(args, "--allow-worker")
+	}
+	return args
+}
+
+// sandboxFlags detects the flags of each node runtime once, the first
+// time a sandboxed route using it runs.
+type sandboxFlags struct {
+	mu        sync.Mutex
+	byRuntime map[string]*runtimeFlags
+}
+
+type runtimeFlags struct {
+	once  sync.Once
+	flags nodeFlags
+	err   error
+}
+
+func (s *sandboxFlags) get(runtime string) (nodeFlags, error) {
+	s.mu.Lock()
+	if s.byRuntime == nil {
+		s.byRuntime = map[string]*runtimeFlags{}
+	}
+	rf := s.byRuntime[runtime]
+	if rf == nil {
+		rf = &runtimeFlags{}
+		s.byRuntime[runtime] = rf
+	}
+	s.mu.Unlock()
+
+	rf.once.Do(func() {
+		rf.flags, rf.err = detectNodeFlags(runtime)
+		if rf.err != nil {
+			return
+		}
+		if !rf.flags["--permission"] && !rf.flags["--experimental-permission"] {
+			rf.err = fmt.Errorf("%s does not support the permission model", runtime)
+			return
+		}
+		if !rf.flags["--allow-net"] {
+			log.Printf("sandbox: %s cannot restrict network access", runtime)
+		}
+	})
+	return rf.flags, rf.err
+}
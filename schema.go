@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is the subset of JSON Schema used to validate invoke payloads
+// before a node process is spawned. Unsupported keywords are ignored.
+type Schema struct {
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	Ref  string             `json:"$ref,omitempty"`
+	Defs map[string]*Schema `json:"$defs,omitempty"`
+
+	Type  schemaTypes       `json:"type,omitempty"`
+	Enum  []json.RawMessage `json:"enum,omitempty"`
+	Const json.RawMessage   `json:"const,omitempty"`
+	// Default is only used when coercing payloads; see Coerce.
+	Default json.RawMessage `json:"default,omitempty"`
+
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	MinProperties        *int               `json:"minProperties,omitempty"`
+	MaxProperties        *int               `json:"maxProperties,omitempty"`
+
+	Items       *Schema `json:"items,omitempty"`
+	MinItems    *int    `json:"minItems,omitempty"`
+	MaxItems    *int    `json:"maxItems,omitempty"`
+	UniqueItems bool    `json:"uniqueItems,omitempty"`
+
+	MinLength *int   `json:"minLength,omitempty"`
+	MaxLength *int   `json:"maxLength,omitempty"`
+	Pattern   string `json:"pattern,omitempty"`
+
+	Minimum          *float64 `json:"minimum,omitempty"`
+	Maximum          *float64 `json:"maximum,omitempty"`
+	ExclusiveMinimum *float64 `json:"exclusiveMinimum,omitempty"`
+	ExclusiveMaximum *float64 `json:"exclusiveMaximum,omitempty"`
+	MultipleOf       *float64 `json:"multipleOf,omitempty"`
+
+	AllOf []*Schema `json:"allOf,omitempty"`
+	AnyOf []*Schema `json:"anyOf,omitempty"`
+	OneOf []*Schema `json:"oneOf,omitempty"`
+	Not   *Schema   `json:"not,omitempty"`
+
+	// boolean holds the value of a `true`/`false` schema.
+	boolean *bool
+	pattern *regexp.Regexp
+	root    *Schema
+}
+
+// Violation describes a single way in which a payload fails its schema.
+type Violation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("type must be a string or array of strings")
+	}
+	*t = many
+	return nil
+}
+
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("true")) || bytes.Equal(data, []byte("false")) {
+		b := data[0] == 't'
+		*s = Schema{boolean: &b}
+		return nil
+	}
+
+	type plain Schema
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+
+	// Accept the pre-2019 "definitions" keyword as an alias for $defs.
+	var legacy struct {
+		Definitions map[string]*Schema `json:"definitions"`
+	}
+	if err := json.Unmarshal(data, &legacy); err == nil && len(legacy.Definitions) > 0 {
+		if p.Defs == nil {
+			p.Defs = map[string]*Schema{}
+		}
+		for k, v := range legacy.Definitions {
+			if _, ok := p.Defs[k]; !ok {
+				p.Defs[k] = v
+			}
+		}
+	}
+
+	*s = Schema(p)
+	return nil
+}
+
+// LoadSchema reads and compiles the JSON Schema at path.
+func LoadSchema(path string) (*Schema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSchema(data)
+}
+
+// ParseSchema compiles a JSON Schema document.
+func ParseSchema(data []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("parse schema: %w", err)
+	}
+	if err := s.compile(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *Schema) compile(root *Schema) error {
+	if s == nil {
+		return nil
+	}
+	s.root = root
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", s.Pattern, err)
+		}
+		s.pattern = re
+	}
+
+	children := []*Schema{s.AdditionalProperties, s.Items, s.Not}
+	children = append(children, s.AllOf...)
+	children = append(children, s.AnyOf...)
+	children = append(children, s.OneOf...)
+	for _, c := range s.Properties {
+		children = append(children, c)
+	}
+	for _, c := range s.Defs {
+		children = append(children, c)
+	}
+	for _, c := range children {
+		if err := c.compile(root); err != nil {
+			return err
+		}
+	}
+
+	if s.Ref != "" {
+		if _, err := s.resolve(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve follows a local "#/$defs/name" or "#/definitions/name" reference.
+func (s *Schema) resolve() (*Schema, error) {
+	name, ok := strings.CutPrefix(s.Ref, "#/$defs/")
+	if !ok {
+		name, ok = strings.CutPrefix(s.Ref, "#/definitions/")
+	}
+	if s.Ref == "#" {
+		return s.root, nil
+	}
+	if !ok {
+		return nil, fmt.Errorf("unsupported $ref %q: only local definitions are supported", s.Ref)
+	}
+	target, found := s.root.Defs[name]
+	if !found {
+		return nil, fmt.Errorf("unresolved $ref %q", s.Ref)
+	}
+	return target, nil
+}
+
+// Validate checks payload against the schema and returns every violation
+// found, or nil when the payload conforms.
+func (s *Schema) Validate(payload []byte) ([]Violation, error) {
+	var v any
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return nil, err
+	}
+	var out []Violation
+	s.validate(v, "", &out)
+	return out, nil
+}
+
+func (s *Schema) validate(v any, path string, out *[]Violation) {
+	if s == nil {
+		return
+	}
+	fail := func(format string, args ...any) {
+		p := path
+		if p == "" {
+			p = "/"
+		}
+		*out = append(*out, Violation{Path: p, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if s.boolean != nil {
+		if !*s.boolean {
+			fail("no value is allowed here")
+		}
+		return
+	}
+
+	if s.Ref != "" {
+		if target, err := s.resolve(); err == nil {
+			target.validate(v, path, out)
+		}
+	}
+
+	if len(s.Type) > 0 && !slicesContainsType(s.Type, v) {
+		fail("expected %s, got %s", strings.Join(s.Type, " or "), jsonType(v))
+		return
+	}
+
+	if len(s.Enum) > 0 {
+		match := false
+		for _, raw := range s.Enum {
+			if rawEqual(raw, v) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			fail("value must be one of %s", joinRaw(s.Enum))
+		}
+	}
+	if len(s.Const) > 0 && !rawEqual(s.Const, v) {
+		fail("value must be %s", s.Const)
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		s.validateObject(val, path, out, fail)
+	case []any:
+		s.validateArray(val, path, out, fail)
+	case string:
+		n := utf8.RuneCountInString(val)
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("string is shorter than %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("string is longer than %d characters", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(val) {
+			fail("string does not match pattern %q", s.Pattern)
+		}
+	case float64:
+		if s.Minimum != nil && val < *s.Minimum {
+			fail("must be >= %v", *s.Minimum)
+		}
+		if s.Maximum != nil && val > *s.Maximum {
+			fail("must be <= %v", *s.Maximum)
+		}
+		if s.ExclusiveMinimum != nil && val <= *s.ExclusiveMinimum {
+			fail("must be > %v", *s.ExclusiveMinimum)
+		}
+		if s.ExclusiveMaximum != nil && val >= *s.ExclusiveMaximum {
+			fail("must be < %v", *s.ExclusiveMaximum)
+		}
+		if s.MultipleOf != nil && *s.MultipleOf > 0 {
+			if q := val / *s.MultipleOf; math.Abs(q-math.Round(q)) > 1e-9 {
+				fail("must be a multiple of %v", *s.MultipleOf)
+			}
+		}
+	}
+
+	for _, sub := range s.AllOf {
+		sub.validate(v, path, out)
+	}
+	if len(s.AnyOf) > 0 {
+		ok := false
+		for _, sub := range s.AnyOf {
+			if sub.matches(v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			fail("value does not match any of the allowed schemas")
+		}
+	}
+	if len(s.OneOf) > 0 {
+		n := 0
+		for _, sub := range s.OneOf {
+			if sub.matches(v) {
+				n++
+			}
+		}
+		if n != 1 {
+			fail("value must match exactly one schema, matched %d", n)
+		}
+	}
+	if s.Not != nil && s.Not.matches(v) {
+		fail("value must not match the disallowed schema")
+	}
+}
+
+func (s *Schema) validateObject(obj map[string]any, path string, out *[]Violation, fail func(string, ...any)) {
+	if s.MinProperties != nil && len(obj) < *s.MinProperties {
+		fail("object must have at least %d properties", *s.MinProperties)
+	}
+	if s.MaxProperties != nil && len(obj) > *s.MaxProperties {
+		fail("object must have at most %d properties", *s.MaxProperties)
+	}
+	for _, name := range s.Required {
+		if _, ok := obj[name]; !ok {
+			fail("missing required property %q", name)
+		}
+	}
+
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		child := path + "/" + escapePointer(k)
+		if sub, ok := s.Properties[k]; ok {
+			sub.validate(obj[k], child, out)
+			continue
+		}
+		if s.AdditionalProperties != nil {
+			if b := s.AdditionalProperties.boolean; b != nil && !*b {
+				fail("property %q is not allowed", k)
+				continue
+			}
+			s.AdditionalProperties.validate(obj[k], child, out)
+		}
+	}
+}
+
+func (s *Schema) validateArray(arr []any, path string, out *[]Violation, fail func(string, ...any)) {
+	if s.MinItems != nil && len(arr) < *s.MinItems {
+		fail("array must have at least %d items", *s.MinItems)
+	}
+	if s.MaxItems != nil && len(arr) > *s.MaxItems {
+		fail("array must have at most %d items", *s.MaxItems)
+	}
+	if s.UniqueItems {
+		for i := range arr {
+			for j := i + 1; j < len(arr); j++ {
+				if reflect.DeepEqual(arr[i], arr[j]) {
+					fail("array items %d and %d are equal", i, j)
+				}
+			}
+		}
+	}
+	if s.Items != nil {
+		for i, item := range arr {
+			s.Items.validate(item, path+"/"+strconv.Itoa(i), out)
+		}
+	}
+}
+
+func (s *Schema) matches(v any) bool {
+	var out []Violation
+	s.validate(v, "", &out)
+	return len(out) == 0
+}
+
+func slicesContainsType(types []string, v any) bool {
+	actual := jsonType(v)
+	for _, t := range types {
+		if t == actual {
+			return true
+		}
+		if t == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonType(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if val == math.Trunc(val) && !math.IsInf(val, 0) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func rawEqual(raw json.RawMessage, v any) bool {
+	var want any
+	if err := json.Unmarshal(raw, &want); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(want, v)
+}
+
+func joinRaw(vals []json.RawMessage) string {
+	parts := make([]string, len(vals))
+	for i, v := range vals {
+		parts[i] = string(v)
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+// escapePointer escapes a property name for use in a JSON Pointer.
+func escapePointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// contextEnvKey is the environment variable holding the script's
+	// InvocationContext as JSON.
+	contextEnvKey = "INVOKE_CONTEXT"
+	// contextVersion is the InvocationContext version scripts can check.
+	contextVersion = 1
+
+	requestIDHeader = "X-Request-Id"
+)
+
+// InvocationContext tells a script what it is running for. It is passed
+// as a JSON object in INVOKE_CONTEXT to every invocation, whatever started
+// it, so scripts have one stable place to look:
+//
+//	{
+//	  "version": 1,
+//	  "request_id": "4bf92f3577b34da6",
+//	  "route": "orders/create",
+//	  "deadline": "2024-05-01T12:00:30.5Z",
+//	  "tenant": "acme",
+//	  "experiment": "checkout-copy",
+//	  "variant": "control",
+//	  "claims": {"sub": "user-42"},
+//	  "trace_id": "4bf92f3577b34da6a3ce929d0e0e4736",
+//	  "span_id": "00f067aa0ba902b7",
+//	  "trigger": "cron",
+//	  "build": {"git_sha": "3f2c1ab", "build_time": "2024-05-01T11:00:00Z"},
+//	  "region": "eu-west-1",
+//	  "zone": "eu-west-1a"
+//	}
+//
+// Fields marked omitempty are left out when unknown. Within a version,
+// fields are only ever added; removing or changing the meaning of one
+// bumps Version.
+type InvocationContext struct {
+	Version int `json:"version"`
+	// RequestID is the caller's X-Request-Id, or one generated for the
+	// request. It is echoed in the response.
+	RequestID string `json:"request_id"`
+	Route     string `json:"route"`
+	// Deadline is when the attempt times out and the script is killed.
+	Deadline time.Time `json:"deadline"`
+	// Tenant is the tenant owning the route, or else the value of the
+	// --tenant-header request header.
+	Tenant string `json:"tenant,omitempty"`
+	// Experiment is the route's experiment and Variant the one the caller
+	// was assigned; see ExperimentConfig.
+	Experiment string `json:"experiment,omitempty"`
+	Variant    string `json:"variant,omitempty"`
+	// Claims are the forwarded claims of the caller's verified JWT; see
+	// JWTConfig.
+	Claims map[string]any `json:"claims,omitempty"`
+	// TraceID and SpanID identify the invocation's W3C trace context, as
+	// forwarded in INVOKE_HEADERS' traceparent.
+	TraceID string `json:"trace_id,omitempty"`
+	SpanID  string `json:"span_id,omitempty"`
+	// Trigger is set, like INVOKE_TRIGGER, when a trigger rather than an
+	// HTTP request started the invocation.
+	Trigger string     `json:"trigger,omitempty"`
+	Build   *BuildInfo `json:"build,omitempty"`
+	Region  string     `json:"region,omitempty"`
+	Zone    string     `json:"zone,omitempty"`
+}
+
+// RequestInfo identifies what an invocation was made for; see
+// InvocationContext.
+type RequestInfo struct {
+	ID      string
+	Tenant  string
+	TraceID string
+	SpanID  string
+	Trigger string
+	// Experiment and Variant are set for routes running an experiment.
+	Experiment string
+	Variant    string
+	// Claims are the forwarded claims of the request's JWT.
+	Claims map[string]any
+	// Caller is the client address of an HTTP request, for the audit
+	// log.
+	Caller string
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestInfo describes r, whose forwarded headers are h, and echoes its
+// request ID in the response.
+func requestInfo(w http.ResponseWriter, r *http.Request, h http.Header, opts handlerOptions) RequestInfo {
+	info := RequestInfo{ID: r.Header.Get(requestIDHeader)}
+	if info.ID == "" {
+		info.ID = newRequestID()
+	}
+	w.Header().Set(requestIDHeader, info.ID)
+	info.Claims = requestClaims(r)
+	info.Caller = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		info.Caller = host
+	}
+	if opts.TenantHeader != "" {
+		info.Tenant = r.Header.Get(opts.TenantHeader)
+	}
+	if p, ok := parseTraceparent(h.Get("traceparent")); ok {
+		info.TraceID = hex.EncodeToString(p.traceID[:])
+		info.SpanID = hex.EncodeToString(p.spanID[:])
+	}
+	return info
+}
+
+// contextEnv returns the INVOKE_CONTEXT variable of call, whose attempt
+// ends at deadline.
+func (inv *Invoker) contextEnv(call Invocation, deadline time.Time) string {
+	req := call.Request
+	if req.ID == "" {
+		req.ID = newRequestID()
+	}
+	b, _ := json.Marshal(InvocationContext{
+		Version:    contextVersion,
+		RequestID:  req.ID,
+		Route:      call.Route.Name,
+		Deadline:   deadline.UTC(),
+		Tenant:     req.Tenant,
+		Experiment: req.Experiment,
+		Variant:    req.Variant,
+		Claims:     req.Claims,
+		TraceID:    req.TraceID,
+		SpanID:     req.SpanID,
+		Trigger:    req.Trigger,
+		Build:      call.Route.build(),
+		Region:     inv.cfg.Locality.Region,
+		Zone:       inv.cfg.Locality.Zone,
+	})
+	return contextEnvKey + "=" + string(b)
+}
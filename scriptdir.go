@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// scriptExtensions are tried in order when resolving a request path to a
+// file in the script directory.
+var scriptExtensions = []string{".js", ".mjs", ".cjs", ".ts", ".mts", ".cts"}
+
+var errScriptNotFound = errors.New("script not found")
+
+// ScriptDir maps request paths onto scripts below a root directory, so
+// POST /invoke/foo/bar runs <root>/foo/bar.js.
+type ScriptDir struct {
+	root string
+	// fallback is applied to scripts that have no sibling schema.
+	fallback *Schema
+	envFiles []string
+}
+
+func NewScriptDir(root string, envFiles []string, fallback *Schema) (*ScriptDir, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	abs, err = filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	return &ScriptDir{root: abs, fallback: fallback, envFiles: envFiles}, nil
+}
+
+// Resolve returns the route for name, a slash separated path relative to
+// the root. Names that escape the root, directly or through symlinks, or
+// that contain hidden segments are rejected as not found.
+func (d *ScriptDir) Resolve(name string) (*Route, error) {
+	name = strings.Trim(name, "/")
+	if !validScriptName(name) {
+		return nil, errScriptNotFound
+	}
+
+	base := filepath.Join(d.root, filepath.FromSlash(name))
+	for _, ext := range scriptExtensions {
+		file, err := d.within(base + ext)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		schema := d.fallback
+		if s, err := d.siblingSchema(base + ".schema.json"); err != nil {
+			return nil, err
+		} else if s != nil {
+			schema = s
+		}
+		response, err := d.siblingSchema(base + ".response.schema.json")
+		if err != nil {
+			return nil, err
+		}
+
+		return &Route{
+			Name:           name,
+			ScriptFile:     file,
+			EnvFiles:       d.envFiles,
+			Schema:         schema,
+			ResponseSchema: response,
+		}, nil
+	}
+	return nil, errScriptNotFound
+}
+
+// validScriptName reports whether name is a clean relative path without
+// hidden segments.
+func validScriptName(name string) bool {
+	if name == "" || path.Clean(name) != name {
+		return false
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if seg == ".." || strings.HasPrefix(seg, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+// within resolves symlinks in p and checks the result is a regular file
+// inside the root.
+func (d *ScriptDir) within(p string) (string, error) {
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(d.root, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errScriptNotFound
+	}
+	info, err := os.Stat(real)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", errScriptNotFound
+	}
+	return real, nil
+}
+
+// siblingSchema loads the schema file next to a script, such as
+// <base>.schema.json for its payloads, when it exists.
+func (d *ScriptDir) siblingSchema(path string) (*Schema, error) {
+	file, err := d.within(path)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, errScriptNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return LoadSchema(file)
+}
+
+// serveFunc is the shape shared by serveInvoke and serveBatch.
+type serveFunc func(http.ResponseWriter, *http.Request, *Invoker, *Route, handlerOptions)
+
+// makeScriptDirHandler resolves the request path after prefix to a script in
+// dir and hands the request to serve.
+func makeScriptDirHandler(inv *Invoker, dir *ScriptDir, prefix string, serve serveFunc, opts handlerOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if opts.CORS.handle(w, r) {
+			return
+		}
+		route, err := dir.Resolve(strings.TrimPrefix(r.URL.Path, prefix))
+		if errors.Is(err, errScriptNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("resolve %s: %v", r.URL.Path, err)
+			http.Error(w, "failed to load script", http.StatusInternalServerError)
+			return
+		}
+		serve(w, r, inv, route, opts)
+	}
+}
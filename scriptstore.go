@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxScriptSize = 1 << 20
+	// versionsDir holds the history of uploaded scripts below the script
+	// directory; as a hidden directory it can't be invoked.
+	versionsDir        = ".versions"
+	activeVersionFile  = "active"
+	syntaxCheckTimeout = 10 * time.Second
+)
+
+// ScriptStore lets clients upload scripts into a ScriptDir and roll them
+// back:
+//
+//	PUT  /scripts/{name}           upload a new version and activate it
+//	GET  /scripts/{name}           list the versions and the active one
+//	POST /scripts/{name}/rollback  activate the previous version, or ?version=N
+//
+// Every version is kept in <root>/.versions/<name>/<n>.js and the active
+// one is copied to <root>/<name>.js, so it takes effect on the next
+// invocation. Uploads must pass `node --check`.
+type ScriptStore struct {
+	dir *ScriptDir
+	inv *Invoker
+
+	mu sync.Mutex
+}
+
+func NewScriptStore(dir *ScriptDir, inv *Invoker) *ScriptStore {
+	return &ScriptStore{dir: dir, inv: inv}
+}
+
+type scriptVersion struct {
+	Version int       `json:"version"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+	// Build is the metadata embedded in the uploaded bundle, if any.
+	Build *BuildInfo `json:"build,omitempty"`
+}
+
+type scriptHistory struct {
+	Name     string          `json:"name"`
+	Active   int             `json:"active"`
+	Versions []scriptVersion `json:"versions"`
+}
+
+func (s *ScriptStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/scripts/"), "/")
+	name, rollback := strings.CutSuffix(name, "/rollback")
+	if !validScriptName(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case rollback && r.Method == http.MethodPost:
+		s.rollback(w, r, name)
+	case !rollback && r.Method == http.MethodPut:
+		s.upload(w, r, name)
+	case !rollback && r.Method == http.MethodGet:
+		h, err := s.history(name)
+		if err != nil {
+			s.fail(w, name, err)
+			return
+		}
+		if len(h.Versions) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, h)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *ScriptStore) upload(w http.ResponseWriter, r *http.Request, name string) {
+	src, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxScriptSize))
+	if err != nil {
+		http.Error(w, "script too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, err := s.history(name)
+	if err != nil {
+		s.fail(w, name, err)
+		return
+	}
+	vdir := s.versionDir(name)
+	if err := os.MkdirAll(vdir, 0o755); err != nil {
+		s.fail(w, name, err)
+		return
+	}
+
+	// Keep a script that predates versioning so it can be rolled back to.
+	if len(h.Versions) == 0 {
+		if cur, err := os.ReadFile(s.activePath(name)); err == nil {
+			err := os.WriteFile(s.versionPath(name, 1), cur, 0o644)
+			if err == nil {
+				err = os.WriteFile(filepath.Join(vdir, activeVersionFile), []byte("1"), 0o644)
+			}
+			if err != nil {
+				s.fail(w, name, err)
+				return
+			}
+			h.Versions = append(h.Versions, scriptVersion{Version: 1})
+		}
+	}
+	version := 1
+	if n := len(h.Versions); n > 0 {
+		version = h.Versions[n-1].Version + 1
+	}
+
+	file := s.versionPath(name, version)
+	if err := os.WriteFile(file, src, 0o644); err != nil {
+		s.fail(w, name, err)
+		return
+	}
+	if out, err := syntaxCheck(r.Context(), file); err != nil {
+		os.Remove(file)
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{
+			"error":   "syntax check failed",
+			"details": out,
+		})
+		return
+	}
+	if err := s.activate(name, version); err != nil {
+		s.fail(w, name, err)
+		return
+	}
+	build := parseBuildInfo(src[:min(len(src), buildHeaderSize)])
+	logAdmin(r, "script %s: uploaded and activated version %d, %s", name, version, build)
+	writeJSON(w, http.StatusCreated, map[string]any{"name": name, "version": version, "build": build})
+}
+
+func (s *ScriptStore) rollback(w http.ResponseWriter, r *http.Request, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, err := s.history(name)
+	if err != nil {
+		s.fail(w, name, err)
+		return
+	}
+	if len(h.Versions) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	target := 0
+	if v := r.URL.Query().Get("version"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid version %q", v), http.StatusBadRequest)
+			return
+		}
+		target = n
+	} else {
+		for _, v := range h.Versions {
+			if v.Version < h.Active {
+				target = v.Version
+			}
+		}
+		if target == 0 {
+			http.Error(w, "no earlier version to roll back to", http.StatusConflict)
+			return
+		}
+	}
+	if _, err := os.Stat(s.versionPath(name, target)); err != nil {
+		http.Error(w, fmt.Sprintf("unknown version %d", target), http.StatusNotFound)
+		return
+	}
+
+	if err := s.activate(name, target); err != nil {
+		s.fail(w, name, err)
+		return
+	}
+	logAdmin(r, "script %s: rolled back from version %d to %d", name, h.Active, target)
+	writeJSON(w, http.StatusOK, map[string]any{"name": name, "version": target})
+}
+
+// activate installs version as the script invocations run, replacing the
+// previous file atomically.
+func (s *ScriptStore) activate(name string, version int) error {
+	src, err := os.ReadFile(s.versionPath(name, version))
+	if err != nil {
+		return err
+	}
+	dst := s.activePath(name)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	s.inv.cache.Purge()
+	return os.WriteFile(filepath.Join(s.versionDir(name), activeVersionFile), []byte(strconv.Itoa(version)), 0o644)
+}
+
+// history lists the stored versions of name in ascending order.
+func (s *ScriptStore) history(name string) (scriptHistory, error) {
+	h := scriptHistory{Name: name, Versions: []scriptVersion{}}
+	entries, err := os.ReadDir(s.versionDir(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return h, err
+	}
+	for _, e := range entries {
+		n, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".js"))
+		if err != nil || !strings.HasSuffix(e.Name(), ".js") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return h, err
+		}
+		h.Versions = append(h.Versions, scriptVersion{
+			Version: n,
+			Size:    info.Size(),
+			Created: info.ModTime().UTC(),
+			Build:   readBuildInfo(filepath.Join(s.versionDir(name), e.Name())),
+		})
+	}
+	sort.Slice(h.Versions, func(i, j int) bool { return h.Versions[i].Version < h.Versions[j].Version })
+
+	if b, err := os.ReadFile(filepath.Join(s.versionDir(name), activeVersionFile)); err == nil {
+		h.Active, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+	}
+	return h, nil
+}
+
+func (s *ScriptStore) versionDir(name string) string {
+	return filepath.Join(s.dir.root, versionsDir, filepath.FromSlash(name))
+}
+
+func (s *ScriptStore) versionPath(name string, version int) string {
+	return filepath.Join(s.versionDir(name), strconv.Itoa(version)+".js")
+}
+
+func (s *ScriptStore) activePath(name string) string {
+	return filepath.Join(s.dir.root, filepath.FromSlash(name)+".js")
+}
+
+func (s *ScriptStore) fail(w http.ResponseWriter, name string, err error) {
+	log.Printf("script %s: %v", name, err)
+	http.Error(w, "script store failed", http.StatusInternalServerError)
+}
+
+// syntaxCheck runs `node --check` on file and returns its diagnostics.
+func syntaxCheck(ctx context.Context, file string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, syntaxCheckTimeout)
+	defer cancel()
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, nodeBinary, "--check", file)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	return strings.TrimSpace(out.String()), err
+}
@@ -0,0 +1,62 @@
+// Type declarations of go-invoke, the helper for go-invoke-node scripts.
+
+/// <reference types="node" />
+
+/** The --store client; TTLs are in seconds. */
+export interface StoreClient {
+  cache: {
+    get(key: string): Promise<any>;
+    set(key: string, value: any, ttl?: number): Promise<void>;
+    delete(key: string): Promise<void>;
+    wrap<T>(key: string, ttl: number | undefined, fn: () => Promise<T>): Promise<T>;
+  };
+  kv: {
+    get(key: string): Promise<any>;
+    set(key: string, value: any, ttl?: number): Promise<void>;
+    create(key: string, value: any, ttl?: number): Promise<boolean>;
+    delete(key: string): Promise<void>;
+  };
+  publish(topic: string, message: any): Promise<void>;
+}
+
+/** Context describes one invocation. */
+export declare class Context {
+  /** The INVOKE_CONTEXT object as the server sent it. */
+  readonly raw: Record<string, any>;
+  /** The invocation's environment. */
+  readonly env: Record<string, string | undefined>;
+  readonly requestId: string;
+  readonly route: string;
+  readonly deadline?: Date;
+  readonly tenant?: string;
+  readonly experiment?: string;
+  readonly variant?: string;
+  /** The forwarded claims of the caller's verified JWT. */
+  readonly claims: Record<string, any>;
+  readonly traceId?: string;
+  readonly spanId?: string;
+  /** What started the invocation when it wasn't an HTTP request, e.g. cron. */
+  readonly trigger?: string;
+  readonly region?: string;
+  readonly zone?: string;
+  /** Forwarded request headers, keyed by lower-cased name. */
+  readonly headers: Record<string, string>;
+  /** Milliseconds left until the invocation times out. */
+  remaining(): number;
+  /** Sets the HTTP status; not available to persistent workers. */
+  setStatus(status: number): void;
+  /** Sets an HTTP response header; not available to persistent workers. */
+  setHeader(name: string, value: string | string[]): void;
+  /** Sends an SSE event to streaming callers of routes with stream_events. */
+  emit(event: string, data?: any): void;
+  /** The --store client; throws when the server has no store. */
+  readonly store: StoreClient;
+}
+
+/**
+ * Runs fn for every invocation of the script. The payload is parsed JSON,
+ * or a Buffer on raw routes, where a string or Buffer result is sent as is.
+ */
+export declare function handler<P = any, R = any>(
+  fn: (payload: P, ctx: Context) => R | Promise<R>,
+): void;
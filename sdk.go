@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	sdkPackage = "go-invoke"
+	sdkVersion = "1.0.0"
+)
+
+var (
+	//go:embed sdk.js
+	sdkJS []byte
+	//go:embed sdk.d.ts
+	sdkDTS []byte
+)
+
+// sdkFiles returns the files of the go-invoke package, the helper scripts
+// require to have their payload, context and result handled for them
+// whether they are spawned per invocation or run as persistent workers.
+func sdkFiles() []npmFile {
+	manifest, _ := json.MarshalIndent(map[string]any{
+		"name":        sdkPackage,
+		"version":     sdkVersion,
+		"description": "Handler helper for go-invoke-node scripts",
+		"main":        "index.js",
+		"types":       "index.d.ts",
+		"files":       []string{"index.js", "index.d.ts"},
+	}, "", "  ")
+	return []npmFile{
+		{"package.json", append(manifest, '\n')},
+		{"index.js", sdkJS},
+		{"index.d.ts", sdkDTS},
+	}
+}
+
+// sdkModules writes the go-invoke package to the cache directory once,
+// returning the node_modules directory holding it. Like the preloads, it
+// is named after its content so servers of different versions don't share
+// it.
+var sdkModules = sync.OnceValues(func() (string, error) {
+	files := sdkFiles()
+	h := sha256.New()
+	for _, f := range files {
+		h.Write([]byte(f.name))
+		h.Write(f.data)
+	}
+	modules := filepath.Join(filepath.Dir(tsCacheDir()), "sdk-"+hex.EncodeToString(h.Sum(nil)[:8]), "node_modules")
+	if err := writeFiles(filepath.Join(modules, sdkPackage), files); err != nil {
+		return "", err
+	}
+	return modules, nil
+})
+
+// appendNodePath makes the packages in modules resolvable from every
+// script, after any others, so that a vendored or --package-json copy of a
+// package wins.
+func appendNodePath(modules string) {
+	if prev := os.Getenv("NODE_PATH"); prev != "" {
+		modules = prev + string(os.PathListSeparator) + modules
+	}
+	os.Setenv("NODE_PATH", modules)
+}
+
+// writeFiles writes files, named relative to dir, leaving those already up
+// to date alone.
+func writeFiles(dir string, files []npmFile) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if b, err := os.ReadFile(path); err == nil && bytes.Equal(b, f.data) {
+			continue
+		}
+		tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+		if err := os.WriteFile(tmp, f.data, 0o644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	return nil
+}
+
+// runSDKCommand runs `go-invoke-node sdk <dir|file.tgz>`, which writes the
+// go-invoke package the server provides to scripts, as a directory or as
+// a tarball for npm install:
+//
+//	go-invoke-node sdk vendor/go-invoke
+//	go-invoke-node sdk go-invoke.tgz && npm install ./go-invoke.tgz
+//
+// Scripts don't need it to run, but editors and type checkers find the
+// package's declarations only when it is installed next to them.
+func runSDKCommand(args []string) int {
+	if len(args) != 1 {
+		log.Print("usage: sdk <dir|file.tgz>")
+		return exitUsage
+	}
+	dest := args[0]
+	if strings.HasSuffix(dest, ".tgz") || strings.HasSuffix(dest, ".tar.gz") {
+		tarball, err := packNPM(sdkFiles())
+		if err == nil {
+			err = os.WriteFile(dest, tarball, 0o644)
+		}
+		if err != nil {
+			log.Print(err)
+			return exitFailure
+		}
+		return 0
+	}
+	if err := writeFiles(dest, sdkFiles()); err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	return 0
+}
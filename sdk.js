@@ -0,0 +1,143 @@
+// go-invoke: the helper for go-invoke-node scripts.
+//
+//   const { handler } = require('go-invoke');
+//   handler(async (payload, ctx) => ({ hello: payload.name }));
+//
+// It reads the payload, runs the function and writes what it returns as
+// the response, however the server runs the script: spawned per
+// invocation, where the payload arrives on stdin, or as a persistent
+// worker speaking the stdio or http protocol. A thrown error fails the
+// invocation with its stack on stderr.
+//
+// The server makes the module resolvable from every script; `go-invoke-node
+// sdk <dir>` writes it out for vendoring or npm install, e.g. to get its
+// type declarations into an editor.
+'use strict';
+
+const fs = require('node:fs');
+
+function parseJSON(text, fallback) {
+  if (!text) return fallback;
+  try {
+    return JSON.parse(text);
+  } catch {
+    return fallback;
+  }
+}
+
+// Context describes one invocation; see InvocationContext on the server.
+class Context {
+  constructor(env) {
+    const c = parseJSON(env.INVOKE_CONTEXT, {});
+    this.raw = c;
+    this.env = env;
+    this.requestId = c.request_id;
+    this.route = c.route;
+    this.deadline = c.deadline ? new Date(c.deadline) : undefined;
+    this.tenant = c.tenant;
+    this.experiment = c.experiment;
+    this.variant = c.variant;
+    this.claims = c.claims || {};
+    this.traceId = c.trace_id;
+    this.spanId = c.span_id;
+    this.trigger = c.trigger;
+    this.region = c.region;
+    this.zone = c.zone;
+    this.headers = parseJSON(env.INVOKE_HEADERS, {});
+    this.response = { status: 0, headers: {} };
+  }
+
+  // remaining returns the milliseconds left until the invocation times
+  // out.
+  remaining() {
+    return this.deadline ? Math.max(0, this.deadline.getTime() - Date.now()) : Infinity;
+  }
+
+  // setStatus and setHeader shape the HTTP response. Only scripts spawned
+  // per invocation can; persistent workers always answer 200.
+  setStatus(status) {
+    this.response.status = status;
+  }
+
+  setHeader(name, value) {
+    this.response.headers[name] = value;
+  }
+
+  // emit sends an SSE event to streaming callers of routes with
+  // stream_events.
+  emit(event, data) {
+    process.stdout.write(`@@${event} ${JSON.stringify(data === undefined ? null : data)}\n`);
+  }
+
+  // store is the --store client, when the server has one.
+  get store() {
+    if (!this.env.INVOKE_STORE_CLIENT) throw new Error('go-invoke: the server has no --store');
+    return require(this.env.INVOKE_STORE_CLIENT);
+  }
+}
+
+function encode(result, raw) {
+  if (result === undefined || result === null) return '';
+  if (raw && (typeof result === 'string' || Buffer.isBuffer(result))) return result;
+  return JSON.stringify(result) + '\n';
+}
+
+// once runs fn for the single invocation of a spawned script.
+async function once(fn) {
+  const raw = Boolean(process.env.INVOKE_CONTENT_TYPE);
+  const chunks = [];
+  for await (const chunk of process.stdin) chunks.push(chunk);
+  const input = Buffer.concat(chunks);
+  const ctx = new Context(process.env);
+  let result;
+  try {
+    result = await fn(raw ? input : parseJSON(input.toString(), {}), ctx);
+  } catch (err) {
+    console.error((err && err.stack) || String(err));
+    process.exitCode = 1;
+    return;
+  }
+  const { status, headers } = ctx.response;
+  const fd = Number(process.env.INVOKE_RESPONSE_FD);
+  if (fd && (status || Object.keys(headers).length > 0)) {
+    fs.writeSync(fd, JSON.stringify({ status: status || undefined, headers }));
+  }
+  const out = encode(result, raw);
+  if (out.length > 0) process.stdout.write(out);
+}
+
+// serveHTTP answers invocations on the socket of an http worker.
+function serveHTTP(fn) {
+  const http = require('node:http');
+  http
+    .createServer(async (req, res) => {
+      const chunks = [];
+      for await (const chunk of req) chunks.push(chunk);
+      const env = { ...process.env, ...parseJSON(req.headers['x-invoke-env'], {}) };
+      try {
+        const result = await fn(parseJSON(Buffer.concat(chunks).toString(), {}), new Context(env));
+        res.writeHead(200, { 'Content-Type': 'application/json' });
+        res.end(encode(result, false));
+      } catch (err) {
+        res.writeHead(500, { 'Content-Type': 'text/plain' });
+        res.end((err && err.stack) || String(err));
+      }
+    })
+    .listen(process.env.INVOKE_SOCKET);
+}
+
+// handler runs fn for every invocation of the script. fn receives the
+// payload, parsed from JSON or as a Buffer on raw routes, and a Context,
+// and returns the output: a value sent as JSON, or on raw routes also a
+// string or Buffer sent as is.
+function handler(fn) {
+  if (process.env.INVOKE_WORKER_CLIENT) {
+    require(process.env.INVOKE_WORKER_CLIENT)((payload, env) => fn(payload, new Context({ ...process.env, ...env })));
+  } else if (process.env.INVOKE_SOCKET) {
+    serveHTTP(fn);
+  } else {
+    once(fn);
+  }
+}
+
+module.exports = { handler, Context };
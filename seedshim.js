@@ -0,0 +1,89 @@
+// Seeded randomness of go-invoke-node, preloaded with --require into
+// scripts in deterministic mode. Math.random and the random functions of
+// node:crypto and Web Crypto draw from a generator seeded with
+// INVOKE_SEED, so an invocation can be replayed exactly. Keys generated
+// by crypto.generateKey* are not covered.
+'use strict';
+
+const crypto = require('node:crypto');
+
+// splitmix64, over BigInts to keep all 64 bits.
+let state = BigInt.asUintN(64, BigInt(process.env.INVOKE_SEED || '0'));
+function next64() {
+  state = BigInt.asUintN(64, state + 0x9e3779b97f4a7c15n);
+  let z = state;
+  z = BigInt.asUintN(64, (z ^ (z >> 30n)) * 0xbf58476d1ce4e5b9n);
+  z = BigInt.asUintN(64, (z ^ (z >> 27n)) * 0x94d049bb133111ebn);
+  return z ^ (z >> 31n);
+}
+
+Math.random = function random() {
+  // The top 53 bits make a double in [0, 1).
+  return Number(next64() >> 11n) / 2 ** 53;
+};
+
+function fill(view) {
+  const bytes = new Uint8Array(view.buffer, view.byteOffset, view.byteLength);
+  for (let i = 0; i < bytes.length; i += 8) {
+    let v = next64();
+    for (let j = i; j < Math.min(i + 8, bytes.length); j++) {
+      bytes[j] = Number(v & 0xffn);
+      v >>= 8n;
+    }
+  }
+  return view;
+}
+
+crypto.randomFillSync = function randomFillSync(buf, offset = 0, size) {
+  const view = ArrayBuffer.isView(buf) ? buf : new Uint8Array(buf);
+  const start = view.byteOffset + offset * (view.BYTES_PER_ELEMENT || 1);
+  const length = size === undefined ? view.byteLength - (start - view.byteOffset) : size * (view.BYTES_PER_ELEMENT || 1);
+  fill(new Uint8Array(view.buffer, start, length));
+  return buf;
+};
+
+crypto.randomFill = function randomFill(buf, ...args) {
+  const callback = args.pop();
+  crypto.randomFillSync(buf, ...args);
+  process.nextTick(callback, null, buf);
+};
+
+crypto.randomBytes = function randomBytes(size, callback) {
+  const buf = fill(Buffer.alloc(size));
+  if (typeof callback === 'function') {
+    process.nextTick(callback, null, buf);
+    return;
+  }
+  return buf;
+};
+
+crypto.randomInt = function randomInt(min, max, callback) {
+  if (typeof max !== 'number') {
+    callback = max;
+    max = min;
+    min = 0;
+  }
+  const n = min + Math.floor(Math.random() * (max - min));
+  if (typeof callback === 'function') {
+    process.nextTick(callback, null, n);
+    return;
+  }
+  return n;
+};
+
+function randomUUID() {
+  const b = fill(new Uint8Array(16));
+  b[6] = (b[6] & 0x0f) | 0x40;
+  b[8] = (b[8] & 0x3f) | 0x80;
+  const hex = Buffer.from(b).toString('hex');
+  return `${hex.slice(0, 8)}-${hex.slice(8, 12)}-${hex.slice(12, 16)}-${hex.slice(16, 20)}-${hex.slice(20)}`;
+}
+crypto.randomUUID = randomUUID;
+
+const web = globalThis.crypto || crypto.webcrypto;
+if (web) {
+  web.getRandomValues = function getRandomValues(view) {
+    return fill(view);
+  };
+  web.randomUUID = randomUUID;
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signingHMAC = "hmac"
+	signingJWS  = "jws"
+
+	// responseSignatureHeader carries the HMAC signature of a response,
+	// in the format of callback deliveries.
+	responseSignatureHeader = callbackSignatureHeader
+	// responseJWSHeader carries the detached JWS of a response.
+	responseJWSHeader = "X-Invoke-JWS"
+)
+
+// SigningConfig signs the bodies of successful invocation responses, so
+// consumers behind proxies and queues can verify they came from this
+// server unaltered. Mode is hmac or jws, and KeyFile holds the key:
+//
+//   - hmac: a shared secret. Responses carry an X-Invoke-Signature header
+//     of the form t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">,
+//     verified like a callback delivery.
+//   - jws: a PEM private key, Ed25519, ECDSA P-256 or RSA, signing with
+//     EdDSA, ES256 or RS256. Responses carry an X-Invoke-JWS header holding
+//     a compact JWS with a detached payload (RFC 7515 appendix F), the
+//     body being the payload.
+//
+// The body signed is the one before Content-Encoding, i.e. as read by
+// clients that decompress it. Streamed responses and error responses are
+// not signed.
+type SigningConfig struct {
+	Mode    string
+	KeyFile string
+}
+
+func (c SigningConfig) validate() error {
+	switch c.Mode {
+	case "":
+		if c.KeyFile != "" {
+			return errors.New("--response-signing-key-file requires --response-signing")
+		}
+		return nil
+	case signingHMAC, signingJWS:
+	default:
+		return fmt.Errorf("invalid --response-signing %q: must be %s or %s", c.Mode, signingHMAC, signingJWS)
+	}
+	if c.KeyFile == "" {
+		return errors.New("--response-signing requires --response-signing-key-file")
+	}
+	return nil
+}
+
+// Signer signs response bodies with the key of a SigningConfig, loaded
+// once at startup.
+type Signer struct {
+	hmacKey []byte
+
+	key crypto.Signer
+	alg string
+	// protected is the encoded JWS protected header.
+	protected string
+}
+
+// NewSigner loads the key of c, returning nil when signing is disabled.
+func NewSigner(c SigningConfig) (*Signer, error) {
+	if c.Mode == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if c.Mode == signingHMAC {
+		secret := strings.TrimRight(string(b), "\r\n")
+		if secret == "" {
+			return nil, fmt.Errorf("%s is empty", c.KeyFile)
+		}
+		return &Signer{hmacKey: []byte(secret)}, nil
+	}
+
+	s := &Signer{}
+	if s.key, err = parsePrivateKey(b); err != nil {
+		return nil, fmt.Errorf("%s: %w", c.KeyFile, err)
+	}
+	switch k := s.key.(type) {
+	case ed25519.PrivateKey:
+		s.alg = "EdDSA"
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%s: ECDSA keys must use P-256", c.KeyFile)
+		}
+		s.alg = "ES256"
+	case *rsa.PrivateKey:
+		s.alg = "RS256"
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %T", c.KeyFile, s.key)
+	}
+	header, _ := json.Marshal(map[string]string{"alg": s.alg})
+	s.protected = base64.RawURLEncoding.EncodeToString(header)
+	return s, nil
+}
+
+// parsePrivateKey parses a PEM PKCS #8, SEC 1 or PKCS #1 private key.
+func parsePrivateKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// sign sets the signature header of body in h. It does nothing when
+// signing is disabled.
+func (s *Signer) sign(h http.Header, body []byte) error {
+	if s == nil {
+		return nil
+	}
+	if s.hmacKey != nil {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		sig := hmacSHA256(s.hmacKey, ts, ".", string(body))
+		h.Set(responseSignatureHeader, "t="+ts+",v1="+hex.EncodeToString(sig))
+		return nil
+	}
+	input := s.protected + "." + base64.RawURLEncoding.EncodeToString(body)
+	sig, err := s.jwsSignature([]byte(input))
+	if err != nil {
+		return err
+	}
+	h.Set(responseJWSHeader, s.protected+".."+base64.RawURLEncoding.EncodeToString(sig))
+	return nil
+}
+
+func (s *Signer) jwsSignature(input []byte) ([]byte, error) {
+	switch k := s.key.(type) {
+	case ed25519.PrivateKey:
+		return ed25519.Sign(k, input), nil
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(input)
+		r, ss, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		// JWS encodes ECDSA signatures as R and S of 32 bytes each.
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		ss.FillBytes(sig[32:])
+		return sig, nil
+	default:
+		digest := sha256.Sum256(input)
+		return s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+}
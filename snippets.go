@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"path/filepath"
+)
+
+// addSnippets makes routes of the inline snippets of the config's scripts
+// library, each named after its snippet:
+//
+//	scripts:
+//	  hash: |
+//	    const { handler } = require('go-invoke');
+//	    handler(({ text }) => ({ sha256: require('node:crypto').createHash('sha256').update(text).digest('hex') }));
+//	  uuid: console.log(JSON.stringify(require('node:crypto').randomUUID()))
+//
+// Unlike a route's script, which node runs with -e, snippets are written
+// to files first, so their stack traces name them. A route declared with
+// the snippet's name and no script of its own sets what it runs with.
+func addSnippets(decls map[string]RouteConfig, scripts map[string]string) error {
+	for name, src := range scripts {
+		if !routeNamePattern.MatchString(name) {
+			return fmt.Errorf("script %q: invalid name", name)
+		}
+		rc, ok := decls[name]
+		if ok && (rc.Script != "" || rc.ScriptFile != "" || len(rc.Rules) > 0 || rc.Webhook != nil || len(rc.Pipeline) > 0) {
+			return fmt.Errorf("script %q: route %q runs a script of its own", name, name)
+		}
+		file, err := writeSnippet(name, src)
+		if err != nil {
+			return fmt.Errorf("script %q: %w", name, err)
+		}
+		rc.ScriptFile = file
+		decls[name] = rc
+	}
+	return nil
+}
+
+// writeSnippet writes the snippet src to a directory of its own in the
+// cache directory, returning its path. The directory is named after the
+// content, so servers with different libraries don't share it, and holds
+// nothing else, as sandboxes let scripts read their file's directory.
+func writeSnippet(name, src string) (string, error) {
+	sum := sha256.Sum256([]byte(name + "\x00" + src))
+	dir := filepath.Join(filepath.Dir(tsCacheDir()), "scripts", hex.EncodeToString(sum[:8]))
+	file := path.Base(name) + ".js"
+	if err := writeFiles(dir, []npmFile{{file, []byte(src)}}); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, file), nil
+}
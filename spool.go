@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// spool decouples a producer from a slow consumer by buffering everything
+// written to it in an unlinked temp file. The producer never blocks on the
+// consumer; the consumer reads at its own pace via pump.
+type spool struct {
+	f *os.File
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	size   int64
+	closed bool
+}
+
+func newSpool() (*spool, error) {
+	f, err := os.CreateTemp("", "invoke-spool-*")
+	if err != nil {
+		return nil, err
+	}
+	// The open descriptor keeps the data reachable; nothing is left behind
+	// on disk if the process dies.
+	os.Remove(f.Name())
+	s := &spool{f: f}
+	s.cond = sync.NewCond(&s.mu)
+	return s, nil
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, err := s.f.WriteAt(p, s.size)
+	s.size += int64(n)
+	s.cond.Broadcast()
+	return n, err
+}
+
+// CloseWrite marks the end of the data; pump returns once it is drained.
+func (s *spool) CloseWrite() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// pump copies spooled data to dst until CloseWrite has been called and
+// everything has been delivered, or dst fails.
+func (s *spool) pump(dst io.Writer) error {
+	buf := make([]byte, 32*1024)
+	var off int64
+	for {
+		s.mu.Lock()
+		for off == s.size && !s.closed {
+			s.cond.Wait()
+		}
+		size, closed := s.size, s.closed
+		s.mu.Unlock()
+
+		if off == size && closed {
+			return nil
+		}
+
+		n, err := s.f.ReadAt(buf[:min(int64(len(buf)), size-off)], off)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			off += int64(n)
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+}
+
+func (s *spool) Close() error {
+	return s.f.Close()
+}
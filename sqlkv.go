@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// sqlKVTable holds the keys of every namespace.
+	sqlKVTable = "invoke_kv"
+	// sqliteFile is the database a directory spec opens.
+	sqliteFile    = "invoke.db"
+	sqlTimeout    = 5 * time.Second
+	sqlKVSweep    = 10 * time.Minute
+	sqliteTimeout = 5000 // ms a writer waits for the database lock
+)
+
+// sqlDialect is what differs between the SQL databases.
+type sqlDialect struct {
+	driver string
+	// blob is the column type of values.
+	blob string
+	// numbered placeholders are $1, $2, … rather than ?.
+	numbered bool
+}
+
+var (
+	sqliteDialect   = sqlDialect{driver: "sqlite", blob: "BLOB"}
+	postgresDialect = sqlDialect{driver: "pgx", blob: "BYTEA", numbered: true}
+)
+
+// sqlKV is a KVBackend on a SQL database: a SQLite file, which keeps one
+// server's state across restarts, or a PostgreSQL database shared by
+// several servers. Every namespace's keys are rows of one table, expiring
+// at the time in their expires column, in Unix nanoseconds; expired rows
+// are ignored, and swept every sqlKVSweep.
+type sqlKV struct {
+	db        *sql.DB
+	dialect   sqlDialect
+	namespace string
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// openSQLite opens the SQLite database at path, creating it.
+func openSQLite(path, namespace string) (*sqlKV, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)", path, sqliteTimeout)
+	return openSQLKV(sqliteDialect, dsn, namespace)
+}
+
+func openSQLKV(d sqlDialect, dsn, namespace string) (*sqlKV, error) {
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if d == sqliteDialect {
+		// One connection serializes the process's writers rather than
+		// having them wait on each other for the file lock.
+		db.SetMaxOpenConns(1)
+	}
+	s := &sqlKV{db: db, dialect: d, namespace: namespace, stop: make(chan struct{})}
+	ctx, cancel := context.WithTimeout(context.Background(), sqlTimeout)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+sqlKVTable+` (
+	namespace TEXT NOT NULL,
+	name TEXT NOT NULL,
+	value `+d.blob+` NOT NULL,
+	expires BIGINT,
+	PRIMARY KEY (namespace, name)
+)`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	go s.sweepEvery(sqlKVSweep)
+	return s, nil
+}
+
+// query rewrites the ? placeholders of q for the dialect.
+func (s *sqlKV) query(q string) string {
+	if !s.dialect.numbered {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *sqlKV) Get(key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sqlTimeout)
+	defer cancel()
+	var value []byte
+	err := s.db.QueryRowContext(ctx, s.query(`SELECT value FROM `+sqlKVTable+` WHERE namespace = ? AND name = ? AND (expires IS NULL OR expires > ?)`),
+		s.namespace, key, time.Now().UnixNano()).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errKeyNotFound
+	}
+	return value, err
+}
+
+func (s *sqlKV) Put(key string, value []byte, ttl time.Duration, create bool) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sqlTimeout)
+	defer cancel()
+	now := time.Now()
+	var expires *int64
+	if ttl > 0 {
+		t := now.Add(ttl).UnixNano()
+		expires = &t
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	upsert := `INSERT INTO ` + sqlKVTable + ` (namespace, name, value, expires) VALUES (?, ?, ?, ?)
+ON CONFLICT (namespace, name) DO UPDATE SET value = excluded.value, expires = excluded.expires`
+	if create {
+		// Only an expired row is replaced.
+		res, err := s.db.ExecContext(ctx, s.query(upsert+` WHERE `+sqlKVTable+`.expires IS NOT NULL AND `+sqlKVTable+`.expires <= ?`),
+			s.namespace, key, value, expires, now.UnixNano())
+		if err != nil {
+			return false, err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			if err == nil {
+				err = errKeyExists
+			}
+			return false, err
+		}
+		return true, nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var n int
+	if err := tx.QueryRowContext(ctx, s.query(`SELECT COUNT(*) FROM `+sqlKVTable+` WHERE namespace = ? AND name = ? AND (expires IS NULL OR expires > ?)`),
+		s.namespace, key, now.UnixNano()).Scan(&n); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, s.query(upsert), s.namespace, key, value, expires); err != nil {
+		return false, err
+	}
+	return n == 0, tx.Commit()
+}
+
+func (s *sqlKV) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sqlTimeout)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, s.query(`DELETE FROM `+sqlKVTable+` WHERE namespace = ? AND name = ?`), s.namespace, key)
+	return err
+}
+
+func (s *sqlKV) Len() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sqlTimeout)
+	defer cancel()
+	var n int
+	err := s.db.QueryRowContext(ctx, s.query(`SELECT COUNT(*) FROM `+sqlKVTable+` WHERE namespace = ?`), s.namespace).Scan(&n)
+	return n, err
+}
+
+// Keys filters by prefix itself, since LIKE and range comparisons depend
+// on the database's collation.
+func (s *sqlKV) Keys(prefix string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sqlTimeout)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, s.query(`SELECT name FROM `+sqlKVTable+` WHERE namespace = ?`), s.namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, rows.Err()
+}
+
+// sweepEvery deletes expired keys every interval until s is closed.
+func (s *sqlKV) sweepEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+		if err := s.sweep(); err != nil {
+			log.Printf("%s store: sweep: %v", s.namespace, err)
+		}
+	}
+}
+
+func (s *sqlKV) sweep() error {
+	ctx, cancel := context.WithTimeout(context.Background(), sqlTimeout)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, s.query(`DELETE FROM `+sqlKVTable+` WHERE namespace = ? AND expires IS NOT NULL AND expires <= ?`),
+		s.namespace, time.Now().UnixNano())
+	return err
+}
+
+func (s *sqlKV) Close() error {
+	s.once.Do(func() { close(s.stop) })
+	return s.db.Close()
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// storeSocketEnvKey tells scripts where the store listens.
+	storeSocketEnvKey = "INVOKE_STORE_SOCKET"
+	// storeClientEnvKey is the path of the JS client for the store.
+	storeClientEnvKey = "INVOKE_STORE_CLIENT"
+
+	maxStoreValueSize = 64 << 10
+	// storeSubscriberBuffer is how many messages a subscriber may fall
+	// behind before further messages to it are dropped.
+	storeSubscriberBuffer = 64
+)
+
+//go:embed storeclient.js
+var storeClient []byte
+
+// Store is a small in-memory key/value store, cache and pub/sub hub that
+// scripts reach over HTTP on the unix socket in INVOKE_STORE_SOCKET, most
+// easily through the client module at INVOKE_STORE_CLIENT:
+//
+//	GET    /kv/{key}             the value, or 404
+//	PUT    /kv/{key}?ttl=30s     set the value; If-None-Match: * only creates
+//	DELETE /kv/{key}
+//	GET    /cache/{key}          like /kv, but entries are evicted least
+//	PUT    /cache/{key}?ttl=30s  recently used first once the cache is full
+//	DELETE /cache/{key}
+//	POST   /publish/{topic}      send a JSON message to current subscribers
+//	GET    /subscribe/{topic}    receive messages as newline-delimited JSON
+//
+// Keys live in a KVBackend, in memory unless --store-backend names a
+// durable or shared one, and the cache in memory unless --cache-backend
+// does; pub/sub only lives as long as the server process. Sandboxed scripts need network access to reach the socket.
+type Store struct {
+	dir  string
+	sock string
+	ln   net.Listener
+	// kv backs /kv.
+	kv KVBackend
+	// cache backs /cache; nil disables it.
+	cache *resultCache
+
+	mu   sync.Mutex
+	subs map[string]map[chan []byte]struct{}
+}
+
+// StartStore listens on a socket in a new temporary directory and serves
+// the store in the background.
+func StartStore(kv KVBackend, cache *resultCache) (*Store, error) {
+	dir, err := os.MkdirTemp("", "invoke-store-*")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "client.js"), storeClient, 0o644); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	sock := filepath.Join(dir, "store.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	s := &Store{
+		dir:   dir,
+		sock:  sock,
+		ln:    ln,
+		kv:    kv,
+		cache: cache,
+		subs:  map[string]map[chan []byte]struct{}{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /kv/{key...}", s.get)
+	mux.HandleFunc("PUT /kv/{key...}", s.put)
+	mux.HandleFunc("DELETE /kv/{key...}", s.delete)
+	if cache != nil {
+		mux.HandleFunc("GET /cache/{key...}", s.cacheGet)
+		mux.HandleFunc("PUT /cache/{key...}", s.cachePut)
+		mux.HandleFunc("DELETE /cache/{key...}", s.cacheDelete)
+	}
+	mux.HandleFunc("POST /publish/{topic...}", s.publish)
+	mux.HandleFunc("GET /subscribe/{topic...}", s.subscribe)
+	go http.Serve(ln, mux)
+	return s, nil
+}
+
+// Env returns the variables pointing scripts at the store and its client.
+func (s *Store) Env() []string {
+	return []string{
+		storeSocketEnvKey + "=" + s.sock,
+		storeClientEnvKey + "=" + filepath.Join(s.dir, "client.js"),
+	}
+}
+
+// Keys returns the number of /kv keys, possibly including expired ones
+// not yet dropped.
+func (s *Store) Keys() (int, error) {
+	return s.kv.Len()
+}
+
+// Close stops serving, removes the socket and closes the backend.
+func (s *Store) Close() {
+	s.ln.Close()
+	os.RemoveAll(s.dir)
+	s.kv.Close()
+}
+
+func (s *Store) get(w http.ResponseWriter, r *http.Request) {
+	value, err := s.kv.Get(r.PathValue("key"))
+	if errors.Is(err, errKeyNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.backendError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(value)
+}
+
+// readValue reads the ttl parameter and body of a PUT. It writes the error
+// response and returns false when they are invalid.
+func readValue(w http.ResponseWriter, r *http.Request) (value []byte, ttl time.Duration, ok bool) {
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("invalid ttl %q", v), http.StatusBadRequest)
+			return nil, 0, false
+		}
+		ttl = d
+	}
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxStoreValueSize))
+	if err != nil {
+		http.Error(w, "value too large", http.StatusRequestEntityTooLarge)
+		return nil, 0, false
+	}
+	return value, ttl, true
+}
+
+func (s *Store) put(w http.ResponseWriter, r *http.Request) {
+	value, ttl, ok := readValue(w, r)
+	if !ok {
+		return
+	}
+	created, err := s.kv.Put(r.PathValue("key"), value, ttl, r.Header.Get("If-None-Match") == "*")
+	switch {
+	case errors.Is(err, errKeyExists):
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case errors.Is(err, errStoreFull):
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+	case err != nil:
+		s.backendError(w, err)
+	case created:
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Store) delete(w http.ResponseWriter, r *http.Request) {
+	if err := s.kv.Delete(r.PathValue("key")); err != nil {
+		s.backendError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Store) backendError(w http.ResponseWriter, err error) {
+	log.Printf("store: %v", err)
+	http.Error(w, "store backend unavailable", http.StatusBadGateway)
+}
+
+func (s *Store) cacheGet(w http.ResponseWriter, r *http.Request) {
+	value, ok := s.cache.Get(r.PathValue("key"))
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(value)
+}
+
+// cachePut stores a value for at most the cache's TTL, the default when
+// no ttl is given.
+func (s *Store) cachePut(w http.ResponseWriter, r *http.Request) {
+	value, ttl, ok := readValue(w, r)
+	if !ok {
+		return
+	}
+	if ttl == 0 {
+		ttl = s.cache.ttl
+	}
+	s.cache.PutTTL(r.PathValue("key"), value, ttl)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Store) cacheDelete(w http.ResponseWriter, r *http.Request) {
+	s.cache.Delete(r.PathValue("key"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Store) publish(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxStoreValueSize))
+	if err != nil {
+		http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// Compacting keeps each message on one line of the subscriber stream.
+	var msg bytes.Buffer
+	if err := json.Compact(&msg, body); err != nil {
+		http.Error(w, "message must be JSON", http.StatusBadRequest)
+		return
+	}
+	msg.WriteByte('\n')
+	writeJSON(w, http.StatusOK, map[string]int{"delivered": s.Publish(r.PathValue("topic"), msg.Bytes())})
+}
+
+// Publish sends msg, a line of compact JSON, to the current subscribers
+// of topic, returning how many took it.
+func (s *Store) Publish(topic string, msg []byte) int {
+	delivered := 0
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subs[topic] {
+		select {
+		case ch <- msg:
+			delivered++
+		default:
+		}
+	}
+	return delivered
+}
+
+// Subscribe receives the messages published to topic, each a line of
+// compact JSON, until cancel is called. Up to buffer messages are held
+// for a slow receiver before further ones are dropped.
+func (s *Store) Subscribe(topic string, buffer int) (msgs <-chan []byte, cancel func()) {
+	ch := make(chan []byte, buffer)
+	s.mu.Lock()
+	if s.subs[topic] == nil {
+		s.subs[topic] = map[chan []byte]struct{}{}
+	}
+	s.subs[topic][ch] = struct{}{}
+	s.mu.Unlock()
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.subs[topic], ch)
+		if len(s.subs[topic]) == 0 {
+			delete(s.subs, topic)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Store) subscribe(w http.ResponseWriter, r *http.Request) {
+	ch, cancel := s.Subscribe(r.PathValue("topic"), storeSubscriberBuffer)
+	defer cancel()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg := <-ch:
+			if _, err := w.Write(msg); err != nil {
+				return
+			}
+			rc.Flush()
+		}
+	}
+}
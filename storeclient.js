@@ -0,0 +1,65 @@
+// Client for the go-invoke-node store, loaded by scripts with
+// require(process.env.INVOKE_STORE_CLIENT). Values are JSON.
+'use strict';
+
+const http = require('node:http');
+
+function request(method, path, body, headers) {
+  return new Promise((resolve, reject) => {
+    const req = http.request(
+      { socketPath: process.env.INVOKE_STORE_SOCKET, method, path, headers },
+      (res) => {
+        const chunks = [];
+        res.on('data', (c) => chunks.push(c));
+        res.on('end', () => {
+          const text = Buffer.concat(chunks).toString();
+          if (res.statusCode === 404) return resolve(undefined);
+          if (res.statusCode >= 400) {
+            return reject(new Error(`store: ${method} ${path}: ${res.statusCode} ${text.trim()}`));
+          }
+          resolve(text === '' ? undefined : JSON.parse(text));
+        });
+      },
+    );
+    req.on('error', reject);
+    req.end(body);
+  });
+}
+
+function path(prefix, key, ttl) {
+  const p = `/${prefix}/${encodeURIComponent(key)}`;
+  return ttl ? `${p}?ttl=${ttl}s` : p;
+}
+
+const cache = {
+  get: (key) => request('GET', path('cache', key)),
+  // ttl is in seconds and capped by the server.
+  set: (key, value, ttl) => request('PUT', path('cache', key, ttl), JSON.stringify(value)),
+  delete: (key) => request('DELETE', path('cache', key)),
+  // wrap returns the cached value of key, computing and caching it with
+  // fn on a miss.
+  async wrap(key, ttl, fn) {
+    const hit = await cache.get(key);
+    if (hit !== undefined) return hit;
+    const value = await fn();
+    await cache.set(key, value, ttl);
+    return value;
+  },
+};
+
+const kv = {
+  get: (key) => request('GET', path('kv', key)),
+  set: (key, value, ttl) => request('PUT', path('kv', key, ttl), JSON.stringify(value)),
+  // create sets key only if it doesn't exist and reports whether it did.
+  create: (key, value, ttl) =>
+    request('PUT', path('kv', key, ttl), JSON.stringify(value), { 'If-None-Match': '*' }).then(
+      () => true,
+      (err) => (/ 412 /.test(err.message) ? false : Promise.reject(err)),
+    ),
+  delete: (key) => request('DELETE', path('kv', key)),
+};
+
+const publish = (topic, message) =>
+  request('POST', `/publish/${encodeURIComponent(topic)}`, JSON.stringify(message));
+
+module.exports = { cache, kv, publish };
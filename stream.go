@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	contentTypeSSE    = "text/event-stream"
+	contentTypeNDJSON = "application/x-ndjson"
+
+	// slowClientDisconnect kills the invocation when the client stops
+	// reading; slowClientSpool buffers output to disk so the invocation can
+	// finish and release its slot regardless of the client.
+	slowClientDisconnect = "disconnect"
+	slowClientSpool      = "spool"
+)
+
+// streamMode reports which streaming format the client asked for via the
+// Accept header, or "" for a regular buffered response.
+func streamMode(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, contentTypeSSE):
+		return contentTypeSSE
+	case strings.Contains(accept, contentTypeNDJSON):
+		return contentTypeNDJSON
+	}
+	return ""
+}
+
+// streamWriter forwards script stdout to the client as it is produced.
+// In SSE mode every stdout line becomes a "data" event; otherwise the
+// bytes are passed through chunked. Writes are serialized so keep-alive
+// pings can be interleaved from another goroutine.
+//
+// With events, for routes with StreamEvents, the script's event lines
+// become SSE events of their own, and its last line of output the
+// "result" event; other formats leave event lines out.
+type streamWriter struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	sse     bool
+	events  bool
+	partial []byte
+	// last is the line held back to become the result event.
+	last *string
+
+	// writeTimeout bounds each individual write so a stalled client is
+	// detected instead of blocking forever.
+	writeTimeout time.Duration
+}
+
+func newStreamWriter(w http.ResponseWriter, mode string, events bool, writeTimeout time.Duration) *streamWriter {
+	w.Header().Set("Content-Type", mode)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	return &streamWriter{
+		w:            w,
+		rc:           http.NewResponseController(w),
+		sse:          mode == contentTypeSSE,
+		events:       events,
+		writeTimeout: writeTimeout,
+	}
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.extendDeadlineLocked()
+
+	if !s.sse && !s.events {
+		if _, err := s.w.Write(p); err != nil {
+			return 0, err
+		}
+		return len(p), s.flushLocked()
+	}
+
+	s.partial = append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimSuffix(s.partial[:i], []byte{'\r'})
+		s.partial = s.partial[i+1:]
+		if err := s.lineLocked(string(line), true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), s.flushLocked()
+}
+
+// lineLocked forwards a line of output, terminated by a newline or not.
+func (s *streamWriter) lineLocked(line string, terminated bool) error {
+	if !s.events {
+		return s.eventLocked("", line)
+	}
+	if name, data, ok := eventLine(line); ok {
+		if !s.sse {
+			return nil
+		}
+		// Output before the event is sent before it.
+		if s.last != nil {
+			if err := s.eventLocked("", *s.last); err != nil {
+				return err
+			}
+			s.last = nil
+		}
+		return s.eventLocked(name, data)
+	}
+	if !s.sse {
+		if terminated {
+			line += "\n"
+		}
+		_, err := io.WriteString(s.w, line)
+		return err
+	}
+	if strings.TrimSpace(line) == "" {
+		return nil
+	}
+	var err error
+	if s.last != nil {
+		err = s.eventLocked("", *s.last)
+	}
+	s.last = &line
+	return err
+}
+
+// ping writes a keep-alive that clients ignore: an SSE comment, or a bare
+// newline between NDJSON records.
+func (s *streamWriter) ping() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.extendDeadlineLocked()
+	var err error
+	if s.sse {
+		_, err = fmt.Fprint(s.w, ": keep-alive\n\n")
+	} else {
+		_, err = fmt.Fprint(s.w, "\n")
+	}
+	if err != nil {
+		return err
+	}
+	return s.flushLocked()
+}
+
+// finish flushes any unterminated output and reports the final outcome.
+func (s *streamWriter) finish(runErr error, stderr []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.extendDeadlineLocked()
+
+	if (s.sse || s.events) && len(s.partial) > 0 {
+		s.lineLocked(string(s.partial), false)
+		s.partial = nil
+	}
+	if s.last != nil {
+		if runErr == nil {
+			s.eventLocked("result", *s.last)
+		} else {
+			s.eventLocked("", *s.last)
+		}
+		s.last = nil
+	}
+
+	if runErr == nil {
+		if s.sse {
+			s.eventLocked("done", "{}")
+		}
+		s.flushLocked()
+		return
+	}
+
+	msg := "node.js failed: " + firstLine(string(stderr), runErr.Error())
+	var limit *limitError
+	var open *circuitOpenError
+	if errors.Is(runErr, errTokenUnavailable) {
+		msg = errTokenUnavailable.Error()
+	} else if errors.As(runErr, &limit) {
+		msg = limit.Error()
+	} else if errors.As(runErr, &open) {
+		msg = open.Error()
+	}
+	b, _ := json.Marshal(map[string]string{"error": msg})
+	if s.sse {
+		s.eventLocked("error", string(b))
+	} else {
+		s.w.Write(append([]byte{'\n'}, append(b, '\n')...))
+	}
+	s.flushLocked()
+}
+
+func (s *streamWriter) eventLocked(name, data string) error {
+	var buf bytes.Buffer
+	if name != "" {
+		fmt.Fprintf(&buf, "event: %s\n", name)
+	}
+	fmt.Fprintf(&buf, "data: %s\n\n", data)
+	_, err := s.w.Write(buf.Bytes())
+	return err
+}
+
+func (s *streamWriter) extendDeadlineLocked() {
+	var deadline time.Time
+	if s.writeTimeout > 0 {
+		deadline = time.Now().Add(s.writeTimeout)
+	}
+	s.rc.SetWriteDeadline(deadline)
+}
+
+func (s *streamWriter) flushLocked() error {
+	if err := s.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// serveStream runs the invocation while streaming its stdout to the client,
+// sending a keep-alive every interval so idle timeouts on intermediate
+// proxies don't sever long-running jobs. A client that stops reading is
+// handled according to opts.SlowClientPolicy.
+func serveStream(w http.ResponseWriter, r *http.Request, inv *Invoker, call Invocation, mode string, opts handlerOptions) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	sw := newStreamWriter(w, mode, call.Route.StreamEvents, opts.StreamWriteTimeout)
+
+	var (
+		sp      *spool
+		pumpErr chan error
+		// clientErr is the write error that ended the stream early, if any.
+		clientErr error
+	)
+	if opts.SlowClientPolicy == slowClientSpool {
+		var err error
+		if sp, err = newSpool(); err != nil {
+			log.Printf("create spool: %v", err)
+			sw.finish(err, nil)
+			return
+		}
+		defer sp.Close()
+		pumpErr = make(chan error, 1)
+		go func() {
+			err := sp.pump(sw)
+			if err != nil {
+				cancel()
+			}
+			pumpErr <- err
+		}()
+		call.Stdout = sp
+	} else {
+		call.Stdout = writerFunc(func(p []byte) (int, error) {
+			n, err := sw.Write(p)
+			if err != nil {
+				clientErr = err
+				cancel()
+			}
+			return n, err
+		})
+	}
+
+	done := make(chan struct{})
+	if opts.KeepaliveInterval > 0 {
+		go func() {
+			t := time.NewTicker(opts.KeepaliveInterval)
+			defer t.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-t.C:
+					if err := sw.ping(); err != nil {
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	res, err := inv.Invoke(ctx, call)
+	if sp != nil {
+		sp.CloseWrite()
+		clientErr = <-pumpErr
+	}
+	close(done)
+
+	if clientErr != nil {
+		log.Printf("stream aborted, client not reading: %v", clientErr)
+		return
+	}
+	if err != nil {
+		log.Printf("node error: %v, %s, stderr: %s", err, call.Route.build(), res.Stderr)
+	}
+	sw.finish(err, res.Stderr)
+}
+
+// eventLinePrefix starts the lines by which scripts of routes with
+// StreamEvents send events.
+const eventLinePrefix = "@@"
+
+var eventNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]*$`)
+
+// reservedEvents are the SSE events sent by the server itself.
+var reservedEvents = map[string]bool{"done": true, "error": true, "result": true}
+
+// eventLine parses a line a script prints to send an SSE event, its name
+// followed by its data on the same line, e.g. to report progress:
+//
+//	@@progress {"pct":40}
+//
+// Lines naming a reserved event are output like any other.
+func eventLine(line string) (name, data string, ok bool) {
+	rest, ok := strings.CutPrefix(line, eventLinePrefix)
+	if !ok {
+		return "", "", false
+	}
+	name, data, _ = strings.Cut(rest, " ")
+	if !eventNamePattern.MatchString(name) || reservedEvents[name] {
+		return "", "", false
+	}
+	return name, strings.TrimSpace(data), true
+}
+
+// stripEventLines returns out without its event lines, for responses
+// other than event streams.
+func stripEventLines(out []byte) []byte {
+	if !bytes.Contains(out, []byte(eventLinePrefix)) {
+		return out
+	}
+	var b bytes.Buffer
+	for line := range bytes.Lines(out) {
+		if _, _, ok := eventLine(strings.TrimRight(string(line), "\r\n")); !ok {
+			b.Write(line)
+		}
+	}
+	return b.Bytes()
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamMode(t *testing.T) {
+	for accept, want := range map[string]string{
+		"":                             "",
+		"application/json":             "",
+		"text/event-stream":            contentTypeSSE,
+		"application/x-ndjson":         contentTypeNDJSON,
+		"text/event-stream, */*;q=0.1": contentTypeSSE,
+	} {
+		r := httptest.NewRequest("POST", "/invoke/x", nil)
+		r.Header.Set("Accept", accept)
+		if got := streamMode(r); got != want {
+			t.Errorf("streamMode(Accept: %s) = %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestStreamWriter(t *testing.T) {
+	boom := errors.New("exit status 1")
+	tests := []struct {
+		name   string
+		mode   string
+		events bool
+		writes []string
+		err    error
+		want   string
+	}{{
+		name:   "sse lines",
+		mode:   contentTypeSSE,
+		writes: []string{"a\nb", "c\r\n", "d"},
+		want:   "data: a\n\ndata: bc\n\ndata: d\n\nevent: done\ndata: {}\n\n",
+	}, {
+		name:   "sse failure",
+		mode:   contentTypeSSE,
+		writes: []string{"a\n"},
+		err:    boom,
+		want:   "data: a\n\nevent: error\ndata: {\"error\":\"node.js failed: boom\"}\n\n",
+	}, {
+		name:   "ndjson passes output through",
+		mode:   contentTypeNDJSON,
+		writes: []string{`{"a":1}` + "\n{", `"b":2}`},
+		want:   `{"a":1}` + "\n" + `{"b":2}`,
+	}, {
+		name:   "ndjson failure",
+		mode:   contentTypeNDJSON,
+		writes: []string{`{"a":1}` + "\n"},
+		err:    boom,
+		want:   `{"a":1}` + "\n\n" + `{"error":"node.js failed: boom"}` + "\n",
+	}, {
+		name:   "sse events",
+		mode:   contentTypeSSE,
+		events: true,
+		writes: []string{"log\n@@progress {\"pct\":40}\n", "\n@@done x\n{\"ok\":true}\n"},
+		want: "data: log\n\nevent: progress\ndata: {\"pct\":40}\n\n" +
+			"data: @@done x\n\nevent: result\ndata: {\"ok\":true}\n\nevent: done\ndata: {}\n\n",
+	}, {
+		name:   "sse events failure",
+		mode:   contentTypeSSE,
+		events: true,
+		writes: []string{"partial"},
+		err:    boom,
+		want:   "data: partial\n\nevent: error\ndata: {\"error\":\"node.js failed: boom\"}\n\n",
+	}, {
+		name:   "ndjson leaves events out",
+		mode:   contentTypeNDJSON,
+		events: true,
+		writes: []string{"@@progress {}\n", `{"ok":true}`},
+		want:   `{"ok":true}`,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			sw := newStreamWriter(w, tt.mode, tt.events, 0)
+			for _, p := range tt.writes {
+				if _, err := sw.Write([]byte(p)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sw.finish(tt.err, []byte("boom\nmore"))
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != tt.mode {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.mode)
+			}
+		})
+	}
+}
+
+func TestStreamWriterPing(t *testing.T) {
+	for mode, want := range map[string]string{
+		contentTypeSSE:    ": keep-alive\n\n",
+		contentTypeNDJSON: "\n",
+	} {
+		w := httptest.NewRecorder()
+		if err := newStreamWriter(w, mode, false, 0).ping(); err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Body.String(); got != want {
+			t.Errorf("%s ping = %q, want %q", mode, got, want)
+		}
+	}
+}
+
+// TestServeStreamKeepalive checks that a script quiet for longer than the
+// keep-alive interval has pings sent in between its output.
+func TestServeStreamKeepalive(t *testing.T) {
+	config := `
+routes:
+  slow:
+    script: "console.log(1); setTimeout(() => console.log(2), 300)"
+`
+	s := newRouteTest(t, map[string]string{"config.yaml": config}, nil)
+	s.opts.KeepaliveInterval = 50 * time.Millisecond
+	if _, err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	w := serveTest(t, s, "/invoke/slow", `{}`, http.Header{"Accept": {contentTypeSSE}})
+	body := w.Body.String()
+	first, second := strings.Index(body, "data: 1\n\n"), strings.Index(body, "data: 2\n\n")
+	if first < 0 || second < first || !strings.HasSuffix(body, "event: done\ndata: {}\n\n") {
+		t.Fatalf("body = %q, want both lines and done", body)
+	}
+	if !strings.Contains(body[first:second], ": keep-alive\n\n") {
+		t.Errorf("no keep-alive between the lines: %q", body)
+	}
+}
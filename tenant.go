@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// apiKeyHeader carries a tenant's API key, for routes whose own auth
+// takes the Authorization header.
+const apiKeyHeader = "X-API-Key"
+
+// TenantConfig declares a namespace of routes served to one team:
+//
+//	tenants:
+//	  billing:
+//	    keys_file: billing.keys   # one API key per line
+//	    env_file: billing.env
+//	    rate: 20                  # requests per second
+//	    burst: 40
+//	    concurrency: 4
+//	    routes:
+//	      invoice: {script_file: billing/invoice.js}
+//
+// Its routes are served at /invoke/<tenant>/<route> to callers with one of
+// its API keys, and rules name their targets without the tenant prefix.
+type TenantConfig struct {
+	KeysFile string `yaml:"keys_file"`
+	// KeysEnv names a variable holding comma-separated keys.
+	KeysEnv string `yaml:"keys_env"`
+	// EnvFile is the env_file of routes setting none of their own.
+	EnvFile stringList `yaml:"env_file"`
+	// Rate caps the tenant's requests per second across its routes, with
+	// bursts of up to Burst requests, Rate rounded up when unset.
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+	// Concurrency caps the tenant's invocations running at once, within
+	// the server-wide limit.
+	Concurrency int                    `yaml:"concurrency"`
+	Routes      map[string]RouteConfig `yaml:"routes"`
+}
+
+// Tenant is the runtime side of a TenantConfig, shared by its routes.
+type Tenant struct {
+	Name     string
+	keysFile string
+	keysEnv  string
+	// rate, when set, limits the tenant's request rate.
+	rate *tokenBucket
+	// slots, when set, caps the tenant's concurrent invocations.
+	slots *limiter
+	// revision identifies the tenant's settings, so reloads keep the
+	// tenant, with its rate and quota state, while they are unchanged.
+	revision string
+
+	requests     atomic.Int64
+	throttled    atomic.Int64
+	unauthorized atomic.Int64
+}
+
+func newTenant(name, keysFile string, tc TenantConfig) (*Tenant, error) {
+	if (keysFile == "") == (tc.KeysEnv == "") {
+		return nil, errors.New("must set exactly one of keys_file or keys_env")
+	}
+	if tc.Rate < 0 || tc.Burst < 0 || tc.Concurrency < 0 {
+		return nil, errors.New("rate, burst and concurrency must not be negative")
+	}
+	if tc.Burst > 0 && tc.Rate == 0 {
+		return nil, errors.New("burst requires a rate")
+	}
+	t := &Tenant{Name: name, keysFile: keysFile, keysEnv: tc.KeysEnv}
+	if tc.Rate > 0 {
+		burst := tc.Burst
+		if burst == 0 {
+			burst = int(math.Ceil(tc.Rate))
+		}
+		t.rate = newTokenBucket(tc.Rate, burst)
+	}
+	if tc.Concurrency > 0 {
+		t.slots = newLimiter(tc.Concurrency)
+	}
+	return t, nil
+}
+
+// keys returns the tenant's API keys, re-reading them each time so keys
+// can be issued and revoked without a restart. Blank lines and lines
+// starting with # are ignored.
+func (t *Tenant) keys() ([]string, error) {
+	var raw []string
+	if t.keysFile != "" {
+		b, err := os.ReadFile(t.keysFile)
+		if err != nil {
+			return nil, err
+		}
+		raw = strings.Split(string(b), "\n")
+	} else {
+		raw = strings.Split(os.Getenv(t.keysEnv), ",")
+	}
+	var keys []string
+	for _, k := range raw {
+		k = strings.TrimSpace(k)
+		if k != "" && !strings.HasPrefix(k, "#") {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("tenant %s has no API keys", t.Name)
+	}
+	return keys, nil
+}
+
+// admit reports whether r may be served: it must carry one of the
+// tenant's API keys, in X-API-Key or as a bearer token, and be within
+// the tenant's rate. It writes the error response when not.
+func (t *Tenant) admit(w http.ResponseWriter, r *http.Request) bool {
+	t.requests.Add(1)
+	keys, err := t.keys()
+	if err != nil {
+		// Never let missing keys open the tenant.
+		log.Printf("tenant %s: %v", t.Name, err)
+		http.Error(w, "auth unavailable", http.StatusServiceUnavailable)
+		return false
+	}
+	got := r.Header.Get(apiKeyHeader)
+	if got == "" {
+		got, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	ok := false
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(k)) == 1 {
+			ok = true
+		}
+	}
+	if got == "" || !ok {
+		t.unauthorized.Add(1)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+t.Name+`"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if t.rate != nil {
+		if wait, ok := t.rate.take(); !ok {
+			t.throttled.Add(1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "tenant rate limit exceeded", http.StatusTooManyRequests)
+			return false
+		}
+	}
+	return true
+}
+
+// tokenBucket allows rate events per second on average, in bursts of up
+// to burst.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// take uses up a token if one is left, or returns how long until one is.
+func (b *tokenBucket) take() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second)), false
+}
+
+// tenantRoutes returns the routes of every tenant, named <tenant>/<route>,
+// with the tenant's env_file applied and rule targets qualified, and the
+// tenant each belongs to.
+func (fc *FileConfig) tenantRoutes(base string) (map[string]RouteConfig, map[string]*Tenant, error) {
+	decls := make(map[string]RouteConfig, len(fc.Routes))
+	owners := map[string]*Tenant{}
+	for name, tc := range fc.Tenants {
+		if !validProfile(name) {
+			return nil, nil, fmt.Errorf("tenant %q: invalid name", name)
+		}
+		t, err := newTenant(name, resolvePath(base, tc.KeysFile), tc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tenant %q: %w", name, err)
+		}
+		quotas := tc
+		quotas.Routes = nil
+		t.revision = revisionOf(quotas)
+		for rname, rc := range tc.Routes {
+			if len(rc.EnvFile) == 0 {
+				rc.EnvFile = tc.EnvFile
+			}
+			rules := make([]RuleConfig, len(rc.Rules))
+			for i, rule := range rc.Rules {
+				rule.Route = name + "/" + rule.Route
+				rules[i] = rule
+			}
+			rc.Rules = rules
+			stages := make([]PipelineStageConfig, len(rc.Pipeline))
+			for i, stage := range rc.Pipeline {
+				stage.Route = name + "/" + stage.Route
+				stages[i] = stage
+			}
+			rc.Pipeline = stages
+			decls[name+"/"+rname] = rc
+			owners[name+"/"+rname] = t
+		}
+	}
+	for name, rc := range fc.Routes {
+		if _, ok := decls[name]; ok {
+			return nil, nil, fmt.Errorf("route %q: also declared by a tenant", name)
+		}
+		decls[name] = rc
+	}
+	return decls, owners, nil
+}
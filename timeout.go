@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// timeoutError is an attempt killed by its timeout; it matches errTimeout.
+type timeoutError struct {
+	timeout time.Duration
+	err     error
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%v after %s: %v", errTimeout, e.timeout, e.err)
+}
+
+func (e *timeoutError) Is(target error) bool { return target == errTimeout }
+
+// timeoutResponse is the body of the response to an invocation that timed
+// out, answered with --timeout-status.
+type timeoutResponse struct {
+	Error     string `json:"error"`
+	Route     string `json:"route"`
+	RequestID string `json:"request_id"`
+	// Timeout is the timeout of the last attempt, and Elapsed how long the
+	// invocation took, retries included.
+	Timeout string `json:"timeout"`
+	Elapsed string `json:"elapsed"`
+	// PartialOutput is set when the script had written output before it
+	// was killed; the output itself is discarded.
+	PartialOutput bool `json:"partial_output"`
+	// Stage is the pipeline stage that timed out, counting from 1.
+	Stage int `json:"stage,omitempty"`
+}
+
+// writeTimeout answers an invocation of route that failed with err, an
+// error matching errTimeout, after elapsed.
+func writeTimeout(w http.ResponseWriter, status int, route *Route, call Invocation, res *Result, err error, elapsed time.Duration) {
+	body := timeoutResponse{
+		Error:         errTimeout.Error(),
+		Route:         route.Name,
+		RequestID:     call.Request.ID,
+		Elapsed:       elapsed.Round(time.Millisecond).String(),
+		PartialOutput: len(res.Stdout) > 0,
+	}
+	var te *timeoutError
+	if errors.As(err, &te) {
+		body.Timeout = te.timeout.String()
+	}
+	var stage *stageError
+	if errors.As(err, &stage) {
+		body.Stage = stage.stage
+	}
+	writeJSON(w, status, body)
+}
+
+// timeoutStats counts attempts killed by their timeout per route for
+// /metrics.
+type timeoutStats struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func (s *timeoutStats) record(route string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counts == nil {
+		s.counts = map[string]int64{}
+	}
+	s.counts[route]++
+}
+
+// snapshot returns the counts sorted by route.
+func (s *timeoutStats) snapshot() (routes []string, counts []int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	routes = slices.Sorted(maps.Keys(s.counts))
+	for _, r := range routes {
+		counts = append(counts, s.counts[r])
+	}
+	return routes, counts
+}
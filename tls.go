@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// TLSConfig serves the TCP listener over TLS with the certificate in
+// CertFile and its key in KeyFile. Clients then negotiate HTTP/2 unless
+// --http2=false, which multiplexes their concurrent invocations over one
+// connection.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+}
+
+func (c TLSConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("--tls-cert and --tls-key must be set together")
+	}
+	return nil
+}
+
+// enabled reports whether the listener is served over TLS.
+func (c TLSConfig) enabled() bool {
+	return c.CertFile != ""
+}
+
+// serverProtocols returns the protocols the TCP listener speaks:
+// HTTP/1.1, HTTP/2 over TLS unless disabled, and HTTP/2 over plaintext
+// with h2c.
+func serverProtocols(cfg Config) *http.Protocols {
+	var p http.Protocols
+	p.SetHTTP1(true)
+	p.SetHTTP2(cfg.HTTP2 && cfg.TLS.enabled())
+	p.SetUnencryptedHTTP2(cfg.H2C)
+	return &p
+}
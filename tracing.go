@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds as defined by OTLP.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+const (
+	tracerScope          = "go-invoke-node"
+	defaultServiceName   = "go-invoke-node"
+	traceBatchSize       = 512
+	traceQueueSize       = 2048
+	defaultTraceInterval = 5 * time.Second
+)
+
+// Tracer records spans and exports them to an OTLP/HTTP collector using
+// the JSON encoding. A nil *Tracer is valid and records nothing.
+type Tracer struct {
+	endpoint string
+	headers  map[string]string
+	resource []otlpKeyValue
+	ratio    float64
+	interval time.Duration
+	client   *http.Client
+
+	queue chan *Span
+	once  sync.Once
+	done  chan struct{}
+}
+
+// NewTracerFromEnv configures a tracer from the standard OTEL_* variables.
+// It returns nil when tracing is disabled, which is the case unless an
+// OTLP endpoint is configured. loc supplies the cloud.region and
+// cloud.availability_zone resource attributes OTEL_RESOURCE_ATTRIBUTES
+// doesn't set.
+func NewTracerFromEnv(loc Locality) (*Tracer, error) {
+	if b, _ := strconv.ParseBool(os.Getenv("OTEL_SDK_DISABLED")); b {
+		return nil, nil
+	}
+	if v := os.Getenv("OTEL_TRACES_EXPORTER"); v == "none" {
+		return nil, nil
+	}
+
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil, nil
+		}
+		endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+	}
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q: %w", endpoint, err)
+	}
+
+	headers := parseOTelList(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	for k, v := range parseOTelList(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS")) {
+		headers[k] = v
+	}
+
+	attrs := parseOTelList(os.Getenv("OTEL_RESOURCE_ATTRIBUTES"))
+	for k, v := range loc.resource() {
+		if attrs[k] == "" {
+			attrs[k] = v
+		}
+	}
+	if v := os.Getenv("OTEL_SERVICE_NAME"); v != "" {
+		attrs["service.name"] = v
+	}
+	if attrs["service.name"] == "" {
+		attrs["service.name"] = defaultServiceName
+	}
+
+	ratio := 1.0
+	switch os.Getenv("OTEL_TRACES_SAMPLER") {
+	case "always_off":
+		ratio = 0
+	case "traceidratio", "parentbased_traceidratio":
+		if f, err := strconv.ParseFloat(os.Getenv("OTEL_TRACES_SAMPLER_ARG"), 64); err == nil {
+			ratio = f
+		}
+	}
+
+	interval := defaultTraceInterval
+	if ms, err := strconv.Atoi(os.Getenv("OTEL_BSP_SCHEDULE_DELAY")); err == nil && ms > 0 {
+		interval = time.Duration(ms) * time.Millisecond
+	}
+
+	t := &Tracer{
+		endpoint: endpoint,
+		headers:  headers,
+		resource: toKeyValues(attrs),
+		ratio:    ratio,
+		interval: interval,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *Span, traceQueueSize),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t, nil
+}
+
+// parseOTelList parses the "k1=v1,k2=v2" format used by OTEL_* variables.
+func parseOTelList(s string) map[string]string {
+	out := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		k = strings.TrimSpace(k)
+		if uv, err := url.QueryUnescape(strings.TrimSpace(v)); err == nil {
+			v = uv
+		}
+		if k != "" {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// Span is a single timed operation. A nil *Span is a valid no-op.
+type Span struct {
+	tracer  *Tracer
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  map[string]any
+	errMsg string
+	ended  bool
+}
+
+type spanContextKey struct{}
+
+// spanFromContext returns the span stored in ctx, if any.
+func spanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanContextKey{}).(*Span)
+	return s
+}
+
+// Start begins a span whose parent is the span in ctx.
+func (t *Tracer) Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		// Unsampled remote parents and unsampled roots are recorded by
+		// nobody; keep the context as is so children are skipped too.
+		if remote, ok := ctx.Value(remoteParentKey{}).(remoteParent); ok {
+			if !remote.sampled {
+				return ctx, nil
+			}
+			s := t.newSpan(name, kind, remote.traceID, remote.spanID)
+			return context.WithValue(ctx, spanContextKey{}, s), s
+		}
+		var traceID [16]byte
+		rand.Read(traceID[:])
+		if !t.sample(traceID) {
+			return ctx, nil
+		}
+		s := t.newSpan(name, kind, traceID, [8]byte{})
+		return context.WithValue(ctx, spanContextKey{}, s), s
+	}
+	s := t.newSpan(name, kind, parent.traceID, parent.spanID)
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+func (t *Tracer) newSpan(name string, kind int, traceID [16]byte, parent [8]byte) *Span {
+	s := &Span{
+		tracer:  t,
+		traceID: traceID,
+		parent:  parent,
+		name:    name,
+		kind:    kind,
+		start:   time.Now(),
+		attrs:   map[string]any{},
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+func (t *Tracer) sample(traceID [16]byte) bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	if t.ratio <= 0 {
+		return false
+	}
+	// Same scheme as the TraceIdRatioBased sampler: compare the low 8
+	// bytes of the trace ID against the ratio.
+	x := binary.BigEndian.Uint64(traceID[8:]) >> 1
+	return x < uint64(t.ratio*float64(uint64(1)<<63))
+}
+
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// RecordError marks the span as failed.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errMsg = err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export. Spans are dropped
+// rather than blocking when the export queue is full.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	select {
+	case s.tracer.queue <- s:
+	default:
+	}
+}
+
+// Traceparent formats the span as a W3C traceparent header value.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]))
+}
+
+type remoteParentKey struct{}
+
+type remoteParent struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// extractTraceparent stores the W3C trace context of an incoming request
+// in ctx so the server span continues the caller's trace.
+func extractTraceparent(ctx context.Context, h http.Header) context.Context {
+	p, ok := parseTraceparent(h.Get("traceparent"))
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteParentKey{}, p)
+}
+
+// parseTraceparent parses a W3C traceparent header value.
+func parseTraceparent(v string) (remoteParent, bool) {
+	var p remoteParent
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return p, false
+	}
+	tid, err1 := hex.DecodeString(parts[1])
+	sid, err2 := hex.DecodeString(parts[2])
+	flags, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil || len(tid) != 16 || len(sid) != 8 || len(flags) != 1 {
+		return p, false
+	}
+	copy(p.traceID[:], tid)
+	copy(p.spanID[:], sid)
+	if p.traceID == ([16]byte{}) || p.spanID == ([8]byte{}) {
+		return p, false
+	}
+	p.sampled = flags[0]&1 == 1
+	return p, true
+}
+
+// startServerSpan continues the caller's trace, if any, with a server span
+// covering the whole request. The returned writer records the status code
+// onto the span.
+func startServerSpan(w http.ResponseWriter, r *http.Request, t *Tracer, name string) (http.ResponseWriter, *http.Request, *Span) {
+	ctx := extractTraceparent(r.Context(), r.Header)
+	ctx, span := t.Start(ctx, name, spanKindServer)
+	if span == nil {
+		return w, r, nil
+	}
+	span.SetAttr("http.request.method", r.Method)
+	span.SetAttr("url.path", r.URL.Path)
+	return &statusRecorder{ResponseWriter: w, span: span}, r.WithContext(ctx), span
+}
+
+// statusRecorder copies the response status onto a span.
+type statusRecorder struct {
+	http.ResponseWriter
+	span *Span
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.span.SetAttr("http.response.status_code", code)
+	if code >= 500 {
+		s.span.RecordError(fmt.Errorf("%d %s", code, http.StatusText(code)))
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			log.Printf("otlp export failed: %v", err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.done:
+			for {
+				select {
+				case s := <-t.queue:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Shutdown exports any queued spans.
+func (t *Tracer) Shutdown() {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() { close(t.done) })
+}
+
+// OTLP/JSON wire types. IDs are hex encoded and timestamps are decimal
+// strings, as required by the OTLP JSON mapping.
+type otlpKeyValue struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID      string         `json:"traceId"`
+	SpanID       string         `json:"spanId"`
+	ParentSpanID string         `json:"parentSpanId,omitempty"`
+	Name         string         `json:"name"`
+	Kind         int            `json:"kind"`
+	Start        string         `json:"startTimeUnixNano"`
+	End          string         `json:"endTimeUnixNano"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	Status       map[string]any `json:"status,omitempty"`
+}
+
+func (t *Tracer) export(batch []*Span) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		out := otlpSpan{
+			TraceID:    hex.EncodeToString(s.traceID[:]),
+			SpanID:     hex.EncodeToString(s.spanID[:]),
+			Name:       s.name,
+			Kind:       s.kind,
+			Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+			End:        strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes: toKeyValues(s.attrs),
+		}
+		if s.parent != ([8]byte{}) {
+			out.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		if s.errMsg != "" {
+			out.Status = map[string]any{"code": 2, "message": s.errMsg}
+		}
+		s.mu.Unlock()
+		spans = append(spans, out)
+	}
+
+	body := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": t.resource},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": tracerScope},
+				"spans": spans,
+			}},
+		}},
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+func toKeyValues[V any](m map[string]V) []otlpKeyValue {
+	out := make([]otlpKeyValue, 0, len(m))
+	for k, v := range m {
+		var val map[string]any
+		switch x := any(v).(type) {
+		case string:
+			val = map[string]any{"stringValue": x}
+		case bool:
+			val = map[string]any{"boolValue": x}
+		case int:
+			val = map[string]any{"intValue": strconv.Itoa(x)}
+		case int64:
+			val = map[string]any{"intValue": strconv.FormatInt(x, 10)}
+		case float64:
+			val = map[string]any{"doubleValue": x}
+		default:
+			val = map[string]any{"stringValue": fmt.Sprint(x)}
+		}
+		out = append(out, otlpKeyValue{Key: k, Value: val})
+	}
+	return out
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Transform rewrites a JSON document: a request payload before it is
+// validated and handed to the script, or the script's output before it is
+// returned. Transforms let routes strip PII or reshape legacy payloads
+// without touching the script.
+type Transform interface {
+	// Apply returns the rewritten doc, which was decoded with UseNumber
+	// and may be modified in place.
+	Apply(doc any) (any, error)
+}
+
+// TransformFactory builds a transform from its manifest entry; see
+// TriggerFactory.
+type TransformFactory func(decode func(v any) error) (Transform, error)
+
+var transformFactories = map[string]TransformFactory{
+	"drop":   newDropTransform,
+	"mask":   newMaskTransform,
+	"rename": newRenameTransform,
+	"set":    newSetTransform,
+}
+
+// RegisterTransform makes a custom transform kind available to route
+// manifests. Like RegisterTrigger, it is meant to be called from an init
+// function and panics when kind is already taken.
+func RegisterTransform(kind string, factory TransformFactory) {
+	if kind == "" || transformFactories[kind] != nil {
+		panic(fmt.Sprintf("transform kind %q already registered", kind))
+	}
+	transformFactories[kind] = factory
+}
+
+// TransformConfig lists the transforms applied, in order, to a route's
+// payloads and outputs:
+//
+//	transform:
+//	  request:
+//	    - kind: drop
+//	      paths: [ssn, cards.*.number]
+//	    - kind: rename
+//	      fields: {customer_id: customerId}
+//	  response:
+//	    - kind: mask
+//	      paths: [email]
+//	      with: "***"
+//
+// Paths are dot separated; * matches every key of an object or element of
+// an array. Streamed output is not transformed.
+type TransformConfig struct {
+	Request  []ExtensionConfig `yaml:"request"`
+	Response []ExtensionConfig `yaml:"response"`
+}
+
+func buildTransforms(specs []ExtensionConfig) ([]Transform, error) {
+	var out []Transform
+	for i, spec := range specs {
+		factory, ok := transformFactories[spec.Kind]
+		if !ok {
+			return nil, fmt.Errorf("transform %d: unknown kind %q", i+1, spec.Kind)
+		}
+		t, err := factory(spec.node.Decode)
+		if err != nil {
+			return nil, fmt.Errorf("transform %d (%s): %w", i+1, spec.Kind, err)
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// applyTransforms runs ts over the JSON document b. It returns b unchanged
+// when ts is empty.
+func applyTransforms(ts []Transform, b []byte) ([]byte, error) {
+	if len(ts) == 0 {
+		return b, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("not a JSON document: %w", err)
+	}
+	for _, t := range ts {
+		var err error
+		if doc, err = t.Apply(doc); err != nil {
+			return nil, err
+		}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}), nil
+}
+
+// fieldPath is a parsed dot separated path.
+type fieldPath []string
+
+func parsePaths(paths []string) ([]fieldPath, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no paths")
+	}
+	out := make([]fieldPath, len(paths))
+	for i, p := range paths {
+		segs := strings.Split(p, ".")
+		for _, s := range segs {
+			if s == "" {
+				return nil, fmt.Errorf("invalid path %q", p)
+			}
+		}
+		out[i] = segs
+	}
+	return out, nil
+}
+
+// visit calls fn with the object holding the last segment of path and
+// that segment's key, for every object the path reaches in doc.
+func (p fieldPath) visit(doc any, fn func(obj map[string]any, key string)) {
+	if len(p) == 0 {
+		return
+	}
+	head, rest := p[0], p[1:]
+	switch v := doc.(type) {
+	case map[string]any:
+		if len(rest) == 0 {
+			if head == "*" {
+				for k := range v {
+					fn(v, k)
+				}
+			} else {
+				fn(v, head)
+			}
+			return
+		}
+		if head == "*" {
+			for _, child := range v {
+				rest.visit(child, fn)
+			}
+		} else if child, ok := v[head]; ok {
+			rest.visit(child, fn)
+		}
+	case []any:
+		if head != "*" {
+			return
+		}
+		for _, child := range v {
+			rest.visit(child, fn)
+		}
+	}
+}
+
+// dropTransform removes the fields at Paths.
+type dropTransform struct{ paths []fieldPath }
+
+func newDropTransform(decode func(any) error) (Transform, error) {
+	var spec struct {
+		Paths []string `yaml:"paths"`
+	}
+	if err := decode(&spec); err != nil {
+		return nil, err
+	}
+	paths, err := parsePaths(spec.Paths)
+	return &dropTransform{paths}, err
+}
+
+func (t *dropTransform) Apply(doc any) (any, error) {
+	for _, p := range t.paths {
+		p.visit(doc, func(obj map[string]any, key string) { delete(obj, key) })
+	}
+	return doc, nil
+}
+
+// maskTransform replaces the values at Paths, where present, with With.
+type maskTransform struct {
+	paths []fieldPath
+	with  any
+}
+
+func newMaskTransform(decode func(any) error) (Transform, error) {
+	var spec struct {
+		Paths []string `yaml:"paths"`
+		With  any      `yaml:"with"`
+	}
+	if err := decode(&spec); err != nil {
+		return nil, err
+	}
+	if spec.With == nil {
+		spec.With = "***"
+	}
+	paths, err := parsePaths(spec.Paths)
+	return &maskTransform{paths, spec.With}, err
+}
+
+func (t *maskTransform) Apply(doc any) (any, error) {
+	for _, p := range t.paths {
+		p.visit(doc, func(obj map[string]any, key string) {
+			if _, ok := obj[key]; ok {
+				obj[key] = t.with
+			}
+		})
+	}
+	return doc, nil
+}
+
+// renameTransform moves top-level fields to new names.
+type renameTransform struct{ fields map[string]string }
+
+func newRenameTransform(decode func(any) error) (Transform, error) {
+	var spec struct {
+		Fields map[string]string `yaml:"fields"`
+	}
+	if err := decode(&spec); err != nil {
+		return nil, err
+	}
+	if len(spec.Fields) == 0 {
+		return nil, errors.New("no fields")
+	}
+	return &renameTransform{spec.Fields}, nil
+}
+
+func (t *renameTransform) Apply(doc any) (any, error) {
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		return doc, nil
+	}
+	// Read every source before writing, so swapping two names works.
+	moved := map[string]any{}
+	for from := range t.fields {
+		if v, ok := obj[from]; ok {
+			moved[from] = v
+			delete(obj, from)
+		}
+	}
+	for from, v := range moved {
+		obj[t.fields[from]] = v
+	}
+	return doc, nil
+}
+
+// setTransform sets top-level fields to fixed values, e.g. to supply a
+// field a legacy client doesn't send.
+type setTransform struct{ values map[string]any }
+
+func newSetTransform(decode func(any) error) (Transform, error) {
+	var spec struct {
+		Values map[string]any `yaml:"values"`
+	}
+	if err := decode(&spec); err != nil {
+		return nil, err
+	}
+	if len(spec.Values) == 0 {
+		return nil, errors.New("no values")
+	}
+	return &setTransform{spec.Values}, nil
+}
+
+func (t *setTransform) Apply(doc any) (any, error) {
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		return nil, errors.New("set: document is not an object")
+	}
+	for k, v := range t.values {
+		obj[k] = v
+	}
+	return doc, nil
+}
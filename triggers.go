@@ -0,0 +1,506 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// triggerEnvKey tells scripts what started them: cron, queue or the
+	// kind of a custom trigger. It is unset for HTTP requests.
+	triggerEnvKey = "INVOKE_TRIGGER"
+
+	defaultQueueBuffer = 1000
+)
+
+// Trigger is an event source that invokes a route. Cron schedules and
+// queue subscriptions are triggers; others, such as a proprietary message
+// bus or a CDC stream, are added with RegisterTrigger.
+type Trigger interface {
+	// Kind names the source in logs, metrics and INVOKE_TRIGGER.
+	Kind() string
+	// Run delivers events by calling fire until ctx is done, returning
+	// nil then. fire invokes the route with payload through the same
+	// pipeline as HTTP requests (schema, concurrency limits, retries,
+	// circuit breaker) and returns once the invocation finished. It is
+	// safe to call concurrently; how many invocations a source keeps in
+	// flight is up to it. Sources pulling from a broker should pace
+	// their prefetches and polls with TriggerBackpressure(ctx).
+	Run(ctx context.Context, fire FireFunc) error
+}
+
+// FireFunc invokes a route with payload on behalf of a Trigger. It returns
+// an error when the payload is rejected or the invocation failed, so the
+// source can decide whether to acknowledge the event.
+type FireFunc func(payload []byte) error
+
+// TriggerFactory builds a trigger from its manifest entry. decode unmarshals
+// the entry, including its kind key, into a value of the factory's own
+// type.
+type TriggerFactory func(decode func(v any) error) (Trigger, error)
+
+var triggerFactories = map[string]TriggerFactory{}
+
+// RegisterTrigger makes a custom trigger kind available to route
+// manifests, under triggers.custom. It is meant to be called from an init
+// function in the file implementing the trigger, and panics when kind is
+// already taken.
+func RegisterTrigger(kind string, factory TriggerFactory) {
+	if kind == "" || kind == "cron" || kind == "queue" || triggerFactories[kind] != nil {
+		panic(fmt.Sprintf("trigger kind %q already registered", kind))
+	}
+	triggerFactories[kind] = factory
+}
+
+// TriggersConfig declares, in a route's manifest entry, everything that
+// invokes the route besides being listed under routes:
+//
+//	triggers:
+//	  http: false                    # no /invoke/<name> endpoint
+//	  cron:
+//	    - schedule: "*/5 * * * *"
+//	      timezone: Europe/Berlin    # default: the server's
+//	      payload: {kind: sweep}     # default: {}
+//	      jitter: 30s                # random delay added to each run
+//	  queue:
+//	    - topic: orders              # a --store pub/sub topic
+//	      concurrency: 4
+//	      result_topic: invoices     # publish outputs here
+//	      dedup_key: order_id        # process each order_id once
+//	  custom:
+//	    - kind: mybus                # registered with RegisterTrigger
+//	      stream: orders             # the rest is up to the trigger
+type TriggersConfig struct {
+	HTTP   *bool             `yaml:"http"`
+	Cron   []CronTrigger     `yaml:"cron"`
+	Queue  []QueueTrigger    `yaml:"queue"`
+	Custom []ExtensionConfig `yaml:"custom"`
+}
+
+type CronTrigger struct {
+	Schedule string `yaml:"schedule"`
+	Timezone string `yaml:"timezone"`
+	Payload  any    `yaml:"payload"`
+	// Jitter spreads runs of many servers sharing a schedule by delaying
+	// each by a random duration up to Jitter.
+	Jitter time.Duration `yaml:"jitter"`
+}
+
+// QueueTrigger invokes the route with every message published to Topic.
+// A message is only taken off the subscription when an invocation can
+// start right away, within the route's, its tenant's and the server-wide
+// concurrency limits as well as Concurrency. Up to Buffer messages are
+// held meanwhile; messages beyond that are dropped and not counted as
+// delivered to the publisher.
+//
+// Outputs are published to ResultTopic when set. With DedupKey, the
+// top-level message field of that name identifies messages, which are
+// processed and have their result published exactly once for DedupTTL,
+// through an outbox in the --store-backend; see queueTrigger.handle.
+type QueueTrigger struct {
+	Topic       string        `yaml:"topic"`
+	Concurrency int           `yaml:"concurrency"`
+	Buffer      int           `yaml:"buffer"`
+	ResultTopic string        `yaml:"result_topic"`
+	DedupKey    string        `yaml:"dedup_key"`
+	DedupTTL    time.Duration `yaml:"dedup_ttl"`
+}
+
+// Triggers are the compiled non-HTTP triggers of a route.
+type Triggers struct {
+	DisableHTTP bool
+	Cron        []*cronTrigger
+	Queue       []QueueTrigger
+	Custom      []Trigger
+}
+
+type cronTrigger struct {
+	// route names the route in logs; set by startTriggers.
+	route    string
+	spec     string
+	schedule *cronSchedule
+	loc      *time.Location
+	payload  []byte
+	jitter   time.Duration
+
+	running atomic.Bool
+
+	mu                      sync.Mutex
+	next                    time.Time
+	runs, failures, skipped int64
+	last                    *cronRun
+}
+
+// cronRun is the outcome of a cron trigger's run.
+type cronRun struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// Status is ok or failed.
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// cronStatus is a cron trigger's state as reported by the admin API.
+type cronStatus struct {
+	Route    string `json:"route"`
+	Schedule string `json:"schedule"`
+	Timezone string `json:"timezone"`
+	Jitter   string `json:"jitter,omitempty"`
+	// Next is when the next run is due, before jitter.
+	Next     time.Time `json:"next,omitzero"`
+	Running  bool      `json:"running"`
+	Runs     int64     `json:"runs"`
+	Failures int64     `json:"failures"`
+	// Skipped counts runs left out because the previous one was still
+	// going.
+	Skipped int64    `json:"skipped"`
+	LastRun *cronRun `json:"last_run,omitempty"`
+}
+
+// build compiles c.
+func (c CronTrigger) build() (*cronTrigger, error) {
+	sched, err := parseCron(c.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("cron %q: %w", c.Schedule, err)
+	}
+	loc := time.Local
+	if c.Timezone != "" {
+		if loc, err = time.LoadLocation(c.Timezone); err != nil {
+			return nil, fmt.Errorf("cron %q: %w", c.Schedule, err)
+		}
+	}
+	if sched.Next(time.Now().In(loc)).IsZero() {
+		return nil, fmt.Errorf("cron %q never fires", c.Schedule)
+	}
+	if c.Jitter < 0 {
+		return nil, fmt.Errorf("cron %q: jitter must not be negative", c.Schedule)
+	}
+	payload := []byte("{}")
+	if c.Payload != nil {
+		if payload, err = json.Marshal(c.Payload); err != nil {
+			return nil, fmt.Errorf("cron %q: payload: %w", c.Schedule, err)
+		}
+	}
+	return &cronTrigger{spec: c.Schedule, schedule: sched, loc: loc, payload: payload, jitter: c.Jitter}, nil
+}
+
+func (tc *TriggersConfig) build() (*Triggers, error) {
+	t := &Triggers{DisableHTTP: tc.HTTP != nil && !*tc.HTTP}
+	for _, c := range tc.Cron {
+		ct, err := c.build()
+		if err != nil {
+			return nil, err
+		}
+		t.Cron = append(t.Cron, ct)
+	}
+	for _, q := range tc.Queue {
+		if q.Topic == "" {
+			return nil, errors.New("queue trigger needs a topic")
+		}
+		q.Concurrency = max(q.Concurrency, 1)
+		if q.Buffer <= 0 {
+			q.Buffer = defaultQueueBuffer
+		}
+		if q.DedupTTL <= 0 {
+			q.DedupTTL = defaultDedupTTL
+		}
+		if q.ResultTopic == q.Topic {
+			return nil, fmt.Errorf("queue trigger %q publishes its results to itself", q.Topic)
+		}
+		t.Queue = append(t.Queue, q)
+	}
+	for i, ct := range tc.Custom {
+		factory, ok := triggerFactories[ct.Kind]
+		if !ok {
+			return nil, fmt.Errorf("custom trigger %d: unknown kind %q", i+1, ct.Kind)
+		}
+		tr, err := factory(ct.node.Decode)
+		if err != nil {
+			return nil, fmt.Errorf("custom trigger %d (%s): %w", i+1, ct.Kind, err)
+		}
+		t.Custom = append(t.Custom, tr)
+	}
+	if t.DisableHTTP && len(t.Cron) == 0 && len(t.Queue) == 0 && len(t.Custom) == 0 {
+		return nil, errors.New("http is disabled and no other trigger is declared")
+	}
+	return t, nil
+}
+
+// checkTriggers reports whether route's triggers can start, checking cron
+// payloads against the route's schema.
+func checkTriggers(inv *Invoker, store *Store, route *Route) error {
+	tr := route.Triggers
+	if len(tr.Queue) > 0 && store == nil {
+		return errors.New("queue triggers require --store")
+	}
+	for _, c := range tr.Cron {
+		if _, err := triggerPayload(inv, route, c.payload); err != nil {
+			return fmt.Errorf("cron %q: %w", c.spec, err)
+		}
+	}
+	return nil
+}
+
+// startTriggers runs route's triggers until ctx is done, after checking
+// them with checkTriggers.
+func startTriggers(ctx context.Context, inv *Invoker, store *Store, route *Route) error {
+	if err := checkTriggers(inv, store, route); err != nil {
+		return err
+	}
+	tr := route.Triggers
+
+	var sources []Trigger
+	for _, c := range tr.Cron {
+		c.route = route.Name
+		sources = append(sources, c)
+	}
+	for _, q := range tr.Queue {
+		sources = append(sources, &queueTrigger{QueueTrigger: q, route: route.Name, store: store})
+	}
+	sources = append(sources, tr.Custom...)
+
+	routeBP := newBackpressure(inv, route)
+	for _, src := range sources {
+		kind := src.Kind()
+		bp := routeBP.source()
+		invoke := func(payload []byte) ([]byte, error) {
+			admitted := sync.OnceFunc(bp.Cancel)
+			defer admitted()
+			return invokeTriggered(ctx, inv, route, kind, payload, admitted)
+		}
+		fire := func(payload []byte) error {
+			_, err := invoke(payload)
+			return err
+		}
+		if q, ok := src.(*queueTrigger); ok {
+			q.invoke = invoke
+		}
+		go func() {
+			if err := src.Run(context.WithValue(ctx, backpressureKey{}, bp), fire); err != nil {
+				log.Printf("route %s: %s trigger stopped: %v", route.Name, kind, err)
+			}
+		}()
+	}
+	return nil
+}
+
+func (c *cronTrigger) Kind() string { return "cron" }
+
+// Run invokes the route on c's schedule, each run delayed by up to the
+// jitter. A run is skipped while the previous one is still going.
+func (c *cronTrigger) Run(ctx context.Context, fire FireFunc) error {
+	for {
+		next := c.schedule.Next(time.Now().In(c.loc))
+		c.mu.Lock()
+		c.next = next
+		c.mu.Unlock()
+		infof("route %s: cron %q next runs at %s", c.route, c.spec, next.Format(time.RFC3339))
+		delay := time.Until(next)
+		if c.jitter > 0 {
+			delay += rand.N(c.jitter)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+		if !c.running.CompareAndSwap(false, true) {
+			c.mu.Lock()
+			c.skipped++
+			c.mu.Unlock()
+			log.Printf("route %s: cron %q: previous run still in progress; skipping", c.route, c.spec)
+			continue
+		}
+		go func() {
+			defer c.running.Store(false)
+			run := &cronRun{Started: time.Now().UTC(), Status: "ok"}
+			err := fire(c.payload)
+			run.Finished = time.Now().UTC()
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.runs++
+			if err != nil {
+				c.failures++
+				run.Status, run.Error = "failed", err.Error()
+			}
+			c.last = run
+		}()
+	}
+}
+
+// status reports c, a cron trigger of route.
+func (c *cronTrigger) status(route string) cronStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := cronStatus{
+		Route:    route,
+		Schedule: c.spec,
+		Timezone: c.loc.String(),
+		Next:     c.next,
+		Running:  c.running.Load(),
+		Runs:     c.runs,
+		Failures: c.failures,
+		Skipped:  c.skipped,
+		LastRun:  c.last,
+	}
+	if c.jitter > 0 {
+		st.Jitter = c.jitter.String()
+	}
+	return st
+}
+
+// queueTrigger consumes a --store topic.
+type queueTrigger struct {
+	QueueTrigger
+	route string
+	store *Store
+	// invoke fires a message like FireFunc, also returning the output.
+	invoke func(payload []byte) ([]byte, error)
+}
+
+func (q *queueTrigger) Kind() string { return "queue" }
+
+func (q *queueTrigger) Run(ctx context.Context, fire FireFunc) error {
+	msgs, cancel := q.store.Subscribe(q.Topic, q.Buffer)
+	defer cancel()
+	log.Printf("route %s: consuming queue %q", q.route, q.Topic)
+
+	bp := TriggerBackpressure(ctx)
+	var wg sync.WaitGroup
+	for range q.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if bp.Reserve(ctx) != nil {
+					return
+				}
+				select {
+				case <-ctx.Done():
+					bp.Cancel()
+					return
+				case msg := <-msgs:
+					q.handle(msg)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// triggerPayload transforms, coerces and validates payload like an HTTP
+// request's.
+func triggerPayload(inv *Invoker, route *Route, payload []byte) ([]byte, error) {
+	if !json.Valid(payload) {
+		return nil, errors.New("invalid JSON payload")
+	}
+	payload, err := applyTransforms(route.RequestTransforms, payload)
+	if err != nil {
+		return nil, fmt.Errorf("payload transform failed: %w", err)
+	}
+	if route.Schema == nil {
+		return payload, nil
+	}
+	if route.Coerce || inv.cfg.CoercePayload {
+		payload, _ = route.Schema.Coerce(payload)
+	}
+	violations, _ := route.Schema.Validate(payload)
+	if len(violations) > 0 {
+		b, _ := json.Marshal(violations)
+		return nil, fmt.Errorf("payload does not match schema: %s", b)
+	}
+	return payload, nil
+}
+
+// errRouteDisabled is returned to triggers of a route disabled through the
+// admin API.
+var errRouteDisabled = errors.New("route disabled")
+
+// invokeTriggered invokes route with payload from a kind trigger, calling
+// admitted once the invocation took its concurrency slots, and returns
+// the output.
+func invokeTriggered(ctx context.Context, inv *Invoker, route *Route, kind string, payload []byte, admitted func()) (out []byte, err error) {
+	defer func() { inv.triggerStats.record(route.Name, kind, err) }()
+	if route.disabled.Load() {
+		infof("route %s: %s trigger skipped: route disabled", route.Name, kind)
+		return nil, errRouteDisabled
+	}
+	payload, err = triggerPayload(inv, route, payload)
+	if err != nil {
+		log.Printf("route %s: %s trigger: %v", route.Name, kind, err)
+		return nil, err
+	}
+	// Runs already started finish even when the triggers are stopped.
+	res, err := inv.Invoke(context.WithoutCancel(ctx), Invocation{
+		Route:    route,
+		Payload:  payload,
+		Env:      []string{triggerEnvKey + "=" + kind},
+		Request:  RequestInfo{ID: newRequestID(), Trigger: kind},
+		NoCache:  true,
+		Admitted: admitted,
+		Priority: route.Priority,
+	})
+	if err != nil {
+		log.Printf("route %s: %s trigger: node error: %v, stderr: %s", route.Name, kind, err, res.Stderr)
+		return nil, err
+	}
+	infof("route %s: %s trigger: %s", route.Name, kind, res.Stdout)
+	return res.Stdout, nil
+}
+
+// triggerStats counts trigger invocations per route and kind for
+// /metrics.
+type triggerStats struct {
+	mu     sync.Mutex
+	counts map[triggerKey]*triggerCount
+}
+
+type triggerKey struct{ route, kind string }
+
+type triggerCount struct {
+	invocations, failures int64
+}
+
+func (s *triggerStats) record(route, kind string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counts == nil {
+		s.counts = map[triggerKey]*triggerCount{}
+	}
+	k := triggerKey{route, kind}
+	c := s.counts[k]
+	if c == nil {
+		c = &triggerCount{}
+		s.counts[k] = c
+	}
+	c.invocations++
+	if err != nil {
+		c.failures++
+	}
+}
+
+// snapshot returns the counts sorted by route and kind.
+func (s *triggerStats) snapshot() (keys []triggerKey, counts []triggerCount) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k := range s.counts {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b triggerKey) int {
+		return cmp.Or(cmp.Compare(a.route, b.route), cmp.Compare(a.kind, b.kind))
+	})
+	for _, k := range keys {
+		counts = append(counts, *s.counts[k])
+	}
+	return keys, counts
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultGenTSPackage = "invoke-types"
+
+// npmEpoch is the modification time npm itself stamps on packed files, so
+// tarballs of the same types are byte for byte equal.
+var npmEpoch = time.Date(1985, time.October, 26, 8, 15, 0, 0, time.UTC)
+
+var tsIdentifier = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// tsGenerator writes TypeScript declarations for script authors: the
+// InvocationContext found in INVOKE_CONTEXT, each route's payload and, for
+// routes with a response schema, result, and the handler signature of the
+// stdio worker client. Like generator, it names every object schema and
+// emits shared schemas once.
+type tsGenerator struct {
+	decls     []string
+	named     map[*Schema]string
+	used      map[string]bool
+	resolving map[*Schema]bool
+}
+
+func newTSGenerator() *tsGenerator {
+	return &tsGenerator{named: map[*Schema]string{}, used: map[string]bool{}, resolving: map[*Schema]bool{}}
+}
+
+func (g *tsGenerator) declarations(routes []genRoute) ([]byte, error) {
+	g.used["InvocationContext"] = true
+	g.used["BuildInfo"] = true
+	g.used["RoutePayloads"] = true
+	g.used["RouteResults"] = true
+	g.used["Handler"] = true
+
+	var payloads, results strings.Builder
+	for _, r := range routes {
+		name := goName(r.name, "Route") + "Payload"
+		t := "unknown"
+		if r.schema != nil {
+			var err error
+			if t, err = g.tsType(r.schema, name, r.schema); err != nil {
+				return nil, fmt.Errorf("route %s: %v", r.name, err)
+			}
+		}
+		// Object payloads are named after the route already; others get
+		// an alias.
+		if t != name {
+			name = uniqueName(name, g.used)
+			g.decls = append(g.decls, fmt.Sprintf("\n/** The payload of %s. */\nexport type %s = %s;\n", r.path, name, t))
+		}
+		fmt.Fprintf(&payloads, "  %s: %s;\n", tsKey(r.name), name)
+
+		result := "unknown"
+		if r.response != nil {
+			name := goName(r.name, "Route") + "Result"
+			var err error
+			if result, err = g.tsType(r.response, name, r.response); err != nil {
+				return nil, fmt.Errorf("route %s: response: %v", r.name, err)
+			}
+			if result != name {
+				name = uniqueName(name, g.used)
+				g.decls = append(g.decls, fmt.Sprintf("\n/** The result of %s. */\nexport type %s = %s;\n", r.path, name, result))
+				result = name
+			}
+		}
+		fmt.Fprintf(&results, "  %s: %s;\n", tsKey(r.name), result)
+	}
+
+	var b strings.Builder
+	b.WriteString("// Code generated by go-invoke-node gen. DO NOT EDIT.\n\n")
+	b.WriteString("/** The object in the INVOKE_CONTEXT environment variable. */\n")
+	b.WriteString(tsInterface("InvocationContext", reflect.TypeOf(InvocationContext{})))
+	b.WriteString("\n")
+	b.WriteString(tsInterface("BuildInfo", reflect.TypeOf(BuildInfo{})))
+	b.WriteString("\n/** Maps route names to their payload types. */\n")
+	b.WriteString("export interface RoutePayloads {\n" + payloads.String() + "}\n")
+	b.WriteString("\n/** Maps route names to the types of their results. */\n")
+	b.WriteString("export interface RouteResults {\n" + results.String() + "}\n")
+	b.WriteString(`
+/**
+ * A handler passed to the stdio worker client,
+ * require(process.env.INVOKE_WORKER_CLIENT).
+ */
+export type Handler<R extends keyof RoutePayloads = keyof RoutePayloads, T = RouteResults[R]> = (
+  payload: RoutePayloads[R],
+  env: Record<string, string>,
+) => T | Promise<T>;
+`)
+	for _, d := range g.decls {
+		b.WriteString(d)
+	}
+	return []byte(b.String()), nil
+}
+
+// tsType returns the TypeScript type for s, emitting the named types it
+// needs; see generator.goType.
+func (g *tsGenerator) tsType(s *Schema, name string, root *Schema) (string, error) {
+	if s.Ref != "" {
+		target, err := s.resolve()
+		if err != nil {
+			return "", err
+		}
+		if n, ok := g.named[target]; ok {
+			return n, nil
+		}
+		if g.resolving[target] {
+			return "unknown", nil
+		}
+		g.resolving[target] = true
+		defer delete(g.resolving, target)
+		if target != s.root {
+			for def, ds := range root.Defs {
+				if ds == target {
+					name = goName(def, "Def")
+				}
+			}
+		}
+		return g.tsType(target, name, root)
+	}
+	if s.boolean != nil {
+		if !*s.boolean {
+			return "never", nil
+		}
+		return "unknown", nil
+	}
+	if len(s.Const) > 0 {
+		return string(s.Const), nil
+	}
+	if len(s.Enum) > 0 {
+		lits := make([]string, len(s.Enum))
+		for i, v := range s.Enum {
+			lits[i] = string(v)
+		}
+		return strings.Join(lits, " | "), nil
+	}
+	for _, list := range []struct {
+		schemas []*Schema
+		sep     string
+	}{{s.AnyOf, " | "}, {s.OneOf, " | "}, {s.AllOf, " & "}} {
+		if len(list.schemas) == 0 {
+			continue
+		}
+		parts := make([]string, len(list.schemas))
+		for i, sub := range list.schemas {
+			t, err := g.tsType(sub, fmt.Sprintf("%s%d", name, i+1), root)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = "(" + t + ")"
+		}
+		return strings.Join(parts, list.sep), nil
+	}
+
+	types := []string(s.Type)
+	if len(types) == 0 && len(s.Properties) > 0 {
+		types = []string{"object"}
+	}
+	if len(types) == 0 {
+		return "unknown", nil
+	}
+	var parts []string
+	for _, typ := range types {
+		switch typ {
+		case "string", "boolean", "null":
+			parts = append(parts, typ)
+		case "integer", "number":
+			parts = append(parts, "number")
+		case "array":
+			elem := "unknown"
+			if s.Items != nil {
+				var err error
+				if elem, err = g.tsType(s.Items, name+"Item", root); err != nil {
+					return "", err
+				}
+			}
+			parts = append(parts, "Array<"+elem+">")
+		case "object":
+			t, err := g.objectType(s, name, root)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, t)
+		default:
+			parts = append(parts, "unknown")
+		}
+	}
+	return strings.Join(parts, " | "), nil
+}
+
+// objectType returns a record type for s, or emits an interface for it
+// once when it has properties.
+func (g *tsGenerator) objectType(s *Schema, name string, root *Schema) (string, error) {
+	if len(s.Properties) == 0 {
+		elem := "unknown"
+		if ap := s.AdditionalProperties; ap != nil && ap.boolean == nil {
+			var err error
+			if elem, err = g.tsType(ap, name+"Value", root); err != nil {
+				return "", err
+			}
+		}
+		return "Record<string, " + elem + ">", nil
+	}
+	if n, ok := g.named[s]; ok {
+		return n, nil
+	}
+	if s.Title != "" {
+		name = goName(s.Title, "Object")
+	}
+	name = uniqueName(name, g.used)
+	g.named[s] = name
+	decl := len(g.decls)
+	g.decls = append(g.decls, "")
+
+	required := map[string]bool{}
+	for _, p := range s.Required {
+		required[p] = true
+	}
+	props := make([]string, 0, len(s.Properties))
+	for p := range s.Properties {
+		props = append(props, p)
+	}
+	sort.Strings(props)
+
+	var b strings.Builder
+	b.WriteString("\n" + tsDoc(s.Description, ""))
+	fmt.Fprintf(&b, "export interface %s {\n", name)
+	for _, p := range props {
+		ps := s.Properties[p]
+		t, err := g.tsType(ps, name+goName(p, "Field"), root)
+		if err != nil {
+			return "", fmt.Errorf("property %s: %v", p, err)
+		}
+		opt := "?"
+		if required[p] {
+			opt = ""
+		}
+		b.WriteString(tsDoc(ps.Description, "  "))
+		fmt.Fprintf(&b, "  %s%s: %s;\n", tsKey(p), opt, t)
+	}
+	b.WriteString("}\n")
+	g.decls[decl] = b.String()
+	return name, nil
+}
+
+// tsInterface declares the JSON encoding of the Go struct t.
+func tsInterface(name string, t reflect.Type) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "export interface %s {\n", name)
+	for i := range t.NumField() {
+		f := t.Field(i)
+		key, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		opt := ""
+		if strings.Contains(opts, "omitempty") {
+			opt = "?"
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		var ts string
+		switch {
+		case ft == reflect.TypeOf(time.Time{}):
+			ts = "string"
+		case ft == reflect.TypeOf(BuildInfo{}):
+			ts = "BuildInfo"
+		case ft.Kind() == reflect.String:
+			ts = "string"
+		case ft.Kind() == reflect.Bool:
+			ts = "boolean"
+		default:
+			ts = "number"
+		}
+		fmt.Fprintf(&b, "  %s%s: %s;\n", key, opt, ts)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// tsKey quotes a property name unless it is an identifier.
+func tsKey(k string) string {
+	if tsIdentifier.MatchString(k) {
+		return k
+	}
+	q, _ := json.Marshal(k)
+	return string(q)
+}
+
+func tsDoc(text, indent string) string {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return ""
+	}
+	text = strings.ReplaceAll(text, "*/", "*\\/")
+	if !strings.Contains(text, "\n") {
+		return indent + "/** " + text + " */\n"
+	}
+	var b strings.Builder
+	b.WriteString(indent + "/**\n")
+	for _, line := range strings.Split(text, "\n") {
+		b.WriteString(strings.TrimRight(indent+" * "+line, " ") + "\n")
+	}
+	b.WriteString(indent + " */\n")
+	return b.String()
+}
+
+// npmTarball packs the declarations as an npm package named pkg, ready for
+// npm install <file>.
+func npmTarball(pkg string, dts []byte) ([]byte, error) {
+	manifest, err := json.MarshalIndent(map[string]any{
+		"name":    pkg,
+		"version": "0.0.0",
+		"types":   "index.d.ts",
+		"files":   []string{"index.d.ts"},
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return packNPM([]npmFile{{"package.json", append(manifest, '\n')}, {"index.d.ts", dts}})
+}
+
+// npmFile is a file of an npm package, named relative to its root.
+type npmFile struct {
+	name string
+	data []byte
+}
+
+// packNPM returns the tarball npm pack would make of files.
+func packNPM(files []npmFile) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, f := range files {
+		hdr := &tar.Header{Name: "package/" + f.name, Mode: 0o644, Size: int64(len(f.data)), ModTime: npmEpoch, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
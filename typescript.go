@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tsBuildTimeout bounds how long esbuild may take to transpile a script.
+const tsBuildTimeout = time.Minute
+
+// isTypeScript reports whether file is a TypeScript script.
+func isTypeScript(file string) bool {
+	switch filepath.Ext(file) {
+	case ".ts", ".mts", ".cts":
+		return true
+	}
+	return false
+}
+
+// typeScript runs TypeScript scripts without a build step of their own.
+// Node versions able to strip types run them directly. Older ones run the
+// JavaScript esbuild emits for them, bundled with their imports and
+// cached until the script or a local module it imports changes; esbuild is
+// looked up in the node_modules next to the script, the --package-json
+// install and PATH.
+//
+// Local imports must spell out the .ts extension when node strips types,
+// as node doesn't guess extensions.
+type typeScript struct {
+	mu sync.Mutex
+	// strip holds the flags making each runtime strip types, nil when it
+	// can't.
+	strip  map[string][]string
+	builds map[string]*tsBuild
+}
+
+// tsBuild is the cached transpilation of one script.
+type tsBuild struct {
+	mu     sync.Mutex
+	out    string
+	built  time.Time
+	inputs []string
+}
+
+// prepare returns the node flags and the file that run the TypeScript
+// script of route; modules is the --package-json install, if any.
+func (ts *typeScript) prepare(route *Route, modules string) ([]string, string, error) {
+	flags, err := ts.stripFlags(route.runtime())
+	if err != nil {
+		return nil, "", err
+	}
+	if flags != nil {
+		return flags, absPath(route.ScriptFile), nil
+	}
+	out, err := ts.transpile(absPath(route.ScriptFile), modules)
+	return []string{"--enable-source-maps"}, out, err
+}
+
+// stripFlags detects once per runtime whether node strips types itself.
+func (ts *typeScript) stripFlags(runtime string) ([]string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if flags, ok := ts.strip[runtime]; ok {
+		return flags, nil
+	}
+	available, err := detectNodeFlags(runtime)
+	if err != nil {
+		return nil, err
+	}
+	var flags []string
+	switch {
+	case available["--experimental-transform-types"]:
+		// Also covers enums and namespaces, which need code generated.
+		flags = []string{"--experimental-transform-types"}
+	case available["--experimental-strip-types"]:
+		flags = []string{"--experimental-strip-types"}
+	}
+	if flags != nil && available["--disable-warning"] {
+		flags = append(flags, "--disable-warning=ExperimentalWarning")
+	}
+	if ts.strip == nil {
+		ts.strip = map[string][]string{}
+	}
+	ts.strip[runtime] = flags
+	return flags, nil
+}
+
+// transpile returns the cached JavaScript for script, building it first
+// when it is missing or older than one of its local inputs.
+func (ts *typeScript) transpile(script, modules string) (string, error) {
+	ts.mu.Lock()
+	if ts.builds == nil {
+		ts.builds = map[string]*tsBuild{}
+	}
+	b := ts.builds[script]
+	if b == nil {
+		b = &tsBuild{}
+		ts.builds[script] = b
+	}
+	ts.mu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.out == "" {
+		// A build left by an earlier run is as good as a fresh one.
+		b.load(script)
+	}
+	if b.out != "" && b.fresh() {
+		return b.out, nil
+	}
+	if err := b.build(script, modules); err != nil {
+		return "", err
+	}
+	return b.out, nil
+}
+
+// tsCacheDir is where transpiled scripts are kept.
+func tsCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "go-invoke-node", "ts")
+}
+
+// paths returns the emitted JavaScript and the esbuild metafile listing
+// its inputs. .mts scripts are emitted as ES modules so they may use top
+// level await, others as CommonJS.
+func (b *tsBuild) paths(script string) (out, meta string) {
+	sum := sha256.Sum256([]byte(script))
+	base := filepath.Join(tsCacheDir(), filepath.Base(script)+"-"+hex.EncodeToString(sum[:8]))
+	if filepath.Ext(script) == ".mts" {
+		return base + ".mjs", base + ".meta.json"
+	}
+	return base + ".cjs", base + ".meta.json"
+}
+
+func (b *tsBuild) load(script string) {
+	out, meta := b.paths(script)
+	info, err := os.Stat(out)
+	if err != nil {
+		return
+	}
+	inputs, err := readMetafile(meta, filepath.Dir(script))
+	if err != nil {
+		return
+	}
+	b.out, b.built, b.inputs = out, info.ModTime(), inputs
+}
+
+// fresh reports whether none of the inputs changed since the build.
+// Packages from node_modules aren't checked, to keep this cheap.
+func (b *tsBuild) fresh() bool {
+	for _, in := range b.inputs {
+		info, err := os.Stat(in)
+		if err != nil || info.ModTime().After(b.built) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *tsBuild) build(script, modules string) error {
+	esbuild, err := findESBuild(script, modules)
+	if err != nil {
+		return err
+	}
+	out, meta := b.paths(script)
+	if err := os.MkdirAll(filepath.Dir(out), 0o755); err != nil {
+		return err
+	}
+	format := "cjs"
+	if filepath.Ext(out) == ".mjs" {
+		format = "esm"
+	}
+	// Builds are written beside the cached one and renamed over it, so
+	// running invocations keep a complete file.
+	tmp := out + fmt.Sprintf(".%d.tmp", os.Getpid())
+	started := time.Now()
+	cmd := exec.Command(esbuild, script,
+		"--bundle", "--platform=node", "--format="+format, "--sourcemap=inline",
+		"--log-level=warning", "--outfile="+tmp, "--metafile="+meta)
+	cmd.Dir = filepath.Dir(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = orphanWaitDelay
+	timer := time.AfterFunc(tsBuildTimeout, func() { cmd.Process.Kill() })
+	err = cmd.Run()
+	timer.Stop()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("esbuild %s: %v: %s", script, err, strings.TrimSpace(stderr.String()))
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		return err
+	}
+	inputs, err := readMetafile(meta, filepath.Dir(script))
+	if err != nil {
+		return err
+	}
+	b.out, b.built, b.inputs = out, started, inputs
+	log.Printf("typescript: transpiled %s in %s", script, time.Since(started).Round(time.Millisecond))
+	return nil
+}
+
+// readMetafile returns the local inputs recorded in an esbuild metafile,
+// whose paths are relative to dir, the directory esbuild ran in.
+func readMetafile(meta, dir string) ([]string, error) {
+	data, err := os.ReadFile(meta)
+	if err != nil {
+		return nil, err
+	}
+	var m struct {
+		Inputs map[string]json.RawMessage `json:"inputs"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", meta, err)
+	}
+	inputs := make([]string, 0, len(m.Inputs))
+	for in := range m.Inputs {
+		// Skip packages and esbuild's virtual modules.
+		if strings.Contains(in, "node_modules/") || strings.Contains(in, ":") {
+			continue
+		}
+		inputs = append(inputs, filepath.Join(dir, filepath.FromSlash(in)))
+	}
+	return inputs, nil
+}
+
+// findESBuild returns the esbuild of the nearest node_modules above
+// script, else that of the --package-json install, else esbuild from
+// PATH.
+func findESBuild(script, modules string) (string, error) {
+	for dir := filepath.Dir(script); ; dir = filepath.Dir(dir) {
+		if p := filepath.Join(dir, "node_modules", ".bin", "esbuild"); fileExists(p) {
+			return p, nil
+		}
+		if filepath.Dir(dir) == dir {
+			break
+		}
+	}
+	if modules != "" {
+		if p := filepath.Join(modules, ".bin", "esbuild"); fileExists(p) {
+			return p, nil
+		}
+	}
+	if p, err := exec.LookPath("esbuild"); err == nil {
+		return p, nil
+	}
+	return "", errors.New("node can't strip types and esbuild isn't installed; add esbuild to the scripts' node_modules or --package-json, or use node 22.6 or newer")
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webhookTolerance bounds the age of signed timestamps, limiting replay of
+// captured deliveries.
+const webhookTolerance = 5 * time.Minute
+
+var errBadSignature = errors.New("invalid webhook signature")
+
+// Webhook verifies deliveries from a provider and rewrites them into a
+// common envelope, so scripts only implement the handling itself:
+//
+//	{"provider": "github", "event": "push", "id": "…", "payload": {…}}
+type Webhook struct {
+	preset     *webhookPreset
+	secretFile string
+	secretEnv  string
+}
+
+// webhookPreset is the provider-specific part of a Webhook.
+type webhookPreset struct {
+	name   string
+	verify func(h http.Header, body, secret []byte, now time.Time) error
+	parse  func(h http.Header, body []byte) (*delivery, error)
+}
+
+// delivery is a verified webhook request.
+type delivery struct {
+	Event   string
+	ID      string
+	Payload json.RawMessage
+	// Reply, when set, is sent to the provider directly instead of
+	// running a script, e.g. for Slack's URL verification handshake.
+	Reply any
+}
+
+var webhookPresets = map[string]*webhookPreset{
+	"github": {name: "github", verify: verifyGitHub, parse: parseGitHub},
+	"stripe": {name: "stripe", verify: verifyStripe, parse: parseStripe},
+	"slack":  {name: "slack", verify: verifySlack, parse: parseSlack},
+}
+
+func newWebhook(preset, secretFile, secretEnv string) (*Webhook, error) {
+	p, ok := webhookPresets[preset]
+	if !ok {
+		return nil, fmt.Errorf("unknown preset %q (want github, stripe or slack)", preset)
+	}
+	if (secretFile == "") == (secretEnv == "") {
+		return nil, errors.New("must set exactly one of secret_file or secret_env")
+	}
+	return &Webhook{preset: p, secretFile: secretFile, secretEnv: secretEnv}, nil
+}
+
+// secret returns the signing secret, re-reading the file each time so a
+// rotated secret applies without a restart.
+func (wh *Webhook) secret() ([]byte, error) {
+	if wh.secretFile != "" {
+		b, err := os.ReadFile(wh.secretFile)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(string(b), "\r\n")), nil
+	}
+	v := os.Getenv(wh.secretEnv)
+	if v == "" {
+		return nil, fmt.Errorf("%s is not set", wh.secretEnv)
+	}
+	return []byte(v), nil
+}
+
+// Receive verifies body against the request signature and parses it.
+// Signature failures wrap errBadSignature.
+func (wh *Webhook) Receive(h http.Header, body []byte) (*delivery, error) {
+	secret, err := wh.secret()
+	if err != nil {
+		return nil, fmt.Errorf("load secret: %w", err)
+	}
+	if err := wh.preset.verify(h, body, secret, time.Now()); err != nil {
+		return nil, err
+	}
+	return wh.preset.parse(h, body)
+}
+
+// Envelope returns the normalized payload passed to scripts.
+func (wh *Webhook) Envelope(d *delivery) []byte {
+	b, _ := json.Marshal(map[string]any{
+		"provider": wh.preset.name,
+		"event":    d.Event,
+		"id":       d.ID,
+		"payload":  d.Payload,
+	})
+	return b
+}
+
+func hmacSHA256(secret []byte, parts ...string) []byte {
+	m := hmac.New(sha256.New, secret)
+	for _, p := range parts {
+		m.Write([]byte(p))
+	}
+	return m.Sum(nil)
+}
+
+// checkHexMAC compares a hex encoded signature against want.
+func checkHexMAC(sig string, want []byte) error {
+	got, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, want) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// checkTimestamp rejects signed timestamps outside webhookTolerance.
+func checkTimestamp(ts string, now time.Time) error {
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: bad timestamp", errBadSignature)
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > webhookTolerance || d < -webhookTolerance {
+		return fmt.Errorf("%w: timestamp outside tolerance", errBadSignature)
+	}
+	return nil
+}
+
+func isForm(h http.Header) bool {
+	mt, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return mt == "application/x-www-form-urlencoded"
+}
+
+func verifyGitHub(h http.Header, body, secret []byte, _ time.Time) error {
+	sig, ok := strings.CutPrefix(h.Get("X-Hub-Signature-256"), "sha256=")
+	if !ok {
+		return fmt.Errorf("%w: missing X-Hub-Signature-256", errBadSignature)
+	}
+	return checkHexMAC(sig, hmacSHA256(secret, string(body)))
+}
+
+func parseGitHub(h http.Header, body []byte) (*delivery, error) {
+	payload := body
+	// Webhooks configured with the form content type wrap the JSON in a
+	// "payload" field.
+	if isForm(h) {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		payload = []byte(form.Get("payload"))
+	}
+	if !json.Valid(payload) {
+		return nil, errors.New("payload is not JSON")
+	}
+	return &delivery{
+		Event:   h.Get("X-GitHub-Event"),
+		ID:      h.Get("X-GitHub-Delivery"),
+		Payload: payload,
+	}, nil
+}
+
+func verifyStripe(h http.Header, body, secret []byte, now time.Time) error {
+	var ts string
+	var sigs []string
+	for _, part := range strings.Split(h.Get("Stripe-Signature"), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sigs = append(sigs, v)
+		}
+	}
+	if ts == "" || len(sigs) == 0 {
+		return fmt.Errorf("%w: malformed Stripe-Signature", errBadSignature)
+	}
+	if err := checkTimestamp(ts, now); err != nil {
+		return err
+	}
+	want := hmacSHA256(secret, ts, ".", string(body))
+	// Stripe sends one v1 signature per active secret while rolling.
+	for _, sig := range sigs {
+		if checkHexMAC(sig, want) == nil {
+			return nil
+		}
+	}
+	return errBadSignature
+}
+
+func parseStripe(_ http.Header, body []byte) (*delivery, error) {
+	var ev struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(body, &ev); err != nil {
+		return nil, errors.New("payload is not a JSON event")
+	}
+	return &delivery{Event: ev.Type, ID: ev.ID, Payload: body}, nil
+}
+
+func verifySlack(h http.Header, body, secret []byte, now time.Time) error {
+	ts := h.Get("X-Slack-Request-Timestamp")
+	if err := checkTimestamp(ts, now); err != nil {
+		return err
+	}
+	sig, ok := strings.CutPrefix(h.Get("X-Slack-Signature"), "v0=")
+	if !ok {
+		return fmt.Errorf("%w: missing X-Slack-Signature", errBadSignature)
+	}
+	return checkHexMAC(sig, hmacSHA256(secret, "v0:", ts, ":", string(body)))
+}
+
+// parseSlack handles the Events API (JSON), slash commands (form fields)
+// and interactive components (JSON in a "payload" form field). Slash
+// commands use the command, e.g. "/deploy", as the event type.
+func parseSlack(h http.Header, body []byte) (*delivery, error) {
+	if isForm(h) {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		if p := form.Get("payload"); p != "" {
+			var ia struct {
+				Type      string `json:"type"`
+				TriggerID string `json:"trigger_id"`
+			}
+			if err := json.Unmarshal([]byte(p), &ia); err != nil {
+				return nil, errors.New("interaction payload is not JSON")
+			}
+			return &delivery{Event: ia.Type, ID: ia.TriggerID, Payload: json.RawMessage(p)}, nil
+		}
+		fields := map[string]string{}
+		for k := range form {
+			fields[k] = form.Get(k)
+		}
+		b, _ := json.Marshal(fields)
+		return &delivery{Event: form.Get("command"), ID: form.Get("trigger_id"), Payload: b}, nil
+	}
+
+	var ev struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		EventID   string `json:"event_id"`
+		Event     struct {
+			Type string `json:"type"`
+		} `json:"event"`
+	}
+	if err := json.Unmarshal(body, &ev); err != nil {
+		return nil, errors.New("payload is not JSON")
+	}
+	switch ev.Type {
+	case "url_verification":
+		return &delivery{Event: ev.Type, Reply: map[string]string{"challenge": ev.Challenge}}, nil
+	case "event_callback":
+		return &delivery{Event: ev.Event.Type, ID: ev.EventID, Payload: body}, nil
+	}
+	return &delivery{Event: ev.Type, ID: ev.EventID, Payload: body}, nil
+}
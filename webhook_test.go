@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookReceive(t *testing.T) {
+	const secret = "whsec"
+	t.Setenv("WEBHOOK_SECRET", secret)
+	now := time.Now()
+	ts := strconv.FormatInt(now.Unix(), 10)
+	stale := strconv.FormatInt(now.Add(-2*webhookTolerance).Unix(), 10)
+	sign := func(parts ...string) string { return hex.EncodeToString(hmacSHA256([]byte(secret), parts...)) }
+
+	const event = `{"id":"evt_1","type":"invoice.paid"}`
+	const slackEvent = `{"type":"event_callback","event_id":"Ev1","event":{"type":"app_mention"}}`
+	tests := []struct {
+		name      string
+		preset    string
+		headers   map[string]string
+		body      string
+		wantEvent string
+		wantID    string
+		// wantErr is errBadSignature for rejected signatures, or any
+		// other error for rejected payloads.
+		wantErr error
+	}{{
+		name:      "github",
+		preset:    "github",
+		headers:   map[string]string{"X-Hub-Signature-256": "sha256=" + sign(`{"ref":"main"}`), "X-GitHub-Event": "push", "X-GitHub-Delivery": "d1"},
+		body:      `{"ref":"main"}`,
+		wantEvent: "push",
+		wantID:    "d1",
+	}, {
+		name:      "github form",
+		preset:    "github",
+		headers:   map[string]string{"X-Hub-Signature-256": "sha256=" + sign(`payload=%7B%7D`), "Content-Type": "application/x-www-form-urlencoded", "X-GitHub-Event": "ping"},
+		body:      `payload=%7B%7D`,
+		wantEvent: "ping",
+	}, {
+		name:    "github wrong secret",
+		preset:  "github",
+		headers: map[string]string{"X-Hub-Signature-256": "sha256=" + hex.EncodeToString(hmacSHA256([]byte("other"), "{}"))},
+		body:    `{}`,
+		wantErr: errBadSignature,
+	}, {
+		name:    "github tampered body",
+		preset:  "github",
+		headers: map[string]string{"X-Hub-Signature-256": "sha256=" + sign(`{"ref":"main"}`)},
+		body:    `{"ref":"prod"}`,
+		wantErr: errBadSignature,
+	}, {
+		name:    "github unsigned",
+		preset:  "github",
+		body:    `{}`,
+		wantErr: errBadSignature,
+	}, {
+		name:    "github signed non-JSON",
+		preset:  "github",
+		headers: map[string]string{"X-Hub-Signature-256": "sha256=" + sign(`nope`)},
+		body:    `nope`,
+		wantErr: errors.New("payload is not JSON"),
+	}, {
+		name:      "stripe",
+		preset:    "stripe",
+		headers:   map[string]string{"Stripe-Signature": "t=" + ts + ",v1=" + sign(ts, ".", event)},
+		body:      event,
+		wantEvent: "invoice.paid",
+		wantID:    "evt_1",
+	}, {
+		name:      "stripe rolling secrets",
+		preset:    "stripe",
+		headers:   map[string]string{"Stripe-Signature": "t=" + ts + ",v1=00ff,v1=" + sign(ts, ".", event)},
+		body:      event,
+		wantEvent: "invoice.paid",
+		wantID:    "evt_1",
+	}, {
+		name:    "stripe stale",
+		preset:  "stripe",
+		headers: map[string]string{"Stripe-Signature": "t=" + stale + ",v1=" + sign(stale, ".", event)},
+		body:    event,
+		wantErr: errBadSignature,
+	}, {
+		name:    "stripe signature for another timestamp",
+		preset:  "stripe",
+		headers: map[string]string{"Stripe-Signature": "t=" + ts + ",v1=" + sign(stale, ".", event)},
+		body:    event,
+		wantErr: errBadSignature,
+	}, {
+		name:    "stripe malformed",
+		preset:  "stripe",
+		headers: map[string]string{"Stripe-Signature": "v1=" + sign(ts, ".", event)},
+		body:    event,
+		wantErr: errBadSignature,
+	}, {
+		name:      "slack",
+		preset:    "slack",
+		headers:   map[string]string{"X-Slack-Request-Timestamp": ts, "X-Slack-Signature": "v0=" + sign("v0:", ts, ":", slackEvent)},
+		body:      slackEvent,
+		wantEvent: "app_mention",
+		wantID:    "Ev1",
+	}, {
+		name:    "slack stale",
+		preset:  "slack",
+		headers: map[string]string{"X-Slack-Request-Timestamp": stale, "X-Slack-Signature": "v0=" + sign("v0:", stale, ":", slackEvent)},
+		body:    slackEvent,
+		wantErr: errBadSignature,
+	}, {
+		name:    "slack bad hex",
+		preset:  "slack",
+		headers: map[string]string{"X-Slack-Request-Timestamp": ts, "X-Slack-Signature": "v0=zz"},
+		body:    slackEvent,
+		wantErr: errBadSignature,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wh, err := newWebhook(tt.preset, "", "WEBHOOK_SECRET")
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := http.Header{}
+			for k, v := range tt.headers {
+				h.Set(k, v)
+			}
+			d, err := wh.Receive(h, []byte(tt.body))
+			if tt.wantErr != nil {
+				if err == nil {
+					t.Fatalf("Receive accepted the delivery, want %v", tt.wantErr)
+				}
+				if errors.Is(tt.wantErr, errBadSignature) != errors.Is(err, errBadSignature) {
+					t.Errorf("Receive = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Receive: %v", err)
+			}
+			if d.Event != tt.wantEvent || d.ID != tt.wantID {
+				t.Errorf("delivery event %q id %q, want %q and %q", d.Event, d.ID, tt.wantEvent, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestWebhookSlackURLVerification(t *testing.T) {
+	t.Setenv("WEBHOOK_SECRET", "s")
+	wh, _ := newWebhook("slack", "", "WEBHOOK_SECRET")
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	body := `{"type":"url_verification","challenge":"c4"}`
+	h := http.Header{}
+	h.Set("X-Slack-Request-Timestamp", ts)
+	h.Set("X-Slack-Signature", "v0="+hex.EncodeToString(hmacSHA256([]byte("s"), "v0:", ts, ":", body)))
+	d, err := wh.Receive(h, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, _ := d.Reply.(map[string]string); reply["challenge"] != "c4" {
+		t.Errorf("reply = %v, want the challenge echoed", d.Reply)
+	}
+}
+
+func TestNewWebhook(t *testing.T) {
+	if _, err := newWebhook("gitlab", "", "X"); err == nil {
+		t.Error("unknown preset accepted")
+	}
+	if _, err := newWebhook("github", "", ""); err == nil {
+		t.Error("webhook without a secret accepted")
+	}
+	if _, err := newWebhook("github", "secret.txt", "X"); err == nil {
+		t.Error("webhook with two secrets accepted")
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	t.Setenv("WEBHOOK_SECRET", "s")
+	wh, _ := newWebhook("github", "", "WEBHOOK_SECRET")
+	route := &Route{Name: "hook", InlineScript: "0", Webhook: wh}
+	var served []byte
+	serve := func(w http.ResponseWriter, r *http.Request, _ *Invoker, _ *Route, _ handlerOptions) {
+		served, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}
+	h := makeDispatchHandler(nil, route, serve, handlerOptions{MaxUploadSize: 64})
+
+	tests := []struct {
+		name   string
+		body   string
+		sig    string
+		status int
+	}{
+		{"signed", `{"ok":true}`, hex.EncodeToString(hmacSHA256([]byte("s"), `{"ok":true}`)), http.StatusOK},
+		{"unsigned", `{"ok":true}`, "00", http.StatusUnauthorized},
+		// Oversized deliveries are refused before their signature is
+		// checked.
+		{"too large", `{"pad":"` + strings.Repeat("x", 100) + `"}`, "00", http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			served = nil
+			r := httptest.NewRequest("POST", "/invoke/hook", strings.NewReader(tt.body))
+			r.Header.Set("X-Hub-Signature-256", "sha256="+tt.sig)
+			r.Header.Set("X-GitHub-Event", "push")
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusOK && !strings.Contains(string(served), `"event":"push"`) {
+				t.Errorf("script got %s, want the envelope", served)
+			}
+			if tt.status != http.StatusOK && served != nil {
+				t.Errorf("rejected delivery was served")
+			}
+		})
+	}
+}
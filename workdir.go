@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// workdirEnvKey points scripts at their scratch directory; TMPDIR is set
+// to it as well, so os.tmpdir() files are isolated and cleaned up too.
+const workdirEnvKey = "INVOKE_WORKDIR"
+
+// Workdir runs every invocation in a fresh temporary working directory,
+// removed once the script exits, so scripts writing scratch files can't
+// see or clobber each other's. The directory starts as a copy of Template
+// when set. Persistent workers keep the server's working directory.
+type Workdir struct {
+	Isolate bool `yaml:"isolate"`
+	// Template is copied into each directory; it implies Isolate.
+	// Symlinks in it are not supported.
+	Template string `yaml:"template"`
+}
+
+func (wd *Workdir) isolated() bool {
+	return wd != nil && (wd.Isolate || wd.Template != "")
+}
+
+func (wd *Workdir) validate() error {
+	if wd.Template == "" {
+		return nil
+	}
+	info, err := os.Stat(wd.Template)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("template %s is not a directory", wd.Template)
+	}
+	return nil
+}
+
+// create makes an invocation's directory. The caller removes it.
+func (wd *Workdir) create() (string, error) {
+	dir, err := os.MkdirTemp("", "invoke-work-*")
+	if err != nil {
+		return "", err
+	}
+	if wd.Template != "" {
+		if err := os.CopyFS(dir, os.DirFS(wd.Template)); err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("copy template: %w", err)
+		}
+	}
+	return dir, nil
+}
+
+// workdirFor returns route's working directory policy: its own, or the
+// server-wide one. It returns nil when invocations share the server's.
+func (inv *Invoker) workdirFor(route *Route) *Workdir {
+	wd := route.Workdir
+	if wd == nil {
+		wd = &inv.cfg.Workdir
+	}
+	if !wd.isolated() {
+		return nil
+	}
+	return wd
+}
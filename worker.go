@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// socketEnvKey tells a persistent script where to listen.
+	socketEnvKey = "INVOKE_SOCKET"
+	// invokeEnvHeader carries the per-invocation environment, as a JSON
+	// object, to persistent scripts that cannot receive it via exec.
+	invokeEnvHeader = "X-Invoke-Env"
+
+	workerRestartDelay = time.Second
+)
+
+// Worker is a long-lived node process serving invocations, so scripts can
+// keep caches and connection pools warm across requests. With the http
+// protocol the script must listen on the unix socket at INVOKE_SOCKET and
+// answer POST / with the result; any non-2xx status is a failure. With the
+// stdio protocol it exchanges JSON lines over stdin and stdout, most
+// easily through the helper at INVOKE_WORKER_CLIENT; see workerclient.js.
+type Worker struct {
+	route        *Route
+	spec         ExecSpec
+	env          nodeEnv
+	executor     Executor
+	protocol     string
+	dir          string
+	sock         string
+	readyTimeout time.Duration
+	client       *http.Client
+	// limits caps the responses of http workers at MaxOutput.
+	limits ResourceLimits
+
+	mu    sync.Mutex
+	ready chan struct{}
+	proc  *os.Process
+	// ctx ends when the worker is stopped.
+	ctx  context.Context
+	stop context.CancelFunc
+	// conn talks to the current process of a stdio worker.
+	conn *stdioConn
+
+	// calls is read-held by each in-flight invocation, so Restart can
+	// drain them.
+	calls sync.RWMutex
+
+	recycle  WorkerRecycle
+	recycles *recycleStats
+	// requests counts the invocations the current process served.
+	requests atomic.Int64
+}
+
+// StartWorker launches the node process of spec with executor, and waits
+// until the script is ready to serve protocol.
+func StartWorker(spec ExecSpec, env nodeEnv, executor Executor, protocol string, readyTimeout time.Duration) (*Worker, error) {
+	dir, err := os.MkdirTemp("", "invoke-node-*")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "client.js"), workerClient, 0o644); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	sock := filepath.Join(dir, "worker.sock")
+	// The socket and client are reached from inside containers too.
+	spec.WritePaths = append(spec.WritePaths[:len(spec.WritePaths):len(spec.WritePaths)], dir)
+
+	w := &Worker{
+		route:        spec.Route,
+		spec:         spec,
+		env:          env,
+		executor:     executor,
+		protocol:     protocol,
+		dir:          dir,
+		sock:         sock,
+		readyTimeout: readyTimeout,
+		client: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sock)
+			},
+		}},
+		ready: make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w.ctx, w.stop = ctx, cancel
+
+	exited, err := w.spawn(ctx)
+	if err != nil {
+		cancel()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	go w.supervise(ctx, exited)
+	return w, nil
+}
+
+// spawn starts the node process and blocks until it is ready, i.e. the
+// socket accepts connections or a stdio worker announced itself, or the
+// ready timeout expires. The returned channel receives the process exit
+// status.
+func (w *Worker) spawn(ctx context.Context) (<-chan error, error) {
+	os.Remove(w.sock)
+
+	routeEnv, err := w.route.environ()
+	if err != nil {
+		return nil, err
+	}
+
+	spec := w.spec
+	spec.Env = w.env.apply(append(childEnv(), routeEnv...))
+	if w.protocol == workerProtocolStdio {
+		spec.Env = append(spec.Env, workerClientEnvKey+"="+filepath.Join(w.dir, "client.js"))
+	} else {
+		spec.Env = append(spec.Env, socketEnvKey+"="+w.sock)
+	}
+	cmd, release := w.executor.Command(ctx, spec)
+	cmd.Stderr = logWriter("worker stderr: ")
+	var conn *stdioConn
+	var stdout io.Reader
+	if w.protocol == workerProtocolStdio {
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if stdout, err = cmd.StdoutPipe(); err != nil {
+			return nil, err
+		}
+		conn = newStdioConn(stdin)
+	} else {
+		cmd.Stdout = logWriter("worker stdout: ")
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	if conn != nil {
+		go conn.read(stdout)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		if conn != nil {
+			// Wait closes stdout, which must be read to the end first.
+			<-conn.done
+		}
+		err := cmd.Wait()
+		release()
+		exited <- err
+	}()
+
+	if conn != nil {
+		select {
+		case <-conn.ready:
+		case err := <-exited:
+			return nil, fmt.Errorf("worker exited before it was ready: %v", err)
+		case <-time.After(w.readyTimeout):
+			killProcessGroup(cmd.Process)
+			<-exited
+			return nil, fmt.Errorf("worker not ready after %s", w.readyTimeout)
+		}
+	} else {
+		deadline := time.Now().Add(w.readyTimeout)
+		for {
+			if conn, err := net.Dial("unix", w.sock); err == nil {
+				conn.Close()
+				break
+			}
+			select {
+			case err := <-exited:
+				return nil, fmt.Errorf("worker exited before listening on %s: %v", socketEnvKey, err)
+			case <-time.After(50 * time.Millisecond):
+			}
+			if time.Now().After(deadline) {
+				killProcessGroup(cmd.Process)
+				<-exited
+				return nil, fmt.Errorf("worker not listening after %s", w.readyTimeout)
+			}
+		}
+	}
+
+	w.mu.Lock()
+	w.proc = cmd.Process
+	w.conn = conn
+	w.requests.Store(0)
+	close(w.ready)
+	w.mu.Unlock()
+	log.Printf("worker for %s ready (pid %d)", w.route.Name, cmd.Process.Pid)
+	return exited, nil
+}
+
+// supervise restarts the worker whenever it exits until the worker is
+// stopped.
+func (w *Worker) supervise(ctx context.Context, exited <-chan error) {
+	for {
+		err := <-exited
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("worker for %s exited: %v; restarting", w.route.Name, err)
+
+		// Restart replaces the ready channel before a planned exit, which
+		// is respawned without delay.
+		delay := time.Duration(0)
+		w.mu.Lock()
+		if w.isReadyLocked() {
+			w.ready = make(chan struct{})
+			delay = workerRestartDelay
+		}
+		w.mu.Unlock()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay = workerRestartDelay
+			if exited, err = w.spawn(ctx); err == nil {
+				break
+			}
+			log.Printf("worker for %s failed to restart: %v", w.route.Name, err)
+		}
+	}
+}
+
+func (w *Worker) isReadyLocked() bool {
+	select {
+	case <-w.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// pid returns the process ID of the running worker, or 0.
+func (w *Worker) pid() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.proc == nil {
+		return 0
+	}
+	return w.proc.Pid
+}
+
+// Ready reports whether the worker is accepting invocations.
+func (w *Worker) Ready() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.isReadyLocked()
+}
+
+// Restart stops handing invocations to the current process, waits for
+// those in flight to finish and then replaces the process. Invocations
+// arriving meanwhile wait for the new process.
+func (w *Worker) Restart() {
+	w.mu.Lock()
+	if !w.isReadyLocked() {
+		// Already (re)starting.
+		w.mu.Unlock()
+		return
+	}
+	w.ready = make(chan struct{})
+	proc := w.proc
+	w.mu.Unlock()
+
+	w.calls.Lock()
+	defer w.calls.Unlock()
+	log.Printf("worker for %s drained; restarting", w.route.Name)
+	killProcessGroup(proc)
+}
+
+// acquire waits until the worker is ready and registers an in-flight
+// call, which the caller ends with w.calls.RUnlock.
+func (w *Worker) acquire(ctx context.Context) error {
+	for {
+		w.mu.Lock()
+		ready := w.ready
+		w.mu.Unlock()
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		w.calls.RLock()
+		w.mu.Lock()
+		current := w.ready == ready
+		w.mu.Unlock()
+		if current {
+			return nil
+		}
+		// A restart began after we were woken.
+		w.calls.RUnlock()
+	}
+}
+
+// Do forwards one invocation to the worker.
+func (w *Worker) Do(ctx context.Context, call Invocation, env []string) (*Result, error) {
+	if err := w.acquire(ctx); err != nil {
+		return &Result{}, err
+	}
+	defer w.calls.RUnlock()
+	defer w.served()
+
+	var vars map[string]string
+	if len(env) > 0 {
+		vars = map[string]string{}
+		for _, kv := range env {
+			k, v, _ := strings.Cut(kv, "=")
+			vars[k] = v
+		}
+	}
+
+	if w.protocol == workerProtocolStdio {
+		w.mu.Lock()
+		conn := w.conn
+		w.mu.Unlock()
+		payload, err := io.ReadAll(call.stdin())
+		if err != nil {
+			return &Result{}, err
+		}
+		res, err := conn.Do(ctx, payload, vars)
+		if err != nil {
+			return res, err
+		}
+		if call.Stdout != nil {
+			_, err = call.Stdout.Write(res.Stdout)
+			return &Result{}, err
+		}
+		return w.limitOutput(res.Stdout)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://worker/", call.stdin())
+	if err != nil {
+		return &Result{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if vars != nil {
+		b, _ := json.Marshal(vars)
+		req.Header.Set(invokeEnvHeader, string(b))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return &Result{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		return &Result{Stderr: body}, &workerStatusError{resp.Status}
+	}
+
+	if call.Stdout != nil {
+		_, err := io.Copy(call.Stdout, resp.Body)
+		return &Result{}, err
+	}
+	body := io.Reader(resp.Body)
+	if w.limits.MaxOutput > 0 {
+		// The rest of an oversized response is left unread; closing the
+		// body drops the connection, so the worker stops writing it.
+		body = io.LimitReader(body, w.limits.MaxOutput+1)
+	}
+	out, err := io.ReadAll(body)
+	if err != nil {
+		return &Result{Stdout: out}, err
+	}
+	return w.limitOutput(out)
+}
+
+// limitOutput applies the output limit to the response out. Over the
+// limit, the invocation fails or its output is truncated, as for a script
+// process, but the worker is left running for the other invocations it
+// serves.
+func (w *Worker) limitOutput(out []byte) (*Result, error) {
+	limit := w.limits.MaxOutput
+	if limit <= 0 || int64(len(out)) <= limit {
+		return &Result{Stdout: out}, nil
+	}
+	if w.limits.OutputPolicy == outputLimitKill {
+		return &Result{}, &limitError{resource: "output", err: fmt.Errorf("response over %d bytes", limit)}
+	}
+	return &Result{Stdout: out[:limit], Truncated: true}, nil
+}
+
+// workerStatusError is a non-2xx answer from a persistent script.
+type workerStatusError struct {
+	status string
+}
+
+func (e *workerStatusError) Error() string {
+	return "worker returned " + e.status
+}
+
+// Retire waits for the invocations in flight to finish and then stops the
+// worker, once a reload replaced its route.
+func (w *Worker) Retire() {
+	w.calls.Lock()
+	defer w.calls.Unlock()
+	w.Stop()
+}
+
+// Stop terminates the worker and removes its socket.
+func (w *Worker) Stop() {
+	w.stop()
+	os.RemoveAll(w.dir)
+}
+
+// logWriter logs each line written to it with prefix.
+type logWriter string
+
+func (p logWriter) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		log.Print(string(p) + line)
+	}
+	return len(b), nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestWorker returns a ready http worker answering with handler.
+func newTestWorker(t *testing.T, limits ResourceLimits, handler http.HandlerFunc) *Worker {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	ready := make(chan struct{})
+	close(ready)
+	return &Worker{
+		route:    &Route{Name: "w"},
+		protocol: workerProtocolHTTP,
+		limits:   limits,
+		ready:    ready,
+		client: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "tcp", srv.Listener.Addr().String())
+			},
+		}},
+	}
+}
+
+func TestWorkerOutputLimit(t *testing.T) {
+	tests := []struct {
+		name          string
+		limits        ResourceLimits
+		output        string
+		want          string
+		wantTruncated bool
+		wantErr       bool
+	}{
+		{name: "unlimited", output: "0123456789", want: "0123456789"},
+		{name: "under the limit", limits: ResourceLimits{MaxOutput: 10, OutputPolicy: outputLimitKill}, output: "0123456789", want: "0123456789"},
+		{name: "truncated", limits: ResourceLimits{MaxOutput: 4, OutputPolicy: outputLimitTruncate}, output: "0123456789", want: "0123", wantTruncated: true},
+		{name: "killed", limits: ResourceLimits{MaxOutput: 4, OutputPolicy: outputLimitKill}, output: "0123456789", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestWorker(t, tt.limits, func(rw http.ResponseWriter, r *http.Request) {
+				rw.Write([]byte(tt.output))
+			})
+			res, err := w.Do(context.Background(), Invocation{Payload: []byte("{}")}, nil)
+			if tt.wantErr {
+				var le *limitError
+				if !errors.As(err, &le) || le.status() != http.StatusBadGateway {
+					t.Errorf("Do = %v, want an output limit error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(res.Stdout) != tt.want || res.Truncated != tt.wantTruncated {
+				t.Errorf("output %q truncated %v, want %q and %v", res.Stdout, res.Truncated, tt.want, tt.wantTruncated)
+			}
+		})
+	}
+}
+
+// TestWorkerRunawayOutput checks that a worker writing without end is cut
+// off at the limit rather than buffered.
+func TestWorkerRunawayOutput(t *testing.T) {
+	for _, policy := range []string{outputLimitKill, outputLimitTruncate} {
+		t.Run(policy, func(t *testing.T) {
+			gone := make(chan struct{})
+			w := newTestWorker(t, ResourceLimits{MaxOutput: 1 << 16, OutputPolicy: policy}, func(rw http.ResponseWriter, r *http.Request) {
+				defer close(gone)
+				chunk := []byte(strings.Repeat("x", 1<<12))
+				for {
+					if _, err := rw.Write(chunk); err != nil {
+						return
+					}
+				}
+			})
+			res, err := w.Do(context.Background(), Invocation{Payload: []byte("{}")}, nil)
+			if policy == outputLimitKill && err == nil {
+				t.Error("runaway output was accepted")
+			}
+			if policy == outputLimitTruncate && (err != nil || len(res.Stdout) != 1<<16) {
+				t.Errorf("Do = %d bytes, %v, want the first 64K", len(res.Stdout), err)
+			}
+			select {
+			case <-gone:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the worker kept writing after the limit")
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+// Helper for persistent go-invoke-node scripts using the stdio worker
+// protocol, loaded with require(process.env.INVOKE_WORKER_CLIENT):
+//
+//   const serve = require(process.env.INVOKE_WORKER_CLIENT);
+//   serve(async (payload, env) => ({ hello: payload.name }));
+//
+// The handler receives the parsed payload and the invocation's environment
+// (INVOKE_CONTEXT and the like) and returns the JSON result, or throws to
+// fail the invocation. Invocations are handled concurrently.
+//
+// The protocol is newline-delimited JSON. The server writes one request
+// per line to the worker's stdin:
+//
+//   {"id": 1, "payload": {...}, "env": {"INVOKE_CONTEXT": "..."}}
+//
+// and the worker answers each on stdout, in any order:
+//
+//   {"id": 1, "result": {...}}
+//   {"id": 1, "error": "message"}
+//
+// A worker announces it is ready with {"ready": true}. Stdout belongs to the
+// protocol, so console.log is redirected to stderr.
+'use strict';
+
+const readline = require('node:readline');
+
+function send(frame) {
+  process.stdout.write(JSON.stringify(frame) + '\n');
+}
+
+module.exports = function serve(handler) {
+  console.log = console.error;
+  console.info = console.error;
+
+  const rl = readline.createInterface({ input: process.stdin, crlfDelay: Infinity });
+  rl.on('line', async (line) => {
+    if (line.trim() === '') return;
+    let req;
+    try {
+      req = JSON.parse(line);
+    } catch (err) {
+      console.error(`worker: invalid request frame: ${err.message}`);
+      return;
+    }
+    try {
+      const result = await handler(req.payload, req.env || {});
+      send({ id: req.id, result: result === undefined ? null : result });
+    } catch (err) {
+      send({ id: req.id, error: String((err && err.stack) || err) });
+    }
+  });
+  rl.on('close', () => process.exit(0));
+  send({ ready: true });
+};
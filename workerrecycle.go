@@ -0,0 +1,118 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// WorkerRecycle replaces persistent workers before slow leaks degrade the
+// host: once a worker's process group holds more than MaxRSS bytes of
+// memory, sampled every Interval, or it has served MaxRequests
+// invocations. Like POST /admin/routes/{name}/restart, the replacement
+// waits for the invocations in flight to finish; invocations arriving
+// meanwhile wait for the new process. Zero disables either limit.
+type WorkerRecycle struct {
+	MaxRSS      int64
+	MaxRequests int64
+	Interval    time.Duration
+}
+
+// recycleOn makes w recycle itself by p, recording recycles in stats,
+// until it is stopped. Only the local executor's workers can have their
+// memory sampled.
+func (w *Worker) recycleOn(p WorkerRecycle, stats *recycleStats) {
+	w.recycle, w.recycles = p, stats
+	if p.MaxRSS <= 0 {
+		return
+	}
+	if !w.executor.Local() {
+		log.Printf("worker for %s: --worker-max-rss only applies to the local executor", w.route.Name)
+		return
+	}
+	go func() {
+		t := time.NewTicker(p.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-w.ctx.Done():
+				return
+			case <-t.C:
+			}
+			pid := w.pid()
+			if pid == 0 || !w.Ready() {
+				continue
+			}
+			rss, err := processGroupRSS(pid)
+			if err != nil {
+				log.Printf("worker for %s: %v", w.route.Name, err)
+				return
+			}
+			stats.observe(w.route.Name, rss)
+			if rss > p.MaxRSS {
+				w.recycleFor("rss", fmt.Sprintf("uses %d MiB, over --worker-max-rss", rss>>20))
+			}
+		}
+	}()
+}
+
+// served counts an invocation answered by the current process, recycling
+// it once it reached the request limit.
+func (w *Worker) served() {
+	if max := w.recycle.MaxRequests; max > 0 && w.requests.Add(1) == max {
+		// The invocation counted still holds its call.
+		go w.recycleFor("requests", fmt.Sprintf("served %d invocations", max))
+	}
+}
+
+func (w *Worker) recycleFor(reason, detail string) {
+	log.Printf("worker for %s %s; recycling", w.route.Name, detail)
+	w.recycles.recycled(w.route.Name, reason)
+	w.Restart()
+}
+
+// recycleStats counts worker recycles per route and reason, and keeps the
+// workers' sampled memory, for /metrics.
+type recycleStats struct {
+	mu     sync.Mutex
+	counts map[recycleKey]int64
+	rss    map[string]int64
+}
+
+type recycleKey struct{ route, reason string }
+
+func (s *recycleStats) recycled(route, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counts == nil {
+		s.counts = map[recycleKey]int64{}
+	}
+	s.counts[recycleKey{route, reason}]++
+}
+
+func (s *recycleStats) observe(route string, rss int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rss == nil {
+		s.rss = map[string]int64{}
+	}
+	s.rss[route] = rss
+}
+
+// snapshot returns the recycle counts sorted by route and reason, and the
+// sampled memory by route.
+func (s *recycleStats) snapshot() (keys []recycleKey, counts []int64, rss map[string]int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys = slices.SortedFunc(maps.Keys(s.counts), func(a, b recycleKey) int {
+		return cmp.Or(cmp.Compare(a.route, b.route), cmp.Compare(a.reason, b.reason))
+	})
+	for _, k := range keys {
+		counts = append(counts, s.counts[k])
+	}
+	return keys, counts, maps.Clone(s.rss)
+}
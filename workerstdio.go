@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// Persistent worker protocols; see Worker and stdioConn.
+const (
+	workerProtocolHTTP  = "http"
+	workerProtocolStdio = "stdio"
+
+	// workerClientEnvKey is the path of the JS helper implementing the
+	// stdio protocol.
+	workerClientEnvKey = "INVOKE_WORKER_CLIENT"
+
+	maxStdioFrame = 64 << 20
+)
+
+//go:embed workerclient.js
+var workerClient []byte
+
+var errWorkerGone = errors.New("worker exited")
+
+func validWorkerProtocol(p string) bool {
+	return p == workerProtocolHTTP || p == workerProtocolStdio
+}
+
+// stdioConn multiplexes invocations over a worker's stdin and stdout as
+// newline-delimited JSON frames matched by ID, as documented in
+// workerclient.js. Any number of requests may be in flight at once.
+type stdioConn struct {
+	wmu sync.Mutex
+	in  io.WriteCloser
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan stdioFrame
+	closed  bool
+
+	ready chan struct{}
+	// done is closed once stdout was read to the end.
+	done chan struct{}
+}
+
+// stdioFrame is a response line; requests are stdioRequest.
+type stdioFrame struct {
+	ID     uint64          `json:"id"`
+	Ready  bool            `json:"ready"`
+	Result json.RawMessage `json:"result"`
+	Error  *string         `json:"error"`
+}
+
+type stdioRequest struct {
+	ID      uint64            `json:"id"`
+	Payload json.RawMessage   `json:"payload"`
+	Env     map[string]string `json:"env,omitempty"`
+}
+
+func newStdioConn(in io.WriteCloser) *stdioConn {
+	return &stdioConn{
+		in:      in,
+		pending: map[uint64]chan stdioFrame{},
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// read dispatches the frames on out until it ends, then fails the requests
+// still waiting. Lines that aren't frames are logged like the output of
+// HTTP workers.
+func (c *stdioConn) read(out io.Reader) {
+	defer close(c.done)
+	sc := bufio.NewScanner(out)
+	sc.Buffer(nil, maxStdioFrame)
+	var readyOnce sync.Once
+	for sc.Scan() {
+		var f stdioFrame
+		if err := json.Unmarshal(sc.Bytes(), &f); err != nil {
+			log.Printf("worker stdout: %s", sc.Bytes())
+			continue
+		}
+		if f.Ready {
+			readyOnce.Do(func() { close(c.ready) })
+			continue
+		}
+		c.mu.Lock()
+		ch := c.pending[f.ID]
+		delete(c.pending, f.ID)
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- f
+		}
+	}
+	if err := sc.Err(); err != nil {
+		log.Printf("worker stdout: %v", err)
+	}
+	c.mu.Lock()
+	c.closed = true
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	c.mu.Unlock()
+}
+
+// Do sends payload and waits for its response.
+func (c *stdioConn) Do(ctx context.Context, payload []byte, env map[string]string) (*Result, error) {
+	if !json.Valid(payload) {
+		return &Result{}, errors.New("stdio workers only accept JSON payloads")
+	}
+	ch := make(chan stdioFrame, 1)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return &Result{}, errWorkerGone
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	b, _ := json.Marshal(stdioRequest{ID: id, Payload: payload, Env: env})
+	c.wmu.Lock()
+	_, err := c.in.Write(append(b, '\n'))
+	c.wmu.Unlock()
+	if err != nil {
+		c.forget(id)
+		return &Result{}, fmt.Errorf("write to worker: %w", err)
+	}
+
+	select {
+	case f, ok := <-ch:
+		if !ok {
+			return &Result{}, errWorkerGone
+		}
+		if f.Error != nil {
+			return &Result{Stderr: []byte(*f.Error)}, &workerStatusError{"an error"}
+		}
+		return &Result{Stdout: f.Result}, nil
+	case <-ctx.Done():
+		// A late response is dropped.
+		c.forget(id)
+		return &Result{}, ctx.Err()
+	}
+}
+
+func (c *stdioConn) forget(id uint64) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}